@@ -0,0 +1,257 @@
+package engine
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	kvstoreBucket = []byte("kvstore")
+	expiryBucket  = []byte("expiry")
+)
+
+// BoltKVStore is a TTLKVStore stored into a single file using a pure-Go
+// embedded transactional database. Use Update to atomically modify
+// several keys at once.
+//
+// We only keep the database open for the duration of each operation. The
+// database file is locked while it is open, hence this strategy allows
+// several processes (e.g. the app and a background service) to safely
+// share the same database. A process waits up to Timeout for another
+// process to release the database before failing.
+type BoltKVStore struct {
+	// Timeout is the maximum time we wait for the database lock.
+	Timeout time.Duration
+
+	mu   sync.Mutex
+	now  func() time.Time
+	path string
+}
+
+// NewBoltKVStore creates a new BoltKVStore using the database at the
+// specified path. We create the database if it does not exist.
+func NewBoltKVStore(path string) (*BoltKVStore, error) {
+	kvs := &BoltKVStore{
+		Timeout: 10 * time.Second,
+		now:     time.Now,
+		path:    path,
+	}
+	// Make sure we can open the database and that buckets exist
+	if err := kvs.Update(func(tx *BoltKVTx) error { return nil }); err != nil {
+		return nil, err
+	}
+	return kvs, nil
+}
+
+func (kvs *BoltKVStore) do(writable bool, fn func(tx *bolt.Tx) error) error {
+	kvs.mu.Lock()
+	defer kvs.mu.Unlock()
+	db, err := bolt.Open(kvs.path, 0600, &bolt.Options{Timeout: kvs.Timeout})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if !writable {
+		return db.View(fn)
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{kvstoreBucket, expiryBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return fn(tx)
+	})
+}
+
+// BoltKVTx is a BoltKVStore transaction. The methods of this type have
+// the same semantics of the BoltKVStore methods with the same name. You
+// should only use a BoltKVTx from inside the function passed to Update.
+type BoltKVTx struct {
+	now func() time.Time
+	tx  *bolt.Tx
+}
+
+// Get returns the specified key's value
+func (tx *BoltKVTx) Get(key string) ([]byte, error) {
+	if key == "" {
+		return nil, ErrInvalidKey
+	}
+	bucket := tx.tx.Bucket(kvstoreBucket)
+	if bucket == nil || tx.expired([]byte(key)) {
+		return nil, ErrNoSuchKey
+	}
+	value := bucket.Get([]byte(key))
+	if value == nil {
+		return nil, ErrNoSuchKey
+	}
+	// The value is only valid during the transaction, hence the copy
+	return append([]byte{}, value...), nil
+}
+
+// Set sets the value of a specific key
+func (tx *BoltKVTx) Set(key string, value []byte) error {
+	if key == "" {
+		return ErrInvalidKey
+	}
+	if err := tx.tx.Bucket(expiryBucket).Delete([]byte(key)); err != nil {
+		return err
+	}
+	// bolt interprets a nil value as a nonexistent key
+	return tx.tx.Bucket(kvstoreBucket).Put([]byte(key), append([]byte{}, value...))
+}
+
+// SetWithTTL is like Set but key expires after ttl
+func (tx *BoltKVTx) SetWithTTL(key string, value []byte, ttl time.Duration) error {
+	if err := tx.Set(key, value); err != nil {
+		return err
+	}
+	expiry, err := tx.now().Add(ttl).MarshalText()
+	if err != nil {
+		return err
+	}
+	return tx.tx.Bucket(expiryBucket).Put([]byte(key), expiry)
+}
+
+// Delete removes the specified key
+func (tx *BoltKVTx) Delete(key string) error {
+	if key == "" {
+		return ErrInvalidKey
+	}
+	if err := tx.tx.Bucket(expiryBucket).Delete([]byte(key)); err != nil {
+		return err
+	}
+	return tx.tx.Bucket(kvstoreBucket).Delete([]byte(key))
+}
+
+// Keys returns the sorted list of keys starting with prefix
+func (tx *BoltKVTx) Keys(prefix string) ([]string, error) {
+	var out []string
+	bucket := tx.tx.Bucket(kvstoreBucket)
+	if bucket == nil {
+		return nil, nil // database has just been created
+	}
+	cursor := bucket.Cursor()
+	bprefix := []byte(prefix)
+	for k, _ := cursor.Seek(bprefix); k != nil && bytes.HasPrefix(k, bprefix); k, _ = cursor.Next() {
+		if !tx.expired(k) {
+			out = append(out, string(k))
+		}
+	}
+	sort.Strings(out) // bolt sorts by bytes but let's be explicit
+	return out, nil
+}
+
+func (tx *BoltKVTx) expired(key []byte) bool {
+	bucket := tx.tx.Bucket(expiryBucket)
+	if bucket == nil {
+		return false // database has just been created
+	}
+	data := bucket.Get(key)
+	if data == nil {
+		return false
+	}
+	var t time.Time
+	if err := t.UnmarshalText(data); err != nil {
+		return false
+	}
+	return !tx.now().Before(t)
+}
+
+// Update runs fn inside a read-write transaction. If fn returns an error,
+// none of the changes performed by fn is applied to the database.
+func (kvs *BoltKVStore) Update(fn func(tx *BoltKVTx) error) error {
+	return kvs.do(true, func(tx *bolt.Tx) error {
+		return fn(&BoltKVTx{now: kvs.now, tx: tx})
+	})
+}
+
+// View runs fn inside a read-only transaction.
+func (kvs *BoltKVStore) View(fn func(tx *BoltKVTx) error) error {
+	return kvs.do(false, func(tx *bolt.Tx) error {
+		return fn(&BoltKVTx{now: kvs.now, tx: tx})
+	})
+}
+
+// Get returns the specified key's value
+func (kvs *BoltKVStore) Get(key string) (value []byte, err error) {
+	err = kvs.View(func(tx *BoltKVTx) error {
+		value, err = tx.Get(key)
+		return err
+	})
+	return
+}
+
+// Set sets the value of a specific key
+func (kvs *BoltKVStore) Set(key string, value []byte) error {
+	return kvs.Update(func(tx *BoltKVTx) error {
+		return tx.Set(key, value)
+	})
+}
+
+// SetWithTTL is like Set but key expires after ttl
+func (kvs *BoltKVStore) SetWithTTL(key string, value []byte, ttl time.Duration) error {
+	return kvs.Update(func(tx *BoltKVTx) error {
+		return tx.SetWithTTL(key, value, ttl)
+	})
+}
+
+// Delete removes the specified key
+func (kvs *BoltKVStore) Delete(key string) error {
+	return kvs.Update(func(tx *BoltKVTx) error {
+		return tx.Delete(key)
+	})
+}
+
+// Keys returns the sorted list of keys starting with prefix
+func (kvs *BoltKVStore) Keys(prefix string) (keys []string, err error) {
+	err = kvs.View(func(tx *BoltKVTx) error {
+		keys, err = tx.Keys(prefix)
+		return err
+	})
+	return
+}
+
+// Wipe securely erases the database file. See SecureWipe for more info.
+func (kvs *BoltKVStore) Wipe() error {
+	kvs.mu.Lock()
+	defer kvs.mu.Unlock()
+	return SecureWipe(kvs.path)
+}
+
+// MigrateFileSystemKVStore copies all the keys stored inside source into
+// destination using a single transaction, preserving the expiry time of
+// keys with a TTL. Keys that already exist in destination are overwritten.
+// We do not modify source, so you can remove it once you are satisfied
+// with the migration, e.g. using FileSystemKVStore.Wipe.
+func MigrateFileSystemKVStore(source *FileSystemKVStore, destination *BoltKVStore) error {
+	keys, err := source.Keys("")
+	if err != nil {
+		return err
+	}
+	return destination.Update(func(tx *BoltKVTx) error {
+		for _, key := range keys {
+			value, err := source.Get(key)
+			if err != nil {
+				return err
+			}
+			expiry, err := source.expiry(key)
+			if err != nil {
+				return err
+			}
+			if expiry.IsZero() {
+				err = tx.Set(key, value)
+			} else {
+				err = tx.SetWithTTL(key, value, expiry.Sub(tx.now()))
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
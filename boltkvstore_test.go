@@ -0,0 +1,183 @@
+package engine
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newBoltKVStoreForTesting(t *testing.T) (*BoltKVStore, string, func()) {
+	tempdir, err := ioutil.TempDir("", "ooniprobe-engine-boltkvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kvs, err := NewBoltKVStore(filepath.Join(tempdir, "kvstore.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kvs, tempdir, func() { os.RemoveAll(tempdir) }
+}
+
+func TestUnitBoltKVStoreWorkflow(t *testing.T) {
+	kvs, _, cleanup := newBoltKVStoreForTesting(t)
+	defer cleanup()
+	var kvstore TTLKVStore = kvs
+	if _, err := kvstore.Get("antani"); err != ErrNoSuchKey {
+		t.Fatal("not the error we expected")
+	}
+	for _, key := range []string{"orchestra.state", "orchestra.token", "antani"} {
+		if err := kvstore.Set(key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	value, err := kvstore.Get("antani")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(value, []byte("antani")) {
+		t.Fatal("invalid value")
+	}
+	keys, err := kvstore.Keys("orchestra.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []string{"orchestra.state", "orchestra.token"}) {
+		t.Fatalf("unexpected keys: %+v", keys)
+	}
+	if err := kvstore.Delete("antani"); err != nil {
+		t.Fatal(err)
+	}
+	if err := kvstore.Delete("antani"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kvstore.Get("antani"); err != ErrNoSuchKey {
+		t.Fatal("not the error we expected")
+	}
+	if err := kvstore.Set("", nil); err != ErrInvalidKey {
+		t.Fatal("not the error we expected")
+	}
+}
+
+func TestUnitBoltKVStoreTTL(t *testing.T) {
+	kvs, _, cleanup := newBoltKVStoreForTesting(t)
+	defer cleanup()
+	now := time.Now()
+	kvs.now = func() time.Time { return now }
+	if err := kvs.SetWithTTL("antani", []byte("mascetti"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kvs.Get("antani"); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(2 * time.Minute)
+	if _, err := kvs.Get("antani"); err != ErrNoSuchKey {
+		t.Fatal("not the error we expected")
+	}
+	keys, err := kvs.Keys("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Fatal("expected no keys here")
+	}
+	// Set must clear a previously set TTL
+	if err := kvs.SetWithTTL("antani", []byte("mascetti"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := kvs.Set("antani", []byte("mascetti")); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(2 * time.Minute)
+	if _, err := kvs.Get("antani"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnitBoltKVStoreUpdateIsAtomic(t *testing.T) {
+	kvs, _, cleanup := newBoltKVStoreForTesting(t)
+	defer cleanup()
+	if err := kvs.Set("antani", []byte("mascetti")); err != nil {
+		t.Fatal(err)
+	}
+	expected := errors.New("mocked error")
+	err := kvs.Update(func(tx *BoltKVTx) error {
+		if err := tx.Set("antani", []byte("melandri")); err != nil {
+			return err
+		}
+		if err := tx.Set("sassaroli", []byte("perozzi")); err != nil {
+			return err
+		}
+		return expected
+	})
+	if err != expected {
+		t.Fatal("not the error we expected")
+	}
+	value, err := kvs.Get("antani")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(value, []byte("mascetti")) {
+		t.Fatal("the transaction has not been rolled back")
+	}
+	if _, err := kvs.Get("sassaroli"); err != ErrNoSuchKey {
+		t.Fatal("the transaction has not been rolled back")
+	}
+}
+
+func TestUnitBoltKVStoreWipe(t *testing.T) {
+	kvs, tempdir, cleanup := newBoltKVStoreForTesting(t)
+	defer cleanup()
+	if err := kvs.Set("antani", []byte("mascetti")); err != nil {
+		t.Fatal(err)
+	}
+	if err := kvs.Wipe(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(tempdir, "kvstore.db")); !os.IsNotExist(err) {
+		t.Fatal("the database still exists")
+	}
+}
+
+func TestUnitMigrateFileSystemKVStore(t *testing.T) {
+	kvs, tempdir, cleanup := newBoltKVStoreForTesting(t)
+	defer cleanup()
+	now := time.Now()
+	kvs.now = func() time.Time { return now }
+	fskvs, err := NewFileSystemKVStore(filepath.Join(tempdir, "kvstore2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fskvs.now = kvs.now
+	if err := fskvs.Set("orchestra.state", []byte("antani")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fskvs.SetWithTTL("geoip.cache", []byte("mascetti"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := MigrateFileSystemKVStore(fskvs, kvs); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := kvs.Keys("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []string{"geoip.cache", "orchestra.state"}) {
+		t.Fatalf("unexpected keys: %+v", keys)
+	}
+	value, err := kvs.Get("orchestra.state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(value, []byte("antani")) {
+		t.Fatal("invalid value")
+	}
+	now = now.Add(2 * time.Hour)
+	if _, err := kvs.Get("geoip.cache"); err != ErrNoSuchKey {
+		t.Fatal("the TTL has not been migrated")
+	}
+}
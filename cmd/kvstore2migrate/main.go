@@ -0,0 +1,53 @@
+// Command kvstore2migrate migrates a kvstore2 directory, like the one
+// created by miniooni, into a single-file BoltKVStore database.
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/apex/log"
+	engine "github.com/ooni/probe-engine"
+	"github.com/pborman/getopt/v2"
+)
+
+var (
+	destination string
+	source      string
+)
+
+func init() {
+	getopt.FlagLong(
+		&destination, "destination", 'd',
+		"Set the path of the database to create or update", "PATH",
+	)
+	getopt.FlagLong(
+		&source, "source", 's', "Set the kvstore2 directory to migrate", "PATH",
+	)
+}
+
+func main() {
+	getopt.Parse()
+	miniooniDir := filepath.Join(os.Getenv("HOME"), ".miniooni")
+	if source == "" {
+		source = filepath.Join(miniooniDir, "kvstore2")
+	}
+	if destination == "" {
+		destination = filepath.Join(miniooniDir, "kvstore.db")
+	}
+	if _, err := os.Stat(source); err != nil {
+		log.WithError(err).Fatal("cannot access the source directory")
+	}
+	from, err := engine.NewFileSystemKVStore(source)
+	if err != nil {
+		log.WithError(err).Fatal("cannot open the source kvstore")
+	}
+	to, err := engine.NewBoltKVStore(destination)
+	if err != nil {
+		log.WithError(err).Fatal("cannot open the destination database")
+	}
+	if err := engine.MigrateFileSystemKVStore(from, to); err != nil {
+		log.WithError(err).Fatal("cannot migrate the kvstore")
+	}
+	log.Infof("migrated %s into %s", source, destination)
+}
@@ -0,0 +1,50 @@
+// Command oohelperd is a Web Connectivity control helper. You can run
+// it to use a private helper with the web_connectivity experiment, e.g.
+// by setting its TestHelperURL option, or by adding the helper URL to
+// the session's AvailableTestHelpers["web-connectivity"].
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/ooni/probe-engine/internal/oohelper"
+	"github.com/pborman/getopt/v2"
+)
+
+var (
+	address = "127.0.0.1:8080"
+	timeout = 30 * time.Second
+	verbose bool
+)
+
+func init() {
+	getopt.FlagLong(
+		&address, "address", 'a', "Set the address to listen on", "ADDRESS",
+	)
+	getopt.FlagLong(
+		&timeout, "timeout", 't', "Set the timeout of each measurement", "DURATION",
+	)
+	getopt.FlagLong(&verbose, "verbose", 'v', "Increase verbosity")
+}
+
+func main() {
+	getopt.Parse()
+	if verbose {
+		log.SetLevel(log.DebugLevel)
+	}
+	log.Infof("oohelperd: listening on %s", address)
+	// We derive the server timeouts from the measurement timeout, so
+	// slow clients cannot keep connections open indefinitely. Writing
+	// the response must also account for the time spent measuring.
+	server := &http.Server{
+		Addr:              address,
+		Handler:           oohelper.Handler{Logger: log.Log, Timeout: timeout},
+		IdleTimeout:       timeout,
+		ReadHeaderTimeout: timeout,
+		ReadTimeout:       timeout,
+		WriteTimeout:      2 * timeout,
+	}
+	log.WithError(server.ListenAndServe()).Fatal("oohelperd: server failed")
+}
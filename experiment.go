@@ -2,27 +2,41 @@
 package engine
 
 import (
+	"bufio"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"os"
 	"reflect"
 	"time"
 
 	"github.com/ooni/probe-engine/experiment"
 	"github.com/ooni/probe-engine/experiment/dash"
+	"github.com/ooni/probe-engine/experiment/dnscheck"
+	"github.com/ooni/probe-engine/experiment/dnsconsistency"
+	"github.com/ooni/probe-engine/experiment/dnsinjection"
 	"github.com/ooni/probe-engine/experiment/example"
 	"github.com/ooni/probe-engine/experiment/fbmessenger"
 	"github.com/ooni/probe-engine/experiment/handler"
 	"github.com/ooni/probe-engine/experiment/hhfm"
 	"github.com/ooni/probe-engine/experiment/hirl"
+	"github.com/ooni/probe-engine/experiment/httphost"
+	"github.com/ooni/probe-engine/experiment/meekfrontedrequests"
 	"github.com/ooni/probe-engine/experiment/ndt"
 	"github.com/ooni/probe-engine/experiment/ndt7"
 	"github.com/ooni/probe-engine/experiment/psiphon"
+	"github.com/ooni/probe-engine/experiment/quichandshake"
+	"github.com/ooni/probe-engine/experiment/riseupvpn"
 	"github.com/ooni/probe-engine/experiment/sniblocking"
+	"github.com/ooni/probe-engine/experiment/stunreachability"
 	"github.com/ooni/probe-engine/experiment/telegram"
+	"github.com/ooni/probe-engine/experiment/tlsmiddlebox"
 	"github.com/ooni/probe-engine/experiment/tor"
+	"github.com/ooni/probe-engine/experiment/urlgetter"
 	"github.com/ooni/probe-engine/experiment/web_connectivity"
 	"github.com/ooni/probe-engine/experiment/whatsapp"
+	"github.com/ooni/probe-engine/internal/atrest"
 	"github.com/ooni/probe-engine/model"
 )
 
@@ -221,6 +235,80 @@ func (e *Experiment) SaveMeasurement(measurement *Measurement, path string) erro
 	return e.experiment.SaveMeasurement(measurement.m, path)
 }
 
+// SaveMeasurementEncrypted is like SaveMeasurement except that each line
+// of the file contains the measurement encrypted with a key derived from
+// secret and then encoded using base64. The secret must be at least 16
+// bytes long. Use LoadEncryptedMeasurements to read the file back.
+func (e *Experiment) SaveMeasurementEncrypted(
+	measurement *Measurement, path string, secret []byte,
+) error {
+	sealer, err := atrest.NewSealer(secret, measurementsPurpose)
+	if err != nil {
+		return err
+	}
+	return e.experiment.SaveMeasurementEx(
+		measurement.m, path, func(v interface{}) ([]byte, error) {
+			data, err := json.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+			sealed, err := sealer.Seal(data, nil)
+			if err != nil {
+				return nil, err
+			}
+			return []byte(base64.StdEncoding.EncodeToString(sealed)), nil
+		}, os.OpenFile, func(fp *os.File, b []byte) (int, error) {
+			return fp.Write(b)
+		},
+	)
+}
+
+// LoadEncryptedMeasurements loads the measurements for this experiment
+// from a file written by SaveMeasurementEncrypted using the same secret. We
+// skip the measurements belonging to other experiments. We fail if any
+// line cannot be decrypted, because that means the file was tampered with
+// or that we are using the wrong secret.
+func (e *Experiment) LoadEncryptedMeasurements(
+	path string, secret []byte,
+) ([]*Measurement, error) {
+	sealer, err := atrest.NewSealer(secret, measurementsPurpose)
+	if err != nil {
+		return nil, err
+	}
+	filep, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer filep.Close()
+	var out []*Measurement
+	scanner := bufio.NewScanner(filep)
+	scanner.Buffer(nil, 64<<20) // measurements may be quite large
+	for scanner.Scan() {
+		sealed, err := base64.StdEncoding.DecodeString(scanner.Text())
+		if err != nil {
+			return nil, err
+		}
+		data, err := sealer.Open(sealed, nil)
+		if err != nil {
+			return nil, err
+		}
+		var measurement model.Measurement
+		if err := json.Unmarshal(data, &measurement); err != nil {
+			return nil, err
+		}
+		if measurement.TestName != e.Name() {
+			continue
+		}
+		out = append(out, &Measurement{m: measurement})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+const measurementsPurpose = "ooniprobe-engine measurements"
+
 // CloseReport is an idempotent method that closes and open report
 // if one has previously been opened, otherwise it does nothing.
 func (e *Experiment) CloseReport() error {
@@ -237,6 +325,11 @@ func (m *Measurement) AddAnnotations(annotations map[string]string) {
 	m.m.AddAnnotations(annotations)
 }
 
+// ID returns the locally generated measurement ID
+func (m *Measurement) ID() string {
+	return m.m.ID
+}
+
 // MakeGenericTestKeys casts the m.TestKeys to a map[string]interface{}.
 //
 // Ideally, all tests should have a clear Go structure, well defined, that
@@ -267,6 +360,51 @@ func (m *Measurement) makeGenericTestKeys(
 	return result, err
 }
 
+// PerformanceSummary is the summary of a performance experiment
+// that uses SI units. See model.PerformanceSummary for more info.
+type PerformanceSummary = model.PerformanceSummary
+
+// ErrNoPerformanceSummary indicates that a measurement does not
+// contain any performance summary.
+var ErrNoPerformanceSummary = errors.New("engine: no performance summary")
+
+// PerformanceSummary returns the performance summary of the measurement
+// if it's been generated by a performance experiment. Go experiments
+// include the summary inside their test keys. For MK's ndt, instead, we
+// compute the summary from the simple results, converting the units.
+func (m *Measurement) PerformanceSummary() (*PerformanceSummary, error) {
+	tk, err := m.MakeGenericTestKeys()
+	if err != nil {
+		return nil, err
+	}
+	if value, ok := tk["performance_summary"]; ok && value != nil {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		var summary PerformanceSummary
+		if err := json.Unmarshal(data, &summary); err != nil {
+			return nil, err
+		}
+		return &summary, nil
+	}
+	simple, ok := tk["simple"].(map[string]interface{})
+	if !ok || m.m.TestName != "ndt" {
+		return nil, ErrNoPerformanceSummary
+	}
+	number := func(key string) float64 {
+		value, _ := simple[key].(float64)
+		return value
+	}
+	server, _ := tk["server_address"].(string)
+	return &PerformanceSummary{
+		Download: number("download") * 1e03, // kbit/s to bit/s
+		Latency:  number("ping") / 1e03,     // millisecond to second
+		Server:   server,
+		Upload:   number("upload") * 1e03, // kbit/s to bit/s
+	}, nil
+}
+
 var experimentsByName = map[string]func(*Session) *ExperimentBuilder{
 	"dash": func(session *Session) *ExperimentBuilder {
 		return &ExperimentBuilder{
@@ -278,6 +416,46 @@ var experimentsByName = map[string]func(*Session) *ExperimentBuilder{
 		}
 	},
 
+	"dns_consistency": func(session *Session) *ExperimentBuilder {
+		return &ExperimentBuilder{
+			build: func(config interface{}) *experiment.Experiment {
+				return dnsconsistency.NewExperiment(
+					session.session, *config.(*dnsconsistency.Config),
+				)
+			},
+			config: &dnsconsistency.Config{
+				Resolvers: dnsconsistency.DefaultResolvers,
+			},
+			needsInput: true,
+		}
+	},
+
+	"dns_injection": func(session *Session) *ExperimentBuilder {
+		return &ExperimentBuilder{
+			build: func(config interface{}) *experiment.Experiment {
+				return dnsinjection.NewExperiment(session.session, *config.(*dnsinjection.Config))
+			},
+			config: &dnsinjection.Config{
+				Resolvers: "8.8.8.1",
+			},
+			needsInput: true,
+		}
+	},
+
+	"dnscheck": func(session *Session) *ExperimentBuilder {
+		return &ExperimentBuilder{
+			build: func(config interface{}) *experiment.Experiment {
+				return dnscheck.NewExperiment(
+					session.session, *config.(*dnscheck.Config),
+				)
+			},
+			config: &dnscheck.Config{
+				Domain: dnscheck.DefaultDomain,
+			},
+			needsInput: true,
+		}
+	},
+
 	"example": func(session *Session) *ExperimentBuilder {
 		return &ExperimentBuilder{
 			build: func(config interface{}) *experiment.Experiment {
@@ -313,6 +491,20 @@ var experimentsByName = map[string]func(*Session) *ExperimentBuilder{
 		}
 	},
 
+	"http_host": func(session *Session) *ExperimentBuilder {
+		return &ExperimentBuilder{
+			build: func(config interface{}) *experiment.Experiment {
+				return httphost.NewExperiment(
+					session.session, *config.(*httphost.Config),
+				)
+			},
+			config: &httphost.Config{
+				ControlHost: "example.org",
+			},
+			needsInput: true,
+		}
+	},
+
 	"http_invalid_request_line": func(session *Session) *ExperimentBuilder {
 		return &ExperimentBuilder{
 			build: func(config interface{}) *experiment.Experiment {
@@ -323,6 +515,18 @@ var experimentsByName = map[string]func(*Session) *ExperimentBuilder{
 		}
 	},
 
+	"meek_fronted_requests": func(session *Session) *ExperimentBuilder {
+		return &ExperimentBuilder{
+			build: func(config interface{}) *experiment.Experiment {
+				return meekfrontedrequests.NewExperiment(session.session, *config.(*meekfrontedrequests.Config))
+			},
+			config: &meekfrontedrequests.Config{
+				ExpectedBody: "I’m just a happy little web server.\n",
+			},
+			needsInput: true,
+		}
+	},
+
 	"ndt": func(session *Session) *ExperimentBuilder {
 		return &ExperimentBuilder{
 			build: func(config interface{}) *experiment.Experiment {
@@ -355,6 +559,31 @@ var experimentsByName = map[string]func(*Session) *ExperimentBuilder{
 		}
 	},
 
+	"quic_handshake": func(session *Session) *ExperimentBuilder {
+		return &ExperimentBuilder{
+			build: func(config interface{}) *experiment.Experiment {
+				return quichandshake.NewExperiment(session.session, *config.(*quichandshake.Config))
+			},
+			config: &quichandshake.Config{
+				ALPN:       "h3-24",
+				ControlSNI: "www.google.com",
+			},
+			needsInput: true,
+		}
+	},
+
+	"riseupvpn": func(session *Session) *ExperimentBuilder {
+		return &ExperimentBuilder{
+			build: func(config interface{}) *experiment.Experiment {
+				return riseupvpn.NewExperiment(session.session, *config.(*riseupvpn.Config))
+			},
+			config: &riseupvpn.Config{
+				ProviderURL: "https://riseup.net/provider.json",
+			},
+			needsInput: false,
+		}
+	},
+
 	"sni_blocking": func(session *Session) *ExperimentBuilder {
 		return &ExperimentBuilder{
 			build: func(config interface{}) *experiment.Experiment {
@@ -367,6 +596,16 @@ var experimentsByName = map[string]func(*Session) *ExperimentBuilder{
 		}
 	},
 
+	"stun_reachability": func(session *Session) *ExperimentBuilder {
+		return &ExperimentBuilder{
+			build: func(config interface{}) *experiment.Experiment {
+				return stunreachability.NewExperiment(session.session, *config.(*stunreachability.Config))
+			},
+			config:     &stunreachability.Config{},
+			needsInput: true,
+		}
+	},
+
 	"telegram": func(session *Session) *ExperimentBuilder {
 		return &ExperimentBuilder{
 			build: func(config interface{}) *experiment.Experiment {
@@ -377,6 +616,18 @@ var experimentsByName = map[string]func(*Session) *ExperimentBuilder{
 		}
 	},
 
+	"tls_middlebox": func(session *Session) *ExperimentBuilder {
+		return &ExperimentBuilder{
+			build: func(config interface{}) *experiment.Experiment {
+				return tlsmiddlebox.NewExperiment(session.session, *config.(*tlsmiddlebox.Config))
+			},
+			config: &tlsmiddlebox.Config{
+				Targets: "www.google.com,www.facebook.com,www.wikipedia.org,www.example.com",
+			},
+			needsInput: false,
+		}
+	},
+
 	"tor": func(session *Session) *ExperimentBuilder {
 		return &ExperimentBuilder{
 			build: func(config interface{}) *experiment.Experiment {
@@ -387,6 +638,18 @@ var experimentsByName = map[string]func(*Session) *ExperimentBuilder{
 		}
 	},
 
+	"urlgetter": func(session *Session) *ExperimentBuilder {
+		return &ExperimentBuilder{
+			build: func(config interface{}) *experiment.Experiment {
+				return urlgetter.NewExperiment(
+					session.session, *config.(*urlgetter.Config),
+				)
+			},
+			config:     &urlgetter.Config{},
+			needsInput: true,
+		}
+	},
+
 	"web_connectivity": func(session *Session) *ExperimentBuilder {
 		return &ExperimentBuilder{
 			build: func(config interface{}) *experiment.Experiment {
@@ -0,0 +1,324 @@
+// Package dash contains the dash network experiment. We use the
+// pure-Go implementation regardless of cgo, so that all builds report
+// the same test keys.
+//
+// Spec: https://github.com/ooni/spec/blob/master/nettests/ts-021-dash.md
+package dash
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/montanaflynn/stats"
+	"github.com/neubot/dash/client"
+	neubotModel "github.com/neubot/dash/model"
+	"github.com/ooni/probe-engine/experiment"
+	"github.com/ooni/probe-engine/experiment/handler"
+	"github.com/ooni/probe-engine/log"
+	"github.com/ooni/probe-engine/model"
+	"github.com/ooni/probe-engine/session"
+)
+
+const (
+	testName       = "dash"
+	testVersion    = "0.9.0"
+	defaultTimeout = 55 * time.Second
+	timeoutMargin  = 15 * time.Second
+	totalStep      = 15.0
+)
+
+// Config contains the experiment config.
+type Config struct {
+	Runtime   int64  `ooni:"Maximum runtime in seconds (zero means the default timeout)"`
+	ServerURL string `ooni:"URL of the DASH server to use instead of asking mlab-ns"`
+}
+
+// Simple contains the experiment total summary
+type Simple struct {
+	ConnectLatency  float64 `json:"connect_latency"`
+	MedianBitrate   int64   `json:"median_bitrate"`
+	MinPlayoutDelay float64 `json:"min_playout_delay"`
+}
+
+// Advanced contains the extended summary. Bitrates are in kbit/s and
+// times are in seconds, like in Simple.
+type Advanced struct {
+	Bitrate10thPercentile int64     `json:"bitrate_10th_percentile"`
+	Bitrate25thPercentile int64     `json:"bitrate_25th_percentile"`
+	Bitrate75thPercentile int64     `json:"bitrate_75th_percentile"`
+	Bitrate90thPercentile int64     `json:"bitrate_90th_percentile"`
+	Elapsed               []float64 `json:"elapsed"`
+	RebufferingEvents     int64     `json:"rebuffering_events"`
+	RebufferingTime       float64   `json:"rebuffering_time"`
+}
+
+// TestKeys contains the test keys
+type TestKeys struct {
+	Advanced           Advanced                    `json:"advanced"`
+	Simple             Simple                      `json:"simple"`
+	Failure            *string                     `json:"failure"`
+	PerformanceSummary *model.PerformanceSummary   `json:"performance_summary"`
+	ReceiverData       []neubotModel.ClientResults `json:"receiver_data"`
+	Server             string                      `json:"server"`
+}
+
+type dashClient interface {
+	StartDownload(ctx context.Context) (<-chan neubotModel.ClientResults, error)
+	Error() error
+	ServerResults() []neubotModel.ServerResults
+}
+
+type runner struct {
+	callbacks   handler.Callbacks
+	client      dashClient
+	jsonMarshal func(v interface{}) ([]byte, error)
+	logger      log.Logger
+	runtime     time.Duration
+	tk          *TestKeys
+}
+
+func newRunner(
+	logger log.Logger, client dashClient,
+	callbacks handler.Callbacks,
+	jsonMarshal func(v interface{}) ([]byte, error),
+) *runner {
+	return &runner{
+		callbacks:   callbacks,
+		client:      client,
+		jsonMarshal: jsonMarshal,
+		logger:      logger,
+		tk:          new(TestKeys),
+	}
+}
+
+// loop runs the neubot/dash measurement loop and writes
+// interim results of the test in `tk`. It is not this
+// function's concern to set tk.Failure. The caller must do it
+// when this function returns a non-nil error. If the runner has a
+// runtime, we stop the loop when the runtime expires, and this is
+// not an error provided that we have collected some results.
+func (r *runner) loop(ctx context.Context) error {
+	loopctx, cancel := ctx, context.CancelFunc(func() {})
+	if r.runtime > 0 {
+		loopctx, cancel = context.WithTimeout(ctx, r.runtime)
+	}
+	defer cancel()
+	ch, err := r.client.StartDownload(loopctx)
+	if err != nil {
+		return err
+	}
+	percentage := 0.0
+	step := 1 / (totalStep + 1)
+	for results := range ch {
+		percentage += step
+		message := fmt.Sprintf(
+			"rate: %s/s speed: %s/s elapsed: %.2f s",
+			humanize.Bytes(uint64(results.Rate*1000/8)), // Rate is kbit in SI size
+			humanize.Bytes(uint64(float64(results.Received)/results.Elapsed)),
+			results.Elapsed,
+		)
+		r.callbacks.OnProgress(percentage, message)
+		data, err := r.jsonMarshal(results)
+		if err != nil {
+			return err
+		}
+		r.logger.Debugf("%s", string(data))
+		r.tk.ReceiverData = append(r.tk.ReceiverData, results)
+	}
+	if err := r.client.Error(); err != nil {
+		expired := ctx.Err() == nil && loopctx.Err() != nil
+		if !expired || len(r.tk.ReceiverData) <= 0 {
+			return err
+		}
+		r.logger.Debugf("dash: runtime expired after %s", r.runtime)
+	}
+	data, err := r.jsonMarshal(r.client.ServerResults())
+	if err != nil {
+		return err
+	}
+	r.logger.Debugf("Server result: %s", string(data))
+	// TODO(bassosimone): it seems we're not saving the server data?
+	return nil
+}
+
+// analyze analyzes the results of DASH and fills stats inside of tk.
+func (tk *TestKeys) analyze() error {
+	var rates []float64
+	var frameReadyTime float64
+	var playTime float64
+	for _, results := range tk.ReceiverData {
+		rates = append(rates, float64(results.Rate))
+		tk.Simple.ConnectLatency = results.ConnectTime // same in all samples
+		// Rationale: first segment plays when it arrives. Subsequent segments
+		// would play in ElapsedTarget seconds. However, will play when they
+		// arrive. Stall is the time we need to wait for a frame to arrive with
+		// the video stopped and the spinning icon.
+		frameReadyTime += results.Elapsed
+		if playTime == 0.0 {
+			playTime += frameReadyTime
+		} else {
+			playTime += float64(results.ElapsedTarget)
+		}
+		stall := frameReadyTime - playTime
+		if stall > tk.Simple.MinPlayoutDelay {
+			tk.Simple.MinPlayoutDelay = stall
+		}
+	}
+	median, err := stats.Median(rates)
+	tk.Simple.MedianBitrate = int64(median)
+	if err != nil {
+		return err
+	}
+	if err := tk.analyzeAdvanced(rates); err != nil {
+		return err
+	}
+	tk.PerformanceSummary = &model.PerformanceSummary{
+		Download: float64(tk.Simple.MedianBitrate) * 1e03, // kbit/s to bit/s
+		Latency:  tk.Simple.ConnectLatency,
+		Server:   tk.Server,
+	}
+	return nil
+}
+
+// analyzeAdvanced computes the extended summary. To estimate rebuffering
+// we assume that the video starts playing as soon as the first segment
+// arrives and that the player stalls whenever a segment arrives after
+// the previous segment has finished playing.
+func (tk *TestKeys) analyzeAdvanced(rates []float64) error {
+	for _, entry := range []struct {
+		percent float64
+		value   *int64
+	}{
+		{10, &tk.Advanced.Bitrate10thPercentile},
+		{25, &tk.Advanced.Bitrate25thPercentile},
+		{75, &tk.Advanced.Bitrate75thPercentile},
+		{90, &tk.Advanced.Bitrate90thPercentile},
+	} {
+		percentile, err := stats.PercentileNearestRank(rates, entry.percent)
+		if err != nil {
+			return err
+		}
+		*entry.value = int64(percentile)
+	}
+	var arrival, playEnd float64
+	for idx, results := range tk.ReceiverData {
+		tk.Advanced.Elapsed = append(tk.Advanced.Elapsed, results.Elapsed)
+		arrival += results.Elapsed
+		if idx > 0 && arrival > playEnd {
+			tk.Advanced.RebufferingEvents++
+			tk.Advanced.RebufferingTime += arrival - playEnd
+		}
+		if arrival > playEnd {
+			playEnd = arrival
+		}
+		playEnd += float64(results.ElapsedTarget)
+	}
+	return nil
+}
+
+// printSummary just prints a debug-level summary. We cannot use the info
+// level because that is reserved for the OONI Probe CLI.
+func (tk *TestKeys) printSummary(logger log.Logger) {
+	logger.Debugf("Test Summary: ")
+	logger.Debugf("Connect latency: %s",
+		// convert to nanoseconds
+		time.Duration(tk.Simple.ConnectLatency*1000000000),
+	)
+	logger.Debugf("Median bitrate: %s/s",
+		// MedianBitrate is kbit in SI size
+		humanize.Bytes(uint64(tk.Simple.MedianBitrate*1000/8)),
+	)
+	logger.Debugf("Min. playout delay: %.3f s", tk.Simple.MinPlayoutDelay)
+	logger.Debugf("Rebuffering: %d events, %.3f s",
+		tk.Advanced.RebufferingEvents, tk.Advanced.RebufferingTime,
+	)
+}
+
+// do is the main function of the runner
+func (r *runner) do(ctx context.Context) error {
+	err := r.loop(ctx)
+	if err != nil {
+		s := err.Error()
+		r.tk.Failure = &s
+		return err
+	}
+	err = r.tk.analyze()
+	if err != nil {
+		s := err.Error()
+		r.tk.Failure = &s
+		return err
+	}
+	r.callbacks.OnProgress(1, "done")
+	r.tk.printSummary(r.logger)
+	return nil
+}
+
+type measurer struct {
+	config Config
+}
+
+// timeout returns the timeout for the whole measurement. When the user
+// has configured a runtime, we allow for some margin on top of it, to
+// account for discovery, negotiation and collection, rather than using
+// the default timeout, which may be shorter than the runtime.
+func (m *measurer) timeout() time.Duration {
+	if m.config.Runtime <= 0 {
+		return defaultTimeout
+	}
+	return time.Duration(m.config.Runtime)*time.Second + timeoutMargin
+}
+
+func (m *measurer) measure(
+	ctx context.Context, sess *session.Session,
+	measurement *model.Measurement, callbacks handler.Callbacks,
+) error {
+	client, err := m.newClient(sess)
+	if err != nil {
+		return err
+	}
+	r := newRunner(sess.Logger, client, callbacks, json.Marshal)
+	r.runtime = time.Duration(m.config.Runtime) * time.Second
+	measurement.TestKeys = r.tk
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+	callbacks.OnProgress(0, fmt.Sprintf("server: %s", client.FQDN))
+	err = r.do(ctx)
+	r.tk.Server = client.FQDN // set by the client when using mlab-ns
+	if r.tk.PerformanceSummary != nil {
+		r.tk.PerformanceSummary.Server = r.tk.Server
+	}
+	return err
+}
+
+// newClient creates a new neubot/dash client. If the config contains a
+// server URL, we use it rather than asking mlab-ns. This allows to run
+// the experiment against a local neubot/dash server.
+func (m *measurer) newClient(sess *session.Session) (*client.Client, error) {
+	clnt := client.New(sess.SoftwareName, sess.SoftwareVersion)
+	if m.config.ServerURL == "" {
+		return clnt, nil
+	}
+	URL, err := url.Parse(m.config.ServerURL)
+	if err != nil {
+		return nil, err
+	}
+	if (URL.Scheme != "http" && URL.Scheme != "https") || URL.Host == "" {
+		return nil, errors.New("dash: invalid server URL")
+	}
+	clnt.FQDN = URL.Host
+	clnt.Scheme = URL.Scheme
+	return clnt, nil
+}
+
+// NewExperiment creates a new experiment.
+func NewExperiment(
+	sess *session.Session, config Config,
+) *experiment.Experiment {
+	m := &measurer{config: config}
+	return experiment.New(sess, testName, testVersion, m.measure)
+}
@@ -1,56 +0,0 @@
-// +build cgo
-
-// Package dash contains the dash network experiment.
-package dash
-
-import (
-	"context"
-
-	"github.com/ooni/probe-engine/experiment"
-	"github.com/ooni/probe-engine/experiment/handler"
-	"github.com/ooni/probe-engine/experiment/mkrunner"
-	"github.com/ooni/probe-engine/measurementkit"
-	"github.com/ooni/probe-engine/model"
-	"github.com/ooni/probe-engine/session"
-)
-
-const (
-	testName    = "dash"
-	testVersion = "0.7.0"
-)
-
-// Config contains the experiment config.
-type Config struct {
-	// LogLevel is the MK log level. Empty implies "WARNING".
-	LogLevel string
-}
-
-func measure(
-	ctx context.Context, sess *session.Session, measurement *model.Measurement,
-	callbacks handler.Callbacks, config Config,
-) error {
-	settings := measurementkit.NewSettings(
-		"Dash", sess.SoftwareName, sess.SoftwareVersion,
-		sess.CABundlePath(), sess.ProbeASNString(), sess.ProbeCC(),
-		sess.ProbeIP(), sess.ProbeNetworkName(), config.LogLevel,
-	)
-	return mkrunner.Do(
-		settings, sess, measurement, callbacks, measurementkit.StartEx,
-	)
-}
-
-// NewExperiment creates a new experiment.
-func NewExperiment(
-	sess *session.Session, config Config,
-) *experiment.Experiment {
-	return experiment.New(
-		sess, testName, testVersion,
-		func(
-			ctx context.Context,
-			sess *session.Session,
-			measurement *model.Measurement,
-			callbacks handler.Callbacks,
-		) error {
-			return measure(ctx, sess, measurement, callbacks, config)
-		})
-}
@@ -1,5 +1,3 @@
-// +build !cgo
-
 package dash
 
 import (
@@ -7,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"testing"
+	"time"
 
 	"github.com/apex/log"
 	"github.com/montanaflynn/stats"
@@ -176,6 +175,9 @@ func TestUnitTestKeysAnalyzeMedian(t *testing.T) {
 	if tk.Simple.MedianBitrate != 2 {
 		t.Fatal("unexpected median value")
 	}
+	if tk.PerformanceSummary == nil || tk.PerformanceSummary.Download != 2000 {
+		t.Fatal("unexpected performance summary")
+	}
 }
 
 func TestUnitTestKeysAnalyzeMinPlayoutDelay(t *testing.T) {
@@ -234,3 +236,117 @@ func TestUnitRunnerDoWithNoData(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+type runtimeClient struct {
+	err error
+}
+
+func (c *runtimeClient) StartDownload(
+	ctx context.Context,
+) (<-chan neubotModel.ClientResults, error) {
+	ch := make(chan neubotModel.ClientResults)
+	go func() {
+		defer close(ch)
+		for {
+			select {
+			case <-ctx.Done():
+				c.err = ctx.Err()
+				return
+			case ch <- neubotModel.ClientResults{Rate: 100}:
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+	}()
+	return ch, nil
+}
+
+func (c *runtimeClient) Error() error {
+	return c.err
+}
+
+func (c *runtimeClient) ServerResults() []neubotModel.ServerResults {
+	return nil
+}
+
+func TestUnitRunnerLoopWithRuntime(t *testing.T) {
+	runner := newRunner(
+		log.Log, &runtimeClient{}, handler.NewPrinterCallbacks(log.Log),
+		json.Marshal,
+	)
+	runner.runtime = 100 * time.Millisecond
+	if err := runner.loop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(runner.tk.ReceiverData) <= 0 {
+		t.Fatal("expected some results")
+	}
+}
+
+func TestUnitRunnerLoopWithParentContextExpired(t *testing.T) {
+	runner := newRunner(
+		log.Log, &runtimeClient{}, handler.NewPrinterCallbacks(log.Log),
+		json.Marshal,
+	)
+	runner.runtime = time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := runner.loop(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("not the error we expected")
+	}
+}
+
+func TestUnitTestKeysAnalyzeAdvanced(t *testing.T) {
+	tk := &TestKeys{}
+	for _, elapsed := range []float64{1, 1, 3, 1, 4, 1, 1, 1, 1, 1} {
+		tk.ReceiverData = append(tk.ReceiverData, neubotModel.ClientResults{
+			Elapsed:       elapsed,
+			ElapsedTarget: 2,
+			Rate:          int64(len(tk.ReceiverData)+1) * 100,
+		})
+	}
+	if err := tk.analyze(); err != nil {
+		t.Fatal(err)
+	}
+	advanced := tk.Advanced
+	if advanced.Bitrate10thPercentile != 100 || advanced.Bitrate90thPercentile != 900 {
+		t.Fatalf("unexpected percentiles: %+v", advanced)
+	}
+	if len(advanced.Elapsed) != 10 || advanced.Elapsed[4] != 4 {
+		t.Fatal("unexpected elapsed")
+	}
+	// The third segment arrives at 5 s while the second one has
+	// finished playing at 5 s, so there is no stall. The fifth
+	// one arrives at 10 s while the fourth finished at 9 s.
+	if advanced.RebufferingEvents != 1 || advanced.RebufferingTime != 1 {
+		t.Fatalf("unexpected rebuffering: %+v", advanced)
+	}
+}
+
+func TestUnitMeasurerTimeout(t *testing.T) {
+	m := &measurer{}
+	if m.timeout() != defaultTimeout {
+		t.Fatal("expected the default timeout without runtime")
+	}
+	m.config.Runtime = 120
+	if m.timeout() != 120*time.Second+timeoutMargin {
+		t.Fatal("expected the timeout to depend on the runtime")
+	}
+}
+
+func TestUnitNewClientWithServerURL(t *testing.T) {
+	sess := &session.Session{Logger: log.Log}
+	m := &measurer{config: Config{ServerURL: "http://127.0.0.1:8888/"}}
+	clnt, err := m.newClient(sess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clnt.FQDN != "127.0.0.1:8888" || clnt.Scheme != "http" {
+		t.Fatal("unexpected client settings")
+	}
+	for _, URL := range []string{"ftp://127.0.0.1/", "http://", "\t"} {
+		m := &measurer{config: Config{ServerURL: URL}}
+		if _, err := m.newClient(sess); err == nil {
+			t.Fatalf("expected an error with %s", URL)
+		}
+	}
+}
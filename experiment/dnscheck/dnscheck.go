@@ -0,0 +1,411 @@
+// Package dnscheck contains the DNS check network experiment.
+//
+// The input is the URL of a resolver: https://... for DoH,
+// dot://host:port for DoT and udp://ip:port for plain DNS. We
+// bootstrap the resolver addresses using the system resolver,
+// then, for every address, we connect, perform the TLS handshake
+// when needed, and resolve a control domain. This tells us
+// which encrypted resolvers are usable in the current network.
+package dnscheck
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/ooni/netx/modelx"
+	"github.com/ooni/probe-engine/experiment"
+	"github.com/ooni/probe-engine/experiment/handler"
+	"github.com/ooni/probe-engine/experiment/httpheader"
+	"github.com/ooni/probe-engine/internal/netxlogger"
+	"github.com/ooni/probe-engine/internal/oonidatamodel"
+	"github.com/ooni/probe-engine/internal/oonitemplates"
+	"github.com/ooni/probe-engine/internal/tlsx"
+	"github.com/ooni/probe-engine/model"
+	"github.com/ooni/probe-engine/session"
+)
+
+const (
+	testName    = "dnscheck"
+	testVersion = "0.1.0"
+
+	// DefaultDomain is the control domain we resolve by default.
+	DefaultDomain = "example.org"
+
+	// maxMessageSize is the maximum size of a DNS message.
+	maxMessageSize = 1 << 16
+)
+
+// Config contains the experiment config.
+type Config struct {
+	Domain string `ooni:"control domain to resolve using the resolver"`
+}
+
+// EndpointResult contains the results of using a specific
+// address of the resolver to resolve the control domain.
+type EndpointResult struct {
+	Address            string   `json:"address"`
+	Addresses          []string `json:"addresses"`
+	ConnectFailure     *string  `json:"connect_failure"`
+	DNSFailure         *string  `json:"dns_failure"`
+	Failure            *string  `json:"failure"`
+	NegotiatedProtocol string   `json:"negotiated_protocol,omitempty"`
+	TLSFailure         *string  `json:"tls_failure"`
+	TLSVersion         string   `json:"tls_version,omitempty"`
+
+	NetworkEvents oonidatamodel.NetworkEventsList `json:"network_events"`
+	Requests      oonidatamodel.RequestList       `json:"requests"`
+	TCPConnect    oonidatamodel.TCPConnectList    `json:"tcp_connect"`
+	TLSHandshakes oonidatamodel.TLSHandshakesList `json:"tls_handshakes"`
+}
+
+// TestKeys contains dnscheck test keys.
+type TestKeys struct {
+	Bootstrap        oonidatamodel.DNSQueriesList `json:"bootstrap"`
+	BootstrapFailure *string                      `json:"bootstrap_failure"`
+	Domain           string                       `json:"domain"`
+	Endpoints        []EndpointResult             `json:"endpoints"`
+	Failure          *string                      `json:"failure"`
+}
+
+// resolverInfo contains the information parsed from the input URL.
+type resolverInfo struct {
+	hostname string
+	network  string
+	port     string
+	url      *url.URL
+}
+
+// parseInput parses the resolver URL provided as input.
+func parseInput(input string) (*resolverInfo, error) {
+	parsed, err := url.Parse(input)
+	if err != nil {
+		return nil, err
+	}
+	info := &resolverInfo{hostname: parsed.Hostname(), url: parsed}
+	if info.hostname == "" {
+		return nil, fmt.Errorf("dnscheck: missing host in %s", input)
+	}
+	defaultPort := map[string]string{"https": "443", "dot": "853", "udp": "53"}
+	networks := map[string]string{"https": "doh", "dot": "dot", "udp": "udp"}
+	info.network = networks[parsed.Scheme]
+	if info.network == "" {
+		return nil, fmt.Errorf("dnscheck: unsupported scheme in %s", input)
+	}
+	info.port = parsed.Port()
+	if info.port == "" {
+		info.port = defaultPort[parsed.Scheme]
+	}
+	return info, nil
+}
+
+func makeFailure(err error) *string {
+	if err == nil {
+		return nil
+	}
+	s := err.Error()
+	return &s
+}
+
+// exchanger performs a DNS round trip with a specific endpoint.
+type exchanger struct {
+	address      string
+	beginning    time.Time
+	caBundlePath string
+	handler      modelx.Handler
+	info         *resolverInfo
+	result       *EndpointResult
+}
+
+// do returns the function that sends the query and reads the reply
+// using conn. When framed is true, we use the TCP framing.
+func (e *exchanger) do(
+	ctx context.Context, query []byte, framed bool, reply *[]byte,
+) func(conn net.Conn) error {
+	return func(conn net.Conn) error {
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+		}
+		if !framed {
+			if _, err := conn.Write(query); err != nil {
+				return err
+			}
+			data := make([]byte, maxMessageSize)
+			count, err := conn.Read(data)
+			if err != nil {
+				return err
+			}
+			*reply = data[:count]
+			return nil
+		}
+		// See RFC7858 and RFC1035 Sect. 4.2.2: over TCP every message
+		// is prefixed by its length as a two byte big endian integer.
+		frame := make([]byte, 2, 2+len(query))
+		binary.BigEndian.PutUint16(frame, uint16(len(query)))
+		if _, err := conn.Write(append(frame, query...)); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, frame); err != nil {
+			return err
+		}
+		data := make([]byte, binary.BigEndian.Uint16(frame))
+		if _, err := io.ReadFull(conn, data); err != nil {
+			return err
+		}
+		*reply = data
+		return nil
+	}
+}
+
+func (e *exchanger) roundTripUDP(
+	ctx context.Context, query []byte,
+) ([]byte, oonitemplates.Results, error) {
+	var reply []byte
+	results := oonitemplates.ConnectAndDo(ctx, oonitemplates.ConnectAndDoConfig{
+		Address:   e.address,
+		Beginning: e.beginning,
+		Do:        e.do(ctx, query, false, &reply),
+		Handler:   e.handler,
+		Network:   "udp",
+	})
+	return reply, results.TestKeys, results.Error
+}
+
+func (e *exchanger) roundTripDoT(
+	ctx context.Context, query []byte,
+) ([]byte, oonitemplates.Results, error) {
+	var reply []byte
+	results := oonitemplates.ConnectAndDo(ctx, oonitemplates.ConnectAndDoConfig{
+		Address:      e.address,
+		Beginning:    e.beginning,
+		CABundlePath: e.caBundlePath,
+		Do:           e.do(ctx, query, true, &reply),
+		Handler:      e.handler,
+		Network:      "tcp",
+		SNI:          e.info.hostname,
+		TLS:          true,
+	})
+	return reply, results.TestKeys, results.Error
+}
+
+func (e *exchanger) roundTripDoH(
+	ctx context.Context, query []byte,
+) ([]byte, oonitemplates.Results, error) {
+	// We connect to the endpoint address, so we're sure we're measuring
+	// the endpoint we're interested into, and we use the resolver's
+	// hostname as the Host header and as the SNI.
+	URL := *e.info.url
+	URL.Host = e.address
+	results := oonitemplates.HTTPDo(ctx, oonitemplates.HTTPDoConfig{
+		Accept:       "application/dns-message",
+		Beginning:    e.beginning,
+		Body:         query,
+		CABundlePath: e.caBundlePath,
+		Handler:      e.handler,
+		Headers: http.Header{
+			"Content-Type": []string{"application/dns-message"},
+		},
+		Host:                    e.info.url.Host,
+		MaxEventsBodySnapSize:   maxMessageSize,
+		MaxResponseBodySnapSize: maxMessageSize,
+		Method:                  "POST",
+		SNI:                     e.info.hostname,
+		URL:                     URL.String(),
+		UserAgent:               httpheader.RandomUserAgent(),
+	})
+	if results.Error != nil {
+		return nil, results.TestKeys, results.Error
+	}
+	if results.StatusCode != 200 {
+		return nil, results.TestKeys, fmt.Errorf(
+			"dnscheck: DoH server returned %d", results.StatusCode)
+	}
+	return results.BodySnap, results.TestKeys, nil
+}
+
+// lookup resolves domain, fills the endpoint result and returns
+// the results of the round trip, which we use to count bytes.
+func (e *exchanger) lookup(ctx context.Context, domain string) oonitemplates.Results {
+	query := new(dns.Msg)
+	query.SetQuestion(dns.Fqdn(domain), dns.TypeA)
+	data, err := query.Pack()
+	if err != nil {
+		e.result.Failure = makeFailure(err)
+		return oonitemplates.Results{}
+	}
+	var (
+		reply   []byte
+		results oonitemplates.Results
+	)
+	switch e.info.network {
+	case "doh":
+		reply, results, err = e.roundTripDoH(ctx, data)
+	case "dot":
+		reply, results, err = e.roundTripDoT(ctx, data)
+	default:
+		reply, results, err = e.roundTripUDP(ctx, data)
+	}
+	e.result.NetworkEvents = oonidatamodel.NewNetworkEventsList(results)
+	e.result.Requests = oonidatamodel.NewRequestList(results)
+	if e.info.network != "udp" {
+		e.result.TCPConnect = oonidatamodel.NewTCPConnectList(results)
+	}
+	e.result.TLSHandshakes = oonidatamodel.NewTLSHandshakesList(results)
+	for _, connect := range results.Connects {
+		e.result.ConnectFailure = makeFailure(connect.Error)
+	}
+	for _, handshake := range results.TLSHandshakes {
+		e.result.TLSFailure = makeFailure(handshake.Error)
+		if handshake.Error == nil {
+			state := handshake.ConnectionState
+			e.result.NegotiatedProtocol = state.NegotiatedProtocol
+			e.result.TLSVersion = tlsx.VersionString(state.Version)
+		}
+	}
+	if err == nil {
+		e.result.Addresses, err = parseReply(query, reply)
+		e.result.DNSFailure = makeFailure(err)
+	}
+	e.result.Failure = makeFailure(err)
+	return results
+}
+
+// parseReply parses the reply and returns the A records in it.
+func parseReply(query *dns.Msg, data []byte) ([]string, error) {
+	reply := new(dns.Msg)
+	if err := reply.Unpack(data); err != nil {
+		return nil, err
+	}
+	if reply.Id != query.Id {
+		return nil, errors.New("dnscheck: reply ID mismatch")
+	}
+	if reply.Rcode == dns.RcodeNameError {
+		return nil, errors.New("dns_nxdomain_error")
+	}
+	if reply.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("dnscheck: rcode: %s", dns.RcodeToString[reply.Rcode])
+	}
+	var addrs []string
+	for _, answer := range reply.Answer {
+		if record, ok := answer.(*dns.A); ok {
+			addrs = append(addrs, record.A.String())
+		}
+	}
+	if len(addrs) <= 0 {
+		return nil, errors.New("dnscheck: no A records in reply")
+	}
+	return addrs, nil
+}
+
+type measurer struct {
+	config Config
+
+	// caBundlePath allows tests to use a custom CA bundle.
+	caBundlePath string
+}
+
+func newMeasurer(config Config) *measurer {
+	return &measurer{config: config}
+}
+
+func (m *measurer) bootstrap(
+	ctx context.Context, sess *session.Session,
+	measurement *model.Measurement, info *resolverInfo, tk *TestKeys,
+) ([]string, int64, int64) {
+	if net.ParseIP(info.hostname) != nil {
+		return []string{info.hostname}, 0, 0
+	}
+	results := oonitemplates.DNSLookup(ctx, oonitemplates.DNSLookupConfig{
+		Beginning: measurement.MeasurementStartTimeSaved,
+		Handler:   netxlogger.NewHandler(sess.Logger),
+		Hostname:  info.hostname,
+	})
+	tk.Bootstrap = oonidatamodel.NewDNSQueriesList(results.TestKeys)
+	tk.BootstrapFailure = makeFailure(results.Error)
+	return results.Addresses, results.TestKeys.ReceivedBytes, results.TestKeys.SentBytes
+}
+
+func (m *measurer) measure(
+	ctx context.Context,
+	sess *session.Session,
+	measurement *model.Measurement,
+	callbacks handler.Callbacks,
+) error {
+	if measurement.Input == "" {
+		return errors.New("Experiment requires measurement.Input")
+	}
+	info, err := parseInput(measurement.Input)
+	if err != nil {
+		return err
+	}
+	tk := &TestKeys{Domain: m.config.Domain}
+	if tk.Domain == "" {
+		tk.Domain = DefaultDomain
+	}
+	measurement.TestKeys = tk
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	addrs, receivedBytes, sentBytes := m.bootstrap(ctx, sess, measurement, info, tk)
+	if len(addrs) <= 0 {
+		tk.Failure = tk.BootstrapFailure
+		return nil
+	}
+	tk.Endpoints = make([]EndpointResult, len(addrs))
+	results := make([]oonitemplates.Results, len(addrs))
+	var waitgroup sync.WaitGroup
+	waitgroup.Add(len(addrs))
+	for idx, addr := range addrs {
+		go func(idx int, address string) {
+			defer waitgroup.Done()
+			tk.Endpoints[idx].Address = address
+			ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			defer cancel()
+			results[idx] = (&exchanger{
+				address:      address,
+				beginning:    measurement.MeasurementStartTimeSaved,
+				caBundlePath: m.caBundlePath,
+				handler:      netxlogger.NewHandler(sess.Logger),
+				info:         info,
+				result:       &tk.Endpoints[idx],
+			}).lookup(ctx, tk.Domain)
+		}(idx, net.JoinHostPort(addr, info.port))
+	}
+	waitgroup.Wait()
+	var working int
+	for idx, result := range tk.Endpoints {
+		if result.Failure == nil {
+			working++
+		}
+		receivedBytes += results[idx].ReceivedBytes
+		sentBytes += results[idx].SentBytes
+	}
+	if working <= 0 {
+		s := "all_endpoints_failed"
+		tk.Failure = &s
+	}
+	callbacks.OnProgress(1, fmt.Sprintf(
+		"dnscheck: %s: %d/%d working endpoints",
+		measurement.Input, working, len(tk.Endpoints),
+	))
+	callbacks.OnDataUsage(
+		float64(receivedBytes)/1024.0, // downloaded
+		float64(sentBytes)/1024.0,     // uploaded
+	)
+	return nil
+}
+
+// NewExperiment creates a new experiment.
+func NewExperiment(
+	sess *session.Session, config Config,
+) *experiment.Experiment {
+	return experiment.New(sess, testName, testVersion,
+		newMeasurer(config).measure)
+}
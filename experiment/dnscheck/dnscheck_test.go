@@ -0,0 +1,296 @@
+package dnscheck
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/apex/log"
+	"github.com/miekg/dns"
+	"github.com/ooni/probe-engine/experiment/handler"
+	"github.com/ooni/probe-engine/internal/kvstore"
+	"github.com/ooni/probe-engine/model"
+	"github.com/ooni/probe-engine/session"
+)
+
+const (
+	softwareName    = "ooniprobe-example"
+	softwareVersion = "0.0.1"
+)
+
+func newsession() *session.Session {
+	return session.New(
+		log.Log, softwareName, softwareVersion,
+		"../../testdata", nil, nil, "../../testdata",
+		kvstore.NewMemoryKeyValueStore(),
+	)
+}
+
+// reply replies with 127.0.0.1 for example.org and NXDOMAIN otherwise.
+func reply(query *dns.Msg) *dns.Msg {
+	reply := new(dns.Msg)
+	reply.SetReply(query)
+	if len(query.Question) != 1 || query.Question[0].Name != "example.org." {
+		reply.Rcode = dns.RcodeNameError
+		return reply
+	}
+	reply.Answer = append(reply.Answer, &dns.A{
+		Hdr: dns.RR_Header{
+			Name: "example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60,
+		},
+		A: net.IPv4(127, 0, 0, 1),
+	})
+	return reply
+}
+
+var dnsHandler = dns.HandlerFunc(func(w dns.ResponseWriter, query *dns.Msg) {
+	w.WriteMsg(reply(query))
+})
+
+func newDoHServer() *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			data, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				w.WriteHeader(400)
+				return
+			}
+			query := new(dns.Msg)
+			if err := query.Unpack(data); err != nil {
+				w.WriteHeader(400)
+				return
+			}
+			data, err = reply(query).Pack()
+			if err != nil {
+				w.WriteHeader(500)
+				return
+			}
+			w.Header().Set("content-type", "application/dns-message")
+			w.Write(data)
+		},
+	))
+}
+
+// newCABundle writes the certificate of server into a CA bundle
+// and returns the bundle path. The caller must remove it.
+func newCABundle(t *testing.T, server *httptest.Server) string {
+	bundle, err := ioutil.TempFile("", "dnscheck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pem.Encode(bundle, &pem.Block{
+		Type: "CERTIFICATE", Bytes: server.Certificate().Raw,
+	})
+	bundle.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bundle.Name()
+}
+
+type dataUsageCallbacks struct {
+	handler.Callbacks
+	downloaded, uploaded float64
+}
+
+func (c *dataUsageCallbacks) OnDataUsage(dloadKiB, uploadKiB float64) {
+	c.downloaded += dloadKiB
+	c.uploaded += uploadKiB
+}
+
+func measure(
+	t *testing.T, caBundlePath, input string, config Config,
+) (*TestKeys, *dataUsageCallbacks) {
+	measurement := &model.Measurement{Input: input}
+	measurer := newMeasurer(config)
+	measurer.caBundlePath = caBundlePath
+	callbacks := &dataUsageCallbacks{
+		Callbacks: handler.NewPrinterCallbacks(log.Log),
+	}
+	err := measurer.measure(
+		context.Background(), newsession(), measurement, callbacks,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return measurement.TestKeys.(*TestKeys), callbacks
+}
+
+func TestUnitNewExperiment(t *testing.T) {
+	experiment := NewExperiment(newsession(), Config{})
+	if experiment == nil {
+		t.Fatal("nil experiment returned")
+	}
+}
+
+func TestUnitMeasureWithInvalidInput(t *testing.T) {
+	for _, input := range []string{"", "\t", "ftp://8.8.8.8", "dot://"} {
+		err := newMeasurer(Config{}).measure(
+			context.Background(),
+			newsession(),
+			&model.Measurement{Input: input},
+			handler.NewPrinterCallbacks(log.Log),
+		)
+		if err == nil {
+			t.Fatalf("expected an error with '%s'", input)
+		}
+	}
+}
+
+func TestUnitParseInput(t *testing.T) {
+	var tests = []struct {
+		input   string
+		network string
+		port    string
+	}{
+		{"https://dns.google/dns-query", "doh", "443"},
+		{"https://127.0.0.1:8443/dns-query", "doh", "8443"},
+		{"dot://dns.google", "dot", "853"},
+		{"udp://8.8.8.8:5353", "udp", "5353"},
+		{"udp://8.8.8.8", "udp", "53"},
+	}
+	for _, tt := range tests {
+		info, err := parseInput(tt.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.network != tt.network || info.port != tt.port {
+			t.Fatalf("unexpected info for %s: %+v", tt.input, info)
+		}
+	}
+}
+
+func TestUnitMeasureWithLocalDoH(t *testing.T) {
+	server := newDoHServer()
+	defer server.Close()
+	bundle := newCABundle(t, server)
+	defer os.Remove(bundle)
+	tk, callbacks := measure(t, bundle, server.URL+"/dns-query", Config{})
+	if tk.Failure != nil || len(tk.Endpoints) != 1 {
+		t.Fatalf("unexpected results: %+v", tk)
+	}
+	endpoint := tk.Endpoints[0]
+	if endpoint.Failure != nil || len(endpoint.Addresses) != 1 ||
+		endpoint.Addresses[0] != "127.0.0.1" || endpoint.TLSVersion == "" {
+		t.Fatalf("unexpected endpoint: %+v", endpoint)
+	}
+	if len(endpoint.TCPConnect) != 1 || len(endpoint.TLSHandshakes) != 1 ||
+		len(endpoint.Requests) != 1 {
+		t.Fatalf("unexpected events: %+v", endpoint)
+	}
+	if callbacks.downloaded <= 0 || callbacks.uploaded <= 0 {
+		t.Fatal("expected to count the bytes we have exchanged")
+	}
+}
+
+func TestUnitMeasureWithLocalDoHAndNXDOMAIN(t *testing.T) {
+	server := newDoHServer()
+	defer server.Close()
+	bundle := newCABundle(t, server)
+	defer os.Remove(bundle)
+	tk, _ := measure(
+		t, bundle, server.URL+"/dns-query", Config{Domain: "antani.example.org"},
+	)
+	if tk.Failure == nil || *tk.Failure != "all_endpoints_failed" {
+		t.Fatal("expected a failure here")
+	}
+	endpoint := tk.Endpoints[0]
+	if endpoint.DNSFailure == nil || *endpoint.DNSFailure != "dns_nxdomain_error" ||
+		endpoint.TLSFailure != nil || endpoint.ConnectFailure != nil {
+		t.Fatalf("unexpected endpoint: %+v", endpoint)
+	}
+}
+
+func TestUnitMeasureWithUntrustedDoH(t *testing.T) {
+	server := newDoHServer()
+	defer server.Close()
+	tk, _ := measure(t, "", server.URL+"/dns-query", Config{})
+	endpoint := tk.Endpoints[0]
+	if endpoint.TLSFailure == nil || *endpoint.TLSFailure != "ssl_unknown_authority" ||
+		endpoint.Failure == nil || endpoint.ConnectFailure != nil ||
+		endpoint.DNSFailure != nil {
+		t.Fatalf("unexpected endpoint: %+v", endpoint)
+	}
+}
+
+func TestUnitMeasureWithLocalDoT(t *testing.T) {
+	// We borrow the certificate of a TLS server created by httptest
+	// because it is valid for 127.0.0.1 and we can easily trust it.
+	certsource := httptest.NewTLSServer(http.NotFoundHandler())
+	defer certsource.Close()
+	bundle := newCABundle(t, certsource)
+	defer os.Remove(bundle)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", certsource.TLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{Listener: listener, Handler: dnsHandler}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+	tk, _ := measure(t, bundle, "dot://"+listener.Addr().String(), Config{})
+	endpoint := tk.Endpoints[0]
+	if endpoint.Failure != nil || len(endpoint.Addresses) != 1 ||
+		endpoint.TLSVersion == "" {
+		t.Fatalf("unexpected endpoint: %+v", endpoint)
+	}
+	if len(endpoint.NetworkEvents) <= 0 || len(endpoint.TCPConnect) != 1 ||
+		len(endpoint.TLSHandshakes) != 1 {
+		t.Fatalf("unexpected events: %+v", endpoint)
+	}
+}
+
+func TestUnitMeasureWithLocalUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: conn, Handler: dnsHandler}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+	tk, callbacks := measure(t, "", "udp://"+conn.LocalAddr().String(), Config{})
+	endpoint := tk.Endpoints[0]
+	if endpoint.Failure != nil || len(endpoint.Addresses) != 1 ||
+		endpoint.TLSVersion != "" {
+		t.Fatalf("unexpected endpoint: %+v", endpoint)
+	}
+	if len(endpoint.NetworkEvents) <= 0 || len(endpoint.TCPConnect) != 0 {
+		t.Fatalf("unexpected events: %+v", endpoint)
+	}
+	if callbacks.downloaded <= 0 || callbacks.uploaded <= 0 {
+		t.Fatal("expected to count the bytes we have exchanged")
+	}
+}
+
+func TestUnitMeasureWithConnectionRefused(t *testing.T) {
+	// Port 1 is reserved and most likely nobody is listening there
+	tk, _ := measure(t, "", "dot://127.0.0.1:1", Config{})
+	endpoint := tk.Endpoints[0]
+	if endpoint.ConnectFailure == nil || *endpoint.ConnectFailure != "connection_refused" ||
+		endpoint.TLSFailure != nil {
+		t.Fatalf("unexpected endpoint: %+v", endpoint)
+	}
+}
+
+func TestUnitMeasureWithBootstrapFailure(t *testing.T) {
+	tk, _ := measure(t, "", "dot://antani.invalid", Config{})
+	if tk.BootstrapFailure == nil || tk.Failure == nil || len(tk.Endpoints) != 0 {
+		t.Fatalf("unexpected results: %+v", tk)
+	}
+}
+
+func TestIntegrationMeasure(t *testing.T) {
+	for _, input := range []string{
+		"https://dns.google/dns-query", "dot://dns.google", "udp://8.8.8.8:53",
+	} {
+		tk, _ := measure(t, "", input, Config{})
+		if tk.Failure != nil {
+			t.Fatalf("%s: unexpected failure: %s", input, *tk.Failure)
+		}
+	}
+}
@@ -0,0 +1,386 @@
+// Package dnsconsistency contains the DNS consistency network experiment.
+//
+// We resolve the input domain using the system resolver and a set of
+// trusted control resolvers (DoH, DoT or plain UDP/TCP), and we flag as
+// inconsistent answers that do not match the ones of the controls.
+//
+// See https://github.com/ooni/spec/blob/master/nettests/ts-002-dns-consistency.md.
+package dnsconsistency
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ooni/probe-engine/experiment"
+	"github.com/ooni/probe-engine/experiment/handler"
+	"github.com/ooni/probe-engine/geoiplookup/mmdblookup"
+	"github.com/ooni/probe-engine/internal/netxlogger"
+	"github.com/ooni/probe-engine/internal/oonidatamodel"
+	"github.com/ooni/probe-engine/internal/oonitemplates"
+	"github.com/ooni/probe-engine/model"
+	"github.com/ooni/probe-engine/session"
+)
+
+const (
+	testName    = "dns_consistency"
+	testVersion = "0.1.0"
+
+	// DefaultResolvers contains the control resolvers we use by default.
+	DefaultResolvers = "https://cloudflare-dns.com/dns-query,dot://8.8.8.8:853,udp://9.9.9.9:53"
+)
+
+const (
+	// ClassificationConsistent means that at least one of the
+	// control resolvers agrees with the system resolver.
+	ClassificationConsistent = "consistent"
+
+	// ClassificationInconclusive means that all the control
+	// resolvers failed, or that we could not map the addresses
+	// to ASNs to compare them, so we cannot say anything.
+	ClassificationInconclusive = "inconclusive"
+
+	// ClassificationNXDOMAINInjection means that the system resolver
+	// says the domain does not exist while the controls resolve it.
+	ClassificationNXDOMAINInjection = "nxdomain_injection"
+
+	// ClassificationBogonAnswer means that the system resolver returned
+	// private or reserved addresses that the controls did not return.
+	ClassificationBogonAnswer = "bogon_answer"
+
+	// ClassificationASNMismatch means that the addresses returned by the
+	// system resolver and by the controls belong to different ASNs.
+	ClassificationASNMismatch = "asn_mismatch"
+
+	// ClassificationSystemFailure means that the system resolver failed
+	// for reasons other than NXDOMAIN while the controls did not.
+	ClassificationSystemFailure = "system_resolver_failure"
+)
+
+// Config contains the experiment config.
+type Config struct {
+	Resolvers string `ooni:"comma separated list of control resolvers (e.g. https://cloudflare-dns.com/dns-query,dot://8.8.8.8:853,udp://9.9.9.9:53)"`
+}
+
+// ResolverResult contains the result of resolving the input
+// domain with a specific resolver.
+type ResolverResult struct {
+	Addresses      []string `json:"addresses"`
+	Classification string   `json:"classification,omitempty"`
+	Failure        *string  `json:"failure"`
+	Resolver       string   `json:"resolver"`
+}
+
+// TestKeys contains dns_consistency test keys.
+type TestKeys struct {
+	Classification string                       `json:"classification"`
+	Controls       []ResolverResult             `json:"controls"`
+	Inconsistent   []string                     `json:"inconsistent"`
+	Queries        oonidatamodel.DNSQueriesList `json:"queries"`
+	System         ResolverResult               `json:"system"`
+}
+
+// resolver is a parsed entry of Config.Resolvers.
+type resolver struct {
+	address string
+	network string
+	url     string
+}
+
+// parseResolvers parses the comma separated list of resolvers. We use
+// the https scheme for DoH and dot, tcp, and udp for the others.
+func parseResolvers(list string) ([]resolver, error) {
+	var out []resolver
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parsed, err := url.Parse(entry)
+		if err != nil {
+			return nil, err
+		}
+		if parsed.Host == "" {
+			return nil, fmt.Errorf("dnsconsistency: missing host in %s", entry)
+		}
+		switch parsed.Scheme {
+		case "https":
+			out = append(out, resolver{address: entry, network: "doh", url: entry})
+		case "dot", "tcp", "udp":
+			address := parsed.Host
+			if parsed.Port() == "" {
+				port := "53"
+				if parsed.Scheme == "dot" {
+					port = "853"
+				}
+				address = net.JoinHostPort(parsed.Hostname(), port)
+			}
+			out = append(out, resolver{
+				address: address, network: parsed.Scheme, url: entry,
+			})
+		default:
+			return nil, fmt.Errorf("dnsconsistency: unsupported scheme in %s", entry)
+		}
+	}
+	if len(out) <= 0 {
+		return nil, errors.New("dnsconsistency: no control resolvers")
+	}
+	return out, nil
+}
+
+// bogons contains private and reserved IPv4 and IPv6 networks.
+var bogons = func() (out []*net.IPNet) {
+	for _, cidr := range []string{
+		"0.0.0.0/8",
+		"10.0.0.0/8",
+		"100.64.0.0/10",
+		"127.0.0.0/8",
+		"169.254.0.0/16",
+		"172.16.0.0/12",
+		"192.0.0.0/24",
+		"192.0.2.0/24",
+		"192.168.0.0/16",
+		"198.18.0.0/15",
+		"198.51.100.0/24",
+		"203.0.113.0/24",
+		"224.0.0.0/4",
+		"240.0.0.0/4",
+		"::/128",
+		"::1/128",
+		"fc00::/7",
+		"fe80::/10",
+		"ff00::/8",
+	} {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		out = append(out, network)
+	}
+	return
+}()
+
+// isBogon returns true if addr is a private or reserved address.
+func isBogon(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range bogons {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasBogons(addrs []string) bool {
+	for _, addr := range addrs {
+		if isBogon(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// compare compares the results of the system resolver with the results
+// of a control that did not fail. It returns the classification.
+func compare(
+	system, control ResolverResult, lookupASN func(addr string) uint,
+) string {
+	if system.Failure != nil {
+		if *system.Failure == "dns_nxdomain_error" {
+			return ClassificationNXDOMAINInjection
+		}
+		return ClassificationSystemFailure
+	}
+	if hasBogons(system.Addresses) && !hasBogons(control.Addresses) {
+		return ClassificationBogonAnswer
+	}
+	ours := make(map[string]bool)
+	for _, addr := range system.Addresses {
+		ours[addr] = true
+	}
+	for _, addr := range control.Addresses {
+		if ours[addr] {
+			return ClassificationConsistent
+		}
+	}
+	// Also consider consistent addresses belonging to the same ASN
+	// as the ones seen by the control, as it happens with CDNs. When
+	// we cannot map either side to ASNs (e.g. because we do not have
+	// the ASN database) we cannot claim there is a mismatch.
+	ourASNs, theirASNs := knownASNs(system.Addresses, lookupASN),
+		knownASNs(control.Addresses, lookupASN)
+	if len(ourASNs) <= 0 || len(theirASNs) <= 0 {
+		return ClassificationInconclusive
+	}
+	for asn := range theirASNs {
+		if ourASNs[asn] {
+			return ClassificationConsistent
+		}
+	}
+	return ClassificationASNMismatch
+}
+
+// knownASNs returns the set of the ASNs of addrs, excluding the
+// zero ASN, which means that the ASN is not known.
+func knownASNs(addrs []string, lookupASN func(addr string) uint) map[uint]bool {
+	asns := make(map[uint]bool)
+	for _, addr := range addrs {
+		if asn := lookupASN(addr); asn != 0 {
+			asns[asn] = true
+		}
+	}
+	return asns
+}
+
+// classify compares the system resolver with every control that did not
+// fail and sets the classification. It's enough for a single control
+// to agree with the system resolver to consider it consistent, because
+// different controls may legitimately see different CDN nodes. Controls
+// for which the comparison is inconclusive are not inconsistent.
+func (tk *TestKeys) classify(lookupASN func(addr string) uint) {
+	tk.Classification = ClassificationInconclusive
+	for idx := range tk.Controls {
+		control := &tk.Controls[idx]
+		if control.Failure != nil {
+			continue
+		}
+		control.Classification = compare(tk.System, *control, lookupASN)
+		if control.Classification == ClassificationConsistent {
+			tk.Classification = ClassificationConsistent
+			continue
+		}
+		if control.Classification == ClassificationInconclusive {
+			continue
+		}
+		tk.Inconsistent = append(tk.Inconsistent, control.Resolver)
+		if tk.Classification == ClassificationInconclusive {
+			tk.Classification = control.Classification
+		}
+	}
+}
+
+func makeResolverResult(
+	name string, results *oonitemplates.DNSLookupResults,
+) ResolverResult {
+	out := ResolverResult{Addresses: results.Addresses, Resolver: name}
+	if results.Error != nil {
+		s := results.Error.Error()
+		out.Failure = &s
+	}
+	return out
+}
+
+// maybeURLToHostname handles the case where the input is from the
+// test-lists and hence every input is a URL rather than a domain.
+func maybeURLToHostname(input string) (string, error) {
+	parsed, err := url.Parse(input)
+	if err != nil {
+		return "", err
+	}
+	if parsed.Path == input {
+		return input, nil
+	}
+	return parsed.Hostname(), nil
+}
+
+type measurer struct {
+	config Config
+}
+
+func newMeasurer(config Config) *measurer {
+	return &measurer{config: config}
+}
+
+func (m *measurer) measure(
+	ctx context.Context,
+	sess *session.Session,
+	measurement *model.Measurement,
+	callbacks handler.Callbacks,
+) error {
+	if measurement.Input == "" {
+		return errors.New("Experiment requires measurement.Input")
+	}
+	hostname, err := maybeURLToHostname(measurement.Input)
+	if err != nil {
+		return err
+	}
+	list := m.config.Resolvers
+	if list == "" {
+		list = DefaultResolvers
+	}
+	controls, err := parseResolvers(list)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	// The first entry is the system resolver, the others are the
+	// controls, which we run in parallel with the system resolver.
+	resolvers := append([]resolver{{url: "system"}}, controls...)
+	results := make([]*oonitemplates.DNSLookupResults, len(resolvers))
+	var waitgroup sync.WaitGroup
+	waitgroup.Add(len(resolvers))
+	for idx, r := range resolvers {
+		go func(idx int, r resolver) {
+			defer waitgroup.Done()
+			results[idx] = oonitemplates.DNSLookup(ctx, oonitemplates.DNSLookupConfig{
+				Beginning:     measurement.MeasurementStartTimeSaved,
+				Handler:       netxlogger.NewHandler(sess.Logger),
+				Hostname:      hostname,
+				ServerAddress: r.address,
+				ServerNetwork: r.network,
+			})
+		}(idx, r)
+	}
+	waitgroup.Wait()
+	testkeys := new(TestKeys)
+	measurement.TestKeys = testkeys
+	var receivedBytes, sentBytes int64
+	for idx, r := range resolvers {
+		testkeys.Queries = append(
+			testkeys.Queries,
+			oonidatamodel.NewDNSQueriesList(results[idx].TestKeys)...,
+		)
+		receivedBytes += results[idx].TestKeys.ReceivedBytes
+		sentBytes += results[idx].TestKeys.SentBytes
+		entry := makeResolverResult(r.url, results[idx])
+		if idx == 0 {
+			testkeys.System = entry
+			continue
+		}
+		testkeys.Controls = append(testkeys.Controls, entry)
+	}
+	testkeys.classify(func(addr string) uint {
+		asn, _, err := mmdblookup.LookupASN(
+			sess.ASNDatabasePath(), addr, sess.Logger,
+		)
+		if err != nil {
+			return 0
+		}
+		return asn
+	})
+	callbacks.OnProgress(1, fmt.Sprintf(
+		"dns_consistency: %s: %s", hostname, testkeys.Classification,
+	))
+	callbacks.OnDataUsage(
+		float64(receivedBytes)/1024.0, // downloaded
+		float64(sentBytes)/1024.0,     // uploaded
+	)
+	return nil
+}
+
+// NewExperiment creates a new experiment.
+func NewExperiment(
+	sess *session.Session, config Config,
+) *experiment.Experiment {
+	return experiment.New(sess, testName, testVersion,
+		newMeasurer(config).measure)
+}
@@ -0,0 +1,242 @@
+package dnsconsistency
+
+import (
+	"context"
+	"testing"
+
+	"github.com/apex/log"
+	"github.com/ooni/probe-engine/experiment/handler"
+	"github.com/ooni/probe-engine/internal/kvstore"
+	"github.com/ooni/probe-engine/model"
+	"github.com/ooni/probe-engine/session"
+)
+
+const (
+	softwareName    = "ooniprobe-example"
+	softwareVersion = "0.0.1"
+)
+
+func newsession() *session.Session {
+	return session.New(
+		log.Log, softwareName, softwareVersion,
+		"../../testdata", nil, nil, "../../testdata",
+		kvstore.NewMemoryKeyValueStore(),
+	)
+}
+
+func TestUnitNewExperiment(t *testing.T) {
+	experiment := NewExperiment(newsession(), Config{})
+	if experiment == nil {
+		t.Fatal("nil experiment returned")
+	}
+}
+
+func TestUnitMeasureWithoutInput(t *testing.T) {
+	err := newMeasurer(Config{}).measure(
+		context.Background(),
+		newsession(),
+		new(model.Measurement),
+		handler.NewPrinterCallbacks(log.Log),
+	)
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+}
+
+func TestUnitMeasureWithInvalidResolvers(t *testing.T) {
+	err := newMeasurer(Config{Resolvers: "ftp://8.8.8.8"}).measure(
+		context.Background(),
+		newsession(),
+		&model.Measurement{Input: "www.example.com"},
+		handler.NewPrinterCallbacks(log.Log),
+	)
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+}
+
+func TestUnitMeasureWithCancelledContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	measurement := &model.Measurement{Input: "http://www.example.com/"}
+	err := newMeasurer(Config{}).measure(
+		ctx,
+		newsession(),
+		measurement,
+		handler.NewPrinterCallbacks(log.Log),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tk := measurement.TestKeys.(*TestKeys)
+	if tk.Classification != ClassificationInconclusive {
+		t.Fatal("unexpected classification")
+	}
+	if len(tk.Controls) != 3 || tk.System.Resolver != "system" {
+		t.Fatal("unexpected resolvers")
+	}
+}
+
+func TestIntegrationMeasure(t *testing.T) {
+	ctx := context.Background()
+	sess := newsession()
+	if err := sess.MaybeLookupLocation(ctx); err != nil {
+		t.Fatal(err)
+	}
+	measurement := &model.Measurement{Input: "www.example.com"}
+	err := newMeasurer(Config{}).measure(
+		ctx, sess, measurement, handler.NewPrinterCallbacks(log.Log),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tk := measurement.TestKeys.(*TestKeys)
+	if tk.Classification != ClassificationConsistent {
+		t.Fatalf("unexpected classification: %+v", tk)
+	}
+	if len(tk.Queries) <= 0 {
+		t.Fatal("no queries")
+	}
+}
+
+func TestUnitParseResolvers(t *testing.T) {
+	resolvers, err := parseResolvers(DefaultResolvers + ",dot://1.1.1.1, tcp://8.8.4.4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []resolver{
+		{"https://cloudflare-dns.com/dns-query", "doh", "https://cloudflare-dns.com/dns-query"},
+		{"8.8.8.8:853", "dot", "dot://8.8.8.8:853"},
+		{"9.9.9.9:53", "udp", "udp://9.9.9.9:53"},
+		{"1.1.1.1:853", "dot", "dot://1.1.1.1"},
+		{"8.8.4.4:53", "tcp", "tcp://8.8.4.4"},
+	}
+	if len(resolvers) != len(expected) {
+		t.Fatal("unexpected number of resolvers")
+	}
+	for idx := range expected {
+		if resolvers[idx] != expected[idx] {
+			t.Fatalf("unexpected resolver: %+v", resolvers[idx])
+		}
+	}
+	for _, list := range []string{"", " , ", "\t", "udp://", "ftp://8.8.8.8"} {
+		if _, err := parseResolvers(list); err == nil {
+			t.Fatalf("expected an error with '%s'", list)
+		}
+	}
+}
+
+func TestUnitIsBogon(t *testing.T) {
+	for _, addr := range []string{"10.0.0.1", "127.0.0.1", "192.168.1.1", "::1", "fd00::1"} {
+		if !isBogon(addr) {
+			t.Fatalf("%s should be a bogon", addr)
+		}
+	}
+	for _, addr := range []string{"8.8.8.8", "2001:4860:4860::8888", "antani"} {
+		if isBogon(addr) {
+			t.Fatalf("%s should not be a bogon", addr)
+		}
+	}
+}
+
+func TestUnitClassify(t *testing.T) {
+	lookup := func(addr string) uint {
+		switch addr {
+		case "93.184.216.34", "93.184.216.35":
+			return 15133
+		case "130.192.91.211":
+			return 137
+		}
+		return 0
+	}
+	nxdomain := "dns_nxdomain_error"
+	timeout := "generic_timeout_error"
+	control := ResolverResult{Addresses: []string{"93.184.216.34"}, Resolver: "udp://9.9.9.9:53"}
+	failed := ResolverResult{Failure: &timeout, Resolver: "dot://8.8.8.8:853"}
+	var tests = []struct {
+		name     string
+		system   ResolverResult
+		controls []ResolverResult
+		expect   string
+	}{{
+		name:     "same addresses",
+		system:   ResolverResult{Addresses: []string{"93.184.216.34"}},
+		controls: []ResolverResult{failed, control},
+		expect:   ClassificationConsistent,
+	}, {
+		name:     "same ASN",
+		system:   ResolverResult{Addresses: []string{"93.184.216.35"}},
+		controls: []ResolverResult{control},
+		expect:   ClassificationConsistent,
+	}, {
+		name:     "no working controls",
+		system:   ResolverResult{Addresses: []string{"10.10.34.35"}},
+		controls: []ResolverResult{failed},
+		expect:   ClassificationInconclusive,
+	}, {
+		name:     "NXDOMAIN injection",
+		system:   ResolverResult{Failure: &nxdomain},
+		controls: []ResolverResult{control},
+		expect:   ClassificationNXDOMAINInjection,
+	}, {
+		name:     "system resolver failure",
+		system:   ResolverResult{Failure: &timeout},
+		controls: []ResolverResult{control},
+		expect:   ClassificationSystemFailure,
+	}, {
+		name:     "bogon answer",
+		system:   ResolverResult{Addresses: []string{"10.10.34.35"}},
+		controls: []ResolverResult{control},
+		expect:   ClassificationBogonAnswer,
+	}, {
+		name:     "ASN mismatch",
+		system:   ResolverResult{Addresses: []string{"130.192.91.211"}},
+		controls: []ResolverResult{control},
+		expect:   ClassificationASNMismatch,
+	}, {
+		name:     "unknown system ASN",
+		system:   ResolverResult{Addresses: []string{"1.1.1.1"}},
+		controls: []ResolverResult{control},
+		expect:   ClassificationInconclusive,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tk := &TestKeys{System: tt.system}
+			tk.Controls = append(tk.Controls, tt.controls...)
+			tk.classify(lookup)
+			if tk.Classification != tt.expect {
+				t.Fatalf("expected %s, got %s", tt.expect, tk.Classification)
+			}
+			if tt.expect == ClassificationConsistent ||
+				tt.expect == ClassificationInconclusive {
+				if len(tk.Inconsistent) != 0 {
+					t.Fatal("expected no inconsistent resolvers")
+				}
+				return
+			}
+			if len(tk.Inconsistent) != 1 || tk.Inconsistent[0] != control.Resolver {
+				t.Fatal("unexpected inconsistent resolvers")
+			}
+		})
+	}
+}
+
+func TestUnitClassifyWithoutASNs(t *testing.T) {
+	lookup := func(addr string) uint {
+		return 0 // emulate missing ASN database
+	}
+	tk := &TestKeys{System: ResolverResult{Addresses: []string{"130.192.91.211"}}}
+	tk.Controls = append(tk.Controls, ResolverResult{
+		Addresses: []string{"93.184.216.34"}, Resolver: "udp://9.9.9.9:53",
+	})
+	tk.classify(lookup)
+	if tk.Classification != ClassificationInconclusive {
+		t.Fatalf("unexpected classification: %s", tk.Classification)
+	}
+	if tk.Controls[0].Classification != ClassificationInconclusive {
+		t.Fatalf("unexpected control classification: %s", tk.Controls[0].Classification)
+	}
+	if len(tk.Inconsistent) != 0 {
+		t.Fatal("expected no inconsistent resolvers")
+	}
+}
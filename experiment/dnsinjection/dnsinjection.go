@@ -0,0 +1,201 @@
+// Package dnsinjection contains the DNS injection network experiment.
+//
+// We send DNS queries for the input domain to IP addresses that are
+// known not to run a DNS resolver. Hence, we should not receive any
+// response and the queries should time out. If we instead receive a
+// response, including a NXDOMAIN response, it means that something on
+// the path is injecting DNS responses.
+//
+// See https://github.com/ooni/spec/blob/master/nettests/ts-012-dns-injection.md.
+package dnsinjection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ooni/probe-engine/experiment"
+	"github.com/ooni/probe-engine/experiment/handler"
+	"github.com/ooni/probe-engine/internal/netxlogger"
+	"github.com/ooni/probe-engine/internal/oonidatamodel"
+	"github.com/ooni/probe-engine/internal/oonitemplates"
+	"github.com/ooni/probe-engine/model"
+	"github.com/ooni/probe-engine/session"
+)
+
+const (
+	testName    = "dns_injection"
+	testVersion = "0.1.0"
+
+	// defaultTimeout is the default timeout of each query. Because we
+	// don't expect any response, most queries will last this long.
+	defaultTimeout = 5 * time.Second
+)
+
+// Config contains the experiment config.
+type Config struct {
+	Resolvers string `ooni:"comma separated IP addresses not running a DNS resolver"`
+}
+
+// ResolverResult contains the results of querying a resolver.
+type ResolverResult struct {
+	Addresses []string `json:"addresses"`
+	Failure   *string  `json:"failure"`
+	Injected  bool     `json:"injected"`
+	Resolver  string   `json:"resolver"`
+	Time      float64  `json:"time"` // seconds
+}
+
+// TestKeys contains dns_injection test keys.
+type TestKeys struct {
+	Injection bool                         `json:"injection"`
+	Queries   oonidatamodel.DNSQueriesList `json:"queries"`
+	Resolvers []ResolverResult             `json:"resolvers"`
+}
+
+// injected returns whether we have received a DNS reply, given the
+// error of the lookup and the number of bytes we have received. Because
+// we don't expect any reply, any reply is an injection, including a
+// NXDOMAIN, a refused or a malformed reply. Errors occurring without
+// receiving any byte (e.g. a timeout, connection refused, network
+// unreachable, a cancelled context) are failures but not injections.
+func injected(err error, receivedBytes int64) bool {
+	return err == nil || receivedBytes > 0
+}
+
+// parseResolvers parses the comma separated list of resolvers,
+// adding the default port to those that don't specify a port.
+func parseResolvers(resolvers string) ([]string, error) {
+	var out []string
+	for _, resolver := range strings.Split(resolvers, ",") {
+		resolver = strings.TrimSpace(resolver)
+		if host, _, err := net.SplitHostPort(resolver); err == nil && net.ParseIP(host) != nil {
+			out = append(out, resolver)
+			continue
+		}
+		if net.ParseIP(resolver) == nil {
+			return nil, fmt.Errorf("dns_injection: invalid resolver: '%s'", resolver)
+		}
+		out = append(out, net.JoinHostPort(resolver, "53"))
+	}
+	return out, nil
+}
+
+// maybeURLToDomain handles the case where the input is from the
+// test-lists and hence every input is a URL rather than a domain.
+func maybeURLToDomain(input string) (string, error) {
+	parsed, err := url.Parse(input)
+	if err != nil {
+		return "", err
+	}
+	if parsed.Path == input {
+		return input, nil
+	}
+	return parsed.Hostname(), nil
+}
+
+type measurer struct {
+	config  Config
+	timeout time.Duration
+}
+
+func newMeasurer(config Config) *measurer {
+	return &measurer{config: config, timeout: defaultTimeout}
+}
+
+// query queries resolver for domain and returns the results.
+func (m *measurer) query(
+	ctx context.Context, sess *session.Session, measurement *model.Measurement,
+	domain, resolver string,
+) (ResolverResult, oonitemplates.Results) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout)
+	defer cancel()
+	begin := time.Now()
+	results := oonitemplates.DNSLookup(ctx, oonitemplates.DNSLookupConfig{
+		Beginning:     measurement.MeasurementStartTimeSaved,
+		Handler:       netxlogger.NewHandler(sess.Logger),
+		Hostname:      domain,
+		ServerAddress: resolver,
+		ServerNetwork: "udp",
+	})
+	rr := ResolverResult{
+		Addresses: results.Addresses,
+		Injected:  injected(results.Error, results.TestKeys.ReceivedBytes),
+		Resolver:  resolver,
+		Time:      time.Since(begin).Seconds(),
+	}
+	if results.Error != nil {
+		s := results.Error.Error()
+		rr.Failure = &s
+	}
+	return rr, results.TestKeys
+}
+
+func (m *measurer) measure(
+	ctx context.Context,
+	sess *session.Session,
+	measurement *model.Measurement,
+	callbacks handler.Callbacks,
+) error {
+	if m.config.Resolvers == "" {
+		return errors.New("Experiment requires Resolvers")
+	}
+	if measurement.Input == "" {
+		return errors.New("Experiment requires measurement.Input")
+	}
+	resolvers, err := parseResolvers(m.config.Resolvers)
+	if err != nil {
+		return err
+	}
+	domain, err := maybeURLToDomain(measurement.Input)
+	if err != nil {
+		return err
+	}
+	measurement.Input = domain
+	var (
+		completed     int
+		mu            sync.Mutex
+		receivedBytes int64
+		sentBytes     int64
+		waitgroup     sync.WaitGroup
+	)
+	tk := &TestKeys{Resolvers: make([]ResolverResult, len(resolvers))}
+	measurement.TestKeys = tk
+	waitgroup.Add(len(resolvers))
+	for idx, resolver := range resolvers {
+		go func(idx int, resolver string) {
+			defer waitgroup.Done()
+			rr, results := m.query(ctx, sess, measurement, domain, resolver)
+			mu.Lock()
+			defer mu.Unlock()
+			tk.Resolvers[idx] = rr
+			tk.Queries = append(tk.Queries, oonidatamodel.NewDNSQueriesList(results)...)
+			tk.Injection = tk.Injection || rr.Injected
+			receivedBytes += results.ReceivedBytes
+			sentBytes += results.SentBytes
+			completed++
+			callbacks.OnProgress(float64(completed)/float64(len(resolvers)), fmt.Sprintf(
+				"dns_injection: %s: injected: %+v", resolver, rr.Injected,
+			))
+		}(idx, resolver)
+	}
+	waitgroup.Wait()
+	callbacks.OnDataUsage(
+		float64(receivedBytes)/1024.0, // downloaded
+		float64(sentBytes)/1024.0,     // uploaded
+	)
+	return nil
+}
+
+// NewExperiment creates a new experiment.
+func NewExperiment(
+	sess *session.Session, config Config,
+) *experiment.Experiment {
+	return experiment.New(sess, testName, testVersion,
+		newMeasurer(config).measure)
+}
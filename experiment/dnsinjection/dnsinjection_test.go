@@ -0,0 +1,301 @@
+package dnsinjection
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/miekg/dns"
+	"github.com/ooni/probe-engine/experiment/handler"
+	"github.com/ooni/probe-engine/internal/kvstore"
+	"github.com/ooni/probe-engine/model"
+	"github.com/ooni/probe-engine/session"
+)
+
+const (
+	softwareName    = "ooniprobe-example"
+	softwareVersion = "0.0.1"
+)
+
+func newsession() *session.Session {
+	return session.New(
+		log.Log, softwareName, softwareVersion,
+		"../../testdata", nil, nil, "../../testdata",
+		kvstore.NewMemoryKeyValueStore(),
+	)
+}
+
+// startInjector starts a local UDP server emulating an on path injector
+// that replies to every query using rcode and, on success, 10.10.34.34.
+func startInjector(t *testing.T, rcode int) (*dns.Server, string) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{
+		PacketConn: conn,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, query *dns.Msg) {
+			reply := new(dns.Msg)
+			reply.SetRcode(query, rcode)
+			if rcode == dns.RcodeSuccess && query.Question[0].Qtype == dns.TypeA {
+				reply.Answer = append(reply.Answer, &dns.A{
+					Hdr: dns.RR_Header{
+						Name:   query.Question[0].Name,
+						Rrtype: dns.TypeA,
+						Class:  dns.ClassINET,
+						Ttl:    60,
+					},
+					A: net.IPv4(10, 10, 34, 34),
+				})
+			}
+			w.WriteMsg(reply)
+		}),
+	}
+	go server.ActivateAndServe()
+	return server, conn.LocalAddr().String()
+}
+
+// startSilent starts a local UDP server that never replies, which
+// is what we expect from an address not running a DNS resolver.
+func startSilent(t *testing.T) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// startGarbage starts a local UDP server that replies to every
+// query with bytes that are not a valid DNS message.
+func startGarbage(t *testing.T) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buffer := make([]byte, 1024)
+		for {
+			_, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			conn.WriteTo([]byte("antani"), addr)
+		}
+	}()
+	return conn
+}
+
+type dataUsageCallbacks struct {
+	handler.Callbacks
+	downloaded, uploaded float64
+}
+
+func (c *dataUsageCallbacks) OnDataUsage(dloadKiB, uploadKiB float64) {
+	c.downloaded += dloadKiB
+	c.uploaded += uploadKiB
+}
+
+func measure(t *testing.T, resolvers, input string) (*TestKeys, *dataUsageCallbacks) {
+	measurer := newMeasurer(Config{Resolvers: resolvers})
+	measurer.timeout = 500 * time.Millisecond
+	measurement := &model.Measurement{Input: input}
+	callbacks := &dataUsageCallbacks{
+		Callbacks: handler.NewPrinterCallbacks(log.Log),
+	}
+	err := measurer.measure(
+		context.Background(), newsession(), measurement, callbacks,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return measurement.TestKeys.(*TestKeys), callbacks
+}
+
+func TestUnitNewExperiment(t *testing.T) {
+	experiment := NewExperiment(newsession(), Config{})
+	if experiment == nil {
+		t.Fatal("nil experiment returned")
+	}
+}
+
+func TestUnitMeasureWithInvalidConfigOrInput(t *testing.T) {
+	var tests = []struct {
+		config Config
+		input  string
+	}{
+		{Config{}, "www.example.com"},
+		{Config{Resolvers: "8.8.8.1"}, ""},
+		{Config{Resolvers: "8.8.8.1"}, "\t"},
+		{Config{Resolvers: "dns.example.com"}, "www.example.com"},
+		{Config{Resolvers: "8.8.8.1,"}, "www.example.com"},
+	}
+	for _, tt := range tests {
+		err := newMeasurer(tt.config).measure(
+			context.Background(),
+			newsession(),
+			&model.Measurement{Input: tt.input},
+			handler.NewPrinterCallbacks(log.Log),
+		)
+		if err == nil {
+			t.Fatalf("expected an error with %+v", tt)
+		}
+	}
+}
+
+func TestUnitParseResolvers(t *testing.T) {
+	resolvers, err := parseResolvers("8.8.8.1, 127.0.0.1:5353,::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"8.8.8.1:53", "127.0.0.1:5353", "[::1]:53"}
+	if len(resolvers) != len(expected) {
+		t.Fatalf("unexpected resolvers: %+v", resolvers)
+	}
+	for idx := range expected {
+		if resolvers[idx] != expected[idx] {
+			t.Fatalf("unexpected resolvers: %+v", resolvers)
+		}
+	}
+}
+
+func TestUnitMeasureWithInjection(t *testing.T) {
+	server, address := startInjector(t, dns.RcodeSuccess)
+	defer server.Shutdown()
+	silent := startSilent(t)
+	defer silent.Close()
+	tk, callbacks := measure(t, address+","+silent.LocalAddr().String(), "http://www.example.com/")
+	if !tk.Injection || len(tk.Resolvers) != 2 {
+		t.Fatalf("unexpected results: %+v", tk)
+	}
+	injected := tk.Resolvers[0]
+	if !injected.Injected || injected.Failure != nil || injected.Resolver != address {
+		t.Fatalf("unexpected result: %+v", injected)
+	}
+	if len(injected.Addresses) != 1 || injected.Addresses[0] != "10.10.34.34" {
+		t.Fatalf("unexpected addresses: %+v", injected.Addresses)
+	}
+	if injected.Time <= 0 {
+		t.Fatal("unexpected time")
+	}
+	if tk.Resolvers[1].Injected || tk.Resolvers[1].Failure == nil {
+		t.Fatalf("unexpected result: %+v", tk.Resolvers[1])
+	}
+	if callbacks.downloaded <= 0 || callbacks.uploaded <= 0 {
+		t.Fatal("expected to count the bytes we have exchanged")
+	}
+}
+
+func TestUnitMeasureWithNXDOMAINInjection(t *testing.T) {
+	server, address := startInjector(t, dns.RcodeNameError)
+	defer server.Shutdown()
+	tk, _ := measure(t, address, "www.example.com")
+	if !tk.Injection || !tk.Resolvers[0].Injected {
+		t.Fatalf("unexpected results: %+v", tk)
+	}
+	failure := tk.Resolvers[0].Failure
+	if failure == nil || *failure != "dns_nxdomain_error" {
+		t.Fatal("not the failure we expected")
+	}
+}
+
+func TestUnitMeasureWithoutInjection(t *testing.T) {
+	silent := startSilent(t)
+	defer silent.Close()
+	tk, _ := measure(t, silent.LocalAddr().String(), "www.example.com")
+	if tk.Injection || tk.Resolvers[0].Injected || tk.Resolvers[0].Failure == nil {
+		t.Fatalf("unexpected results: %+v", tk)
+	}
+}
+
+func TestUnitMeasureWithServerFailureInjection(t *testing.T) {
+	server, address := startInjector(t, dns.RcodeServerFailure)
+	defer server.Shutdown()
+	tk, _ := measure(t, address, "www.example.com")
+	if !tk.Injection || !tk.Resolvers[0].Injected || tk.Resolvers[0].Failure == nil {
+		t.Fatalf("unexpected results: %+v", tk)
+	}
+}
+
+func TestUnitMeasureWithMalformedInjection(t *testing.T) {
+	garbage := startGarbage(t)
+	defer garbage.Close()
+	tk, _ := measure(t, garbage.LocalAddr().String(), "www.example.com")
+	if !tk.Injection || !tk.Resolvers[0].Injected || tk.Resolvers[0].Failure == nil {
+		t.Fatalf("unexpected results: %+v", tk)
+	}
+}
+
+func TestUnitMeasureWithConnectionRefused(t *testing.T) {
+	// We bind and close a UDP socket so that we know nobody is listening
+	// there and the kernel answers our query with ICMP port unreachable.
+	closed := startSilent(t)
+	address := closed.LocalAddr().String()
+	closed.Close()
+	tk, _ := measure(t, address, "www.example.com")
+	failure := tk.Resolvers[0].Failure
+	if failure == nil || *failure != "connection_refused" {
+		t.Fatalf("unexpected results: %+v", tk)
+	}
+	if tk.Injection || tk.Resolvers[0].Injected {
+		t.Fatalf("unexpected results: %+v", tk)
+	}
+}
+
+func TestUnitMeasureWithCancelledContext(t *testing.T) {
+	server, address := startInjector(t, dns.RcodeSuccess)
+	defer server.Shutdown()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel() // so we fail immediately
+	measurement := &model.Measurement{Input: "www.example.com"}
+	err := newMeasurer(Config{Resolvers: address}).measure(
+		ctx, newsession(), measurement, handler.NewPrinterCallbacks(log.Log),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tk := measurement.TestKeys.(*TestKeys)
+	if tk.Injection || tk.Resolvers[0].Injected || tk.Resolvers[0].Failure == nil {
+		t.Fatalf("unexpected results: %+v", tk)
+	}
+}
+
+func TestUnitInjected(t *testing.T) {
+	var tests = []struct {
+		err           error
+		receivedBytes int64
+		injected      bool
+	}{
+		{nil, 64, true},
+		{errors.New("dns_nxdomain_error"), 64, true},
+		{errors.New("unknown_failure: dns: overflow unpacking uint16"), 6, true},
+		{errors.New("generic_timeout_error"), 0, false},
+		{errors.New("connection_refused"), 0, false},
+		{errors.New("unknown_failure: connect: network is unreachable"), 0, false},
+		{context.Canceled, 0, false},
+	}
+	for _, tt := range tests {
+		if injected(tt.err, tt.receivedBytes) != tt.injected {
+			t.Fatalf("unexpected result for %+v", tt.err)
+		}
+	}
+}
+
+func TestIntegrationMeasure(t *testing.T) {
+	measurement := &model.Measurement{Input: "www.example.com"}
+	err := newMeasurer(Config{Resolvers: "8.8.8.1"}).measure(
+		context.Background(),
+		newsession(),
+		measurement,
+		handler.NewPrinterCallbacks(log.Log),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tk := measurement.TestKeys.(*TestKeys)
+	if tk.Injection {
+		t.Fatalf("unexpected results: %+v", tk)
+	}
+}
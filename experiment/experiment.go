@@ -3,11 +3,14 @@ package experiment
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"os"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/ooni/probe-engine/collector"
 	"github.com/ooni/probe-engine/experiment/handler"
 	"github.com/ooni/probe-engine/model"
@@ -113,11 +116,31 @@ func (e *Experiment) ReportID() string {
 	return e.Report.ID
 }
 
+// NewMeasurementID returns a new, random, locally generated measurement
+// ID. We use this ID to correlate the same measurement across saves to
+// disk, resubmissions and deduplication by the collector.
+func NewMeasurementID() string {
+	return uuid.New().String()
+}
+
+// ComputeInputHashes computes the input hashes for the specified input
+// according to df-000-base. That is, the list contains the hex encoded
+// SHA256 hash of the input. When the input is empty, the list is empty.
+func ComputeInputHashes(input string) []string {
+	if input == "" {
+		return nil
+	}
+	sum := sha256.Sum256([]byte(input))
+	return []string{hex.EncodeToString(sum[:])}
+}
+
 func (e *Experiment) newMeasurement(input string) model.Measurement {
 	utctimenow := time.Now().UTC()
 	return model.Measurement{
 		DataFormatVersion:         collector.DefaultDataFormatVersion,
+		ID:                        NewMeasurementID(),
 		Input:                     input,
+		InputHashes:               ComputeInputHashes(input),
 		MeasurementStartTime:      utctimenow.Format(dateFormat),
 		MeasurementStartTimeSaved: utctimenow,
 		ProbeIP:                   e.Session.ProbeIP(),
@@ -150,6 +173,9 @@ func (e *Experiment) Measure(
 	err = e.DoMeasure(ctx, e.Session, &measurement, e.Callbacks)
 	stop := time.Now()
 	measurement.MeasurementRuntime = stop.Sub(start).Seconds()
+	// Some experiments normalize the input they have been given, so we
+	// recompute the hashes to make sure they match the submitted input.
+	measurement.InputHashes = ComputeInputHashes(measurement.Input)
 	scrubErr := e.Session.PrivacySettings.Apply(
 		&measurement, e.Session.ProbeIP(),
 	)
@@ -123,6 +123,31 @@ func TestMeasureLookupLocationFailure(t *testing.T) {
 	}
 }
 
+func TestIntegrationInputHashes(t *testing.T) {
+	ctx := context.Background()
+	exp, err := newExperiment(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp.DoMeasure = func(
+		ctx context.Context,
+		sess *session.Session,
+		measurement *model.Measurement,
+		callbacks handler.Callbacks,
+	) error {
+		measurement.Input = "www.example.com" // emulate normalization
+		return nil
+	}
+	m, err := exp.Measure(ctx, "https://www.example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes := experiment.ComputeInputHashes(m.Input)
+	if len(m.InputHashes) != 1 || m.InputHashes[0] != hashes[0] {
+		t.Fatal("the input hashes do not match the input")
+	}
+}
+
 func TestSaveMeasurementErrors(t *testing.T) {
 	ctx := context.Background()
 	exp, err := newExperiment(ctx)
@@ -189,3 +214,27 @@ func newExperiment(ctx context.Context) (*experiment.Experiment, error) {
 			return nil
 		}), nil
 }
+
+func TestUnitNewMeasurementID(t *testing.T) {
+	first, second := experiment.NewMeasurementID(), experiment.NewMeasurementID()
+	if len(first) != 36 {
+		t.Fatal("unexpected measurement ID length")
+	}
+	if first == second {
+		t.Fatal("measurement IDs are not unique")
+	}
+}
+
+func TestUnitComputeInputHashes(t *testing.T) {
+	if hashes := experiment.ComputeInputHashes(""); hashes != nil {
+		t.Fatal("expected no input hashes with empty input")
+	}
+	hashes := experiment.ComputeInputHashes("https://www.example.com/")
+	if len(hashes) != 1 {
+		t.Fatal("expected a single input hash")
+	}
+	const expected = "49365e2b6b265ccba4bed01f5fa3cbcf6a028e5354d2b647f5eb37be735991c5"
+	if hashes[0] != expected {
+		t.Fatal("not the input hash we expected")
+	}
+}
@@ -1,55 +1,280 @@
 // Package fbmessenger contains the Facebook Messenger network experiment.
+// This file in particular is a pure-Go implementation of that.
+//
+// See https://github.com/ooni/spec/blob/master/nettests/ts-019-facebook-messenger.md.
 package fbmessenger
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/ooni/probe-engine/experiment"
 	"github.com/ooni/probe-engine/experiment/handler"
-	"github.com/ooni/probe-engine/experiment/mkrunner"
-	"github.com/ooni/probe-engine/measurementkit"
+	"github.com/ooni/probe-engine/geoiplookup/mmdblookup"
+	"github.com/ooni/probe-engine/internal/netxlogger"
+	"github.com/ooni/probe-engine/internal/oonidatamodel"
+	"github.com/ooni/probe-engine/internal/oonitemplates"
 	"github.com/ooni/probe-engine/model"
 	"github.com/ooni/probe-engine/session"
 )
 
 const (
 	testName    = "facebook_messenger"
-	testVersion = "0.0.2"
+	testVersion = "0.1.0"
+
+	// FacebookASN is Facebook's AS number.
+	FacebookASN = 32934
 )
 
 // Config contains the experiment config.
-type Config struct {
-	// LogLevel is the MK log level. Empty implies "WARNING".
-	LogLevel string
+type Config struct{}
+
+// TestKeys contains fbmessenger test keys.
+type TestKeys struct {
+	FacebookBAPIDNSConsistent        *bool                        `json:"facebook_b_api_dns_consistent"`
+	FacebookBAPIReachable            *bool                        `json:"facebook_b_api_reachable"`
+	FacebookBGraphDNSConsistent      *bool                        `json:"facebook_b_graph_dns_consistent"`
+	FacebookBGraphReachable          *bool                        `json:"facebook_b_graph_reachable"`
+	FacebookEdgeDNSConsistent        *bool                        `json:"facebook_edge_dns_consistent"`
+	FacebookEdgeReachable            *bool                        `json:"facebook_edge_reachable"`
+	FacebookExternalCDNDNSConsistent *bool                        `json:"facebook_external_cdn_dns_consistent"`
+	FacebookExternalCDNReachable     *bool                        `json:"facebook_external_cdn_reachable"`
+	FacebookScontentCDNDNSConsistent *bool                        `json:"facebook_scontent_cdn_dns_consistent"`
+	FacebookScontentCDNReachable     *bool                        `json:"facebook_scontent_cdn_reachable"`
+	FacebookStarDNSConsistent        *bool                        `json:"facebook_star_dns_consistent"`
+	FacebookStarReachable            *bool                        `json:"facebook_star_reachable"`
+	FacebookSTUNDNSConsistent        *bool                        `json:"facebook_stun_dns_consistent"`
+	FacebookSTUNReachable            *bool                        `json:"facebook_stun_reachable"`
+	FacebookDNSBlocking              bool                         `json:"facebook_dns_blocking"`
+	FacebookTCPBlocking              bool                         `json:"facebook_tcp_blocking"`
+	Queries                          oonidatamodel.DNSQueriesList `json:"queries"`
+	TCPConnect                       oonidatamodel.TCPConnectList `json:"tcp_connect"`
+}
+
+// services maps each service name to its hostname.
+var services = map[string]string{
+	"b_api":        "b-api.facebook.com",
+	"b_graph":      "b-graph.facebook.com",
+	"edge":         "edge-mqtt.facebook.com",
+	"external_cdn": "external.xx.fbcdn.net",
+	"scontent_cdn": "scontent.xx.fbcdn.net",
+	"star":         "star.c10r.facebook.com",
+	"stun":         "stun.fbsbx.com",
+}
+
+// serviceMeasurements contains the measurements of a service. When
+// we cannot determine whether the DNS is consistent, for example
+// because the ASN database is missing, consistent is nil.
+type serviceMeasurements struct {
+	connects   []*oonitemplates.TCPConnectResults
+	consistent *bool
+	dns        *oonitemplates.DNSLookupResults
+}
+
+// fields returns the DNS consistency and reachability fields of service.
+func (tk *TestKeys) fields(service string) (consistent, reachable **bool) {
+	switch service {
+	case "b_api":
+		return &tk.FacebookBAPIDNSConsistent, &tk.FacebookBAPIReachable
+	case "b_graph":
+		return &tk.FacebookBGraphDNSConsistent, &tk.FacebookBGraphReachable
+	case "edge":
+		return &tk.FacebookEdgeDNSConsistent, &tk.FacebookEdgeReachable
+	case "external_cdn":
+		return &tk.FacebookExternalCDNDNSConsistent, &tk.FacebookExternalCDNReachable
+	case "scontent_cdn":
+		return &tk.FacebookScontentCDNDNSConsistent, &tk.FacebookScontentCDNReachable
+	case "star":
+		return &tk.FacebookStarDNSConsistent, &tk.FacebookStarReachable
+	case "stun":
+		return &tk.FacebookSTUNDNSConsistent, &tk.FacebookSTUNReachable
+	}
+	return nil, nil
+}
+
+// processone processes the results of service. When the DNS is not
+// consistent we do not attempt to connect and hence we leave the
+// reachable key null, as MK does. We do the same when we do not know
+// whether the DNS is consistent, in which case we also leave the
+// consistent key null and we do not flag DNS blocking.
+func (tk *TestKeys) processone(service string, v *serviceMeasurements) error {
+	if v == nil || v.dns == nil {
+		return errors.New("passed nil results")
+	}
+	consistentField, reachableField := tk.fields(service)
+	if consistentField == nil {
+		return fmt.Errorf("unknown service: %s", service)
+	}
+	tk.Queries = append(
+		tk.Queries, oonidatamodel.NewDNSQueriesList(v.dns.TestKeys)...,
+	)
+	if v.consistent == nil {
+		return nil
+	}
+	consistent := *v.consistent
+	*consistentField = &consistent
+	if !consistent {
+		tk.FacebookDNSBlocking = true
+		return nil
+	}
+	reachable := false
+	for _, connect := range v.connects {
+		tk.TCPConnect = append(
+			tk.TCPConnect, oonidatamodel.NewTCPConnectList(connect.TestKeys)...,
+		)
+		if connect.Error == nil {
+			reachable = true
+		}
+	}
+	*reachableField = &reachable
+	if !reachable {
+		tk.FacebookTCPBlocking = true
+	}
+	return nil
 }
 
-func measure(
-	ctx context.Context, sess *session.Session, measurement *model.Measurement,
-	callbacks handler.Callbacks, config Config,
+// processall processes the results of all services. We process them
+// in alphabetical order, so that the queries and the tcp_connect
+// entries always appear in the same order.
+func (tk *TestKeys) processall(m map[string]*serviceMeasurements) error {
+	var names []string
+	for service := range m {
+		names = append(names, service)
+	}
+	sort.Strings(names)
+	for _, service := range names {
+		if err := tk.processone(service, m[service]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dnsConsistent returns true when we have resolved at least one address
+// and all the addresses belong to Facebook's AS. It returns an error when
+// we cannot map an address to its AS, in which case we don't know.
+func dnsConsistent(
+	addrs []string, lookupASN func(addr string) (uint, error),
+) (bool, error) {
+	for _, addr := range addrs {
+		asn, err := lookupASN(addr)
+		if err != nil {
+			return false, err
+		}
+		if asn != FacebookASN {
+			return false, nil
+		}
+	}
+	return len(addrs) > 0, nil
+}
+
+type measurer struct {
+	config Config
+}
+
+func newMeasurer(config Config) *measurer {
+	return &measurer{config: config}
+}
+
+func (m *measurer) measure(
+	ctx context.Context,
+	sess *session.Session,
+	measurement *model.Measurement,
+	callbacks handler.Callbacks,
 ) error {
-	settings := measurementkit.NewSettings(
-		"FacebookMessenger", sess.SoftwareName, sess.SoftwareVersion,
-		sess.CABundlePath(), sess.ProbeASNString(), sess.ProbeCC(),
-		sess.ProbeIP(), sess.ProbeNetworkName(), config.LogLevel,
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	lookupASN := func(addr string) (uint, error) {
+		asn, _, err := mmdblookup.LookupASN(
+			sess.ASNDatabasePath(), addr, sess.Logger,
+		)
+		return asn, err
+	}
+	// setup data container
+	servicemeasurements := make(map[string]*serviceMeasurements)
+	for service := range services {
+		servicemeasurements[service] = &serviceMeasurements{}
+	}
+	// run all measurements in parallel
+	var (
+		completed     int64
+		receivedBytes int64
+		sentBytes     int64
+		waitgroup     sync.WaitGroup
 	)
-	settings.Options.GeoIPASNPath = sess.ASNDatabasePath()
-	return mkrunner.Do(
-		settings, sess, measurement, callbacks, measurementkit.StartEx,
+	waitgroup.Add(len(servicemeasurements))
+	for service, entry := range servicemeasurements {
+		go func(service string, entry *serviceMeasurements) {
+			defer waitgroup.Done()
+			hostname := services[service]
+			entry.dns = oonitemplates.DNSLookup(ctx, oonitemplates.DNSLookupConfig{
+				Beginning: measurement.MeasurementStartTimeSaved,
+				Handler:   netxlogger.NewHandler(sess.Logger),
+				Hostname:  hostname,
+			})
+			atomic.AddInt64(&sentBytes, entry.dns.TestKeys.SentBytes)
+			atomic.AddInt64(&receivedBytes, entry.dns.TestKeys.ReceivedBytes)
+			consistent := false
+			entry.consistent = &consistent
+			if entry.dns.Error == nil {
+				var err error
+				consistent, err = dnsConsistent(entry.dns.Addresses, lookupASN)
+				if err != nil {
+					sess.Logger.Warnf("fbmessenger: %s: cannot lookup ASN: %s", hostname, err)
+					entry.consistent = nil
+				}
+			}
+			if consistent {
+				for _, addr := range entry.dns.Addresses {
+					connect := oonitemplates.TCPConnect(ctx, oonitemplates.TCPConnectConfig{
+						Address:   net.JoinHostPort(addr, "443"),
+						Beginning: measurement.MeasurementStartTimeSaved,
+						Handler:   netxlogger.NewHandler(sess.Logger),
+					})
+					atomic.AddInt64(&sentBytes, connect.TestKeys.SentBytes)
+					atomic.AddInt64(&receivedBytes, connect.TestKeys.ReceivedBytes)
+					entry.connects = append(entry.connects, connect)
+					if connect.Error == nil {
+						break // one working address is enough
+					}
+				}
+			}
+			sofar := atomic.AddInt64(&completed, 1)
+			percentage := float64(sofar) / float64(len(servicemeasurements))
+			callbacks.OnProgress(percentage, fmt.Sprintf(
+				"fbmessenger: %s: dns consistent: %s", hostname, consistencyString(entry.consistent),
+			))
+		}(service, entry)
+	}
+	waitgroup.Wait()
+	// fill the measurement entry
+	testkeys := new(TestKeys)
+	measurement.TestKeys = testkeys
+	err := testkeys.processall(servicemeasurements)
+	callbacks.OnDataUsage(
+		float64(receivedBytes)/1024.0, // downloaded
+		float64(sentBytes)/1024.0,     // uploaded
 	)
+	return err
 }
 
 // NewExperiment creates a new experiment.
 func NewExperiment(
 	sess *session.Session, config Config,
 ) *experiment.Experiment {
-	return experiment.New(
-		sess, testName, testVersion,
-		func(
-			ctx context.Context,
-			sess *session.Session,
-			measurement *model.Measurement,
-			callbacks handler.Callbacks,
-		) error {
-			return measure(ctx, sess, measurement, callbacks, config)
-		})
+	return experiment.New(sess, testName, testVersion,
+		newMeasurer(config).measure)
+}
+
+func consistencyString(consistent *bool) string {
+	if consistent == nil {
+		return "unknown"
+	}
+	return fmt.Sprintf("%+v", *consistent)
 }
@@ -1,13 +1,16 @@
-package fbmessenger_test
+package fbmessenger
 
 import (
 	"context"
+	"errors"
 	"testing"
 
 	"github.com/apex/log"
-	"github.com/ooni/probe-engine/experiment/fbmessenger"
+	"github.com/ooni/netx/modelx"
+	"github.com/ooni/probe-engine/experiment/handler"
 	"github.com/ooni/probe-engine/internal/kvstore"
-	"github.com/ooni/probe-engine/measurementkit"
+	"github.com/ooni/probe-engine/internal/oonitemplates"
+	"github.com/ooni/probe-engine/model"
 	"github.com/ooni/probe-engine/session"
 )
 
@@ -16,35 +19,262 @@ const (
 	softwareVersion = "0.0.1"
 )
 
-func TestIntegration(t *testing.T) {
-	if !measurementkit.Available() {
-		t.Skip("Measurement Kit not available; skipping")
+func newsession() *session.Session {
+	return session.New(
+		log.Log, softwareName, softwareVersion,
+		"../../testdata", nil, nil, "../../testdata",
+		kvstore.NewMemoryKeyValueStore(),
+	)
+}
+
+func TestUnitNewExperiment(t *testing.T) {
+	experiment := NewExperiment(newsession(), Config{})
+	if experiment == nil {
+		t.Fatal("nil experiment returned")
 	}
-	log.SetLevel(log.DebugLevel)
-	ctx := context.Background()
+}
 
-	sess := session.New(
-		log.Log, softwareName, softwareVersion, "../../testdata", nil, nil,
-		"../../testdata", kvstore.NewMemoryKeyValueStore(),
+func TestUnitMeasureWithCancelledContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	measurement := new(model.Measurement)
+	err := newMeasurer(Config{}).measure(
+		ctx,
+		newsession(),
+		measurement,
+		handler.NewPrinterCallbacks(log.Log),
 	)
-	if err := sess.MaybeLookupBackends(ctx); err != nil {
+	if err != nil {
 		t.Fatal(err)
 	}
+	tk := measurement.TestKeys.(*TestKeys)
+	if !tk.FacebookDNSBlocking || tk.FacebookTCPBlocking {
+		t.Fatal("expected to see only DNS blocking")
+	}
+}
+
+func TestIntegrationMeasure(t *testing.T) {
+	ctx := context.Background()
+	sess := newsession()
 	if err := sess.MaybeLookupLocation(ctx); err != nil {
 		t.Fatal(err)
 	}
+	measurement := new(model.Measurement)
+	err := newMeasurer(Config{}).measure(
+		ctx, sess, measurement, handler.NewPrinterCallbacks(log.Log),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tk := measurement.TestKeys.(*TestKeys)
+	if tk.FacebookDNSBlocking || tk.FacebookTCPBlocking {
+		t.Fatalf("unexpected blocking: %+v", tk)
+	}
+}
+
+func TestUnitDNSConsistent(t *testing.T) {
+	lookup := func(addr string) (uint, error) {
+		switch addr {
+		case "157.240.1.35":
+			return FacebookASN, nil
+		case "127.0.0.1":
+			return 0, errors.New("mocked error")
+		}
+		return 30722, nil
+	}
+	if consistent, err := dnsConsistent([]string{"157.240.1.35"}, lookup); err != nil || !consistent {
+		t.Fatal("expected consistent DNS")
+	}
+	if consistent, err := dnsConsistent([]string{"157.240.1.35", "10.0.0.1"}, lookup); err != nil || consistent {
+		t.Fatal("expected inconsistent DNS")
+	}
+	if consistent, err := dnsConsistent(nil, lookup); err != nil || consistent {
+		t.Fatal("expected inconsistent DNS with no addresses")
+	}
+	if _, err := dnsConsistent([]string{"157.240.1.35", "127.0.0.1"}, lookup); err == nil {
+		t.Fatal("expected an error here")
+	}
+}
 
-	experiment := fbmessenger.NewExperiment(sess, fbmessenger.Config{})
-	if err := experiment.OpenReport(ctx); err != nil {
+func TestIntegrationMeasureWithoutASNDatabase(t *testing.T) {
+	sess := session.New(
+		log.Log, softwareName, softwareVersion,
+		"../../testdata/nonexistent", nil, nil, "../../testdata",
+		kvstore.NewMemoryKeyValueStore(),
+	)
+	measurement := new(model.Measurement)
+	err := newMeasurer(Config{}).measure(
+		context.Background(), sess, measurement,
+		handler.NewPrinterCallbacks(log.Log),
+	)
+	if err != nil {
 		t.Fatal(err)
 	}
-	defer experiment.CloseReport(ctx)
+	tk := measurement.TestKeys.(*TestKeys)
+	if tk.FacebookDNSBlocking || tk.FacebookTCPBlocking {
+		t.Fatalf("unexpected blocking: %+v", tk)
+	}
+	for service := range services {
+		consistent, reachable := tk.fields(service)
+		if *reachable != nil {
+			t.Fatalf("unexpected results for %s", service)
+		}
+		if *consistent != nil && **consistent {
+			t.Fatalf("unexpected results for %s", service)
+		}
+	}
+}
 
-	measurement, err := experiment.Measure(ctx, "")
+func TestUnitProcessoneNil(t *testing.T) {
+	tk := new(TestKeys)
+	err := tk.processone("stun", nil)
+	if err == nil || err.Error() != "passed nil results" {
+		t.Fatal("not the error we expected")
+	}
+}
+
+func TestUnitProcessoneUnknownService(t *testing.T) {
+	tk := new(TestKeys)
+	err := tk.processone("antani", &serviceMeasurements{
+		dns: &oonitemplates.DNSLookupResults{},
+	})
+	if err == nil || err.Error() != "unknown service: antani" {
+		t.Fatal("not the error we expected")
+	}
+}
+
+func TestUnitProcessallWithMixedResults(t *testing.T) {
+	tk := new(TestKeys)
+	err := tk.processall(map[string]*serviceMeasurements{
+		"b_api": &serviceMeasurements{
+			dns:        &oonitemplates.DNSLookupResults{},
+			consistent: newbool(false),
+		},
+		"edge": &serviceMeasurements{
+			dns:        &oonitemplates.DNSLookupResults{},
+			consistent: newbool(true),
+			connects: []*oonitemplates.TCPConnectResults{
+				&oonitemplates.TCPConnectResults{
+					Error: errors.New("mocked error"),
+				},
+			},
+		},
+		"stun": &serviceMeasurements{
+			dns:        &oonitemplates.DNSLookupResults{},
+			consistent: newbool(true),
+			connects: []*oonitemplates.TCPConnectResults{
+				&oonitemplates.TCPConnectResults{
+					Error: errors.New("mocked error"),
+				},
+				&oonitemplates.TCPConnectResults{
+					Error: nil, // one address is enough
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tk.FacebookDNSBlocking || !tk.FacebookTCPBlocking {
+		t.Fatal("expected to see DNS and TCP blocking")
+	}
+	if *tk.FacebookBAPIDNSConsistent || tk.FacebookBAPIReachable != nil {
+		t.Fatal("unexpected b_api results")
+	}
+	if !*tk.FacebookEdgeDNSConsistent || *tk.FacebookEdgeReachable {
+		t.Fatal("unexpected edge results")
+	}
+	if !*tk.FacebookSTUNDNSConsistent || !*tk.FacebookSTUNReachable {
+		t.Fatal("unexpected stun results")
+	}
+	if tk.FacebookStarDNSConsistent != nil || tk.FacebookStarReachable != nil {
+		t.Fatal("unexpected star results")
+	}
+}
+
+func TestUnitProcessallWithUnknownConsistency(t *testing.T) {
+	tk := new(TestKeys)
+	err := tk.processall(map[string]*serviceMeasurements{
+		"b_api": &serviceMeasurements{
+			dns: &oonitemplates.DNSLookupResults{},
+		},
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
-	if err := experiment.SubmitMeasurement(ctx, &measurement); err != nil {
+	if tk.FacebookDNSBlocking || tk.FacebookTCPBlocking {
+		t.Fatal("unexpected blocking")
+	}
+	if tk.FacebookBAPIDNSConsistent != nil || tk.FacebookBAPIReachable != nil {
+		t.Fatal("unexpected b_api results")
+	}
+}
+
+func TestUnitProcessallIsStable(t *testing.T) {
+	m := make(map[string]*serviceMeasurements)
+	for service, hostname := range services {
+		m[service] = &serviceMeasurements{
+			dns: &oonitemplates.DNSLookupResults{
+				TestKeys: oonitemplates.Results{
+					Resolves: []*modelx.ResolveDoneEvent{
+						&modelx.ResolveDoneEvent{Hostname: hostname},
+					},
+				},
+			},
+			consistent: newbool(false),
+		}
+	}
+	expected := []string{
+		"b-api.facebook.com",
+		"b-graph.facebook.com",
+		"edge-mqtt.facebook.com",
+		"external.xx.fbcdn.net",
+		"scontent.xx.fbcdn.net",
+		"star.c10r.facebook.com",
+		"stun.fbsbx.com",
+	}
+	for i := 0; i < 8; i++ {
+		tk := new(TestKeys)
+		if err := tk.processall(m); err != nil {
+			t.Fatal(err)
+		}
+		if len(tk.Queries) != 2*len(expected) {
+			t.Fatal("unexpected number of queries")
+		}
+		for idx, hostname := range expected {
+			if tk.Queries[2*idx].Hostname != hostname {
+				t.Fatalf("queries are not sorted: %+v", tk.Queries)
+			}
+		}
+	}
+}
+
+func TestUnitProcessallWithAllGood(t *testing.T) {
+	tk := new(TestKeys)
+	m := make(map[string]*serviceMeasurements)
+	for service := range services {
+		m[service] = &serviceMeasurements{
+			dns:        &oonitemplates.DNSLookupResults{},
+			consistent: newbool(true),
+			connects: []*oonitemplates.TCPConnectResults{
+				&oonitemplates.TCPConnectResults{},
+			},
+		}
+	}
+	if err := tk.processall(m); err != nil {
 		t.Fatal(err)
 	}
+	if tk.FacebookDNSBlocking || tk.FacebookTCPBlocking {
+		t.Fatal("unexpected blocking")
+	}
+	for service := range services {
+		consistent, reachable := tk.fields(service)
+		if *consistent == nil || !**consistent || *reachable == nil || !**reachable {
+			t.Fatalf("unexpected results for %s", service)
+		}
+	}
+}
+
+func newbool(v bool) *bool {
+	return &v
 }
@@ -1,59 +1,238 @@
-// Package hhfm contains the HTTP Header Field Manipulation network experiment.
+// Package hhfm contains the HTTP Header Field Manipulation network
+// experiment. This file in particular is a pure-Go implementation of it.
+//
+// See https://github.com/ooni/spec/blob/master/nettests/ts-006-header-field-manipulation.md.
 package hhfm
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
 
 	"github.com/ooni/probe-engine/experiment"
 	"github.com/ooni/probe-engine/experiment/handler"
-	"github.com/ooni/probe-engine/experiment/mkhelper"
-	"github.com/ooni/probe-engine/experiment/mkrunner"
-	"github.com/ooni/probe-engine/measurementkit"
+	"github.com/ooni/probe-engine/experiment/httpheader"
+	"github.com/ooni/probe-engine/experiment/testhelper"
+	"github.com/ooni/probe-engine/internal/echohelper"
+	"github.com/ooni/probe-engine/internal/netxlogger"
+	"github.com/ooni/probe-engine/internal/oonidatamodel"
+	"github.com/ooni/probe-engine/internal/oonitemplates"
 	"github.com/ooni/probe-engine/model"
 	"github.com/ooni/probe-engine/session"
 )
 
 const (
 	testName    = "http_header_field_manipulation"
-	testVersion = "0.0.1"
+	testVersion = "0.1.0"
 )
 
 // Config contains the experiment config.
-type Config struct {
-	// LogLevel is the MK log level. Empty implies "WARNING".
-	LogLevel string
+type Config struct{}
+
+// Tampering describes the tampering we have detected.
+type Tampering struct {
+	HeaderFieldName           bool     `json:"header_field_name"`
+	HeaderFieldNumber         bool     `json:"header_field_number"`
+	HeaderFieldValue          bool     `json:"header_field_value"`
+	HeaderNameCapitalization  bool     `json:"header_name_capitalization"`
+	HeaderNameDiff            []string `json:"header_name_diff"`
+	RequestLineCapitalization bool     `json:"request_line_capitalization"`
+	Total                     bool     `json:"total"`
+}
+
+// TestKeys contains hhfm test keys.
+type TestKeys struct {
+	Agent      string                    `json:"agent"`
+	Failure    *string                   `json:"failure"`
+	Requests   oonidatamodel.RequestList `json:"requests"`
+	SOCKSProxy *string                   `json:"socksproxy"` // unused
+	Tampering  Tampering                 `json:"tampering"`
+}
+
+// ignoredHeaders contains the headers that Go adds by itself and
+// whose case we cannot control. We do not compare them.
+var ignoredHeaders = map[string]bool{
+	"accept-encoding": true,
+	"host":            true,
+}
+
+type measurer struct {
+	config Config
+}
+
+func newMeasurer(config Config) *measurer {
+	return &measurer{config: config}
 }
 
-func measure(
-	ctx context.Context, sess *session.Session, measurement *model.Measurement,
-	callbacks handler.Callbacks, config Config,
+func (m *measurer) measure(
+	ctx context.Context,
+	sess *session.Session,
+	measurement *model.Measurement,
+	callbacks handler.Callbacks,
 ) error {
-	settings := measurementkit.NewSettings(
-		"HttpHeaderFieldManipulation", sess.SoftwareName, sess.SoftwareVersion,
-		sess.CABundlePath(), sess.ProbeASNString(), sess.ProbeCC(),
-		sess.ProbeIP(), sess.ProbeNetworkName(), config.LogLevel,
-	)
-	err := mkhelper.Set(sess, "http-return-json-headers", "legacy", &settings)
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	helperURL, err := testhelper.Get(sess, "http-return-json-headers", "legacy")
+	if err != nil {
+		return err
+	}
+	URL, err := url.Parse(helperURL)
 	if err != nil {
 		return err
 	}
-	return mkrunner.Do(
-		settings, sess, measurement, callbacks, measurementkit.StartEx,
+	testkeys := &TestKeys{Agent: "agent"}
+	measurement.TestKeys = testkeys
+	gen := rand.New(rand.NewSource(time.Now().UnixNano()))
+	headers := http.Header{
+		randomCase(gen, "Accept"): []string{httpheader.RandomAccept()},
+		randomCase(gen, "Accept-Charset"): []string{
+			"ISO-8859-1,utf-8;q=0.7,*;q=0.3",
+		},
+		randomCase(gen, "Accept-Language"): []string{
+			httpheader.RandomAcceptLanguage(),
+		},
+		randomCase(gen, "User-Agent"): []string{httpheader.RandomUserAgent()},
+	}
+	results := oonitemplates.HTTPDo(ctx, oonitemplates.HTTPDoConfig{
+		Beginning: measurement.MeasurementStartTimeSaved,
+		Handler:   netxlogger.NewHandler(sess.Logger),
+		Headers:   headers,
+		Method:    "GET",
+		URL:       helperURL,
+	})
+	testkeys.Requests = oonidatamodel.NewRequestList(results.TestKeys)
+	callbacks.OnDataUsage(
+		float64(results.TestKeys.ReceivedBytes)/1024.0, // downloaded
+		float64(results.TestKeys.SentBytes)/1024.0,     // uploaded
 	)
+	if results.Error != nil {
+		failure := results.Error.Error()
+		testkeys.Failure = &failure
+		callbacks.OnProgress(1.0, fmt.Sprintf("hhfm: failure: %s", failure))
+		return nil
+	}
+	var resp echohelper.JSONHeadersResponse
+	if err := json.Unmarshal(results.BodySnap, &resp); err != nil {
+		// Something between us and the helper modified the response
+		testkeys.Tampering.Total = true
+		callbacks.OnProgress(1.0, "hhfm: cannot parse the helper response")
+		return nil
+	}
+	requestLine := fmt.Sprintf("GET %s HTTP/1.1", URL.RequestURI())
+	testkeys.Tampering = compare(headers, requestLine, resp)
+	callbacks.OnProgress(1.0, fmt.Sprintf(
+		"hhfm: tampering: %+v", testkeys.Tampering.Total,
+	))
+	return nil
+}
+
+// compare compares the headers and the request line we have sent
+// with the ones that the helper says it has received. We say that a
+// header field name has been tampered with when a header has been
+// added or removed, while we say that its capitalization has been
+// tampered with when it has been received with a different case.
+func compare(
+	headers http.Header, requestLine string, resp echohelper.JSONHeadersResponse,
+) (tampering Tampering) {
+	var sentCount, receivedCount int
+	sent := make(map[string]bool)
+	sentValues := make(map[string][]string)
+	for key, values := range headers {
+		sent[key] = true
+		lower := strings.ToLower(key)
+		sentValues[lower] = append(sentValues[lower], values...)
+		sentCount += len(values)
+	}
+	received := make(map[string]bool)
+	receivedValues := make(map[string][]string)
+	for _, pair := range resp.RequestHeaders {
+		if len(pair) != 2 || ignoredHeaders[strings.ToLower(pair[0])] {
+			continue
+		}
+		received[pair[0]] = true
+		lower := strings.ToLower(pair[0])
+		receivedValues[lower] = append(receivedValues[lower], pair[1])
+		receivedCount++
+	}
+	tampering.HeaderNameDiff = []string{}
+	for key := range sent {
+		if !received[key] {
+			tampering.HeaderNameDiff = append(tampering.HeaderNameDiff, key)
+		}
+	}
+	for key := range received {
+		if !sent[key] {
+			tampering.HeaderNameDiff = append(tampering.HeaderNameDiff, key)
+			_, found := sentValues[strings.ToLower(key)]
+			tampering.HeaderNameCapitalization = tampering.HeaderNameCapitalization || found
+		}
+	}
+	sort.Strings(tampering.HeaderNameDiff)
+	for lower, values := range sentValues {
+		other, found := receivedValues[lower]
+		if !found {
+			tampering.HeaderFieldName = true
+			continue
+		}
+		tampering.HeaderFieldValue = tampering.HeaderFieldValue || !equal(values, other)
+	}
+	for lower := range receivedValues {
+		if _, found := sentValues[lower]; !found {
+			tampering.HeaderFieldName = true
+		}
+	}
+	tampering.HeaderFieldNumber = sentCount != receivedCount
+	tampering.RequestLineCapitalization = resp.RequestLine != requestLine
+	tampering.Total = (tampering.HeaderFieldName ||
+		tampering.HeaderFieldNumber ||
+		tampering.HeaderFieldValue ||
+		tampering.HeaderNameCapitalization ||
+		tampering.RequestLineCapitalization)
+	return
+}
+
+// equal returns whether a and b contain the same values.
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for idx := range a {
+		if a[idx] != b[idx] {
+			return false
+		}
+	}
+	return true
+}
+
+// randomCase randomly changes the case of each letter in s. We make
+// sure that the result differs from s, which we assume to be in
+// canonical form, because HTTPDo would otherwise override canonical
+// headers like User-Agent with its own values.
+func randomCase(gen *rand.Rand, s string) string {
+	out := []byte(s)
+	for string(out) == s {
+		for idx, c := range []byte(s) {
+			if gen.Intn(2) == 0 {
+				out[idx] = byte(unicode.ToUpper(rune(c)))
+			} else {
+				out[idx] = byte(unicode.ToLower(rune(c)))
+			}
+		}
+	}
+	return string(out)
 }
 
 // NewExperiment creates a new experiment.
 func NewExperiment(
 	sess *session.Session, config Config,
 ) *experiment.Experiment {
-	return experiment.New(
-		sess, testName, testVersion,
-		func(
-			ctx context.Context,
-			sess *session.Session,
-			measurement *model.Measurement,
-			callbacks handler.Callbacks,
-		) error {
-			return measure(ctx, sess, measurement, callbacks, config)
-		})
+	return experiment.New(sess, testName, testVersion,
+		newMeasurer(config).measure)
 }
@@ -1,13 +1,20 @@
-package hhfm_test
+package hhfm
 
 import (
 	"context"
+	"encoding/json"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
 	"testing"
 
 	"github.com/apex/log"
-	"github.com/ooni/probe-engine/experiment/hhfm"
+	"github.com/ooni/probe-engine/experiment/handler"
+	"github.com/ooni/probe-engine/internal/echohelper"
 	"github.com/ooni/probe-engine/internal/kvstore"
-	"github.com/ooni/probe-engine/measurementkit"
+	"github.com/ooni/probe-engine/model"
 	"github.com/ooni/probe-engine/session"
 )
 
@@ -16,35 +23,210 @@ const (
 	softwareVersion = "0.0.1"
 )
 
-func TestIntegration(t *testing.T) {
-	if !measurementkit.Available() {
-		t.Skip("Measurement Kit not available; skipping")
+func newsession(helperURL string) *session.Session {
+	sess := session.New(
+		log.Log, softwareName, softwareVersion,
+		"../../testdata", nil, nil, "../../testdata",
+		kvstore.NewMemoryKeyValueStore(),
+	)
+	if helperURL != "" {
+		sess.AvailableTestHelpers = map[string][]model.Service{
+			"http-return-json-headers": []model.Service{
+				model.Service{Address: helperURL, Type: "legacy"},
+			},
+		}
 	}
-	log.SetLevel(log.DebugLevel)
-	ctx := context.Background()
+	return sess
+}
 
-	sess := session.New(
-		log.Log, softwareName, softwareVersion, "../../testdata", nil, nil,
-		"../../testdata", kvstore.NewMemoryKeyValueStore(),
+func measure(t *testing.T, helperURL string) *TestKeys {
+	measurement := new(model.Measurement)
+	err := newMeasurer(Config{}).measure(
+		context.Background(),
+		newsession(helperURL),
+		measurement,
+		handler.NewPrinterCallbacks(log.Log),
 	)
-	if err := sess.MaybeLookupBackends(ctx); err != nil {
+	if err != nil {
 		t.Fatal(err)
 	}
-	if err := sess.MaybeLookupLocation(ctx); err != nil {
-		t.Fatal(err)
+	return measurement.TestKeys.(*TestKeys)
+}
+
+func TestUnitNewExperiment(t *testing.T) {
+	experiment := NewExperiment(newsession(""), Config{})
+	if experiment == nil {
+		t.Fatal("nil experiment returned")
 	}
+}
 
-	experiment := hhfm.NewExperiment(sess, hhfm.Config{})
-	if err := experiment.OpenReport(ctx); err != nil {
-		t.Fatal(err)
+func TestUnitMeasureWithNoHelper(t *testing.T) {
+	err := newMeasurer(Config{}).measure(
+		context.Background(),
+		newsession(""),
+		new(model.Measurement),
+		handler.NewPrinterCallbacks(log.Log),
+	)
+	if err == nil || err.Error() != "No available http-return-json-headers test helper" {
+		t.Fatal("not the error we expected")
 	}
-	defer experiment.CloseReport(ctx)
+}
 
-	measurement, err := experiment.Measure(ctx, "")
+func TestUnitMeasureWithLocalHelper(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
 		t.Fatal(err)
 	}
-	if err := experiment.SubmitMeasurement(ctx, &measurement); err != nil {
-		t.Fatal(err)
+	defer listener.Close()
+	go echohelper.Serve(listener, echohelper.HTTPReturnJSONHeaders)
+	tk := measure(t, "http://"+listener.Addr().String())
+	if tk.Failure != nil {
+		t.Fatal(*tk.Failure)
+	}
+	if tk.Tampering.Total {
+		t.Fatalf("unexpected tampering: %+v", tk.Tampering)
+	}
+}
+
+func TestUnitMeasureWithNormalizingMiddlebox(t *testing.T) {
+	// This server behaves like a proxy that canonicalizes headers
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			resp := echohelper.JSONHeadersResponse{
+				HeadersDict: r.Header,
+				RequestLine: "GET / HTTP/1.1",
+			}
+			for key, values := range r.Header {
+				for _, value := range values {
+					resp.RequestHeaders = append(
+						resp.RequestHeaders, []string{key, value})
+				}
+			}
+			json.NewEncoder(w).Encode(resp)
+		},
+	))
+	defer server.Close()
+	tk := measure(t, server.URL)
+	if !tk.Tampering.HeaderNameCapitalization || !tk.Tampering.Total {
+		t.Fatal("expected to see header name capitalization tampering")
+	}
+	if tk.Tampering.HeaderFieldName || tk.Tampering.HeaderFieldValue {
+		t.Fatalf("unexpected header tampering: %+v", tk.Tampering)
+	}
+	if tk.Tampering.HeaderFieldNumber || tk.Tampering.RequestLineCapitalization {
+		t.Fatalf("unexpected tampering: %+v", tk.Tampering)
+	}
+}
+
+func TestUnitMeasureWithNonJSONResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("<html><title>Blocked</title></html>"))
+		},
+	))
+	defer server.Close()
+	tk := measure(t, server.URL)
+	if !tk.Tampering.Total {
+		t.Fatal("expected to see tampering")
+	}
+}
+
+func TestUnitMeasureWithNetworkFailure(t *testing.T) {
+	tk := measure(t, "http://127.0.0.1:1")
+	if tk.Failure == nil {
+		t.Fatal("expected a failure here")
+	}
+	if tk.Tampering.Total {
+		t.Fatal("we should not have detected any tampering")
+	}
+}
+
+func TestUnitCompare(t *testing.T) {
+	headers := http.Header{"aCcEpT": []string{"*/*"}}
+	tampering := compare(headers, "GET / HTTP/1.1", echohelper.JSONHeadersResponse{
+		RequestHeaders: [][]string{
+			[]string{"Host", "www.example.com"},
+			[]string{"Accept", "*/*"},
+			[]string{"Via", "antani"},
+		},
+		RequestLine: "get / HTTP/1.1",
+	})
+	if !tampering.HeaderFieldName || !tampering.RequestLineCapitalization {
+		t.Fatal("expected to see tampering")
+	}
+	if !tampering.HeaderNameCapitalization || !tampering.HeaderFieldNumber {
+		t.Fatal("expected to see tampering")
+	}
+	if tampering.HeaderFieldValue || !tampering.Total {
+		t.Fatalf("unexpected tampering: %+v", tampering)
+	}
+	expected := []string{"Accept", "Via", "aCcEpT"}
+	if len(tampering.HeaderNameDiff) != len(expected) {
+		t.Fatal("unexpected header name diff")
+	}
+	for idx, name := range expected {
+		if tampering.HeaderNameDiff[idx] != name {
+			t.Fatal("unexpected header name diff")
+		}
+	}
+}
+
+func TestUnitCompareEachKind(t *testing.T) {
+	headers := http.Header{
+		"aCcEpT":     []string{"*/*"},
+		"uSeR-aGeNt": []string{"antani/1.0"},
+	}
+	var tests = []struct {
+		name      string
+		received  [][]string
+		tampering Tampering
+	}{{
+		name: "header_field_value",
+		received: [][]string{
+			[]string{"aCcEpT", "text/html"},
+			[]string{"uSeR-aGeNt", "antani/1.0"},
+		},
+		tampering: Tampering{HeaderFieldValue: true},
+	}, {
+		name: "header_field_name",
+		received: [][]string{
+			[]string{"aCcEpT", "*/*"},
+		},
+		tampering: Tampering{HeaderFieldName: true, HeaderFieldNumber: true},
+	}, {
+		name: "header_field_number",
+		received: [][]string{
+			[]string{"aCcEpT", "*/*"},
+			[]string{"aCcEpT", "*/*"},
+			[]string{"uSeR-aGeNt", "antani/1.0"},
+		},
+		tampering: Tampering{HeaderFieldNumber: true, HeaderFieldValue: true},
+	}, {
+		name: "header_name_capitalization",
+		received: [][]string{
+			[]string{"Accept", "*/*"},
+			[]string{"uSeR-aGeNt", "antani/1.0"},
+		},
+		tampering: Tampering{HeaderNameCapitalization: true},
+	}}
+	for _, tt := range tests {
+		tampering := compare(headers, "GET / HTTP/1.1", echohelper.JSONHeadersResponse{
+			RequestHeaders: tt.received,
+			RequestLine:    "GET / HTTP/1.1",
+		})
+		tampering.HeaderNameDiff = nil
+		tt.tampering.Total = true
+		if !reflect.DeepEqual(tampering, tt.tampering) {
+			t.Fatalf("%s: unexpected tampering: %+v", tt.name, tampering)
+		}
+	}
+}
+
+func TestUnitRandomCase(t *testing.T) {
+	gen := rand.New(rand.NewSource(0))
+	for i := 0; i < 64; i++ {
+		if randomCase(gen, "User-Agent") == "User-Agent" {
+			t.Fatal("randomCase returned the canonical header")
+		}
 	}
 }
@@ -1,59 +1,207 @@
 // Package hirl contains the HTTP Invalid Request Line network experiment.
+// This file in particular is a pure-Go implementation of it.
+//
+// See https://github.com/ooni/spec/blob/master/nettests/ts-007-http-invalid-request-line.md.
 package hirl
 
 import (
 	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
 
 	"github.com/ooni/probe-engine/experiment"
 	"github.com/ooni/probe-engine/experiment/handler"
-	"github.com/ooni/probe-engine/experiment/mkhelper"
-	"github.com/ooni/probe-engine/experiment/mkrunner"
-	"github.com/ooni/probe-engine/measurementkit"
+	"github.com/ooni/probe-engine/experiment/testhelper"
+	"github.com/ooni/probe-engine/internal/netxlogger"
+	"github.com/ooni/probe-engine/internal/oonidatamodel"
+	"github.com/ooni/probe-engine/internal/oonitemplates"
 	"github.com/ooni/probe-engine/model"
 	"github.com/ooni/probe-engine/session"
 )
 
 const (
 	testName    = "http_invalid_request_line"
-	testVersion = "0.0.3"
+	testVersion = "0.1.0"
+
+	// defaultPort is the port of the tcp-echo helper when the helper
+	// address does not specify it. The helper listens on port 80 so
+	// that transparent HTTP proxies see our traffic.
+	defaultPort = "80"
+
+	// timeout is the timeout of each request line we send.
+	timeout = 5 * time.Second
 )
 
 // Config contains the experiment config.
-type Config struct {
-	// LogLevel is the MK log level. Empty implies "WARNING".
-	LogLevel string
+type Config struct{}
+
+// TestKeys contains hirl test keys.
+type TestKeys struct {
+	FailureList   []*string                        `json:"failure_list"`
+	NetworkEvents oonidatamodel.NetworkEventsList  `json:"network_events"`
+	Received      []oonidatamodel.MaybeBinaryValue `json:"received"`
+	Sent          []string                         `json:"sent"`
+	TCPConnect    oonidatamodel.TCPConnectList     `json:"tcp_connect"`
+	Tampering     bool                             `json:"tampering"`
+	TamperingList []bool                           `json:"tampering_list"`
+}
+
+// requestLine is a request line we send to the helper.
+type requestLine struct {
+	name string
+	line func(gen *rand.Rand) string
+}
+
+// requestLines contains the request lines defined by the spec.
+var requestLines = []requestLine{{
+	name: "random_invalid_method",
+	line: func(gen *rand.Rand) string {
+		return randomString(gen, 4) + " / HTTP/1.1\n\r"
+	},
+}, {
+	name: "random_invalid_field_count",
+	line: func(gen *rand.Rand) string {
+		return strings.Join([]string{
+			randomString(gen, 5), randomString(gen, 5),
+			randomString(gen, 5), randomString(gen, 5),
+		}, " ") + "\r\n"
+	},
+}, {
+	name: "random_big_request_method",
+	line: func(gen *rand.Rand) string {
+		return randomString(gen, 1024) + " / HTTP/1.1\n\r"
+	},
+}, {
+	name: "random_invalid_version_number",
+	line: func(gen *rand.Rand) string {
+		return "GET / HTTP/" + randomString(gen, 3) + "\n\r"
+	},
+}, {
+	name: "squid_cache_manager",
+	line: func(gen *rand.Rand) string {
+		return "GET cache_object://localhost/ HTTP/1.0\n\r"
+	},
+}}
+
+type measurer struct {
+	config Config
+}
+
+func newMeasurer(config Config) *measurer {
+	return &measurer{config: config}
 }
 
-func measure(
-	ctx context.Context, sess *session.Session, measurement *model.Measurement,
-	callbacks handler.Callbacks, config Config,
+func (m *measurer) measure(
+	ctx context.Context,
+	sess *session.Session,
+	measurement *model.Measurement,
+	callbacks handler.Callbacks,
 ) error {
-	settings := measurementkit.NewSettings(
-		"HttpInvalidRequestLine", sess.SoftwareName, sess.SoftwareVersion,
-		sess.CABundlePath(), sess.ProbeASNString(), sess.ProbeCC(),
-		sess.ProbeIP(), sess.ProbeNetworkName(), config.LogLevel,
-	)
-	err := mkhelper.Set(sess, "tcp-echo", "legacy", &settings)
+	helper, err := testhelper.Get(sess, "tcp-echo", "legacy")
 	if err != nil {
 		return err
 	}
-	return mkrunner.Do(
-		settings, sess, measurement, callbacks, measurementkit.StartEx,
+	address := helper
+	if _, _, err := net.SplitHostPort(helper); err != nil {
+		address = net.JoinHostPort(helper, defaultPort)
+	}
+	testkeys := &TestKeys{
+		FailureList:   []*string{},
+		Received:      []oonidatamodel.MaybeBinaryValue{},
+		Sent:          []string{},
+		TamperingList: []bool{},
+	}
+	measurement.TestKeys = testkeys
+	gen := rand.New(rand.NewSource(time.Now().UnixNano()))
+	var sentBytes, receivedBytes int64
+	for idx, rl := range requestLines {
+		line := rl.line(gen)
+		data, results := roundTrip(ctx, sess, measurement, address, line)
+		sentBytes += results.TestKeys.SentBytes
+		receivedBytes += results.TestKeys.ReceivedBytes
+		var failure *string
+		tampering := false
+		if results.Error != nil && len(data) <= 0 {
+			s := results.Error.Error()
+			failure = &s
+		} else {
+			tampering = data != line
+		}
+		testkeys.FailureList = append(testkeys.FailureList, failure)
+		testkeys.NetworkEvents = append(
+			testkeys.NetworkEvents,
+			oonidatamodel.NewNetworkEventsList(results.TestKeys)...,
+		)
+		testkeys.TCPConnect = append(
+			testkeys.TCPConnect,
+			oonidatamodel.NewTCPConnectList(results.TestKeys)...,
+		)
+		testkeys.Received = append(
+			testkeys.Received, oonidatamodel.MaybeBinaryValue{Value: data})
+		testkeys.Sent = append(testkeys.Sent, line)
+		testkeys.TamperingList = append(testkeys.TamperingList, tampering)
+		testkeys.Tampering = testkeys.Tampering || tampering
+		callbacks.OnProgress(
+			float64(idx+1)/float64(len(requestLines)),
+			fmt.Sprintf("hirl: %s: tampering: %+v", rl.name, tampering),
+		)
+	}
+	callbacks.OnDataUsage(
+		float64(receivedBytes)/1024.0, // downloaded
+		float64(sentBytes)/1024.0,     // uploaded
 	)
+	return nil
+}
+
+// roundTrip sends line to the helper at address and returns what the
+// helper sends back, along with the results of the whole operation. We
+// read at most as many bytes as we have sent.
+func roundTrip(
+	ctx context.Context, sess *session.Session,
+	measurement *model.Measurement, address, line string,
+) (string, *oonitemplates.ConnectAndDoResults) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var data []byte
+	results := oonitemplates.ConnectAndDo(ctx, oonitemplates.ConnectAndDoConfig{
+		Address:   address,
+		Beginning: measurement.MeasurementStartTimeSaved,
+		Do: func(conn net.Conn) error {
+			if deadline, ok := ctx.Deadline(); ok {
+				conn.SetDeadline(deadline)
+			}
+			if _, err := conn.Write([]byte(line)); err != nil {
+				return err
+			}
+			data = make([]byte, len(line))
+			count, err := io.ReadFull(conn, data)
+			data = data[:count]
+			return err
+		},
+		Handler: netxlogger.NewHandler(sess.Logger),
+		Network: "tcp",
+	})
+	return string(data), results
+}
+
+// randomString returns a random uppercase string of the given length.
+func randomString(gen *rand.Rand, length int) string {
+	const letters = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	out := make([]byte, length)
+	for idx := range out {
+		out[idx] = letters[gen.Intn(len(letters))]
+	}
+	return string(out)
 }
 
 // NewExperiment creates a new experiment.
 func NewExperiment(
 	sess *session.Session, config Config,
 ) *experiment.Experiment {
-	return experiment.New(
-		sess, testName, testVersion,
-		func(
-			ctx context.Context,
-			sess *session.Session,
-			measurement *model.Measurement,
-			callbacks handler.Callbacks,
-		) error {
-			return measure(ctx, sess, measurement, callbacks, config)
-		})
+	return experiment.New(sess, testName, testVersion,
+		newMeasurer(config).measure)
 }
@@ -1,13 +1,17 @@
-package hirl_test
+package hirl
 
 import (
 	"context"
+	"io"
+	"io/ioutil"
+	"net"
 	"testing"
 
 	"github.com/apex/log"
-	"github.com/ooni/probe-engine/experiment/hirl"
+	"github.com/ooni/probe-engine/experiment/handler"
+	"github.com/ooni/probe-engine/internal/echohelper"
 	"github.com/ooni/probe-engine/internal/kvstore"
-	"github.com/ooni/probe-engine/measurementkit"
+	"github.com/ooni/probe-engine/model"
 	"github.com/ooni/probe-engine/session"
 )
 
@@ -16,35 +20,139 @@ const (
 	softwareVersion = "0.0.1"
 )
 
-func TestIntegration(t *testing.T) {
-	if !measurementkit.Available() {
-		t.Skip("Measurement Kit not available; skipping")
+func newsession(helper string) *session.Session {
+	sess := session.New(
+		log.Log, softwareName, softwareVersion,
+		"../../testdata", nil, nil, "../../testdata",
+		kvstore.NewMemoryKeyValueStore(),
+	)
+	if helper != "" {
+		sess.AvailableTestHelpers = map[string][]model.Service{
+			"tcp-echo": []model.Service{
+				model.Service{Address: helper, Type: "legacy"},
+			},
+		}
 	}
-	log.SetLevel(log.DebugLevel)
-	ctx := context.Background()
+	return sess
+}
 
-	sess := session.New(
-		log.Log, softwareName, softwareVersion, "../../testdata", nil, nil,
-		"../../testdata", kvstore.NewMemoryKeyValueStore(),
+func measure(t *testing.T, helper string) *TestKeys {
+	measurement := new(model.Measurement)
+	err := newMeasurer(Config{}).measure(
+		context.Background(),
+		newsession(helper),
+		measurement,
+		handler.NewPrinterCallbacks(log.Log),
 	)
-	if err := sess.MaybeLookupBackends(ctx); err != nil {
+	if err != nil {
 		t.Fatal(err)
 	}
-	if err := sess.MaybeLookupLocation(ctx); err != nil {
-		t.Fatal(err)
+	tk := measurement.TestKeys.(*TestKeys)
+	if len(tk.FailureList) != len(requestLines) ||
+		len(tk.Received) != len(requestLines) ||
+		len(tk.Sent) != len(requestLines) ||
+		len(tk.TamperingList) != len(requestLines) {
+		t.Fatal("unexpected number of results")
 	}
+	return tk
+}
 
-	experiment := hirl.NewExperiment(sess, hirl.Config{})
-	if err := experiment.OpenReport(ctx); err != nil {
+func listen(t *testing.T, handler func(net.Conn)) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
 		t.Fatal(err)
 	}
-	defer experiment.CloseReport(ctx)
+	go echohelper.Serve(listener, handler)
+	return listener
+}
 
-	measurement, err := experiment.Measure(ctx, "")
-	if err != nil {
-		t.Fatal(err)
+func TestUnitNewExperiment(t *testing.T) {
+	experiment := NewExperiment(newsession(""), Config{})
+	if experiment == nil {
+		t.Fatal("nil experiment returned")
 	}
-	if err := experiment.SubmitMeasurement(ctx, &measurement); err != nil {
-		t.Fatal(err)
+}
+
+func TestUnitMeasureWithNoHelper(t *testing.T) {
+	err := newMeasurer(Config{}).measure(
+		context.Background(),
+		newsession(""),
+		new(model.Measurement),
+		handler.NewPrinterCallbacks(log.Log),
+	)
+	if err == nil || err.Error() != "No available tcp-echo test helper" {
+		t.Fatal("not the error we expected")
+	}
+}
+
+func TestUnitMeasureWithLocalHelper(t *testing.T) {
+	listener := listen(t, echohelper.TCPEcho)
+	defer listener.Close()
+	tk := measure(t, listener.Addr().String())
+	if tk.Tampering {
+		t.Fatal("unexpected tampering")
+	}
+	for idx, failure := range tk.FailureList {
+		if failure != nil {
+			t.Fatal(*failure)
+		}
+		if tk.Received[idx].Value != tk.Sent[idx] {
+			t.Fatal("received and sent differ")
+		}
+	}
+	if len(tk.TCPConnect) != len(requestLines) || len(tk.NetworkEvents) <= 0 {
+		t.Fatal("network events not recorded")
+	}
+}
+
+func TestUnitMeasureWithMiddlebox(t *testing.T) {
+	// This server behaves like a transparent HTTP proxy that refuses
+	// to forward our invalid request lines to the helper
+	listener := listen(t, func(conn net.Conn) {
+		defer conn.Close()
+		conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+		conn.(*net.TCPConn).CloseWrite()
+		io.Copy(ioutil.Discard, conn)
+	})
+	defer listener.Close()
+	tk := measure(t, listener.Addr().String())
+	if !tk.Tampering {
+		t.Fatal("expected to see tampering")
+	}
+	for idx, tampering := range tk.TamperingList {
+		if !tampering || tk.FailureList[idx] != nil {
+			t.Fatal("expected to see tampering and no failure")
+		}
+	}
+}
+
+func TestUnitMeasureWithNetworkFailure(t *testing.T) {
+	// Port 1 is reserved and most likely nobody is listening there
+	tk := measure(t, "127.0.0.1:1")
+	if tk.Tampering {
+		t.Fatal("we should not have detected any tampering")
+	}
+	for _, failure := range tk.FailureList {
+		if failure == nil || *failure != "connection_refused" {
+			t.Fatal("expected a connection_refused failure")
+		}
+	}
+}
+
+func TestUnitMeasureWithClosedConnection(t *testing.T) {
+	listener := listen(t, func(conn net.Conn) {
+		defer conn.Close()
+		conn.(*net.TCPConn).CloseWrite()
+		io.Copy(ioutil.Discard, conn)
+	})
+	defer listener.Close()
+	tk := measure(t, listener.Addr().String())
+	if tk.Tampering {
+		t.Fatal("we should not have detected any tampering")
+	}
+	for _, failure := range tk.FailureList {
+		if failure == nil || *failure != "eof_error" {
+			t.Fatal("expected an eof_error failure")
+		}
 	}
 }
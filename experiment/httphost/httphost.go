@@ -0,0 +1,340 @@
+// Package httphost contains the HTTP Host network experiment.
+//
+// We send HTTP requests to the http-return-json-headers helper using
+// the input domain as the Host header, as well as a control host. As
+// the destination IP is always the one of the helper, if the control
+// works but the input domain does not, the middlebox is filtering on
+// the plaintext Host header. We also try variants of the Host header
+// with different case and whitespace, to see whether the filter can
+// be evaded, which tells us something about how it's implemented.
+package httphost
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ooni/netx/modelx"
+	"github.com/ooni/probe-engine/experiment"
+	"github.com/ooni/probe-engine/experiment/handler"
+	"github.com/ooni/probe-engine/experiment/httpheader"
+	"github.com/ooni/probe-engine/experiment/testhelper"
+	"github.com/ooni/probe-engine/internal/echohelper"
+	"github.com/ooni/probe-engine/internal/netxlogger"
+	"github.com/ooni/probe-engine/internal/oonidatamodel"
+	"github.com/ooni/probe-engine/internal/oonitemplates"
+	"github.com/ooni/probe-engine/model"
+	"github.com/ooni/probe-engine/session"
+)
+
+const (
+	testName    = "http_host"
+	testVersion = "0.1.0"
+
+	// maxResponseSize is the maximum response size we read.
+	maxResponseSize = 1 << 20
+
+	// timeout is the timeout of each request.
+	timeout = 10 * time.Second
+)
+
+// Config contains the experiment config.
+type Config struct {
+	ControlHost string `ooni:"host to use as the control Host header"`
+}
+
+// Request contains the results of a single request. ConnectFailure
+// is set when we could not connect to the helper, in which case also
+// Failure is set and we did not send the Host header at all.
+type Request struct {
+	ConnectFailure *string `json:"connect_failure"`
+	Failure        *string `json:"failure"`
+	HostLine       string  `json:"host_line"`
+	StatusCode     int64   `json:"status_code"`
+	Tampering      bool    `json:"tampering"`
+	Variant        string  `json:"variant"`
+}
+
+// blocked returns true if the request failed or has been tampered with.
+func (r Request) blocked() bool {
+	return r.Failure != nil || r.Tampering
+}
+
+// TestKeys contains http_host test keys.
+type TestKeys struct {
+	Control            Request                         `json:"control"`
+	EvadingVariants    []string                        `json:"evading_variants"`
+	HostBasedFiltering *bool                           `json:"host_based_filtering"`
+	NetworkEvents      oonidatamodel.NetworkEventsList `json:"network_events"`
+	Requests           []Request                       `json:"requests"`
+	TCPConnect         oonidatamodel.TCPConnectList    `json:"tcp_connect"`
+}
+
+// variant is a way of writing the Host header line.
+type variant struct {
+	name string
+	line func(host string) string
+}
+
+// variants contains the Host header variants. The first one
+// is the standard one and we also use it for the control.
+var variants = []variant{{
+	name: "standard",
+	line: func(host string) string { return "Host: " + host },
+}, {
+	name: "lowercase_name",
+	line: func(host string) string { return "host: " + host },
+}, {
+	name: "uppercase_value",
+	line: func(host string) string { return "Host: " + strings.ToUpper(host) },
+}, {
+	name: "extra_whitespace",
+	line: func(host string) string { return "Host:    " + host + "  " },
+}, {
+	name: "tab_separator",
+	line: func(host string) string { return "Host:\t" + host },
+}}
+
+// analyze computes the overall results. If the control failed we
+// cannot say anything, otherwise the filtering is Host based if the
+// standard request for the input domain is blocked after we have
+// connected to the helper. When we cannot connect, we have not sent
+// the Host header, hence we cannot say anything either.
+func (tk *TestKeys) analyze() {
+	tk.EvadingVariants = []string{}
+	if tk.Control.blocked() || len(tk.Requests) <= 0 {
+		return
+	}
+	if tk.Requests[0].ConnectFailure != nil {
+		return
+	}
+	filtering := tk.Requests[0].blocked()
+	tk.HostBasedFiltering = &filtering
+	if !filtering {
+		return
+	}
+	for _, r := range tk.Requests[1:] {
+		if r.ConnectFailure == nil && !r.blocked() {
+			tk.EvadingVariants = append(tk.EvadingVariants, r.Variant)
+		}
+	}
+}
+
+// roundTrip sends the request to address and returns the raw
+// response along with the results of connecting and sending.
+func roundTrip(
+	ctx context.Context, sess *session.Session,
+	measurement *model.Measurement, address string, request []byte,
+) ([]byte, *oonitemplates.ConnectAndDoResults) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var data []byte
+	results := oonitemplates.ConnectAndDo(ctx, oonitemplates.ConnectAndDoConfig{
+		Address:   address,
+		Beginning: measurement.MeasurementStartTimeSaved,
+		Do: func(conn net.Conn) error {
+			if deadline, ok := ctx.Deadline(); ok {
+				conn.SetDeadline(deadline)
+			}
+			if _, err := conn.Write(request); err != nil {
+				return err
+			}
+			// We're using Connection: close, so we read until EOF
+			var err error
+			data, err = ioutil.ReadAll(io.LimitReader(eofReader{conn}, maxResponseSize))
+			return err
+		},
+		Handler: netxlogger.NewHandler(sess.Logger),
+		Network: "tcp",
+	})
+	return data, results
+}
+
+// eofReader unwraps the EOF error wrapped by netx, so that we can
+// read until EOF using ioutil.ReadAll.
+type eofReader struct {
+	io.Reader
+}
+
+func (r eofReader) Read(b []byte) (int, error) {
+	count, err := r.Reader.Read(b)
+	var wrapper *modelx.ErrWrapper
+	if errors.As(err, &wrapper) && wrapper.WrappedErr == io.EOF {
+		err = io.EOF
+	}
+	return count, err
+}
+
+// parseResponse parses the raw response returned by roundTrip.
+func parseResponse(data []byte) (*http.Response, []byte, error) {
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(data)), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	return resp, body, err
+}
+
+// tampered returns true if the helper has not received the Host header
+// exactly as we have sent it, or if the response is not the one we
+// expect from the helper. The helper trims the header value.
+func tampered(hostLine string, resp *http.Response, body []byte) bool {
+	if resp.StatusCode != 200 {
+		return true
+	}
+	var helperResp echohelper.JSONHeadersResponse
+	if err := json.Unmarshal(body, &helperResp); err != nil {
+		return true
+	}
+	idx := strings.Index(hostLine, ":")
+	name, value := hostLine[:idx], strings.TrimSpace(hostLine[idx+1:])
+	for _, pair := range helperResp.RequestHeaders {
+		if len(pair) == 2 && strings.ToLower(pair[0]) == "host" {
+			return pair[0] != name || pair[1] != value
+		}
+	}
+	return true
+}
+
+type measurer struct {
+	config Config
+}
+
+func newMeasurer(config Config) *measurer {
+	return &measurer{config: config}
+}
+
+// runner sends requests to the helper and keeps track of the
+// network events and of the number of bytes sent and received.
+type runner struct {
+	address       string
+	measurement   *model.Measurement
+	path          string
+	receivedBytes int64
+	sentBytes     int64
+	sess          *session.Session
+	tk            *TestKeys
+}
+
+// do sends a request using hostLine and returns the results. A response
+// that we cannot parse counts as tampering, because the helper always
+// sends back a well formed response.
+func (r *runner) do(ctx context.Context, hostLine, variant string) Request {
+	result := Request{HostLine: hostLine, Variant: variant}
+	request := []byte(fmt.Sprintf("GET %s HTTP/1.1\r\n%s\r\n"+
+		"User-Agent: %s\r\nAccept: %s\r\nConnection: close\r\n\r\n",
+		r.path, hostLine, httpheader.RandomUserAgent(), httpheader.RandomAccept()))
+	data, results := roundTrip(ctx, r.sess, r.measurement, r.address, request)
+	r.sentBytes += results.TestKeys.SentBytes
+	r.receivedBytes += results.TestKeys.ReceivedBytes
+	r.tk.NetworkEvents = append(
+		r.tk.NetworkEvents, oonidatamodel.NewNetworkEventsList(results.TestKeys)...,
+	)
+	r.tk.TCPConnect = append(
+		r.tk.TCPConnect, oonidatamodel.NewTCPConnectList(results.TestKeys)...,
+	)
+	for _, connect := range results.TestKeys.Connects {
+		if connect.Error != nil {
+			s := connect.Error.Error()
+			result.ConnectFailure = &s
+		}
+	}
+	if results.Error != nil {
+		s := results.Error.Error()
+		result.Failure = &s
+		return result
+	}
+	resp, body, err := parseResponse(data)
+	if err != nil {
+		result.Tampering = true
+		return result
+	}
+	result.StatusCode = int64(resp.StatusCode)
+	result.Tampering = tampered(hostLine, resp, body)
+	return result
+}
+
+// maybeURLToHost handles the case where the input is from the
+// test-lists and hence every input is a URL rather than a domain.
+func maybeURLToHost(input string) (string, error) {
+	parsed, err := url.Parse(input)
+	if err != nil {
+		return "", err
+	}
+	if parsed.Path == input {
+		return input, nil
+	}
+	return parsed.Hostname(), nil
+}
+
+func (m *measurer) measure(
+	ctx context.Context,
+	sess *session.Session,
+	measurement *model.Measurement,
+	callbacks handler.Callbacks,
+) error {
+	if m.config.ControlHost == "" {
+		return errors.New("Experiment requires ControlHost")
+	}
+	if measurement.Input == "" {
+		return errors.New("Experiment requires measurement.Input")
+	}
+	host, err := maybeURLToHost(measurement.Input)
+	if err != nil {
+		return err
+	}
+	measurement.Input = host
+	helperURL, err := testhelper.Get(sess, "http-return-json-headers", "legacy")
+	if err != nil {
+		return err
+	}
+	URL, err := url.Parse(helperURL)
+	if err != nil {
+		return err
+	}
+	tk := new(TestKeys)
+	measurement.TestKeys = tk
+	r := &runner{
+		address:     URL.Host,
+		measurement: measurement,
+		path:        URL.RequestURI(),
+		sess:        sess,
+		tk:          tk,
+	}
+	if URL.Port() == "" {
+		r.address = net.JoinHostPort(URL.Hostname(), "80")
+	}
+	tk.Control = r.do(ctx, variants[0].line(m.config.ControlHost), variants[0].name)
+	for idx, v := range variants {
+		result := r.do(ctx, v.line(host), v.name)
+		tk.Requests = append(tk.Requests, result)
+		callbacks.OnProgress(float64(idx+1)/float64(len(variants)), fmt.Sprintf(
+			"http_host: %s: blocked: %+v", v.name, result.blocked(),
+		))
+	}
+	tk.analyze()
+	callbacks.OnDataUsage(
+		float64(r.receivedBytes)/1024.0, // downloaded
+		float64(r.sentBytes)/1024.0,     // uploaded
+	)
+	return nil
+}
+
+// NewExperiment creates a new experiment.
+func NewExperiment(
+	sess *session.Session, config Config,
+) *experiment.Experiment {
+	return experiment.New(sess, testName, testVersion,
+		newMeasurer(config).measure)
+}
@@ -0,0 +1,274 @@
+package httphost
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/apex/log"
+	"github.com/ooni/probe-engine/experiment/handler"
+	"github.com/ooni/probe-engine/internal/echohelper"
+	"github.com/ooni/probe-engine/internal/kvstore"
+	"github.com/ooni/probe-engine/model"
+	"github.com/ooni/probe-engine/session"
+)
+
+const (
+	softwareName    = "ooniprobe-example"
+	softwareVersion = "0.0.1"
+)
+
+func newsession(helperURL string) *session.Session {
+	sess := session.New(
+		log.Log, softwareName, softwareVersion,
+		"../../testdata", nil, nil, "../../testdata",
+		kvstore.NewMemoryKeyValueStore(),
+	)
+	if helperURL != "" {
+		sess.AvailableTestHelpers = map[string][]model.Service{
+			"http-return-json-headers": []model.Service{
+				model.Service{Address: helperURL, Type: "legacy"},
+			},
+		}
+	}
+	return sess
+}
+
+func measure(t *testing.T, helperURL, input string) *TestKeys {
+	measurement := &model.Measurement{Input: input}
+	err := newMeasurer(Config{ControlHost: "example.org"}).measure(
+		context.Background(),
+		newsession(helperURL),
+		measurement,
+		handler.NewPrinterCallbacks(log.Log),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return measurement.TestKeys.(*TestKeys)
+}
+
+// startHelper starts a local helper using handler.
+func startHelper(t *testing.T, handler func(net.Conn)) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go echohelper.Serve(listener, handler)
+	return listener
+}
+
+// replayConn is a net.Conn that replays what we have already read.
+type replayConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// filteringHelper emulates a naive middlebox in front of the helper
+// that blocks requests containing a specific Host header line.
+func filteringHelper(conn net.Conn) {
+	var head bytes.Buffer
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		head.WriteString(line)
+		if err != nil || line == "\r\n" {
+			break
+		}
+	}
+	if strings.Contains(head.String(), "\r\nHost: blocked.example.com\r\n") {
+		conn.Write([]byte("HTTP/1.1 403 Forbidden\r\nConnection: close\r\n\r\n"))
+		conn.Close()
+		return
+	}
+	echohelper.HTTPReturnJSONHeaders(&replayConn{
+		Conn: conn, reader: io.MultiReader(&head, reader),
+	})
+}
+
+func TestUnitNewExperiment(t *testing.T) {
+	experiment := NewExperiment(newsession(""), Config{})
+	if experiment == nil {
+		t.Fatal("nil experiment returned")
+	}
+}
+
+func TestUnitMeasureWithInvalidConfigOrInput(t *testing.T) {
+	var tests = []struct {
+		config Config
+		input  string
+	}{
+		{Config{}, "www.example.com"},
+		{Config{ControlHost: "example.org"}, ""},
+		{Config{ControlHost: "example.org"}, "\t"},
+		{Config{ControlHost: "example.org"}, "www.example.com"}, // no helper
+	}
+	for _, tt := range tests {
+		err := newMeasurer(tt.config).measure(
+			context.Background(),
+			newsession(""),
+			&model.Measurement{Input: tt.input},
+			handler.NewPrinterCallbacks(log.Log),
+		)
+		if err == nil {
+			t.Fatalf("expected an error with %+v", tt)
+		}
+	}
+}
+
+func TestUnitMeasureWithLocalHelper(t *testing.T) {
+	listener := startHelper(t, echohelper.HTTPReturnJSONHeaders)
+	defer listener.Close()
+	tk := measure(t, "http://"+listener.Addr().String()+"/", "http://www.example.com/")
+	if tk.Control.blocked() || len(tk.Requests) != len(variants) {
+		t.Fatalf("unexpected results: %+v", tk)
+	}
+	for _, r := range tk.Requests {
+		if r.blocked() || r.StatusCode != 200 {
+			t.Fatalf("unexpected request: %+v", r)
+		}
+	}
+	if tk.HostBasedFiltering == nil || *tk.HostBasedFiltering != false {
+		t.Fatal("expected no Host based filtering")
+	}
+}
+
+func TestUnitMeasureWithFilteringHelper(t *testing.T) {
+	listener := startHelper(t, filteringHelper)
+	defer listener.Close()
+	tk := measure(t, "http://"+listener.Addr().String()+"/", "blocked.example.com")
+	if tk.HostBasedFiltering == nil || *tk.HostBasedFiltering != true {
+		t.Fatal("expected Host based filtering")
+	}
+	if tk.Requests[0].StatusCode != 403 || !tk.Requests[0].Tampering {
+		t.Fatalf("unexpected request: %+v", tk.Requests[0])
+	}
+	if len(tk.EvadingVariants) != len(variants)-1 {
+		t.Fatalf("unexpected evading variants: %+v", tk.EvadingVariants)
+	}
+}
+
+// resettingHelper emulates a middlebox that resets the connection
+// when it sees a request containing a specific Host header line.
+func resettingHelper(conn net.Conn) {
+	var head bytes.Buffer
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		head.WriteString(line)
+		if err != nil || line == "\r\n" {
+			break
+		}
+	}
+	if strings.Contains(head.String(), "\r\nHost: blocked.example.com\r\n") {
+		conn.(*net.TCPConn).SetLinger(0)
+		conn.Close()
+		return
+	}
+	echohelper.HTTPReturnJSONHeaders(&replayConn{
+		Conn: conn, reader: io.MultiReader(&head, reader),
+	})
+}
+
+func TestUnitMeasureWithResettingHelper(t *testing.T) {
+	listener := startHelper(t, resettingHelper)
+	defer listener.Close()
+	tk := measure(t, "http://"+listener.Addr().String()+"/", "blocked.example.com")
+	if tk.HostBasedFiltering == nil || *tk.HostBasedFiltering != true {
+		t.Fatal("expected Host based filtering")
+	}
+	r := tk.Requests[0]
+	if r.Failure == nil || *r.Failure != "connection_reset" || r.ConnectFailure != nil {
+		t.Fatalf("unexpected request: %+v", r)
+	}
+	if len(tk.TCPConnect) != len(variants)+1 || len(tk.NetworkEvents) <= 0 {
+		t.Fatal("expected to see the network events")
+	}
+}
+
+func TestUnitMeasureWithConnectionRefused(t *testing.T) {
+	// Port 1 is reserved and most likely nobody is listening there
+	tk := measure(t, "http://127.0.0.1:1/", "www.example.com")
+	if tk.Control.Failure == nil || tk.HostBasedFiltering != nil {
+		t.Fatalf("unexpected results: %+v", tk)
+	}
+	if tk.Control.ConnectFailure == nil ||
+		*tk.Control.ConnectFailure != "connection_refused" {
+		t.Fatalf("unexpected control: %+v", tk.Control)
+	}
+}
+
+func TestUnitAnalyzeWithConnectFailure(t *testing.T) {
+	failure := "generic_timeout_error"
+	tk := &TestKeys{Requests: []Request{{
+		ConnectFailure: &failure, Failure: &failure, Variant: "standard",
+	}, {
+		ConnectFailure: &failure, Failure: &failure, Variant: "lowercase_name",
+	}}}
+	tk.analyze()
+	if tk.HostBasedFiltering != nil || len(tk.EvadingVariants) != 0 {
+		t.Fatalf("unexpected results: %+v", tk)
+	}
+}
+
+func TestUnitTampered(t *testing.T) {
+	listener := startHelper(t, func(conn net.Conn) {
+		// Emulate a middlebox that normalizes the Host header
+		var head bytes.Buffer
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := reader.ReadString('\n')
+			if strings.HasPrefix(strings.ToLower(line), "host:") {
+				line = "Host: " + strings.ToLower(strings.TrimSpace(line[5:])) + "\r\n"
+			}
+			head.WriteString(line)
+			if err != nil || line == "\r\n" {
+				break
+			}
+		}
+		echohelper.HTTPReturnJSONHeaders(&replayConn{
+			Conn: conn, reader: io.MultiReader(&head, reader),
+		})
+	})
+	defer listener.Close()
+	tk := measure(t, "http://"+listener.Addr().String()+"/", "www.example.com")
+	tampering := map[string]bool{
+		"standard":         false,
+		"lowercase_name":   true,
+		"uppercase_value":  true,
+		"extra_whitespace": false,
+		"tab_separator":    false,
+	}
+	for _, r := range tk.Requests {
+		if r.Tampering != tampering[r.Variant] {
+			t.Fatalf("unexpected tampering for %s", r.Variant)
+		}
+	}
+}
+
+func TestIntegrationMeasure(t *testing.T) {
+	ctx := context.Background()
+	sess := newsession("")
+	if err := sess.MaybeLookupBackends(ctx); err != nil {
+		t.Fatal(err)
+	}
+	measurement := &model.Measurement{Input: "www.example.com"}
+	err := newMeasurer(Config{ControlHost: "example.org"}).measure(
+		ctx, sess, measurement, handler.NewPrinterCallbacks(log.Log),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tk := measurement.TestKeys.(*TestKeys)
+	if tk.HostBasedFiltering == nil || *tk.HostBasedFiltering {
+		t.Fatalf("unexpected results: %+v", tk)
+	}
+}
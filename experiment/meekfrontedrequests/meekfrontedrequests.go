@@ -0,0 +1,143 @@
+// Package meekfrontedrequests contains the meek fronted requests experiment.
+//
+// The input is a front domain and a hidden host separated by a colon,
+// e.g. `a0.awsstatic.com:d2cly7j4zqgua7.cloudfront.net`. We connect to
+// the front domain, using it as the SNI, and then we send a request
+// using the hidden host as the Host header. If domain fronting works,
+// we get back the body that the meek server at the hidden host emits.
+//
+// See https://github.com/ooni/spec/blob/master/nettests/ts-014-meek-fronted-requests.md.
+package meekfrontedrequests
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ooni/probe-engine/experiment"
+	"github.com/ooni/probe-engine/experiment/handler"
+	"github.com/ooni/probe-engine/experiment/httpheader"
+	"github.com/ooni/probe-engine/internal/netxlogger"
+	"github.com/ooni/probe-engine/internal/oonidatamodel"
+	"github.com/ooni/probe-engine/internal/oonitemplates"
+	"github.com/ooni/probe-engine/model"
+	"github.com/ooni/probe-engine/session"
+)
+
+const (
+	testName    = "meek_fronted_requests"
+	testVersion = "0.1.0"
+
+	// maxBodySize is the maximum body size we read.
+	maxBodySize = 1 << 10
+)
+
+// Config contains the experiment config.
+type Config struct {
+	ExpectedBody string `ooni:"body we expect to receive from the hidden host"`
+}
+
+// TestKeys contains meek_fronted_requests test keys.
+type TestKeys struct {
+	Agent         string                          `json:"agent"`
+	Failure       *string                         `json:"failure"`
+	FrontDomain   string                          `json:"front_domain"`
+	HiddenHost    string                          `json:"hidden_host"`
+	NetworkEvents oonidatamodel.NetworkEventsList `json:"network_events"`
+	Queries       oonidatamodel.DNSQueriesList    `json:"queries"`
+	Requests      oonidatamodel.RequestList       `json:"requests"`
+	Success       bool                            `json:"success"`
+	TCPConnect    oonidatamodel.TCPConnectList    `json:"tcp_connect"`
+	TLSHandshakes oonidatamodel.TLSHandshakesList `json:"tls_handshakes"`
+}
+
+// parseInput splits the input into front domain and hidden host. We
+// split at the last colon, so the front domain may include a port.
+func parseInput(input string) (string, string, error) {
+	idx := strings.LastIndex(input, ":")
+	if idx <= 0 || idx == len(input)-1 {
+		return "", "", errors.New("meek_fronted_requests: input must be front:hidden")
+	}
+	return input[:idx], input[idx+1:], nil
+}
+
+type measurer struct {
+	config Config
+
+	// caBundlePath allows tests to use a custom CA bundle.
+	caBundlePath string
+}
+
+func newMeasurer(config Config) *measurer {
+	return &measurer{config: config}
+}
+
+func (m *measurer) measure(
+	ctx context.Context,
+	sess *session.Session,
+	measurement *model.Measurement,
+	callbacks handler.Callbacks,
+) error {
+	if m.config.ExpectedBody == "" {
+		return errors.New("Experiment requires ExpectedBody")
+	}
+	if measurement.Input == "" {
+		return errors.New("Experiment requires measurement.Input")
+	}
+	front, hidden, err := parseInput(measurement.Input)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	URL := &url.URL{Scheme: "https", Host: front, Path: "/"}
+	results := oonitemplates.HTTPDo(ctx, oonitemplates.HTTPDoConfig{
+		Accept:                  httpheader.RandomAccept(),
+		AcceptLanguage:          httpheader.RandomAcceptLanguage(),
+		Beginning:               measurement.MeasurementStartTimeSaved,
+		CABundlePath:            m.caBundlePath,
+		Handler:                 netxlogger.NewHandler(sess.Logger),
+		Host:                    hidden,
+		MaxEventsBodySnapSize:   maxBodySize,
+		MaxResponseBodySnapSize: maxBodySize,
+		Method:                  "GET",
+		URL:                     URL.String(),
+		UserAgent:               httpheader.RandomUserAgent(),
+	})
+	tk := &TestKeys{
+		Agent:         "redirect",
+		FrontDomain:   front,
+		HiddenHost:    hidden,
+		NetworkEvents: oonidatamodel.NewNetworkEventsList(results.TestKeys),
+		Queries:       oonidatamodel.NewDNSQueriesList(results.TestKeys),
+		Requests:      oonidatamodel.NewRequestList(results.TestKeys),
+		TCPConnect:    oonidatamodel.NewTCPConnectList(results.TestKeys),
+		TLSHandshakes: oonidatamodel.NewTLSHandshakesList(results.TestKeys),
+	}
+	measurement.TestKeys = tk
+	if results.Error != nil {
+		s := results.Error.Error()
+		tk.Failure = &s
+	}
+	tk.Success = (results.Error == nil && results.StatusCode == 200 &&
+		string(results.BodySnap) == m.config.ExpectedBody)
+	callbacks.OnProgress(1.0, fmt.Sprintf(
+		"meek_fronted_requests: %s via %s: success: %+v", hidden, front, tk.Success,
+	))
+	callbacks.OnDataUsage(
+		float64(results.TestKeys.ReceivedBytes)/1024.0, // downloaded
+		float64(results.TestKeys.SentBytes)/1024.0,     // uploaded
+	)
+	return nil
+}
+
+// NewExperiment creates a new experiment.
+func NewExperiment(
+	sess *session.Session, config Config,
+) *experiment.Experiment {
+	return experiment.New(sess, testName, testVersion,
+		newMeasurer(config).measure)
+}
@@ -0,0 +1,156 @@
+package meekfrontedrequests
+
+import (
+	"context"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/apex/log"
+	"github.com/ooni/probe-engine/experiment/handler"
+	"github.com/ooni/probe-engine/internal/kvstore"
+	"github.com/ooni/probe-engine/model"
+	"github.com/ooni/probe-engine/session"
+)
+
+const (
+	softwareName    = "ooniprobe-example"
+	softwareVersion = "0.0.1"
+	expectedBody    = "I’m just a happy little web server.\n"
+)
+
+func newsession() *session.Session {
+	return session.New(
+		log.Log, softwareName, softwareVersion,
+		"../../testdata", nil, nil, "../../testdata",
+		kvstore.NewMemoryKeyValueStore(),
+	)
+}
+
+// startServer starts a local TLS server that emulates a CDN where
+// only hidden.example.com is served by a meek server. It returns the
+// server and the path of a CA bundle containing its certificate.
+func startServer(t *testing.T) (*httptest.Server, string) {
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Host != "hidden.example.com" {
+				w.WriteHeader(404)
+				return
+			}
+			w.Write([]byte(expectedBody))
+		},
+	))
+	bundle, err := ioutil.TempFile("", "meekfrontedrequests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pem.Encode(bundle, &pem.Block{
+		Type: "CERTIFICATE", Bytes: server.Certificate().Raw,
+	})
+	bundle.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, bundle.Name()
+}
+
+func measure(t *testing.T, caBundlePath, input string) *TestKeys {
+	measurer := newMeasurer(Config{ExpectedBody: expectedBody})
+	measurer.caBundlePath = caBundlePath
+	measurement := &model.Measurement{Input: input}
+	err := measurer.measure(
+		context.Background(),
+		newsession(),
+		measurement,
+		handler.NewPrinterCallbacks(log.Log),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return measurement.TestKeys.(*TestKeys)
+}
+
+func TestUnitNewExperiment(t *testing.T) {
+	experiment := NewExperiment(newsession(), Config{})
+	if experiment == nil {
+		t.Fatal("nil experiment returned")
+	}
+}
+
+func TestUnitMeasureWithInvalidConfigOrInput(t *testing.T) {
+	var tests = []struct {
+		config Config
+		input  string
+	}{
+		{Config{}, "front.example.com:hidden.example.com"},
+		{Config{ExpectedBody: expectedBody}, ""},
+		{Config{ExpectedBody: expectedBody}, "front.example.com"},
+		{Config{ExpectedBody: expectedBody}, "front.example.com:"},
+		{Config{ExpectedBody: expectedBody}, ":hidden.example.com"},
+	}
+	for _, tt := range tests {
+		err := newMeasurer(tt.config).measure(
+			context.Background(),
+			newsession(),
+			&model.Measurement{Input: tt.input},
+			handler.NewPrinterCallbacks(log.Log),
+		)
+		if err == nil {
+			t.Fatalf("expected an error with %+v", tt)
+		}
+	}
+}
+
+func TestUnitParseInput(t *testing.T) {
+	front, hidden, err := parseInput("127.0.0.1:8443:hidden.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if front != "127.0.0.1:8443" || hidden != "hidden.example.com" {
+		t.Fatalf("unexpected results: %s %s", front, hidden)
+	}
+}
+
+func TestUnitMeasureWithLocalServer(t *testing.T) {
+	server, caBundlePath := startServer(t)
+	defer server.Close()
+	defer os.Remove(caBundlePath)
+	front := strings.TrimPrefix(server.URL, "https://")
+	tk := measure(t, caBundlePath, front+":hidden.example.com")
+	if !tk.Success || tk.Failure != nil {
+		t.Fatalf("unexpected results: %+v", tk)
+	}
+	if tk.FrontDomain != front || tk.HiddenHost != "hidden.example.com" {
+		t.Fatalf("unexpected results: %+v", tk)
+	}
+	if len(tk.Requests) != 1 {
+		t.Fatal("unexpected number of requests")
+	}
+	tk = measure(t, caBundlePath, front+":other.example.com")
+	if tk.Success || tk.Failure != nil {
+		t.Fatalf("unexpected results: %+v", tk)
+	}
+}
+
+func TestUnitMeasureWithTLSFailure(t *testing.T) {
+	server, caBundlePath := startServer(t)
+	defer server.Close()
+	os.Remove(caBundlePath)
+	// Without the CA bundle the certificate cannot be verified
+	front := strings.TrimPrefix(server.URL, "https://")
+	tk := measure(t, "", front+":hidden.example.com")
+	if tk.Success || tk.Failure == nil {
+		t.Fatalf("unexpected results: %+v", tk)
+	}
+}
+
+func TestIntegrationMeasure(t *testing.T) {
+	tk := measure(t, "", "a0.awsstatic.com:d2cly7j4zqgua7.cloudfront.net")
+	if tk.Failure != nil {
+		t.Fatalf("unexpected results: %+v", tk)
+	}
+}
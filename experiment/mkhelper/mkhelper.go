@@ -3,8 +3,7 @@
 package mkhelper
 
 import (
-	"fmt"
-
+	"github.com/ooni/probe-engine/experiment/testhelper"
 	"github.com/ooni/probe-engine/measurementkit"
 	"github.com/ooni/probe-engine/session"
 )
@@ -14,19 +13,9 @@ func Set(
 	sess *session.Session, name, kind string,
 	settings *measurementkit.Settings,
 ) error {
-	ths, ok := sess.AvailableTestHelpers[name]
-	if !ok {
-		return fmt.Errorf("No available %s test helper", name)
-	}
-	address := ""
-	for _, th := range ths {
-		if th.Type == kind {
-			address = th.Address
-			break
-		}
-	}
-	if address == "" {
-		return fmt.Errorf("No suitable %s test helper", name)
+	address, err := testhelper.Get(sess, name, kind)
+	if err != nil {
+		return err
 	}
 	settings.Options.Backend = address
 	return nil
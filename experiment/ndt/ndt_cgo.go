@@ -1,3 +1,5 @@
+// +build cgo
+
 // Package ndt contains the ndt network experiment.
 package ndt
 
@@ -0,0 +1,221 @@
+// +build !cgo
+
+// Package ndt contains the ndt network experiment. This file
+// in particular is a pure-Go implementation of this test.
+//
+// Spec: https://github.com/ooni/spec/blob/master/nettests/ts-022-ndt.md
+package ndt
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/m-lab/ndt7-client-go/mlabns"
+	"github.com/ooni/probe-engine/experiment"
+	"github.com/ooni/probe-engine/experiment/handler"
+	"github.com/ooni/probe-engine/internal/ndt5"
+	"github.com/ooni/probe-engine/model"
+	"github.com/ooni/probe-engine/session"
+)
+
+const (
+	testName       = "ndt"
+	testVersion    = "0.2.0"
+	defaultTimeout = 60 * time.Second
+)
+
+// Config contains the experiment config.
+type Config struct {
+	Server string `ooni:"ndt5 server to use instead of asking mlab-ns"`
+}
+
+// Simple contains the summary of the results.
+type Simple struct {
+	Download float64 `json:"download"` // kbit/s
+	Ping     float64 `json:"ping"`     // millisecond
+	Upload   float64 `json:"upload"`   // kbit/s
+}
+
+// Advanced contains the advanced results, computed using the
+// web100 snapshot that the server sends us at the end of S2C.
+type Advanced struct {
+	AvgRTT            float64 `json:"avg_rtt"` // millisecond
+	CongestionLimited float64 `json:"congestion_limited"`
+	FastRetran        int64   `json:"fast_retran"`
+	MaxRTT            float64 `json:"max_rtt"` // millisecond
+	MinRTT            float64 `json:"min_rtt"` // millisecond
+	MSS               int64   `json:"mss"`
+	OutOfOrder        float64 `json:"out_of_order"`
+	PacketLoss        float64 `json:"packet_loss"`
+	ReceiverLimited   float64 `json:"receiver_limited"`
+	SenderLimited     float64 `json:"sender_limited"`
+	Timeouts          int64   `json:"timeouts"`
+}
+
+// TestKeys contains the test keys
+type TestKeys struct {
+	ndt5.Results
+	Advanced Advanced `json:"advanced"`
+	Failure  *string  `json:"failure"`
+	Protocol int64    `json:"protocol"`
+	Simple   Simple   `json:"simple"`
+
+	// PerformanceSummary is the summary shared by performance experiments
+	PerformanceSummary *model.PerformanceSummary `json:"performance_summary"`
+}
+
+func discover(ctx context.Context, sess *session.Session) (string, error) {
+	client := mlabns.NewClient("ndt", sess.UserAgent())
+	// See the comment in ndt7's discover for the rationale
+	client.HTTPClient = sess.HTTPDefaultClient
+	if sess.ExplicitProxy {
+		client.RequestMaker = func(
+			method, url string, body io.Reader,
+		) (*http.Request, error) {
+			req, err := http.NewRequest(method, url, body)
+			if err != nil {
+				return nil, err
+			}
+			values := req.URL.Query()
+			values.Set("ip", sess.ProbeIP())
+			req.URL.RawQuery = values.Encode()
+			return req, nil
+		}
+	}
+	return client.Query(ctx)
+}
+
+// analyze fills the simple, advanced and performance summary results.
+func (tk *TestKeys) analyze() {
+	if tk.C2S != nil {
+		tk.Simple.Upload = tk.C2S.ServerThroughput
+		if tk.Simple.Upload <= 0 {
+			tk.Simple.Upload = tk.C2S.ClientThroughput
+		}
+	}
+	var jitter float64
+	if tk.S2C != nil {
+		jitter = tk.analyzeS2C()
+	}
+	if tk.Simple.Ping <= 0 && tk.C2S != nil && len(tk.C2S.TCPInfo) > 0 {
+		jitter = tk.analyzeTCPInfo()
+	}
+	tk.PerformanceSummary = &model.PerformanceSummary{
+		Download: tk.Simple.Download * 1e03, // kbit/s to bit/s
+		Jitter:   jitter / 1e03,             // millisecond to second
+		Latency:  tk.Simple.Ping / 1e03,     // millisecond to second
+		Server:   tk.ServerAddress,
+		Upload:   tk.Simple.Upload * 1e03, // kbit/s to bit/s
+	}
+}
+
+// analyzeS2C fills the download speed and the advanced results using
+// the web100 snapshot. It returns the RTT variation in milliseconds,
+// which is zero if the server did not include it in the snapshot.
+func (tk *TestKeys) analyzeS2C() (jitter float64) {
+	tk.Simple.Download = tk.S2C.ClientThroughput
+	web100 := func(name string) float64 {
+		value, _ := strconv.ParseFloat(tk.S2C.Web100[name], 64)
+		return value
+	}
+	tk.Advanced.MinRTT = web100("MinRTT")
+	tk.Advanced.MaxRTT = web100("MaxRTT")
+	if count := web100("CountRTT"); count > 0 {
+		tk.Advanced.AvgRTT = web100("SumRTT") / count
+	}
+	tk.Advanced.MSS = int64(web100("CurMSS"))
+	tk.Advanced.FastRetran = int64(web100("FastRetran"))
+	tk.Advanced.Timeouts = int64(web100("Timeouts"))
+	if acks := web100("AckPktsIn"); acks > 0 {
+		tk.Advanced.OutOfOrder = web100("DupAcksIn") / acks
+	}
+	if pkts := web100("PktsOut"); pkts > 0 {
+		tk.Advanced.PacketLoss = web100("CongestionSignals") / pkts
+	}
+	cwnd, rwin := web100("SndLimTimeCwnd"), web100("SndLimTimeRwin")
+	sender := web100("SndLimTimeSnd")
+	if total := cwnd + rwin + sender; total > 0 {
+		tk.Advanced.CongestionLimited = cwnd / total
+		tk.Advanced.ReceiverLimited = rwin / total
+		tk.Advanced.SenderLimited = sender / total
+	}
+	tk.Simple.Ping = tk.Advanced.MinRTT
+	return web100("RTTVar")
+}
+
+// analyzeTCPInfo fills the ping using the client side TCP_INFO we have
+// collected during C2S, when we are the sender and hence the kernel RTT
+// estimates are meaningful. We use it when the server did not send us
+// the RTT in the web100 snapshot. It returns the RTT variation.
+func (tk *TestKeys) analyzeTCPInfo() (jitter float64) {
+	info := tk.C2S.TCPInfo[len(tk.C2S.TCPInfo)-1].TCPInfo
+	tk.Simple.Ping = float64(info.MinRTT) / 1e03 // microsecond to millisecond
+	return float64(info.RTTVar) / 1e03
+}
+
+type measurer struct {
+	config Config
+}
+
+func (m *measurer) measure(
+	ctx context.Context, sess *session.Session,
+	measurement *model.Measurement, callbacks handler.Callbacks,
+) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+	tk := &TestKeys{Protocol: 5}
+	measurement.TestKeys = tk
+	server := m.config.Server
+	if server == "" {
+		FQDN, err := discover(ctx, sess)
+		if err != nil {
+			s := err.Error()
+			tk.Failure = &s
+			return err
+		}
+		sess.Logger.Debugf("ndt: mlabns returned %s to us", FQDN)
+		server = FQDN
+	}
+	callbacks.OnProgress(0, fmt.Sprintf("server: %s", server))
+	client := &ndt5.Client{
+		Logger: sess.Logger,
+		OnProgress: func(test string, elapsed time.Duration, numBytes int64) {
+			// Upload goes from 0 to 50% and download from 50% to
+			// 100% of the experiment, hence the `/2.0`.
+			percentage := elapsed.Seconds() / ndt5.DefaultDuration.Seconds() / 2.0
+			if test == "download" {
+				percentage += 0.5
+			}
+			speed := float64(numBytes) * 8.0 / elapsed.Seconds()
+			callbacks.OnProgress(percentage, fmt.Sprintf(
+				"%s-speed %s", test, humanize.SI(speed, "bit/s"),
+			))
+		},
+		Server:          server,
+		SoftwareName:    sess.SoftwareName,
+		SoftwareVersion: sess.SoftwareVersion,
+	}
+	results, err := client.Run(ctx)
+	tk.Results = *results
+	if err != nil {
+		s := err.Error()
+		tk.Failure = &s
+		return err
+	}
+	tk.analyze()
+	callbacks.OnProgress(1, "done")
+	return nil
+}
+
+// NewExperiment creates a new experiment.
+func NewExperiment(
+	sess *session.Session, config Config,
+) *experiment.Experiment {
+	m := &measurer{config: config}
+	return experiment.New(sess, testName, testVersion, m.measure)
+}
@@ -0,0 +1,152 @@
+// +build !cgo
+
+package ndt
+
+import (
+	"context"
+	"testing"
+
+	"github.com/apex/log"
+	"github.com/m-lab/tcp-info/tcp"
+	"github.com/ooni/probe-engine/experiment/handler"
+	"github.com/ooni/probe-engine/internal/kvstore"
+	"github.com/ooni/probe-engine/internal/ndt5"
+	"github.com/ooni/probe-engine/model"
+	"github.com/ooni/probe-engine/session"
+)
+
+const (
+	softwareName    = "ooniprobe-example"
+	softwareVersion = "0.0.1"
+)
+
+func newsession() *session.Session {
+	return session.New(
+		log.Log, softwareName, softwareVersion,
+		"../../testdata", nil, nil, "../../testdata",
+		kvstore.NewMemoryKeyValueStore(),
+	)
+}
+
+func TestUnitNewExperiment(t *testing.T) {
+	experiment := NewExperiment(newsession(), Config{})
+	if experiment == nil {
+		t.Fatal("nil experiment returned")
+	}
+}
+
+func TestUnitMeasureWithConnectionRefused(t *testing.T) {
+	// Port 1 is reserved and most likely nobody is listening there
+	m := &measurer{config: Config{Server: "127.0.0.1:1"}}
+	measurement := new(model.Measurement)
+	err := m.measure(
+		context.Background(),
+		newsession(),
+		measurement,
+		handler.NewPrinterCallbacks(log.Log),
+	)
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	tk := measurement.TestKeys.(*TestKeys)
+	if tk.Failure == nil || *tk.Failure != err.Error() {
+		t.Fatal("failure not set or set incorrectly")
+	}
+	if tk.ServerAddress != "127.0.0.1:1" {
+		t.Fatal("server address not set")
+	}
+}
+
+func TestIntegrationMeasure(t *testing.T) {
+	ctx := context.Background()
+	sess := newsession()
+	if err := sess.MaybeLookupLocation(ctx); err != nil {
+		t.Fatal(err)
+	}
+	measurement := new(model.Measurement)
+	err := (&measurer{}).measure(
+		ctx, sess, measurement, handler.NewPrinterCallbacks(log.Log),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tk := measurement.TestKeys.(*TestKeys)
+	if tk.Simple.Download <= 0 || tk.Simple.Upload <= 0 {
+		t.Fatal("unexpected simple results")
+	}
+}
+
+func TestUnitAnalyze(t *testing.T) {
+	tk := &TestKeys{Results: ndt5.Results{
+		C2S: &ndt5.C2SResults{ClientThroughput: 900, ServerThroughput: 1000},
+		S2C: &ndt5.S2CResults{
+			ClientThroughput: 2000,
+			Web100: map[string]string{
+				"AckPktsIn":         "100",
+				"CongestionSignals": "2",
+				"CountRTT":          "4",
+				"CurMSS":            "1448",
+				"DupAcksIn":         "10",
+				"MaxRTT":            "30",
+				"MinRTT":            "10",
+				"PktsOut":           "200",
+				"RTTVar":            "5",
+				"SndLimTimeCwnd":    "25",
+				"SndLimTimeRwin":    "25",
+				"SndLimTimeSnd":     "50",
+				"SumRTT":            "80",
+			},
+		},
+	}}
+	tk.analyze()
+	if tk.Simple.Upload != 1000 || tk.Simple.Download != 2000 || tk.Simple.Ping != 10 {
+		t.Fatalf("unexpected simple results: %+v", tk.Simple)
+	}
+	advanced := tk.Advanced
+	if advanced.AvgRTT != 20 || advanced.MaxRTT != 30 || advanced.MSS != 1448 ||
+		advanced.OutOfOrder != 0.1 || advanced.PacketLoss != 0.01 ||
+		advanced.CongestionLimited != 0.25 || advanced.ReceiverLimited != 0.25 ||
+		advanced.SenderLimited != 0.5 {
+		t.Fatalf("unexpected advanced results: %+v", advanced)
+	}
+	ps := tk.PerformanceSummary
+	if ps == nil || ps.Download != 2e06 || ps.Upload != 1e06 ||
+		ps.Latency != 0.01 || ps.Jitter != 0.005 {
+		t.Fatalf("unexpected performance summary: %+v", ps)
+	}
+}
+
+func TestUnitAnalyzeWithClientTCPInfo(t *testing.T) {
+	tk := &TestKeys{Results: ndt5.Results{
+		C2S: &ndt5.C2SResults{
+			ClientThroughput: 900,
+			TCPInfo: []ndt5.TCPInfo{{
+				TCPInfo: &tcp.LinuxTCPInfo{MinRTT: 40000, RTTVar: 1000},
+			}, {
+				TCPInfo: &tcp.LinuxTCPInfo{MinRTT: 30000, RTTVar: 2000},
+			}},
+		},
+		S2C: &ndt5.S2CResults{ClientThroughput: 2000},
+	}}
+	tk.analyze()
+	if tk.Simple.Ping != 30 {
+		t.Fatalf("unexpected simple results: %+v", tk.Simple)
+	}
+	ps := tk.PerformanceSummary
+	if ps.Latency != 0.03 || ps.Jitter != 0.002 {
+		t.Fatalf("unexpected performance summary: %+v", ps)
+	}
+}
+
+func TestUnitAnalyzeWithMissingResults(t *testing.T) {
+	tk := &TestKeys{Results: ndt5.Results{
+		C2S: &ndt5.C2SResults{ClientThroughput: 900},
+	}}
+	tk.analyze()
+	if tk.Simple.Upload != 900 || tk.Simple.Download != 0 {
+		t.Fatalf("unexpected simple results: %+v", tk.Simple)
+	}
+	if tk.PerformanceSummary.Upload != 900e03 || tk.PerformanceSummary.Latency != 0 {
+		t.Fatalf("unexpected performance summary: %+v", tk.PerformanceSummary)
+	}
+}
@@ -3,10 +3,14 @@ package ndt7
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
+	"net/url"
+	"strings"
 
 	"github.com/dustin/go-humanize"
 
@@ -22,20 +26,41 @@ import (
 
 const (
 	testName    = "ndt7"
-	testVersion = "0.1.0"
+	testVersion = "0.2.0"
 )
 
 // Config contains the experiment settings
-type Config struct{}
+type Config struct {
+	InsecureSkipVerify bool   `ooni:"Skip TLS verification, e.g., when using a local server"`
+	Server             string `ooni:"ndt7 server FQDN[:port] or ws(s):// URL to use instead of asking mlab-ns"`
+}
+
+// Summary contains the performance summary computed from the results.
+type Summary struct {
+	AvgRTT         float64 `json:"avg_rtt"`         // millisecond
+	Download       float64 `json:"download"`        // Mbit/s
+	MinRTT         float64 `json:"min_rtt"`         // millisecond
+	RetransmitRate float64 `json:"retransmit_rate"` // fraction of bytes sent
+	Upload         float64 `json:"upload"`          // Mbit/s
+}
 
 // TestKeys contains the test keys
 type TestKeys struct {
 	// Failure is the failure string
 	Failure string `json:"failure"`
 
+	// PerformanceSummary is the summary shared by performance experiments
+	PerformanceSummary *model.PerformanceSummary `json:"performance_summary"`
+
 	// Download contains download results
 	Download []spec.Measurement `json:"download"`
 
+	// Server is the FQDN of the server we have used
+	Server string `json:"server"`
+
+	// Summary contains the performance summary
+	Summary Summary `json:"summary"`
+
 	// Upload contains upload results
 	Upload []spec.Measurement `json:"upload"`
 }
@@ -63,7 +88,91 @@ func discover(ctx context.Context, sess *session.Session) (string, error) {
 	return client.Query(ctx)
 }
 
-func measure(
+// speed returns the speed in Mbit/s according to the last
+// application level measurement performed by the client.
+func speed(measurements []spec.Measurement) (speed float64) {
+	for _, ev := range measurements {
+		if ev.AppInfo != nil && ev.Origin == "client" && ev.AppInfo.ElapsedTime > 0 {
+			// bit/microsecond is the same as Mbit/s
+			speed = float64(ev.AppInfo.NumBytes) * 8.0 / float64(ev.AppInfo.ElapsedTime)
+		}
+	}
+	return
+}
+
+// summarize computes the summary. We use the download TCPInfo samples
+// for computing the RTT and the retransmission rate, because during
+// the download the server is sending, hence they are meaningful.
+func (tk *TestKeys) summarize() {
+	tk.Summary.Download = speed(tk.Download)
+	tk.Summary.Upload = speed(tk.Upload)
+	var sumRTT, sumJitter, lastRTT float64
+	var countRTT int
+	for _, ev := range tk.Download {
+		if ev.TCPInfo == nil || ev.Origin != "server" {
+			continue
+		}
+		// TCPInfo RTTs are in microseconds
+		tk.Summary.MinRTT = float64(ev.TCPInfo.MinRTT) / 1e03
+		rtt := float64(ev.TCPInfo.RTT) / 1e03
+		if countRTT > 0 {
+			sumJitter += math.Abs(rtt - lastRTT)
+		}
+		lastRTT = rtt
+		sumRTT += rtt
+		countRTT++
+		if ev.TCPInfo.BytesSent > 0 {
+			tk.Summary.RetransmitRate = float64(
+				ev.TCPInfo.BytesRetrans) / float64(ev.TCPInfo.BytesSent)
+		}
+	}
+	if countRTT > 0 {
+		tk.Summary.AvgRTT = sumRTT / float64(countRTT)
+	}
+	// We estimate the jitter as the mean difference between
+	// consecutive RTT samples, as RFC3550 does for packets.
+	var jitter float64
+	if countRTT > 1 {
+		jitter = sumJitter / float64(countRTT-1)
+	}
+	tk.PerformanceSummary = &model.PerformanceSummary{
+		Download: tk.Summary.Download * 1e06,
+		Jitter:   jitter / 1e03,
+		Latency:  tk.Summary.MinRTT / 1e03,
+		Server:   tk.Server,
+		Upload:   tk.Summary.Upload * 1e06,
+	}
+}
+
+// parseServer parses the server configured by the user, which is either
+// a FQDN, optionally followed by a port, for which we use the wss scheme,
+// or a ws:// or wss:// URL. It returns the scheme and the host.
+func parseServer(server string) (string, string, error) {
+	if !strings.Contains(server, "://") {
+		return "wss", server, nil
+	}
+	URL, err := url.Parse(server)
+	if err != nil {
+		return "", "", err
+	}
+	if URL.Scheme != "ws" && URL.Scheme != "wss" {
+		return "", "", fmt.Errorf("ndt7: unsupported scheme: %s", URL.Scheme)
+	}
+	if URL.Host == "" {
+		return "", "", fmt.Errorf("ndt7: missing host in URL: %s", server)
+	}
+	return URL.Scheme, URL.Host, nil
+}
+
+type measurer struct {
+	config Config
+}
+
+func newMeasurer(config Config) *measurer {
+	return &measurer{config: config}
+}
+
+func (m *measurer) measure(
 	ctx context.Context, sess *session.Session, measurement *model.Measurement,
 	callbacks handler.Callbacks,
 ) error {
@@ -74,13 +183,30 @@ func measure(
 	if sess.TLSConfig != nil {
 		client.Dialer.TLSClientConfig = sess.TLSConfig
 	}
-	FQDN, err := discover(ctx, sess)
+	if m.config.InsecureSkipVerify {
+		config := new(tls.Config)
+		if sess.TLSConfig != nil {
+			config = sess.TLSConfig.Clone()
+		}
+		config.InsecureSkipVerify = true
+		client.Dialer.TLSClientConfig = config
+	}
+	scheme, FQDN, err := parseServer(m.config.Server)
 	if err != nil {
 		testkeys.Failure = err.Error()
 		return err
 	}
+	if FQDN == "" {
+		FQDN, err = discover(ctx, sess)
+		if err != nil {
+			testkeys.Failure = err.Error()
+			return err
+		}
+		sess.Logger.Debugf("ndt7: mlabns returned %s to us", FQDN)
+	}
 	client.FQDN = FQDN // skip client's own mlabns call
-	sess.Logger.Debugf("ndt7: mlabns returned %s to us", FQDN)
+	client.Scheme = scheme
+	testkeys.Server = FQDN
 	ch, err := client.StartDownload(ctx)
 	if err != nil {
 		testkeys.Failure = err.Error()
@@ -132,6 +258,8 @@ func measure(
 		}
 		sess.Logger.Debugf("%s", string(data))
 	}
+	testkeys.summarize()
+	sess.Logger.Debugf("ndt7: summary: %+v", testkeys.Summary)
 	callbacks.OnProgress(1, "done")
 	return nil
 }
@@ -140,5 +268,6 @@ func measure(
 func NewExperiment(
 	sess *session.Session, config Config,
 ) *experiment.Experiment {
-	return experiment.New(sess, testName, testVersion, measure)
+	return experiment.New(sess, testName, testVersion,
+		newMeasurer(config).measure)
 }
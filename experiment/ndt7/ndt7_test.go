@@ -1,12 +1,18 @@
-package ndt7_test
+package ndt7
 
 import (
 	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/apex/log"
-	"github.com/ooni/probe-engine/experiment/ndt7"
+	"github.com/m-lab/ndt7-client-go/spec"
+	"github.com/m-lab/tcp-info/tcp"
+	"github.com/ooni/probe-engine/experiment/handler"
 	"github.com/ooni/probe-engine/internal/kvstore"
+	"github.com/ooni/probe-engine/model"
 	"github.com/ooni/probe-engine/session"
 )
 
@@ -30,7 +36,7 @@ func TestIntegration(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	experiment := ndt7.NewExperiment(sess, ndt7.Config{})
+	experiment := NewExperiment(sess, Config{})
 	if err := experiment.OpenReport(ctx); err != nil {
 		t.Fatal(err)
 	}
@@ -44,3 +50,143 @@ func TestIntegration(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestUnitMeasureWithUnreachableServer(t *testing.T) {
+	sess := session.New(
+		log.Log, softwareName, softwareVersion, "../../testdata", nil, nil,
+		"../../testdata", kvstore.NewMemoryKeyValueStore(),
+	)
+	// Port 1 is reserved and most likely nobody is listening there
+	m := newMeasurer(Config{InsecureSkipVerify: true, Server: "127.0.0.1:1"})
+	measurement := new(model.Measurement)
+	err := m.measure(
+		context.Background(), sess, measurement,
+		handler.NewPrinterCallbacks(log.Log),
+	)
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	tk := measurement.TestKeys.(*TestKeys)
+	if tk.Failure != err.Error() || tk.Server != "127.0.0.1:1" {
+		t.Fatal("unexpected test keys")
+	}
+}
+
+func TestUnitMeasureWithWSServer(t *testing.T) {
+	// The server is not a websocket server, so the upgrade fails, but
+	// we can still check that the client used the plain ws scheme.
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			paths = append(paths, r.URL.Path)
+			w.WriteHeader(http.StatusBadRequest)
+		},
+	))
+	defer server.Close()
+	sess := session.New(
+		log.Log, softwareName, softwareVersion, "../../testdata", nil, nil,
+		"../../testdata", kvstore.NewMemoryKeyValueStore(),
+	)
+	host := strings.TrimPrefix(server.URL, "http://")
+	m := newMeasurer(Config{Server: "ws://" + host})
+	measurement := new(model.Measurement)
+	err := m.measure(
+		context.Background(), sess, measurement,
+		handler.NewPrinterCallbacks(log.Log),
+	)
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	tk := measurement.TestKeys.(*TestKeys)
+	if tk.Failure != err.Error() || tk.Server != host {
+		t.Fatal("unexpected test keys")
+	}
+	if len(paths) != 1 || paths[0] != "/ndt/v7/download" {
+		t.Fatalf("unexpected paths: %+v", paths)
+	}
+}
+
+func TestUnitMeasureWithInvalidServer(t *testing.T) {
+	sess := session.New(
+		log.Log, softwareName, softwareVersion, "../../testdata", nil, nil,
+		"../../testdata", kvstore.NewMemoryKeyValueStore(),
+	)
+	m := newMeasurer(Config{Server: "https://127.0.0.1:1"})
+	measurement := new(model.Measurement)
+	err := m.measure(
+		context.Background(), sess, measurement,
+		handler.NewPrinterCallbacks(log.Log),
+	)
+	if err == nil || err.Error() != "ndt7: unsupported scheme: https" {
+		t.Fatalf("not the error we expected: %+v", err)
+	}
+}
+
+func TestUnitParseServer(t *testing.T) {
+	var cases = []struct {
+		server string
+		scheme string
+		host   string
+		failed bool
+	}{
+		{server: "", scheme: "wss", host: ""},
+		{server: "ndt.example.com", scheme: "wss", host: "ndt.example.com"},
+		{server: "127.0.0.1:8080", scheme: "wss", host: "127.0.0.1:8080"},
+		{server: "ws://127.0.0.1:8080", scheme: "ws", host: "127.0.0.1:8080"},
+		{server: "wss://ndt.example.com/", scheme: "wss", host: "ndt.example.com"},
+		{server: "http://ndt.example.com", failed: true},
+		{server: "ws://", failed: true},
+		{server: "ws://[::1", failed: true},
+	}
+	for _, c := range cases {
+		scheme, host, err := parseServer(c.server)
+		if (err != nil) != c.failed {
+			t.Fatalf("%s: unexpected error: %+v", c.server, err)
+		}
+		if scheme != c.scheme || host != c.host {
+			t.Fatalf("%s: unexpected result: %s %s", c.server, scheme, host)
+		}
+	}
+}
+
+func TestUnitSummarize(t *testing.T) {
+	tk := &TestKeys{
+		Download: []spec.Measurement{{
+			AppInfo: &spec.AppInfo{ElapsedTime: 1e06, NumBytes: 1e06},
+			Origin:  "client",
+		}, {
+			Origin: "server",
+			TCPInfo: &spec.TCPInfo{LinuxTCPInfo: tcp.LinuxTCPInfo{
+				BytesRetrans: 100, BytesSent: 10000, MinRTT: 10000, RTT: 20000,
+			}},
+		}, {
+			AppInfo: &spec.AppInfo{ElapsedTime: 2e06, NumBytes: 4e06},
+			Origin:  "client",
+		}, {
+			Origin: "server",
+			TCPInfo: &spec.TCPInfo{LinuxTCPInfo: tcp.LinuxTCPInfo{
+				BytesRetrans: 200, BytesSent: 100000, MinRTT: 8000, RTT: 10000,
+			}},
+		}},
+		Server: "localhost",
+		Upload: []spec.Measurement{{
+			AppInfo: &spec.AppInfo{ElapsedTime: 1e06, NumBytes: 125000},
+			Origin:  "client",
+		}},
+	}
+	tk.summarize()
+	if tk.Summary.Download != 16 || tk.Summary.Upload != 1 {
+		t.Fatalf("unexpected speed: %+v", tk.Summary)
+	}
+	if tk.Summary.MinRTT != 8 || tk.Summary.AvgRTT != 15 {
+		t.Fatalf("unexpected RTT: %+v", tk.Summary)
+	}
+	if tk.Summary.RetransmitRate != 0.002 {
+		t.Fatalf("unexpected retransmit rate: %+v", tk.Summary)
+	}
+	ps := tk.PerformanceSummary
+	if ps == nil || ps.Download != 16e06 || ps.Upload != 1e06 ||
+		ps.Latency != 0.008 || ps.Jitter != 0.01 || ps.Server != "localhost" {
+		t.Fatalf("unexpected performance summary: %+v", ps)
+	}
+}
@@ -0,0 +1,309 @@
+// Package quichandshake contains the QUIC handshake network experiment.
+//
+// This is the QUIC equivalent of sni_blocking. We perform a QUIC handshake
+// with the control SNI and with the input SNI towards the same address. If
+// the control succeeds and the target does not, it's likely that there is
+// QUIC blocking based on the SNI. If also the control fails, the address
+// itself, or QUIC as a whole, is probably blocked.
+//
+// Because netx does not support QUIC, we cannot collect network events
+// here. We record instead the handshake timing, the negotiated protocols,
+// including the QUIC version, and the number of bytes sent and received
+// on the UDP socket.
+package quichandshake
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/ooni/probe-engine/experiment"
+	"github.com/ooni/probe-engine/experiment/handler"
+	"github.com/ooni/probe-engine/model"
+	"github.com/ooni/probe-engine/session"
+)
+
+const (
+	testName    = "quic_handshake"
+	testVersion = "0.1.0"
+
+	// quicVersion is the QUIC version we use, i.e. draft-24, which is
+	// the only version supported by the QUIC library we use.
+	quicVersion = quic.VersionNumber(0xff000018)
+)
+
+// Config contains the experiment config.
+type Config struct {
+	// ALPN is the ALPN to use for the handshake.
+	ALPN string `ooni:"ALPN to use for the handshake"`
+
+	// ControlSNI is the SNI to be used for the control.
+	ControlSNI string `ooni:"SNI to use for the control"`
+
+	// TestHelperAddress is the address of the test helper.
+	TestHelperAddress string `ooni:"address of the QUIC test helper"`
+}
+
+// Subresult contains the keys of a single measurement
+// that targets either the target or the control.
+type Subresult struct {
+	BytesReceived      int64   `json:"-"`
+	BytesSent          int64   `json:"-"`
+	Failure            *string `json:"failure"`
+	HandshakeTime      float64 `json:"handshake_time"` // seconds
+	NegotiatedProtocol string  `json:"negotiated_protocol"`
+	QUICVersion        string  `json:"quic_version"`
+	SNI                string  `json:"sni"`
+	THAddress          string  `json:"th_address"`
+	TLSVersion         string  `json:"tls_version"`
+
+	index int // position in the inputs
+}
+
+// TestKeys contains quichandshake test keys.
+type TestKeys struct {
+	Control Subresult `json:"control"`
+	Target  Subresult `json:"target"`
+}
+
+type measurer struct {
+	config Config
+}
+
+func newMeasurer(config Config) *measurer {
+	return &measurer{config: config}
+}
+
+// countingConn is a net.PacketConn that counts the bytes.
+type countingConn struct {
+	net.PacketConn
+	received int64
+	sent     int64
+}
+
+func (c *countingConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	count, addr, err := c.PacketConn.ReadFrom(b)
+	atomic.AddInt64(&c.received, int64(count))
+	return count, addr, err
+}
+
+func (c *countingConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	count, err := c.PacketConn.WriteTo(b, addr)
+	atomic.AddInt64(&c.sent, int64(count))
+	return count, err
+}
+
+// tlsVersions maps TLS versions to strings.
+var tlsVersions = map[uint16]string{
+	tls.VersionTLS10: "TLSv1",
+	tls.VersionTLS11: "TLSv1.1",
+	tls.VersionTLS12: "TLSv1.2",
+	tls.VersionTLS13: "TLSv1.3",
+}
+
+// classify maps timeouts to the failure string used by netx
+// and otherwise returns the original error string.
+func classify(ctx context.Context, err error) string {
+	var netErr net.Error
+	if ctx.Err() == context.DeadlineExceeded ||
+		(errors.As(err, &netErr) && netErr.Timeout()) {
+		return "generic_timeout_error"
+	}
+	return err.Error()
+}
+
+// handshake performs the QUIC handshake and fills smk.
+func handshake(
+	ctx context.Context, smk *Subresult, tlsConfig *tls.Config,
+) error {
+	remoteAddr, err := net.ResolveUDPAddr("udp", smk.THAddress)
+	if err != nil {
+		return err
+	}
+	pconn, err := net.ListenPacket("udp", "")
+	if err != nil {
+		return err
+	}
+	defer pconn.Close()
+	conn := &countingConn{PacketConn: pconn}
+	defer func() {
+		smk.BytesReceived = atomic.LoadInt64(&conn.received)
+		smk.BytesSent = atomic.LoadInt64(&conn.sent)
+	}()
+	// Because we only offer a single version, a successful handshake
+	// implies that this is the version we have used.
+	config := &quic.Config{Versions: []quic.VersionNumber{quicVersion}}
+	begin := time.Now()
+	sess, err := quic.DialContext(
+		ctx, conn, remoteAddr, smk.SNI, tlsConfig, config,
+	)
+	smk.HandshakeTime = time.Since(begin).Seconds()
+	if err != nil {
+		return err
+	}
+	defer sess.CloseWithError(0, "")
+	state := sess.ConnectionState()
+	smk.NegotiatedProtocol = state.NegotiatedProtocol
+	smk.QUICVersion = config.Versions[0].String()
+	smk.TLSVersion = tlsVersions[state.Version]
+	return nil
+}
+
+func measureone(
+	ctx context.Context,
+	output chan<- Subresult,
+	config *tls.Config,
+	index int,
+	sni string,
+	thaddr string,
+) {
+	// slightly delay the measurement
+	gen := rand.New(rand.NewSource(time.Now().UnixNano()))
+	sleeptime := time.Duration(gen.Intn(250)) * time.Millisecond
+	select {
+	case <-time.After(sleeptime):
+	case <-ctx.Done():
+		s := "generic_timeout_error"
+		output <- Subresult{
+			Failure: &s,
+			SNI:     sni,
+			index:   index,
+		}
+		return
+	}
+	// perform the measurement and publish the results
+	smk := Subresult{SNI: sni, THAddress: thaddr, index: index}
+	config = config.Clone()
+	config.ServerName = sni
+	if err := handshake(ctx, &smk, config); err != nil {
+		s := classify(ctx, err)
+		smk.Failure = &s
+	}
+	output <- smk
+}
+
+func (m *measurer) startall(
+	ctx context.Context, sess *session.Session, inputs []string,
+) <-chan Subresult {
+	config := &tls.Config{NextProtos: []string{m.config.ALPN}}
+	if sess.TLSConfig != nil {
+		config.RootCAs = sess.TLSConfig.RootCAs
+	}
+	outputs := make(chan Subresult, len(inputs))
+	for idx, input := range inputs {
+		go measureone(ctx, outputs, config, idx, input, m.config.TestHelperAddress)
+	}
+	return outputs
+}
+
+// processall collects the results. The first input is the control and
+// the second one is the target. We match results by position rather
+// than by SNI, because the input may be equal to the control SNI.
+func processall(
+	outputs <-chan Subresult,
+	callbacks handler.Callbacks,
+	inputs []string,
+	sess *session.Session,
+) (*TestKeys, error) {
+	var (
+		current       int
+		sentBytes     int64
+		receivedBytes int64
+		testkeys      = new(TestKeys)
+	)
+	for smk := range outputs {
+		switch smk.index {
+		case 0:
+			testkeys.Control = smk
+		case 1:
+			testkeys.Target = smk
+		default:
+			return nil, fmt.Errorf("quic_handshake: unexpected result index: %d", smk.index)
+		}
+		sentBytes += smk.BytesSent
+		receivedBytes += smk.BytesReceived
+		current++
+		sess.Logger.Infof("quic_handshake: %s: %s", smk.SNI, asString(smk.Failure))
+		if current >= len(inputs) {
+			break
+		}
+	}
+	callbacks.OnDataUsage(
+		float64(receivedBytes)/1024.0, // downloaded
+		float64(sentBytes)/1024.0,     // uploaded
+	)
+	return testkeys, nil
+}
+
+// maybeURLToSNI handles the case where the input is from the test-lists
+// and hence every input is a URL rather than a domain.
+func maybeURLToSNI(input string) (string, error) {
+	parsed, err := url.Parse(input)
+	if err != nil {
+		return "", err
+	}
+	if parsed.Path == input {
+		return input, nil
+	}
+	return parsed.Hostname(), nil
+}
+
+func (m *measurer) measure(
+	ctx context.Context,
+	sess *session.Session,
+	measurement *model.Measurement,
+	callbacks handler.Callbacks,
+) error {
+	if m.config.ControlSNI == "" {
+		return errors.New("Experiment requires ControlSNI")
+	}
+	if m.config.ALPN == "" {
+		return errors.New("Experiment requires ALPN")
+	}
+	if measurement.Input == "" {
+		return errors.New("Experiment requires measurement.Input")
+	}
+	if m.config.TestHelperAddress == "" {
+		m.config.TestHelperAddress = net.JoinHostPort(
+			m.config.ControlSNI, "443",
+		)
+	}
+	maybeParsed, err := maybeURLToSNI(measurement.Input)
+	if err != nil {
+		return err
+	}
+	measurement.Input = maybeParsed
+	inputs := []string{m.config.ControlSNI, measurement.Input}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second*time.Duration(len(inputs)))
+	defer cancel()
+	outputs := m.startall(ctx, sess, inputs)
+	testkeys, err := processall(outputs, callbacks, inputs, sess)
+	if err != nil {
+		return err
+	}
+	measurement.TestKeys = testkeys
+	return nil
+}
+
+// NewExperiment creates a new experiment.
+func NewExperiment(
+	sess *session.Session, config Config,
+) *experiment.Experiment {
+	return experiment.New(sess, testName, testVersion,
+		newMeasurer(config).measure)
+}
+
+func asString(failure *string) (result string) {
+	result = "success"
+	if failure != nil {
+		result = *failure
+	}
+	return
+}
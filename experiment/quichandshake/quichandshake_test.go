@@ -0,0 +1,225 @@
+package quichandshake
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/apex/log"
+	"github.com/lucas-clemente/quic-go"
+	"github.com/ooni/probe-engine/experiment/handler"
+	"github.com/ooni/probe-engine/internal/kvstore"
+	"github.com/ooni/probe-engine/model"
+	"github.com/ooni/probe-engine/session"
+)
+
+const (
+	softwareName    = "ooniprobe-example"
+	softwareVersion = "0.0.1"
+	alpn            = "h3-24"
+)
+
+func TestUnitNewExperiment(t *testing.T) {
+	experiment := NewExperiment(newsession(nil), Config{})
+	if experiment == nil {
+		t.Fatal("nil experiment returned")
+	}
+}
+
+func TestUnitMeasurerMeasureNoControlSNI(t *testing.T) {
+	measurer := newMeasurer(Config{ALPN: alpn})
+	err := measurer.measure(
+		context.Background(),
+		newsession(nil),
+		new(model.Measurement),
+		handler.NewPrinterCallbacks(log.Log),
+	)
+	if err.Error() != "Experiment requires ControlSNI" {
+		t.Fatal("not the error we expected")
+	}
+}
+
+func TestUnitMeasurerMeasureNoALPN(t *testing.T) {
+	measurer := newMeasurer(Config{ControlSNI: "example.com"})
+	err := measurer.measure(
+		context.Background(),
+		newsession(nil),
+		new(model.Measurement),
+		handler.NewPrinterCallbacks(log.Log),
+	)
+	if err.Error() != "Experiment requires ALPN" {
+		t.Fatal("not the error we expected")
+	}
+}
+
+func TestUnitMeasurerMeasureNoMeasurementInput(t *testing.T) {
+	measurer := newMeasurer(Config{ALPN: alpn, ControlSNI: "example.com"})
+	err := measurer.measure(
+		context.Background(),
+		newsession(nil),
+		new(model.Measurement),
+		handler.NewPrinterCallbacks(log.Log),
+	)
+	if err.Error() != "Experiment requires measurement.Input" {
+		t.Fatal("not the error we expected")
+	}
+}
+
+func TestUnitMeasurerMeasureWithLocalServer(t *testing.T) {
+	listener, pool := startServer(t)
+	defer listener.Close()
+	measurer := newMeasurer(Config{
+		ALPN:              alpn,
+		ControlSNI:        "example.com",
+		TestHelperAddress: listener.Addr().String(),
+	})
+	measurement := &model.Measurement{Input: "https://kernel.org/robots.txt"}
+	err := measurer.measure(
+		context.Background(),
+		newsession(&tls.Config{RootCAs: pool}),
+		measurement,
+		handler.NewPrinterCallbacks(log.Log),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if measurement.Input != "kernel.org" {
+		t.Fatal("input was not converted to SNI")
+	}
+	tk := measurement.TestKeys.(*TestKeys)
+	control := tk.Control
+	if control.Failure != nil || control.SNI != "example.com" {
+		t.Fatalf("unexpected control: %+v", control)
+	}
+	if control.NegotiatedProtocol != alpn || control.TLSVersion != "TLSv1.3" ||
+		control.QUICVersion != quicVersion.String() {
+		t.Fatalf("unexpected control: %+v", control)
+	}
+	if control.HandshakeTime <= 0 || control.BytesSent <= 0 || control.BytesReceived <= 0 {
+		t.Fatalf("unexpected control: %+v", control)
+	}
+	// The certificate of the local server is not valid for kernel.org,
+	// hence the handshake must fail, emulating SNI based blocking.
+	if tk.Target.Failure == nil || tk.Target.SNI != "kernel.org" {
+		t.Fatalf("unexpected target: %+v", tk.Target)
+	}
+	if tk.Target.QUICVersion != "" {
+		t.Fatalf("unexpected target: %+v", tk.Target)
+	}
+}
+
+func TestUnitMeasurerMeasureWithInputEqualToControlSNI(t *testing.T) {
+	listener, pool := startServer(t)
+	defer listener.Close()
+	measurer := newMeasurer(Config{
+		ALPN:              alpn,
+		ControlSNI:        "example.com",
+		TestHelperAddress: listener.Addr().String(),
+	})
+	measurement := &model.Measurement{Input: "example.com"}
+	err := measurer.measure(
+		context.Background(),
+		newsession(&tls.Config{RootCAs: pool}),
+		measurement,
+		handler.NewPrinterCallbacks(log.Log),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tk := measurement.TestKeys.(*TestKeys)
+	if tk.Control.Failure != nil || tk.Control.SNI != "example.com" {
+		t.Fatalf("unexpected control: %+v", tk.Control)
+	}
+	if tk.Target.Failure != nil || tk.Target.SNI != "example.com" {
+		t.Fatalf("unexpected target: %+v", tk.Target)
+	}
+}
+
+func TestUnitMeasureoneCancelledContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel() // immediately cancel the context
+	output := make(chan Subresult, 1)
+	measureone(ctx, output, &tls.Config{}, 1, "kernel.org", "example.com:443")
+	result := <-output
+	if result.Failure == nil || *result.Failure != "generic_timeout_error" {
+		t.Fatal("unexpected failure")
+	}
+	if result.SNI != "kernel.org" || result.index != 1 {
+		t.Fatal("unexpected SNI or index")
+	}
+}
+
+func TestUnitProcessallFailsIfInvalidIndex(t *testing.T) {
+	outputs := make(chan Subresult, 1)
+	go func() {
+		outputs <- Subresult{SNI: "antani.io", index: 2}
+	}()
+	testkeys, err := processall(
+		outputs,
+		handler.NewPrinterCallbacks(log.Log),
+		[]string{"example.com", "kernel.org"},
+		newsession(nil),
+	)
+	if err == nil || err.Error() != "quic_handshake: unexpected result index: 2" {
+		t.Fatal("not the error we expected")
+	}
+	if testkeys != nil {
+		t.Fatal("expected nil testkeys here")
+	}
+}
+
+func TestIntegrationMeasure(t *testing.T) {
+	measurer := newMeasurer(Config{
+		ALPN:       alpn,
+		ControlSNI: "www.google.com",
+	})
+	measurement := &model.Measurement{Input: "www.youtube.com"}
+	err := measurer.measure(
+		context.Background(),
+		newsession(nil),
+		measurement,
+		handler.NewPrinterCallbacks(log.Log),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tk := measurement.TestKeys.(*TestKeys)
+	if tk.Control.Failure != nil || tk.Target.Failure != nil {
+		t.Fatalf("unexpected results: %+v", tk)
+	}
+}
+
+// startServer starts a local QUIC server using the certificate
+// generated by httptest, which is valid for example.com, and returns
+// the listener and the pool containing its certificate.
+func startServer(t *testing.T) (quic.Listener, *x509.CertPool) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	config := server.TLS.Clone()
+	config.NextProtos = []string{alpn}
+	listener, err := quic.ListenAddr("127.0.0.1:0", config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			if _, err := listener.Accept(context.Background()); err != nil {
+				return
+			}
+		}
+	}()
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	return listener, pool
+}
+
+func newsession(tlsConfig *tls.Config) *session.Session {
+	return session.New(
+		log.Log, softwareName, softwareVersion,
+		"../../testdata", nil, tlsConfig, "../../testdata",
+		kvstore.NewMemoryKeyValueStore(),
+	)
+}
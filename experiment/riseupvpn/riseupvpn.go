@@ -0,0 +1,388 @@
+// Package riseupvpn contains the RiseupVPN network experiment.
+//
+// We fetch the provider.json of the provider and, using the information
+// therein, we fetch the provider CA and then the eip-service.json file,
+// which is served by the API using a certificate signed by such CA. If
+// any of these steps fails, we say the API is blocked. Otherwise, we
+// check whether we can reach all the OpenVPN gateways over TCP and
+// whether we can perform an obfs4 handshake with the obfs4 gateways.
+package riseupvpn
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ooni/probe-engine/experiment"
+	"github.com/ooni/probe-engine/experiment/handler"
+	"github.com/ooni/probe-engine/experiment/httpheader"
+	"github.com/ooni/probe-engine/internal/netxlogger"
+	"github.com/ooni/probe-engine/internal/oonidatamodel"
+	"github.com/ooni/probe-engine/internal/oonitemplates"
+	"github.com/ooni/probe-engine/model"
+	"github.com/ooni/probe-engine/session"
+)
+
+const (
+	testName    = "riseupvpn"
+	testVersion = "0.1.0"
+
+	// maxBodySize is the maximum size of the API responses.
+	maxBodySize = 1 << 20
+
+	// eipServicePath is the path of the eip-service.json file
+	// relative to the API URI contained in provider.json.
+	eipServicePath = "/3/config/eip-service.json"
+)
+
+// Failures specific to this experiment. The other failures are the
+// ones generated by netx when fetching resources using the API.
+const (
+	FailureInvalidCACert        = "riseupvpn_invalid_ca_cert"
+	FailureInvalidJSON          = "riseupvpn_invalid_json"
+	FailureUnexpectedStatusCode = "riseupvpn_unexpected_status_code"
+)
+
+// Config contains the experiment config.
+type Config struct {
+	ProviderURL string `ooni:"URL of the provider.json file"`
+}
+
+// GatewayConnection describes a gateway we could not connect to.
+type GatewayConnection struct {
+	IP            string `json:"ip"`
+	Port          string `json:"port"`
+	TransportType string `json:"transport_type"`
+}
+
+// TestKeys contains riseupvpn test keys.
+type TestKeys struct {
+	APIFailure      *string                         `json:"api_failure"`
+	APIStatus       string                          `json:"api_status"`
+	CACertStatus    bool                            `json:"ca_cert_status"`
+	FailingGateways []GatewayConnection             `json:"failing_gateways"`
+	NetworkEvents   oonidatamodel.NetworkEventsList `json:"network_events"`
+	Queries         oonidatamodel.DNSQueriesList    `json:"queries"`
+	Requests        oonidatamodel.RequestList       `json:"requests"`
+	TCPConnect      oonidatamodel.TCPConnectList    `json:"tcp_connect"`
+	TLSHandshakes   oonidatamodel.TLSHandshakesList `json:"tls_handshakes"`
+	TransportStatus map[string]string               `json:"transport_status"`
+
+	mu            sync.Mutex
+	receivedBytes int64
+	sentBytes     int64
+}
+
+// add adds the results of an operation to the test keys.
+func (tk *TestKeys) add(results oonitemplates.Results) {
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+	tk.NetworkEvents = append(tk.NetworkEvents, oonidatamodel.NewNetworkEventsList(results)...)
+	tk.Queries = append(tk.Queries, oonidatamodel.NewDNSQueriesList(results)...)
+	tk.Requests = append(tk.Requests, oonidatamodel.NewRequestList(results)...)
+	tk.TCPConnect = append(tk.TCPConnect, oonidatamodel.NewTCPConnectList(results)...)
+	tk.TLSHandshakes = append(tk.TLSHandshakes, oonidatamodel.NewTLSHandshakesList(results)...)
+	tk.receivedBytes += results.ReceivedBytes
+	tk.sentBytes += results.SentBytes
+}
+
+// apiFailed records that the API is blocked because of err.
+func (tk *TestKeys) apiFailed(err error) {
+	s := err.Error()
+	tk.APIFailure = &s
+	tk.APIStatus = "blocked"
+}
+
+// gatewayFailed records that we could not use a gateway.
+func (tk *TestKeys) gatewayFailed(gc GatewayConnection) {
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+	tk.FailingGateways = append(tk.FailingGateways, gc)
+	tk.TransportStatus[gc.TransportType] = "blocked"
+}
+
+// provider contains the fields of provider.json we care about.
+type provider struct {
+	APIURI    string `json:"api_uri"`
+	CACertURI string `json:"ca_cert_uri"`
+}
+
+// transport is a transport supported by a gateway.
+type transport struct {
+	Type      string            `json:"type"`
+	Protocols []string          `json:"protocols"`
+	Ports     []string          `json:"ports"`
+	Options   map[string]string `json:"options"`
+}
+
+// gateway is a gateway listed by eip-service.json.
+type gateway struct {
+	Capabilities struct {
+		Transport []transport `json:"transport"`
+	} `json:"capabilities"`
+	Host      string `json:"host"`
+	IPAddress string `json:"ip_address"`
+}
+
+// eipService contains the fields of eip-service.json we care about.
+type eipService struct {
+	Gateways []gateway `json:"gateways"`
+}
+
+// supports returns whether the transport supports protocol.
+func (t transport) supports(protocol string) bool {
+	for _, p := range t.Protocols {
+		if p == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// endpoint is an endpoint we want to connect to.
+type endpoint struct {
+	GatewayConnection
+	params map[string][]string
+}
+
+// endpoints returns the TCP endpoints of the openvpn and obfs4 gateways.
+func (es eipService) endpoints() (out []endpoint) {
+	for _, g := range es.Gateways {
+		for _, t := range g.Capabilities.Transport {
+			if (t.Type != "openvpn" && t.Type != "obfs4") || !t.supports("tcp") {
+				continue
+			}
+			for _, port := range t.Ports {
+				e := endpoint{GatewayConnection: GatewayConnection{
+					IP: g.IPAddress, Port: port, TransportType: t.Type,
+				}}
+				if t.Type == "obfs4" {
+					e.params = map[string][]string{
+						"cert":     []string{t.Options["cert"]},
+						"iat-mode": []string{t.Options["iatMode"]},
+					}
+				}
+				out = append(out, e)
+			}
+		}
+	}
+	return
+}
+
+type measurer struct {
+	config Config
+}
+
+func newMeasurer(config Config) *measurer {
+	return &measurer{config: config}
+}
+
+// get fetches URL, records the results in tk, and returns the body.
+func get(
+	ctx context.Context, sess *session.Session, measurement *model.Measurement,
+	tk *TestKeys, URL, caBundlePath string,
+) ([]byte, error) {
+	results := oonitemplates.HTTPDo(ctx, oonitemplates.HTTPDoConfig{
+		Accept:                  httpheader.RandomAccept(),
+		AcceptLanguage:          httpheader.RandomAcceptLanguage(),
+		Beginning:               measurement.MeasurementStartTimeSaved,
+		CABundlePath:            caBundlePath,
+		Handler:                 netxlogger.NewHandler(sess.Logger),
+		MaxResponseBodySnapSize: maxBodySize,
+		Method:                  "GET",
+		URL:                     URL,
+		UserAgent:               httpheader.RandomUserAgent(),
+	})
+	tk.add(results.TestKeys)
+	if results.Error != nil {
+		return nil, results.Error
+	}
+	if results.StatusCode != 200 {
+		sess.Logger.Warnf("riseupvpn: %s: status code: %d", URL, results.StatusCode)
+		return nil, errors.New(FailureUnexpectedStatusCode)
+	}
+	return results.BodySnap, nil
+}
+
+// checkCACert checks whether data contains a valid PEM certificate.
+func checkCACert(data []byte) error {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return errors.New(FailureInvalidCACert)
+	}
+	if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+		return errors.New(FailureInvalidCACert)
+	}
+	return nil
+}
+
+// unmarshal is like json.Unmarshal but returns FailureInvalidJSON.
+func unmarshal(sess *session.Session, data []byte, v interface{}) error {
+	if err := json.Unmarshal(data, v); err != nil {
+		sess.Logger.Warnf("riseupvpn: cannot parse JSON: %s", err.Error())
+		return errors.New(FailureInvalidJSON)
+	}
+	return nil
+}
+
+// writeCABundle writes the CA to a temporary file whose path is returned.
+func writeCABundle(dir string, data []byte) (string, error) {
+	filep, err := ioutil.TempFile(dir, "riseupvpn")
+	if err != nil {
+		return "", err
+	}
+	if _, err := filep.Write(data); err != nil {
+		filep.Close()
+		os.Remove(filep.Name())
+		return "", err
+	}
+	return filep.Name(), filep.Close()
+}
+
+// fetchEIPService uses the API to fetch eip-service.json.
+func fetchEIPService(
+	ctx context.Context, sess *session.Session,
+	measurement *model.Measurement, tk *TestKeys, providerURL string,
+) (*eipService, error) {
+	data, err := get(ctx, sess, measurement, tk, providerURL, "")
+	if err != nil {
+		return nil, err
+	}
+	var p provider
+	if err := unmarshal(sess, data, &p); err != nil {
+		return nil, err
+	}
+	data, err = get(ctx, sess, measurement, tk, p.CACertURI, "")
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCACert(data); err != nil {
+		return nil, err
+	}
+	tk.CACertStatus = true
+	caBundlePath, err := writeCABundle(sess.TempDir, data)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(caBundlePath)
+	URL := strings.TrimSuffix(p.APIURI, "/") + eipServicePath
+	data, err = get(ctx, sess, measurement, tk, URL, caBundlePath)
+	if err != nil {
+		return nil, err
+	}
+	var es eipService
+	if err := unmarshal(sess, data, &es); err != nil {
+		return nil, err
+	}
+	return &es, nil
+}
+
+// connect checks whether we can use the endpoint.
+func connect(
+	ctx context.Context, sess *session.Session,
+	measurement *model.Measurement, e endpoint,
+) (oonitemplates.Results, error) {
+	address := net.JoinHostPort(e.IP, e.Port)
+	if e.TransportType == "obfs4" {
+		r := oonitemplates.OBFS4Connect(ctx, oonitemplates.OBFS4ConnectConfig{
+			Address:      address,
+			Beginning:    measurement.MeasurementStartTimeSaved,
+			Handler:      netxlogger.NewHandler(sess.Logger),
+			Params:       e.params,
+			StateBaseDir: sess.TempDir,
+		})
+		return r.TestKeys, r.Error
+	}
+	r := oonitemplates.TCPConnect(ctx, oonitemplates.TCPConnectConfig{
+		Address:   address,
+		Beginning: measurement.MeasurementStartTimeSaved,
+		Handler:   netxlogger.NewHandler(sess.Logger),
+	})
+	return r.TestKeys, r.Error
+}
+
+func (m *measurer) measure(
+	ctx context.Context,
+	sess *session.Session,
+	measurement *model.Measurement,
+	callbacks handler.Callbacks,
+) error {
+	if m.config.ProviderURL == "" {
+		return errors.New("Experiment requires ProviderURL")
+	}
+	ctx, cancel := context.WithTimeout(ctx, 90*time.Second)
+	defer cancel()
+	tk := &TestKeys{
+		APIStatus:       "ok",
+		FailingGateways: []GatewayConnection{},
+		TransportStatus: make(map[string]string),
+	}
+	measurement.TestKeys = tk
+	defer func() {
+		callbacks.OnDataUsage(
+			float64(tk.receivedBytes)/1024.0, // downloaded
+			float64(tk.sentBytes)/1024.0,     // uploaded
+		)
+	}()
+	es, err := fetchEIPService(ctx, sess, measurement, tk, m.config.ProviderURL)
+	if err != nil {
+		tk.apiFailed(err)
+		callbacks.OnProgress(1.0, "riseupvpn: api: "+err.Error())
+		return nil
+	}
+	callbacks.OnProgress(0.25, "riseupvpn: api: success")
+	endpoints := es.endpoints()
+	for _, e := range endpoints {
+		tk.TransportStatus[e.TransportType] = "ok"
+	}
+	var (
+		completed int
+		waitgroup sync.WaitGroup
+	)
+	waitgroup.Add(len(endpoints))
+	for _, e := range endpoints {
+		go func(e endpoint) {
+			defer waitgroup.Done()
+			results, err := connect(ctx, sess, measurement, e)
+			tk.add(results)
+			if err != nil {
+				tk.gatewayFailed(e.GatewayConnection)
+			}
+			tk.mu.Lock()
+			completed++
+			progress := 0.25 + 0.75*float64(completed)/float64(len(endpoints))
+			tk.mu.Unlock()
+			callbacks.OnProgress(progress, fmt.Sprintf(
+				"riseupvpn: %s %s: %s", e.TransportType,
+				net.JoinHostPort(e.IP, e.Port), errString(err),
+			))
+		}(e)
+	}
+	waitgroup.Wait()
+	return nil
+}
+
+// NewExperiment creates a new experiment.
+func NewExperiment(
+	sess *session.Session, config Config,
+) *experiment.Experiment {
+	return experiment.New(sess, testName, testVersion,
+		newMeasurer(config).measure)
+}
+
+func errString(err error) (s string) {
+	s = "success"
+	if err != nil {
+		s = err.Error()
+	}
+	return
+}
@@ -0,0 +1,253 @@
+package riseupvpn
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/apex/log"
+	"github.com/ooni/probe-engine/experiment/handler"
+	"github.com/ooni/probe-engine/internal/kvstore"
+	"github.com/ooni/probe-engine/model"
+	"github.com/ooni/probe-engine/session"
+)
+
+const (
+	softwareName    = "ooniprobe-example"
+	softwareVersion = "0.0.1"
+)
+
+func newsession() *session.Session {
+	return session.New(
+		log.Log, softwareName, softwareVersion,
+		"../../testdata", nil, nil, "../../testdata",
+		kvstore.NewMemoryKeyValueStore(),
+	)
+}
+
+func measure(t *testing.T, providerURL string) *TestKeys {
+	measurement := new(model.Measurement)
+	err := newMeasurer(Config{ProviderURL: providerURL}).measure(
+		context.Background(),
+		newsession(),
+		measurement,
+		handler.NewPrinterCallbacks(log.Log),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return measurement.TestKeys.(*TestKeys)
+}
+
+// standIn emulates the provider API. The provider.json and the CA are
+// served over HTTP, while the API is served over HTTPS using a
+// certificate signed by the CA we serve, like the real provider.
+type standIn struct {
+	api      *httptest.Server
+	gateway  net.Listener
+	provider *httptest.Server
+}
+
+func (si *standIn) Close() {
+	si.api.Close()
+	si.gateway.Close()
+	si.provider.Close()
+}
+
+// startStandIn starts the stand-in. When caCert is nil we serve
+// the certificate used by the API server.
+func startStandIn(t *testing.T, caCert []byte) *standIn {
+	si := new(standIn)
+	var err error
+	si.gateway, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := si.gateway.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(si.gateway.Addr().String())
+	si.api = httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != eipServicePath {
+				w.WriteHeader(404)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"gateways": []interface{}{map[string]interface{}{
+					"capabilities": map[string]interface{}{
+						"transport": []interface{}{map[string]interface{}{
+							"type":      "openvpn",
+							"protocols": []string{"tcp", "udp"},
+							"ports":     []string{port},
+						}, map[string]interface{}{
+							"type":      "openvpn",
+							"protocols": []string{"udp"},
+							"ports":     []string{"1"}, // must be ignored
+						}, map[string]interface{}{
+							"type":      "obfs4",
+							"protocols": []string{"tcp"},
+							"ports":     []string{"1"}, // nobody listens here
+							"options": map[string]string{
+								"cert":    "antani",
+								"iatMode": "0",
+							},
+						}},
+					},
+					"host":       "gateway.example.com",
+					"ip_address": "127.0.0.1",
+				}},
+			})
+		},
+	))
+	if caCert == nil {
+		caCert = pem.EncodeToMemory(&pem.Block{
+			Type: "CERTIFICATE", Bytes: si.api.Certificate().Raw,
+		})
+	}
+	si.provider = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/provider.json":
+				json.NewEncoder(w).Encode(provider{
+					APIURI:    si.api.URL,
+					CACertURI: si.provider.URL + "/ca.crt",
+				})
+			case "/ca.crt":
+				w.Write(caCert)
+			default:
+				w.WriteHeader(404)
+			}
+		},
+	))
+	return si
+}
+
+func TestUnitNewExperiment(t *testing.T) {
+	experiment := NewExperiment(newsession(), Config{})
+	if experiment == nil {
+		t.Fatal("nil experiment returned")
+	}
+}
+
+func TestUnitMeasureWithoutProviderURL(t *testing.T) {
+	err := newMeasurer(Config{}).measure(
+		context.Background(),
+		newsession(),
+		new(model.Measurement),
+		handler.NewPrinterCallbacks(log.Log),
+	)
+	if err == nil || err.Error() != "Experiment requires ProviderURL" {
+		t.Fatal("not the error we expected")
+	}
+}
+
+func TestUnitMeasureWithLocalStandIn(t *testing.T) {
+	si := startStandIn(t, nil)
+	defer si.Close()
+	tk := measure(t, si.provider.URL+"/provider.json")
+	if tk.APIStatus != "ok" || tk.APIFailure != nil || !tk.CACertStatus {
+		t.Fatalf("unexpected API results: %+v", tk)
+	}
+	if len(tk.Requests) != 3 {
+		t.Fatalf("unexpected number of requests: %d", len(tk.Requests))
+	}
+	if tk.TransportStatus["openvpn"] != "ok" || tk.TransportStatus["obfs4"] != "blocked" {
+		t.Fatalf("unexpected transport status: %+v", tk.TransportStatus)
+	}
+	if len(tk.FailingGateways) != 1 {
+		t.Fatalf("unexpected failing gateways: %+v", tk.FailingGateways)
+	}
+	failing := tk.FailingGateways[0]
+	if failing.IP != "127.0.0.1" || failing.Port != "1" || failing.TransportType != "obfs4" {
+		t.Fatalf("unexpected failing gateway: %+v", failing)
+	}
+}
+
+func TestUnitMeasureWithInvalidCA(t *testing.T) {
+	si := startStandIn(t, []byte("antani"))
+	defer si.Close()
+	tk := measure(t, si.provider.URL+"/provider.json")
+	if tk.APIStatus != "blocked" || tk.APIFailure == nil ||
+		*tk.APIFailure != FailureInvalidCACert || tk.CACertStatus {
+		t.Fatalf("unexpected API results: %+v", tk)
+	}
+	if len(tk.TransportStatus) != 0 || len(tk.FailingGateways) != 0 {
+		t.Fatalf("unexpected gateway results: %+v", tk)
+	}
+}
+
+func TestUnitMeasureWithInvalidJSON(t *testing.T) {
+	si := startStandIn(t, nil)
+	defer si.Close()
+	tk := measure(t, si.provider.URL+"/ca.crt") // not JSON
+	if tk.APIStatus != "blocked" || tk.APIFailure == nil ||
+		*tk.APIFailure != FailureInvalidJSON {
+		t.Fatalf("unexpected API results: %+v", tk)
+	}
+}
+
+func TestUnitMeasureWithUnexpectedStatusCode(t *testing.T) {
+	si := startStandIn(t, nil)
+	defer si.Close()
+	tk := measure(t, si.provider.URL+"/nonexistent.json")
+	if tk.APIStatus != "blocked" || tk.APIFailure == nil ||
+		*tk.APIFailure != FailureUnexpectedStatusCode {
+		t.Fatalf("unexpected API results: %+v", tk)
+	}
+}
+
+func TestUnitMeasureWithProviderFailure(t *testing.T) {
+	tk := measure(t, "http://127.0.0.1:1/provider.json") // nobody listens here
+	if tk.APIStatus != "blocked" || tk.APIFailure == nil || tk.CACertStatus {
+		t.Fatalf("unexpected API results: %+v", tk)
+	}
+}
+
+func TestUnitEndpoints(t *testing.T) {
+	var es eipService
+	err := json.Unmarshal([]byte(`{"gateways": [{
+		"capabilities": {"transport": [
+			{"type": "openvpn", "protocols": ["tcp", "udp"], "ports": ["53", "443"]},
+			{"type": "obfs4", "protocols": ["tcp"], "ports": ["23042"],
+			 "options": {"cert": "xyz", "iatMode": "0"}},
+			{"type": "antani", "protocols": ["tcp"], "ports": ["80"]}
+		]},
+		"host": "a.example.com",
+		"ip_address": "10.0.0.1"
+	}]}`), &es)
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoints := es.endpoints()
+	if len(endpoints) != 3 {
+		t.Fatalf("unexpected endpoints: %+v", endpoints)
+	}
+	obfs4 := endpoints[2]
+	if obfs4.TransportType != "obfs4" || obfs4.Port != "23042" {
+		t.Fatalf("unexpected obfs4 endpoint: %+v", obfs4)
+	}
+	if obfs4.params["cert"][0] != "xyz" || obfs4.params["iat-mode"][0] != "0" {
+		t.Fatalf("unexpected obfs4 params: %+v", obfs4.params)
+	}
+}
+
+func TestIntegrationMeasure(t *testing.T) {
+	tk := measure(t, "https://riseup.net/provider.json")
+	if tk.APIStatus != "ok" || !tk.CACertStatus {
+		t.Fatalf("unexpected API results: %+v", tk)
+	}
+	if len(tk.TransportStatus) <= 0 {
+		t.Fatal("no gateways?!")
+	}
+}
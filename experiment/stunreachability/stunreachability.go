@@ -0,0 +1,406 @@
+// Package stunreachability contains the STUN reachability experiment.
+//
+// We send a STUN Binding Request (RFC5389) to the input endpoint
+// over UDP and, optionally, over TCP, and we check whether we get
+// back a valid Binding Response. The mapped address in the response
+// is our public address, which may differ from the geolocated probe
+// IP (e.g. with IPv6 or carrier-grade NAT). So, unless the privacy
+// settings allow us to include the probe IP, we redact its IP and we
+// only record whether it is equal to the probe IP.
+package stunreachability
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ooni/probe-engine/experiment"
+	"github.com/ooni/probe-engine/experiment/handler"
+	"github.com/ooni/probe-engine/internal/netxlogger"
+	"github.com/ooni/probe-engine/internal/oonidatamodel"
+	"github.com/ooni/probe-engine/internal/oonitemplates"
+	"github.com/ooni/probe-engine/model"
+	"github.com/ooni/probe-engine/session"
+)
+
+const (
+	testName    = "stun_reachability"
+	testVersion = "0.1.0"
+
+	// defaultPort is the default STUN port.
+	defaultPort = "3478"
+
+	// maxAttempts is the maximum number of requests we send over UDP.
+	maxAttempts = 3
+
+	// readTimeout is the timeout for reading each response.
+	readTimeout = 2 * time.Second
+)
+
+// Failures specific to this experiment. The other failures are the
+// ones generated by netx when connecting, reading or writing.
+const (
+	FailureErrorResponse     = "stun_error_response"
+	FailureMalformedResponse = "stun_malformed_response"
+	FailureNoMappedAddress   = "stun_no_mapped_address"
+)
+
+const (
+	stunHeaderSize        = 20
+	stunMagicCookie       = 0x2112A442
+	stunBindingRequest    = 0x0001
+	stunBindingSuccess    = 0x0101
+	stunBindingError      = 0x0111
+	stunMappedAddress     = 0x0001
+	stunXORMappedAddress  = 0x0020
+	stunAddressFamilyIPv4 = 0x01
+	stunAddressFamilyIPv6 = 0x02
+	stunMaxMessageSize    = 1 << 11
+)
+
+// Config contains the experiment config.
+type Config struct {
+	IncludeTCP bool `ooni:"also send the binding request over TCP"`
+}
+
+// TransportResult contains the results of sending the
+// binding request using a specific transport.
+type TransportResult struct {
+	Failure                *string `json:"failure"`
+	MappedAddress          *string `json:"mapped_address"`
+	MappedAddressIsProbeIP *bool   `json:"mapped_address_is_probe_ip"`
+	RTT                    float64 `json:"rtt"` // seconds
+	Transport              string  `json:"transport"`
+}
+
+// scrub compares the IP of the mapped address with probeIP and, unless
+// includeIP is true, replaces the IP of the mapped address with
+// [REDACTED], so that we never submit it, whatever its value.
+func (result *TransportResult) scrub(probeIP string, includeIP bool) {
+	if result.MappedAddress == nil {
+		return
+	}
+	host, port, err := net.SplitHostPort(*result.MappedAddress)
+	if err != nil {
+		host, port = *result.MappedAddress, "" // should not happen
+	}
+	ip := net.ParseIP(host)
+	isProbeIP := ip != nil && ip.Equal(net.ParseIP(probeIP))
+	result.MappedAddressIsProbeIP = &isProbeIP
+	if includeIP {
+		return
+	}
+	redacted := "[REDACTED]"
+	if port != "" {
+		redacted = net.JoinHostPort(redacted, port)
+	}
+	result.MappedAddress = &redacted
+}
+
+// TestKeys contains stun_reachability test keys.
+type TestKeys struct {
+	Endpoint      string                          `json:"endpoint"`
+	Failure       *string                         `json:"failure"`
+	NetworkEvents oonidatamodel.NetworkEventsList `json:"network_events"`
+	Queries       oonidatamodel.DNSQueriesList    `json:"queries"`
+	TCPConnect    oonidatamodel.TCPConnectList    `json:"tcp_connect"`
+	Transports    []TransportResult               `json:"transports"`
+}
+
+// newBindingRequest returns a binding request with a random
+// transaction ID, along with such transaction ID.
+func newBindingRequest() ([]byte, []byte, error) {
+	message := make([]byte, stunHeaderSize)
+	binary.BigEndian.PutUint16(message[0:2], stunBindingRequest)
+	binary.BigEndian.PutUint16(message[2:4], 0) // no attributes
+	binary.BigEndian.PutUint32(message[4:8], stunMagicCookie)
+	txid := message[8:stunHeaderSize]
+	if _, err := rand.Read(txid); err != nil {
+		return nil, nil, err
+	}
+	return message, txid, nil
+}
+
+// errWrongTransaction indicates that the response belongs to
+// another transaction. When using UDP we keep reading.
+var errWrongTransaction = errors.New("stun: wrong transaction ID")
+
+// parseBindingResponse parses a binding response and returns the mapped
+// address. We prefer XOR-MAPPED-ADDRESS as MAPPED-ADDRESS may have been
+// rewritten by NATs that inspect the packet content.
+func parseBindingResponse(message, txid []byte) (string, error) {
+	if len(message) < stunHeaderSize ||
+		binary.BigEndian.Uint32(message[4:8]) != stunMagicCookie {
+		return "", errors.New(FailureMalformedResponse)
+	}
+	if string(message[8:stunHeaderSize]) != string(txid) {
+		return "", errWrongTransaction
+	}
+	length := int(binary.BigEndian.Uint16(message[2:4]))
+	if len(message) != stunHeaderSize+length {
+		return "", errors.New(FailureMalformedResponse)
+	}
+	switch binary.BigEndian.Uint16(message[0:2]) {
+	case stunBindingSuccess:
+	case stunBindingError:
+		return "", errors.New(FailureErrorResponse)
+	default:
+		return "", errors.New(FailureMalformedResponse)
+	}
+	var mapped string
+	for attrs := message[stunHeaderSize:]; len(attrs) > 0; {
+		if len(attrs) < 4 {
+			return "", errors.New(FailureMalformedResponse)
+		}
+		kind := binary.BigEndian.Uint16(attrs[0:2])
+		size := int(binary.BigEndian.Uint16(attrs[2:4]))
+		padded := 4 + (size+3)&^3 // attributes are aligned to 32 bit
+		if len(attrs) < 4+size {
+			return "", errors.New(FailureMalformedResponse)
+		}
+		value := attrs[4 : 4+size]
+		switch kind {
+		case stunXORMappedAddress:
+			address, err := parseAddress(value, message[4:stunHeaderSize])
+			if err != nil {
+				return "", err
+			}
+			return address, nil
+		case stunMappedAddress:
+			address, err := parseAddress(value, nil)
+			if err != nil {
+				return "", err
+			}
+			mapped = address
+		}
+		if len(attrs) < padded {
+			break
+		}
+		attrs = attrs[padded:]
+	}
+	if mapped == "" {
+		return "", errors.New(FailureNoMappedAddress)
+	}
+	return mapped, nil
+}
+
+// parseAddress parses a (XOR-)MAPPED-ADDRESS attribute. When key is not
+// nil, the port and the address are XORed with it. The key is the magic
+// cookie followed by the transaction ID, as mandated by RFC5389.
+func parseAddress(value, key []byte) (string, error) {
+	if len(value) < 4 {
+		return "", errors.New(FailureMalformedResponse)
+	}
+	var size int
+	switch value[1] {
+	case stunAddressFamilyIPv4:
+		size = net.IPv4len
+	case stunAddressFamilyIPv6:
+		size = net.IPv6len
+	default:
+		return "", errors.New(FailureMalformedResponse)
+	}
+	if len(value) != 4+size {
+		return "", errors.New(FailureMalformedResponse)
+	}
+	port := append([]byte{}, value[2:4]...)
+	ip := append(net.IP{}, value[4:]...)
+	for i := 0; key != nil && i < len(port); i++ {
+		port[i] ^= key[i]
+	}
+	for i := 0; key != nil && i < len(ip); i++ {
+		ip[i] ^= key[i]
+	}
+	return net.JoinHostPort(
+		ip.String(), fmt.Sprintf("%d", binary.BigEndian.Uint16(port)),
+	), nil
+}
+
+// bindingUDP performs the binding request over UDP, where we need
+// to retransmit the request if we don't receive a response.
+func bindingUDP(conn net.Conn, result *TransportResult) error {
+	request, txid, err := newBindingRequest()
+	if err != nil {
+		return err
+	}
+	buffer := make([]byte, stunMaxMessageSize)
+	for attempt := 0; ; attempt++ {
+		begin := time.Now()
+		if _, err := conn.Write(request); err != nil {
+			return err
+		}
+		conn.SetReadDeadline(begin.Add(readTimeout))
+		for {
+			count, err := conn.Read(buffer)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() && attempt+1 < maxAttempts {
+					break // retransmit
+				}
+				return err
+			}
+			address, err := parseBindingResponse(buffer[:count], txid)
+			if err == errWrongTransaction {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			result.RTT = time.Since(begin).Seconds()
+			result.MappedAddress = &address
+			return nil
+		}
+	}
+}
+
+// bindingTCP performs the binding request over TCP.
+func bindingTCP(conn net.Conn, result *TransportResult) error {
+	request, txid, err := newBindingRequest()
+	if err != nil {
+		return err
+	}
+	begin := time.Now()
+	conn.SetDeadline(begin.Add(readTimeout))
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+	// STUN messages are self delimiting so we read the header
+	// first and then as many bytes as indicated therein.
+	response := make([]byte, stunHeaderSize)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return err
+	}
+	length := int(binary.BigEndian.Uint16(response[2:4]))
+	if length > stunMaxMessageSize {
+		return errors.New(FailureMalformedResponse)
+	}
+	response = append(response, make([]byte, length)...)
+	if _, err := io.ReadFull(conn, response[stunHeaderSize:]); err != nil {
+		return err
+	}
+	address, err := parseBindingResponse(response, txid)
+	if err != nil {
+		return err
+	}
+	result.RTT = time.Since(begin).Seconds()
+	result.MappedAddress = &address
+	return nil
+}
+
+// parseInput returns the host:port endpoint from the input, which
+// may also be a stun:// URL, and may lack the port.
+func parseInput(input string) (string, error) {
+	if strings.HasPrefix(input, "stun://") || strings.HasPrefix(input, "stun:") {
+		parsed, err := url.Parse(input)
+		if err != nil {
+			return "", err
+		}
+		input = parsed.Host
+		if input == "" {
+			input = parsed.Opaque // e.g. stun:stun.l.google.com:19302
+		}
+	}
+	if input == "" {
+		return "", errors.New("Experiment requires measurement.Input")
+	}
+	if _, _, err := net.SplitHostPort(input); err != nil {
+		return net.JoinHostPort(input, defaultPort), nil
+	}
+	return input, nil
+}
+
+type measurer struct {
+	config Config
+}
+
+func newMeasurer(config Config) *measurer {
+	return &measurer{config: config}
+}
+
+func (m *measurer) measure(
+	ctx context.Context,
+	sess *session.Session,
+	measurement *model.Measurement,
+	callbacks handler.Callbacks,
+) error {
+	endpoint, err := parseInput(measurement.Input)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	tk := &TestKeys{Endpoint: endpoint}
+	measurement.TestKeys = tk
+	transports := []string{"udp"}
+	if m.config.IncludeTCP {
+		transports = append(transports, "tcp")
+	}
+	var receivedBytes, sentBytes int64
+	for idx, transport := range transports {
+		result := TransportResult{Transport: transport}
+		binding := bindingUDP
+		if transport == "tcp" {
+			binding = bindingTCP
+		}
+		results := oonitemplates.ConnectAndDo(ctx, oonitemplates.ConnectAndDoConfig{
+			Address:   endpoint,
+			Beginning: measurement.MeasurementStartTimeSaved,
+			Do: func(conn net.Conn) error {
+				return binding(conn, &result)
+			},
+			Handler: netxlogger.NewHandler(sess.Logger),
+			Network: transport,
+		})
+		if results.Error != nil {
+			s := results.Error.Error()
+			result.Failure = &s
+		}
+		result.scrub(sess.ProbeIP(), sess.PrivacySettings.IncludeIP)
+		tk.NetworkEvents = append(
+			tk.NetworkEvents, oonidatamodel.NewNetworkEventsList(results.TestKeys)...,
+		)
+		tk.Queries = append(
+			tk.Queries, oonidatamodel.NewDNSQueriesList(results.TestKeys)...,
+		)
+		if transport == "tcp" {
+			tk.TCPConnect = append(
+				tk.TCPConnect, oonidatamodel.NewTCPConnectList(results.TestKeys)...,
+			)
+		}
+		tk.Transports = append(tk.Transports, result)
+		receivedBytes += results.TestKeys.ReceivedBytes
+		sentBytes += results.TestKeys.SentBytes
+		callbacks.OnProgress(float64(idx+1)/float64(len(transports)), fmt.Sprintf(
+			"stun_reachability: %s: %s", transport, asString(result.Failure),
+		))
+	}
+	tk.Failure = tk.Transports[0].Failure
+	callbacks.OnDataUsage(
+		float64(receivedBytes)/1024.0, // downloaded
+		float64(sentBytes)/1024.0,     // uploaded
+	)
+	return nil
+}
+
+// NewExperiment creates a new experiment.
+func NewExperiment(
+	sess *session.Session, config Config,
+) *experiment.Experiment {
+	return experiment.New(sess, testName, testVersion,
+		newMeasurer(config).measure)
+}
+
+func asString(failure *string) (result string) {
+	result = "success"
+	if failure != nil {
+		result = *failure
+	}
+	return
+}
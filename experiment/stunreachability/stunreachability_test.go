@@ -0,0 +1,307 @@
+package stunreachability
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/apex/log"
+	"github.com/ooni/probe-engine/experiment/handler"
+	"github.com/ooni/probe-engine/internal/kvstore"
+	"github.com/ooni/probe-engine/model"
+	"github.com/ooni/probe-engine/session"
+)
+
+const (
+	softwareName    = "ooniprobe-example"
+	softwareVersion = "0.0.1"
+)
+
+func newsession() *session.Session {
+	return session.New(
+		log.Log, softwareName, softwareVersion,
+		"../../testdata", nil, nil, "../../testdata",
+		kvstore.NewMemoryKeyValueStore(),
+	)
+}
+
+// measure measures input allowing the probe IP to be included, so
+// that we can check the mapped address we have received.
+func measure(t *testing.T, config Config, input string) *model.Measurement {
+	measurement := &model.Measurement{Input: input}
+	sess := newsession()
+	sess.PrivacySettings.IncludeIP = true
+	err := newMeasurer(config).measure(
+		context.Background(),
+		sess,
+		measurement,
+		handler.NewPrinterCallbacks(log.Log),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return measurement
+}
+
+// newResponse returns the response to request. We use a MAPPED-ADDRESS
+// attribute containing a bogus address followed by the XOR-MAPPED-ADDRESS
+// containing the real address, to check we prefer the latter.
+func newResponse(request []byte, kind uint16, address *net.UDPAddr) []byte {
+	response := make([]byte, stunHeaderSize)
+	binary.BigEndian.PutUint16(response[0:2], kind)
+	copy(response[4:], request[4:stunHeaderSize])
+	ip, port := address.IP.To4(), make([]byte, 2)
+	binary.BigEndian.PutUint16(port, uint16(address.Port))
+	response = append(response, 0, stunMappedAddress, 0, 8, 0, stunAddressFamilyIPv4)
+	response = append(response, 0, 1, 10, 0, 0, 1)
+	response = append(response, 0, stunXORMappedAddress, 0, 8, 0, stunAddressFamilyIPv4)
+	for i := 0; i < len(port); i++ {
+		response = append(response, port[i]^request[4+i])
+	}
+	for i := 0; i < len(ip); i++ {
+		response = append(response, ip[i]^request[4+i])
+	}
+	binary.BigEndian.PutUint16(response[2:4], uint16(len(response)-stunHeaderSize))
+	return response
+}
+
+// startUDPServer starts a local STUN server over UDP.
+func startUDPServer(t *testing.T, kind uint16) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buffer := make([]byte, stunMaxMessageSize)
+		for {
+			count, address, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			if count < stunHeaderSize {
+				continue
+			}
+			conn.WriteTo(newResponse(buffer[:count], kind, address.(*net.UDPAddr)), address)
+		}
+	}()
+	return conn
+}
+
+// startTCPServer starts a local STUN server over TCP.
+func startTCPServer(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			request := make([]byte, stunHeaderSize)
+			if _, err := io.ReadFull(conn, request); err == nil {
+				tcpAddr := conn.RemoteAddr().(*net.TCPAddr)
+				conn.Write(newResponse(request, stunBindingSuccess, &net.UDPAddr{
+					IP: tcpAddr.IP, Port: tcpAddr.Port,
+				}))
+			}
+			conn.Close()
+		}
+	}()
+	return listener
+}
+
+func TestUnitNewExperiment(t *testing.T) {
+	experiment := NewExperiment(newsession(), Config{})
+	if experiment == nil {
+		t.Fatal("nil experiment returned")
+	}
+}
+
+func TestUnitMeasureWithoutInput(t *testing.T) {
+	err := newMeasurer(Config{}).measure(
+		context.Background(),
+		newsession(),
+		&model.Measurement{},
+		handler.NewPrinterCallbacks(log.Log),
+	)
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+}
+
+func TestUnitParseInput(t *testing.T) {
+	var tests = []struct {
+		input    string
+		endpoint string
+	}{
+		{"stun.example.com", "stun.example.com:3478"},
+		{"stun.example.com:19302", "stun.example.com:19302"},
+		{"stun:stun.example.com:19302", "stun.example.com:19302"},
+		{"stun://stun.example.com", "stun.example.com:3478"},
+		{"1.1.1.1", "1.1.1.1:3478"},
+	}
+	for _, tt := range tests {
+		endpoint, err := parseInput(tt.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if endpoint != tt.endpoint {
+			t.Fatalf("expected %s, got %s", tt.endpoint, endpoint)
+		}
+	}
+}
+
+func TestUnitMeasureWithLocalServers(t *testing.T) {
+	conn := startUDPServer(t, stunBindingSuccess)
+	defer conn.Close()
+	_, port, _ := net.SplitHostPort(conn.LocalAddr().String())
+	listener := startTCPServer(t)
+	defer listener.Close()
+	measurement := measure(t, Config{}, "127.0.0.1:"+port)
+	tk := measurement.TestKeys.(*TestKeys)
+	if tk.Failure != nil || len(tk.Transports) != 1 {
+		t.Fatalf("unexpected results: %+v", tk)
+	}
+	result := tk.Transports[0]
+	if result.Transport != "udp" || result.MappedAddress == nil {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	if !strings.HasPrefix(*result.MappedAddress, "127.0.0.1:") {
+		t.Fatalf("unexpected mapped address: %s", *result.MappedAddress)
+	}
+	if result.RTT <= 0 || len(tk.NetworkEvents) <= 0 {
+		t.Fatalf("unexpected result: %+v", tk)
+	}
+	measurement = measure(t, Config{IncludeTCP: true}, listener.Addr().String())
+	tk = measurement.TestKeys.(*TestKeys)
+	if len(tk.Transports) != 2 || tk.Failure == nil {
+		t.Fatalf("unexpected results: %+v", tk) // nobody is listening on UDP
+	}
+	result = tk.Transports[1]
+	if result.Transport != "tcp" || result.Failure != nil || result.MappedAddress == nil {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	if len(tk.TCPConnect) != 1 {
+		t.Fatalf("unexpected tcp_connect: %+v", tk.TCPConnect)
+	}
+}
+
+func TestUnitMeasureWithErrorResponse(t *testing.T) {
+	conn := startUDPServer(t, stunBindingError)
+	defer conn.Close()
+	tk := measure(t, Config{}, conn.LocalAddr().String()).TestKeys.(*TestKeys)
+	if tk.Failure == nil || *tk.Failure != FailureErrorResponse {
+		t.Fatalf("unexpected results: %+v", tk)
+	}
+}
+
+func TestUnitMappedAddressIsScrubbed(t *testing.T) {
+	conn := startUDPServer(t, stunBindingSuccess)
+	defer conn.Close()
+	measurement := &model.Measurement{Input: conn.LocalAddr().String()}
+	err := newMeasurer(Config{}).measure(
+		context.Background(),
+		newsession(),
+		measurement,
+		handler.NewPrinterCallbacks(log.Log),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := measurement.TestKeys.(*TestKeys).Transports[0]
+	if result.MappedAddressIsProbeIP == nil || !*result.MappedAddressIsProbeIP {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	// The server runs on the loopback, so we only check the transports,
+	// because the endpoint and the network events contain its address.
+	data, err := json.Marshal(measurement.TestKeys.(*TestKeys).Transports)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "127.0.0.1") {
+		t.Fatalf("mapped IP not scrubbed: %s", string(data))
+	}
+	if !strings.Contains(string(data), `"mapped_address":"[REDACTED]:`) {
+		t.Fatalf("mapped address not found: %s", string(data))
+	}
+}
+
+func TestUnitScrub(t *testing.T) {
+	var tests = []struct {
+		address   string
+		includeIP bool
+		expect    string
+		isProbeIP bool
+	}{
+		{"[2001:db8::1]:1234", false, "[REDACTED]:1234", false},
+		{"100.64.1.1:1234", false, "[REDACTED]:1234", false},
+		{"93.184.216.34:1234", false, "[REDACTED]:1234", true},
+		{"100.64.1.1:1234", true, "100.64.1.1:1234", false},
+	}
+	for _, tt := range tests {
+		address := tt.address
+		result := TransportResult{MappedAddress: &address}
+		result.scrub("93.184.216.34", tt.includeIP)
+		if *result.MappedAddress != tt.expect {
+			t.Fatalf("%s: unexpected mapped address: %s", tt.address, *result.MappedAddress)
+		}
+		if result.MappedAddressIsProbeIP == nil || *result.MappedAddressIsProbeIP != tt.isProbeIP {
+			t.Fatalf("%s: unexpected mapped_address_is_probe_ip", tt.address)
+		}
+	}
+	result := TransportResult{}
+	result.scrub("93.184.216.34", false)
+	if result.MappedAddress != nil || result.MappedAddressIsProbeIP != nil {
+		t.Fatal("expected nil fields without a mapped address")
+	}
+}
+
+func TestUnitParseBindingResponse(t *testing.T) {
+	request, txid, err := newBindingRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 5678}
+	valid := newResponse(request, stunBindingSuccess, address)
+	mappedOnly := append([]byte{}, valid[:stunHeaderSize+12]...)
+	binary.BigEndian.PutUint16(mappedOnly[2:4], 12)
+	noAddress := append([]byte{}, valid[:stunHeaderSize]...)
+	binary.BigEndian.PutUint16(noAddress[2:4], 0)
+	var tests = []struct {
+		message []byte
+		txid    []byte
+		address string
+		err     string
+	}{
+		{valid, txid, "1.2.3.4:5678", ""},
+		{mappedOnly, txid, "10.0.0.1:1", ""},
+		{noAddress, txid, "", FailureNoMappedAddress},
+		{valid[:stunHeaderSize-1], txid, "", FailureMalformedResponse},
+		{valid[:len(valid)-1], txid, "", FailureMalformedResponse},
+		{valid, make([]byte, len(txid)), "", errWrongTransaction.Error()},
+		{newResponse(request, stunBindingError, address), txid, "", FailureErrorResponse},
+		{newResponse(request, stunBindingRequest, address), txid, "", FailureMalformedResponse},
+	}
+	for _, tt := range tests {
+		address, err := parseBindingResponse(tt.message, tt.txid)
+		if (err == nil && tt.err != "") || (err != nil && err.Error() != tt.err) {
+			t.Fatalf("expected %s, got %+v", tt.err, err)
+		}
+		if address != tt.address {
+			t.Fatalf("expected %s, got %s", tt.address, address)
+		}
+	}
+}
+
+func TestIntegrationMeasure(t *testing.T) {
+	tk := measure(t, Config{}, "stun.l.google.com:19302").TestKeys.(*TestKeys)
+	if tk.Failure != nil || len(tk.Queries) <= 0 {
+		t.Fatalf("unexpected results: %+v", tk)
+	}
+}
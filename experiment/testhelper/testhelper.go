@@ -0,0 +1,24 @@
+// Package testhelper contains code to select the test helper to be
+// used by an experiment among the ones available to the session.
+package testhelper
+
+import (
+	"fmt"
+
+	"github.com/ooni/probe-engine/session"
+)
+
+// Get returns the address of the first available test helper called
+// name whose type is kind, or an error if there is no such helper.
+func Get(sess *session.Session, name, kind string) (string, error) {
+	ths, ok := sess.AvailableTestHelpers[name]
+	if !ok {
+		return "", fmt.Errorf("No available %s test helper", name)
+	}
+	for _, th := range ths {
+		if th.Type == kind && th.Address != "" {
+			return th.Address, nil
+		}
+	}
+	return "", fmt.Errorf("No suitable %s test helper", name)
+}
@@ -0,0 +1,50 @@
+package testhelper
+
+import (
+	"testing"
+
+	"github.com/apex/log"
+	"github.com/ooni/probe-engine/internal/kvstore"
+	"github.com/ooni/probe-engine/model"
+	"github.com/ooni/probe-engine/session"
+)
+
+func newsession() *session.Session {
+	sess := session.New(
+		log.Log, "ooniprobe-engine", "0.1.0", "../../testdata", nil, nil,
+		"../../testdata", kvstore.NewMemoryKeyValueStore(),
+	)
+	sess.AvailableTestHelpers = map[string][]model.Service{
+		"foobar": []model.Service{
+			model.Service{
+				Address: "mascetti",
+				Type:    "melandri",
+			},
+		},
+	}
+	return sess
+}
+
+func TestUnitGetNoHelpers(t *testing.T) {
+	_, err := Get(newsession(), "antani", "https")
+	if err == nil || err.Error() != "No available antani test helper" {
+		t.Fatal("not the error we expected")
+	}
+}
+
+func TestUnitGetNoSuitableHelper(t *testing.T) {
+	_, err := Get(newsession(), "foobar", "https")
+	if err == nil || err.Error() != "No suitable foobar test helper" {
+		t.Fatal("not the error we expected")
+	}
+}
+
+func TestUnitGetGoodHelper(t *testing.T) {
+	address, err := Get(newsession(), "foobar", "melandri")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if address != "mascetti" {
+		t.Fatal("unexpected address")
+	}
+}
@@ -0,0 +1,340 @@
+// Package tlsmiddlebox contains the TLS middlebox network experiment.
+//
+// We TLS-connect to well-known targets without verifying certificates,
+// so that we always collect the peer certificate chain, even when a
+// middlebox is intercepting the connection and presenting its own chain.
+// Then we validate the collected chain against the bundled CA, we check
+// whether the issuer of the leaf certificate is a trusted CA and, if
+// configured, we check the chain against the target's SPKI pins. A chain
+// that does not validate, whose issuer has been substituted, or that does
+// not match the pins indicates interception.
+package tlsmiddlebox
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/ooni/probe-engine/experiment"
+	"github.com/ooni/probe-engine/experiment/handler"
+	"github.com/ooni/probe-engine/internal/netxlogger"
+	"github.com/ooni/probe-engine/internal/oonidatamodel"
+	"github.com/ooni/probe-engine/internal/oonitemplates"
+	"github.com/ooni/probe-engine/model"
+	"github.com/ooni/probe-engine/session"
+)
+
+const (
+	testName    = "tls_middlebox"
+	testVersion = "0.1.0"
+
+	// timeout is the timeout of each TLS connect.
+	timeout = 10 * time.Second
+)
+
+// Config contains the experiment config.
+type Config struct {
+	// Pins maps domains to the base64 encoded SHA256 of the
+	// SubjectPublicKeyInfo of certificates we expect to see. The format
+	// is `domain=pin1|pin2,domain2=pin3`. When a domain has pins, its
+	// chain must contain at least one certificate matching a pin.
+	Pins string `ooni:"comma separated list of domain=pin1|pin2 base64 SHA256 SPKI pins"`
+
+	// Targets contains the targets to connect to.
+	Targets string `ooni:"comma separated list of domain[:port] to connect to"`
+}
+
+// TargetResult contains the results of measuring a target.
+type TargetResult struct {
+	Address           string                          `json:"address"`
+	ChainValid        bool                            `json:"chain_valid"`
+	Failure           *string                         `json:"failure"`
+	Interception      *bool                           `json:"interception"`
+	Issuer            string                          `json:"issuer"`
+	IssuerSubstituted *bool                           `json:"issuer_substituted"`
+	NetworkEvents     oonidatamodel.NetworkEventsList `json:"network_events"`
+	PinMatched        *bool                           `json:"pin_matched"`
+	Queries           oonidatamodel.DNSQueriesList    `json:"queries"`
+	SNI               string                          `json:"sni"`
+	TCPConnect        oonidatamodel.TCPConnectList    `json:"tcp_connect"`
+	TLSHandshakes     oonidatamodel.TLSHandshakesList `json:"tls_handshakes"`
+	ValidationFailure *string                         `json:"validation_failure"`
+}
+
+// TestKeys contains tls_middlebox test keys.
+type TestKeys struct {
+	Interception bool           `json:"interception"`
+	Targets      []TargetResult `json:"targets"`
+}
+
+// validationFailure maps certificate validation errors to the
+// failure strings used by netx for TLS handshake errors.
+func validationFailure(err error) string {
+	switch err.(type) {
+	case x509.UnknownAuthorityError:
+		return "ssl_unknown_authority"
+	case x509.HostnameError:
+		return "ssl_invalid_hostname"
+	case x509.CertificateInvalidError:
+		return "ssl_invalid_certificate"
+	}
+	return err.Error()
+}
+
+// spkiPin returns the SPKI pin of cert.
+func spkiPin(cert *x509.Certificate) string {
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(digest[:])
+}
+
+// issuerSubstituted returns whether the issuer of the leaf certificate
+// is not a trusted CA. To tell this case apart from other validation
+// failures, we build the chain ignoring the hostname and the validity
+// period and we compare the leaf's issuer with the subject of the
+// certificate that signed it in the chain we have built.
+func issuerSubstituted(chain []*x509.Certificate, roots *x509.CertPool) bool {
+	leaf := chain[0]
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	now := time.Now()
+	if now.After(leaf.NotAfter) {
+		now = leaf.NotAfter
+	}
+	if now.Before(leaf.NotBefore) {
+		now = leaf.NotBefore
+	}
+	verified, err := leaf.Verify(x509.VerifyOptions{
+		CurrentTime:   now,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		Roots:         roots,
+	})
+	if err != nil {
+		_, unknown := err.(x509.UnknownAuthorityError)
+		return unknown
+	}
+	for _, verifiedChain := range verified {
+		signer := verifiedChain[0] // the leaf is also the root when self-signed
+		if len(verifiedChain) > 1 {
+			signer = verifiedChain[1]
+		}
+		if bytes.Equal(leaf.RawIssuer, signer.RawSubject) {
+			return false
+		}
+	}
+	return true
+}
+
+// analyze validates the peer certificates we have collected during the
+// handshake and fills the fields describing the interception.
+func (tr *TargetResult) analyze(roots *x509.CertPool, pins map[string]bool) {
+	var chain []*x509.Certificate
+	if len(tr.TLSHandshakes) > 0 {
+		for _, entry := range tr.TLSHandshakes[0].PeerCertificates {
+			cert, err := x509.ParseCertificate([]byte(entry.Value))
+			if err != nil {
+				s := "ssl_invalid_certificate"
+				tr.ValidationFailure = &s
+				break
+			}
+			chain = append(chain, cert)
+		}
+	}
+	if tr.ValidationFailure == nil && len(chain) <= 0 {
+		s := "ssl_no_peer_certificates"
+		tr.ValidationFailure = &s
+	}
+	if tr.ValidationFailure == nil {
+		tr.Issuer = chain[0].Issuer.String()
+		intermediates := x509.NewCertPool()
+		for _, cert := range chain[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := chain[0].Verify(x509.VerifyOptions{
+			DNSName:       tr.SNI,
+			Intermediates: intermediates,
+			Roots:         roots,
+		})
+		if err != nil {
+			s := validationFailure(err)
+			tr.ValidationFailure = &s
+		}
+		tr.ChainValid = err == nil
+		substituted := issuerSubstituted(chain, roots)
+		tr.IssuerSubstituted = &substituted
+	}
+	if len(pins) > 0 {
+		matched := false
+		for _, cert := range chain {
+			matched = matched || pins[spkiPin(cert)]
+		}
+		tr.PinMatched = &matched
+	}
+	interception := !tr.ChainValid ||
+		(tr.IssuerSubstituted != nil && *tr.IssuerSubstituted) ||
+		(tr.PinMatched != nil && !*tr.PinMatched)
+	tr.Interception = &interception
+}
+
+// parseTargets returns the address and the SNI of each target.
+func parseTargets(targets string) ([][2]string, error) {
+	var out [][2]string
+	for _, target := range strings.Split(targets, ",") {
+		target = strings.TrimSpace(target)
+		host, _, err := net.SplitHostPort(target)
+		if err != nil {
+			host, target = target, net.JoinHostPort(target, "443")
+		}
+		if host == "" {
+			return nil, fmt.Errorf("tls_middlebox: invalid target: '%s'", target)
+		}
+		out = append(out, [2]string{target, host})
+	}
+	return out, nil
+}
+
+// parsePins parses the comma separated list of domain=pin1|pin2
+// entries and returns the set of pins of each domain.
+func parsePins(pins string) (map[string]map[string]bool, error) {
+	out := make(map[string]map[string]bool)
+	for _, entry := range strings.Split(pins, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		v := strings.SplitN(entry, "=", 2)
+		if len(v) != 2 || v[0] == "" {
+			return nil, fmt.Errorf("tls_middlebox: invalid pins entry: '%s'", entry)
+		}
+		if out[v[0]] == nil {
+			out[v[0]] = make(map[string]bool)
+		}
+		for _, pin := range strings.Split(v[1], "|") {
+			data, err := base64.StdEncoding.DecodeString(pin)
+			if err != nil || len(data) != sha256.Size {
+				return nil, fmt.Errorf("tls_middlebox: invalid pin: '%s'", pin)
+			}
+			out[v[0]][pin] = true
+		}
+	}
+	return out, nil
+}
+
+// loadRoots loads the bundled CA.
+func loadRoots(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(data) {
+		return nil, errors.New("tls_middlebox: cannot load CA bundle")
+	}
+	return roots, nil
+}
+
+type measurer struct {
+	config Config
+}
+
+func newMeasurer(config Config) *measurer {
+	return &measurer{config: config}
+}
+
+// measureone connects to address using sni and returns the results.
+func measureone(
+	ctx context.Context, sess *session.Session,
+	measurement *model.Measurement, address, sni string,
+) (TargetResult, oonitemplates.Results) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	results := oonitemplates.TLSConnect(ctx, oonitemplates.TLSConnectConfig{
+		Address:            address,
+		Beginning:          measurement.MeasurementStartTimeSaved,
+		Handler:            netxlogger.NewHandler(sess.Logger),
+		InsecureSkipVerify: true, // we verify later
+		SNI:                sni,
+	})
+	tr := TargetResult{
+		Address:       address,
+		NetworkEvents: oonidatamodel.NewNetworkEventsList(results.TestKeys),
+		Queries:       oonidatamodel.NewDNSQueriesList(results.TestKeys),
+		SNI:           sni,
+		TCPConnect:    oonidatamodel.NewTCPConnectList(results.TestKeys),
+		TLSHandshakes: oonidatamodel.NewTLSHandshakesList(results.TestKeys),
+	}
+	if results.Error != nil {
+		s := results.Error.Error()
+		tr.Failure = &s
+	}
+	return tr, results.TestKeys
+}
+
+func (m *measurer) measure(
+	ctx context.Context,
+	sess *session.Session,
+	measurement *model.Measurement,
+	callbacks handler.Callbacks,
+) error {
+	if m.config.Targets == "" {
+		return errors.New("Experiment requires Targets")
+	}
+	targets, err := parseTargets(m.config.Targets)
+	if err != nil {
+		return err
+	}
+	pins, err := parsePins(m.config.Pins)
+	if err != nil {
+		return err
+	}
+	roots, err := loadRoots(sess.CABundlePath())
+	if err != nil {
+		return err
+	}
+	tk := new(TestKeys)
+	measurement.TestKeys = tk
+	var receivedBytes, sentBytes int64
+	for idx, target := range targets {
+		tr, results := measureone(ctx, sess, measurement, target[0], target[1])
+		if tr.Failure == nil {
+			tr.analyze(roots, pins[tr.SNI])
+			tk.Interception = tk.Interception || *tr.Interception
+		}
+		tk.Targets = append(tk.Targets, tr)
+		receivedBytes += results.ReceivedBytes
+		sentBytes += results.SentBytes
+		callbacks.OnProgress(float64(idx+1)/float64(len(targets)), fmt.Sprintf(
+			"tls_middlebox: %s: %s", target[0], summary(tr),
+		))
+	}
+	callbacks.OnDataUsage(
+		float64(receivedBytes)/1024.0, // downloaded
+		float64(sentBytes)/1024.0,     // uploaded
+	)
+	return nil
+}
+
+// NewExperiment creates a new experiment.
+func NewExperiment(
+	sess *session.Session, config Config,
+) *experiment.Experiment {
+	return experiment.New(sess, testName, testVersion,
+		newMeasurer(config).measure)
+}
+
+func summary(tr TargetResult) string {
+	if tr.Failure != nil {
+		return *tr.Failure
+	}
+	return fmt.Sprintf("interception: %+v", *tr.Interception)
+}
@@ -0,0 +1,311 @@
+package tlsmiddlebox
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/ooni/probe-engine/experiment/handler"
+	"github.com/ooni/probe-engine/internal/kvstore"
+	"github.com/ooni/probe-engine/model"
+	"github.com/ooni/probe-engine/session"
+)
+
+const (
+	softwareName    = "ooniprobe-example"
+	softwareVersion = "0.0.1"
+)
+
+func newsession(assetsDir string) *session.Session {
+	return session.New(
+		log.Log, softwareName, softwareVersion,
+		assetsDir, nil, nil, "../../testdata",
+		kvstore.NewMemoryKeyValueStore(),
+	)
+}
+
+// newAssetsDir creates an assets dir whose CA bundle contains cert.
+func newAssetsDir(t *testing.T, cert *x509.Certificate) string {
+	dir, err := ioutil.TempDir("", "tlsmiddlebox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	err = ioutil.WriteFile(filepath.Join(dir, "ca-bundle.pem"), data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// startMiddlebox starts a TLS server emulating a middlebox that
+// presents a self-signed certificate for all the domains.
+func startMiddlebox(t *testing.T) *httptest.Server {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{Organization: []string{"Middlebox Inc."}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	data, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.NotFoundHandler())
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{{
+		Certificate: [][]byte{data},
+		PrivateKey:  key,
+	}}}
+	server.StartTLS()
+	return server
+}
+
+func measure(t *testing.T, assetsDir string, config Config) *TestKeys {
+	measurement := new(model.Measurement)
+	err := newMeasurer(config).measure(
+		context.Background(),
+		newsession(assetsDir),
+		measurement,
+		handler.NewPrinterCallbacks(log.Log),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return measurement.TestKeys.(*TestKeys)
+}
+
+func TestUnitNewExperiment(t *testing.T) {
+	experiment := NewExperiment(newsession("../../testdata"), Config{})
+	if experiment == nil {
+		t.Fatal("nil experiment returned")
+	}
+}
+
+func TestUnitMeasureWithInvalidConfig(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	assetsDir := newAssetsDir(t, server.Certificate())
+	defer os.RemoveAll(assetsDir)
+	var tests = []struct {
+		assetsDir string
+		config    Config
+	}{
+		{assetsDir, Config{}},
+		{assetsDir, Config{Targets: "example.com,"}},
+		{assetsDir, Config{Targets: "example.com", Pins: "antani"}},
+		{assetsDir, Config{Targets: "example.com", Pins: "=YW50YW5p"}},
+		{assetsDir, Config{Targets: "example.com", Pins: "example.com=YW50YW5p"}},
+		{"../../testdata/nonexistent", Config{Targets: "example.com"}},
+	}
+	for _, tt := range tests {
+		err := newMeasurer(tt.config).measure(
+			context.Background(),
+			newsession(tt.assetsDir),
+			new(model.Measurement),
+			handler.NewPrinterCallbacks(log.Log),
+		)
+		if err == nil {
+			t.Fatalf("expected an error with %+v", tt)
+		}
+	}
+}
+
+func TestUnitParseTargets(t *testing.T) {
+	targets, err := parseTargets("example.com, 127.0.0.1:8443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 2 {
+		t.Fatalf("unexpected targets: %+v", targets)
+	}
+	if targets[0] != [2]string{"example.com:443", "example.com"} {
+		t.Fatalf("unexpected target: %+v", targets[0])
+	}
+	if targets[1] != [2]string{"127.0.0.1:8443", "127.0.0.1"} {
+		t.Fatalf("unexpected target: %+v", targets[1])
+	}
+}
+
+func TestUnitParsePins(t *testing.T) {
+	const (
+		pin1 = "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="
+		pin2 = "LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ="
+	)
+	pins, err := parsePins("example.com=" + pin1 + "|" + pin2 + ", example.org=" + pin1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pins) != 2 || len(pins["example.com"]) != 2 || len(pins["example.org"]) != 1 {
+		t.Fatalf("unexpected pins: %+v", pins)
+	}
+	if !pins["example.com"][pin2] || pins["example.org"][pin2] {
+		t.Fatalf("unexpected pins: %+v", pins)
+	}
+}
+
+func TestUnitMeasureWithoutInterception(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	assetsDir := newAssetsDir(t, server.Certificate())
+	defer os.RemoveAll(assetsDir)
+	tk := measure(t, assetsDir, Config{
+		Pins:    "127.0.0.1=" + spkiPin(server.Certificate()),
+		Targets: server.Listener.Addr().String(),
+	})
+	if tk.Interception || len(tk.Targets) != 1 {
+		t.Fatalf("unexpected results: %+v", tk)
+	}
+	tr := tk.Targets[0]
+	if tr.Failure != nil || !tr.ChainValid || tr.ValidationFailure != nil {
+		t.Fatalf("unexpected result: %+v", tr)
+	}
+	if tr.PinMatched == nil || !*tr.PinMatched {
+		t.Fatal("the pin should have matched")
+	}
+	if tr.IssuerSubstituted == nil || *tr.IssuerSubstituted {
+		t.Fatal("the issuer should not have been substituted")
+	}
+	if tr.Interception == nil || *tr.Interception {
+		t.Fatal("unexpected interception")
+	}
+	if len(tr.TLSHandshakes) != 1 || len(tr.TLSHandshakes[0].PeerCertificates) <= 0 {
+		t.Fatal("the peer certificates were not collected")
+	}
+}
+
+func TestUnitMeasureWithWrongPin(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	assetsDir := newAssetsDir(t, server.Certificate())
+	defer os.RemoveAll(assetsDir)
+	tk := measure(t, assetsDir, Config{
+		Pins:    "127.0.0.1=47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=",
+		Targets: server.Listener.Addr().String(),
+	})
+	tr := tk.Targets[0]
+	if !tk.Interception || !tr.ChainValid || tr.PinMatched == nil || *tr.PinMatched {
+		t.Fatalf("unexpected results: %+v", tk)
+	}
+}
+
+func TestUnitMeasureWithPinsForAnotherDomain(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	assetsDir := newAssetsDir(t, server.Certificate())
+	defer os.RemoveAll(assetsDir)
+	tk := measure(t, assetsDir, Config{
+		Pins:    "example.com=47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=",
+		Targets: server.Listener.Addr().String(),
+	})
+	tr := tk.Targets[0]
+	if tk.Interception || !tr.ChainValid || tr.PinMatched != nil {
+		t.Fatalf("unexpected results: %+v", tk)
+	}
+}
+
+func TestUnitMeasureWithInvalidHostname(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	assetsDir := newAssetsDir(t, server.Certificate())
+	defer os.RemoveAll(assetsDir)
+	_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The certificate is not valid for localhost but it is signed by
+	// a trusted CA, hence the issuer has not been substituted.
+	tk := measure(t, assetsDir, Config{Targets: net.JoinHostPort("localhost", port)})
+	tr := tk.Targets[0]
+	if tr.Failure != nil || tr.ChainValid || !tk.Interception {
+		t.Fatalf("unexpected results: %+v", tk)
+	}
+	if tr.ValidationFailure == nil || *tr.ValidationFailure != "ssl_invalid_hostname" {
+		t.Fatal("not the validation failure we expected")
+	}
+	if tr.IssuerSubstituted == nil || *tr.IssuerSubstituted {
+		t.Fatal("the issuer should not have been substituted")
+	}
+}
+
+func TestUnitMeasureWithMiddlebox(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	assetsDir := newAssetsDir(t, server.Certificate())
+	defer os.RemoveAll(assetsDir)
+	middlebox := startMiddlebox(t)
+	defer middlebox.Close()
+	tk := measure(t, assetsDir, Config{Targets: middlebox.Listener.Addr().String()})
+	if !tk.Interception || len(tk.Targets) != 1 {
+		t.Fatalf("unexpected results: %+v", tk)
+	}
+	tr := tk.Targets[0]
+	if tr.Failure != nil || tr.ChainValid || tr.PinMatched != nil {
+		t.Fatalf("unexpected result: %+v", tr)
+	}
+	if tr.ValidationFailure == nil || *tr.ValidationFailure != "ssl_unknown_authority" {
+		t.Fatal("not the validation failure we expected")
+	}
+	if !strings.Contains(tr.Issuer, "Middlebox Inc.") {
+		t.Fatalf("unexpected issuer: %s", tr.Issuer)
+	}
+	if tr.IssuerSubstituted == nil || !*tr.IssuerSubstituted {
+		t.Fatal("the issuer should have been substituted")
+	}
+}
+
+func TestUnitMeasureWithConnectionFailure(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	assetsDir := newAssetsDir(t, server.Certificate())
+	defer os.RemoveAll(assetsDir)
+	tk := measure(t, assetsDir, Config{Targets: "127.0.0.1:1"}) // nobody listens here
+	tr := tk.Targets[0]
+	if tk.Interception || tr.Failure == nil || tr.Interception != nil {
+		t.Fatalf("unexpected results: %+v", tk)
+	}
+}
+
+func TestIntegrationMeasure(t *testing.T) {
+	ctx := context.Background()
+	sess := newsession("../../testdata")
+	if err := sess.MaybeLookupLocation(ctx); err != nil {
+		t.Fatal(err)
+	}
+	measurement := new(model.Measurement)
+	err := newMeasurer(Config{Targets: "www.google.com,www.example.com"}).measure(
+		ctx, sess, measurement, handler.NewPrinterCallbacks(log.Log),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tk := measurement.TestKeys.(*TestKeys)
+	if tk.Interception {
+		t.Fatalf("unexpected results: %+v", tk)
+	}
+}
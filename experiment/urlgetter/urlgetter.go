@@ -0,0 +1,261 @@
+// Package urlgetter contains the urlgetter network experiment.
+//
+// This experiment exposes the templates in oonitemplates through
+// the experiment options, so that we can perform one-off measurements
+// without writing a new experiment every time. The input is a URL
+// whose scheme selects the template we use:
+//
+// - http:// and https:// perform a HTTP request;
+//
+// - tlshandshake://host:port performs a TLS handshake;
+//
+// - tcpconnect://host:port performs a TCP connect;
+//
+// - dnslookup://domain performs a DNS lookup.
+package urlgetter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/ooni/probe-engine/experiment"
+	"github.com/ooni/probe-engine/experiment/handler"
+	"github.com/ooni/probe-engine/experiment/httpheader"
+	"github.com/ooni/probe-engine/internal/netxlogger"
+	"github.com/ooni/probe-engine/internal/oonidatamodel"
+	"github.com/ooni/probe-engine/internal/oonitemplates"
+	"github.com/ooni/probe-engine/model"
+	"github.com/ooni/probe-engine/session"
+)
+
+const (
+	testName    = "urlgetter"
+	testVersion = "0.1.0"
+)
+
+// Config contains the experiment config.
+type Config struct {
+	MaxEventsBodySnapSize   int64  `ooni:"snap size of bodies in network events (zero means default)"`
+	MaxResponseBodySnapSize int64  `ooni:"snap size of the response body (zero means default)"`
+	Method                  string `ooni:"HTTP method to use (default: GET)"`
+	NoTLSVerify             bool   `ooni:"skip TLS certificate verification"`
+	ResolverURL             string `ooni:"only resolver to use (e.g. udp://8.8.8.8:53, dot://1.1.1.1:853, https://dns.google/dns-query)"`
+	SNI                     string `ooni:"SNI to use with https:// and tlshandshake:// inputs (default: the input host)"`
+	UserAgent               string `ooni:"HTTP user agent to use (default: a common browser one)"`
+}
+
+// TestKeys contains urlgetter test keys. ResolverAddress and
+// ResolverNetwork describe the resolver that answered our query.
+type TestKeys struct {
+	Agent           string                          `json:"agent,omitempty"`
+	Failure         *string                         `json:"failure"`
+	NetworkEvents   oonidatamodel.NetworkEventsList `json:"network_events"`
+	Queries         oonidatamodel.DNSQueriesList    `json:"queries"`
+	Requests        oonidatamodel.RequestList       `json:"requests"`
+	ResolverAddress string                          `json:"resolver_address,omitempty"`
+	ResolverNetwork string                          `json:"resolver_network,omitempty"`
+	SNI             string                          `json:"sni,omitempty"`
+	TCPConnect      oonidatamodel.TCPConnectList    `json:"tcp_connect"`
+	TLSHandshakes   oonidatamodel.TLSHandshakesList `json:"tls_handshakes"`
+}
+
+// fill fills the test keys using the results of a template.
+func (tk *TestKeys) fill(results oonitemplates.Results, err error) {
+	tk.NetworkEvents = oonidatamodel.NewNetworkEventsList(results)
+	tk.Queries = oonidatamodel.NewDNSQueriesList(results)
+	tk.Requests = oonidatamodel.NewRequestList(results)
+	tk.TCPConnect = oonidatamodel.NewTCPConnectList(results)
+	tk.TLSHandshakes = oonidatamodel.NewTLSHandshakesList(results)
+	for _, query := range tk.Queries {
+		if query.Failure == nil {
+			tk.ResolverAddress = query.ResolverAddress
+			tk.ResolverNetwork = query.Engine
+			break
+		}
+	}
+	if err != nil {
+		s := err.Error()
+		tk.Failure = &s
+	}
+}
+
+// parseResolverURL converts the resolver URL into the network
+// and address pair used by oonitemplates. The empty string and
+// system mean that we should use the system resolver. When the
+// user sets a resolver, we only use that resolver, without the
+// fallbacks that oonitemplates would otherwise configure.
+func parseResolverURL(resolverURL string) (network, address string, err error) {
+	if resolverURL == "" || resolverURL == "system" {
+		return "", "", nil
+	}
+	parsed, err := url.Parse(resolverURL)
+	if err != nil {
+		return "", "", err
+	}
+	if parsed.Host == "" {
+		return "", "", fmt.Errorf("urlgetter: missing host in %s", resolverURL)
+	}
+	switch parsed.Scheme {
+	case "https":
+		return "doh", resolverURL, nil
+	case "dot", "tcp", "udp":
+		address = parsed.Host
+		if parsed.Port() == "" {
+			port := "53"
+			if parsed.Scheme == "dot" {
+				port = "853"
+			}
+			address = net.JoinHostPort(parsed.Hostname(), port)
+		}
+		return parsed.Scheme, address, nil
+	}
+	return "", "", fmt.Errorf("urlgetter: unsupported resolver scheme in %s", resolverURL)
+}
+
+type measurer struct {
+	config Config
+}
+
+func newMeasurer(config Config) *measurer {
+	return &measurer{config: config}
+}
+
+// get performs the operation selected by the input URL and returns
+// the results of the template we have used.
+func (m *measurer) get(
+	ctx context.Context, sess *session.Session,
+	measurement *model.Measurement, parsed *url.URL, tk *TestKeys,
+) (*oonitemplates.Results, error) {
+	network, address, err := parseResolverURL(m.config.ResolverURL)
+	if err != nil {
+		return nil, err
+	}
+	switch parsed.Scheme {
+	case "http", "https":
+		method := m.config.Method
+		if method == "" {
+			method = "GET"
+		}
+		userAgent := m.config.UserAgent
+		if userAgent == "" {
+			userAgent = httpheader.RandomUserAgent()
+		}
+		tk.Agent = "redirect"
+		tk.SNI = m.config.SNI
+		results := oonitemplates.HTTPDo(ctx, oonitemplates.HTTPDoConfig{
+			Accept:                  httpheader.RandomAccept(),
+			AcceptLanguage:          httpheader.RandomAcceptLanguage(),
+			Beginning:               measurement.MeasurementStartTimeSaved,
+			DNSServerAddress:        address,
+			DNSServerNetwork:        network,
+			Handler:                 netxlogger.NewHandler(sess.Logger),
+			InsecureSkipVerify:      m.config.NoTLSVerify,
+			MaxEventsBodySnapSize:   m.config.MaxEventsBodySnapSize,
+			MaxResponseBodySnapSize: m.config.MaxResponseBodySnapSize,
+			Method:                  method,
+			NoDNSFallbacks:          m.config.ResolverURL != "",
+			SNI:                     tk.SNI,
+			URL:                     parsed.String(),
+			UserAgent:               userAgent,
+		})
+		return &results.TestKeys, results.Error
+	case "tlshandshake":
+		endpoint := parsed.Host
+		if parsed.Port() == "" {
+			endpoint = net.JoinHostPort(parsed.Hostname(), "443")
+		}
+		tk.SNI = m.config.SNI
+		if tk.SNI == "" {
+			tk.SNI = parsed.Hostname()
+		}
+		results := oonitemplates.TLSConnect(ctx, oonitemplates.TLSConnectConfig{
+			Address:            endpoint,
+			Beginning:          measurement.MeasurementStartTimeSaved,
+			DNSServerAddress:   address,
+			DNSServerNetwork:   network,
+			Handler:            netxlogger.NewHandler(sess.Logger),
+			InsecureSkipVerify: m.config.NoTLSVerify,
+			NoDNSFallbacks:     m.config.ResolverURL != "",
+			SNI:                tk.SNI,
+		})
+		return &results.TestKeys, results.Error
+	case "tcpconnect":
+		if parsed.Port() == "" {
+			return nil, errors.New("urlgetter: tcpconnect requires a port")
+		}
+		results := oonitemplates.TCPConnect(ctx, oonitemplates.TCPConnectConfig{
+			Address:          parsed.Host,
+			Beginning:        measurement.MeasurementStartTimeSaved,
+			DNSServerAddress: address,
+			DNSServerNetwork: network,
+			Handler:          netxlogger.NewHandler(sess.Logger),
+			NoDNSFallbacks:   m.config.ResolverURL != "",
+		})
+		return &results.TestKeys, results.Error
+	case "dnslookup":
+		results := oonitemplates.DNSLookup(ctx, oonitemplates.DNSLookupConfig{
+			Beginning:     measurement.MeasurementStartTimeSaved,
+			Handler:       netxlogger.NewHandler(sess.Logger),
+			Hostname:      parsed.Hostname(),
+			ServerAddress: address,
+			ServerNetwork: network,
+		})
+		return &results.TestKeys, results.Error
+	}
+	return nil, fmt.Errorf("urlgetter: unsupported scheme: %s", parsed.Scheme)
+}
+
+func (m *measurer) measure(
+	ctx context.Context,
+	sess *session.Session,
+	measurement *model.Measurement,
+	callbacks handler.Callbacks,
+) error {
+	if measurement.Input == "" {
+		return errors.New("Experiment requires measurement.Input")
+	}
+	parsed, err := url.Parse(measurement.Input)
+	if err != nil {
+		return err
+	}
+	if parsed.Hostname() == "" {
+		return fmt.Errorf("urlgetter: missing host in %s", measurement.Input)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
+	defer cancel()
+	tk := new(TestKeys)
+	results, err := m.get(ctx, sess, measurement, parsed, tk)
+	if results == nil {
+		return err // we did not start measuring
+	}
+	measurement.TestKeys = tk
+	tk.fill(*results, err)
+	callbacks.OnProgress(1, fmt.Sprintf(
+		"urlgetter: %s: %s", measurement.Input, asString(tk.Failure),
+	))
+	callbacks.OnDataUsage(
+		float64(results.ReceivedBytes)/1024.0, // downloaded
+		float64(results.SentBytes)/1024.0,     // uploaded
+	)
+	return nil
+}
+
+// NewExperiment creates a new experiment.
+func NewExperiment(
+	sess *session.Session, config Config,
+) *experiment.Experiment {
+	return experiment.New(sess, testName, testVersion,
+		newMeasurer(config).measure)
+}
+
+func asString(failure *string) (result string) {
+	result = "success"
+	if failure != nil {
+		result = *failure
+	}
+	return
+}
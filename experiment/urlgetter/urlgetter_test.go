@@ -0,0 +1,282 @@
+package urlgetter
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/apex/log"
+	"github.com/miekg/dns"
+	"github.com/ooni/probe-engine/experiment/handler"
+	"github.com/ooni/probe-engine/internal/kvstore"
+	"github.com/ooni/probe-engine/model"
+	"github.com/ooni/probe-engine/session"
+)
+
+const (
+	softwareName    = "ooniprobe-example"
+	softwareVersion = "0.0.1"
+)
+
+func newsession() *session.Session {
+	return session.New(
+		log.Log, softwareName, softwareVersion,
+		"../../testdata", nil, nil, "../../testdata",
+		kvstore.NewMemoryKeyValueStore(),
+	)
+}
+
+func measure(t *testing.T, input string, config Config) (*TestKeys, error) {
+	measurement := &model.Measurement{Input: input}
+	err := newMeasurer(config).measure(
+		context.Background(), newsession(), measurement,
+		handler.NewPrinterCallbacks(log.Log),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return measurement.TestKeys.(*TestKeys), nil
+}
+
+func TestUnitNewExperiment(t *testing.T) {
+	experiment := NewExperiment(newsession(), Config{})
+	if experiment == nil {
+		t.Fatal("nil experiment returned")
+	}
+}
+
+func TestUnitMeasureWithInvalidInput(t *testing.T) {
+	for _, input := range []string{
+		"", "\t", "ftp://www.example.com/", "tcpconnect://www.example.com",
+		"dnslookup://",
+	} {
+		if _, err := measure(t, input, Config{}); err == nil {
+			t.Fatalf("expected an error with '%s'", input)
+		}
+	}
+}
+
+func TestUnitMeasureWithInvalidResolverURL(t *testing.T) {
+	_, err := measure(t, "dnslookup://www.example.com", Config{
+		ResolverURL: "ftp://8.8.8.8",
+	})
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+}
+
+func TestUnitParseResolverURL(t *testing.T) {
+	var tests = []struct {
+		resolverURL string
+		network     string
+		address     string
+	}{
+		{"", "", ""},
+		{"system", "", ""},
+		{"udp://8.8.8.8", "udp", "8.8.8.8:53"},
+		{"tcp://8.8.8.8:5353", "tcp", "8.8.8.8:5353"},
+		{"dot://1.1.1.1", "dot", "1.1.1.1:853"},
+		{"https://dns.google/dns-query", "doh", "https://dns.google/dns-query"},
+	}
+	for _, tt := range tests {
+		network, address, err := parseResolverURL(tt.resolverURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if network != tt.network || address != tt.address {
+			t.Fatalf("unexpected result for '%s': %s %s", tt.resolverURL, network, address)
+		}
+	}
+	for _, resolverURL := range []string{"\t", "udp://", "ftp://8.8.8.8"} {
+		if _, _, err := parseResolverURL(resolverURL); err == nil {
+			t.Fatalf("expected an error with '%s'", resolverURL)
+		}
+	}
+}
+
+func TestUnitMeasureHTTP(t *testing.T) {
+	var method, userAgent string
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			method, userAgent = r.Method, r.Header.Get("User-Agent")
+		},
+	))
+	defer server.Close()
+	tk, err := measure(t, server.URL, Config{Method: "HEAD", UserAgent: "antani/1.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tk.Failure != nil || tk.Agent != "redirect" {
+		t.Fatalf("unexpected test keys: %+v", tk)
+	}
+	if method != "HEAD" || userAgent != "antani/1.0" {
+		t.Fatal("the config has not been honoured")
+	}
+}
+
+func TestUnitMeasureHTTPSWithSNI(t *testing.T) {
+	var sni string
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			sni = r.TLS.ServerName
+		},
+	))
+	defer server.Close()
+	tk, err := measure(t, server.URL, Config{NoTLSVerify: true, SNI: "example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tk.Failure != nil || tk.SNI != "example.com" {
+		t.Fatalf("unexpected test keys: %+v", tk)
+	}
+	if sni != "example.com" {
+		t.Fatal("the SNI has not been honoured")
+	}
+}
+
+func TestUnitMeasureTLSHandshake(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	parsed, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := "tlshandshake://" + parsed.Host
+	tk, err := measure(t, input, Config{NoTLSVerify: true, SNI: "example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tk.Failure != nil || tk.SNI != "example.com" {
+		t.Fatalf("unexpected test keys: %+v", tk)
+	}
+	// Without skipping verification the self signed certificate is rejected
+	tk, err = measure(t, input, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tk.Failure == nil || tk.SNI != "127.0.0.1" {
+		t.Fatalf("unexpected test keys: %+v", tk)
+	}
+}
+
+func TestUnitMeasureTCPConnect(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	parsed, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tk, err := measure(t, "tcpconnect://"+parsed.Host, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tk.Failure != nil || len(tk.TCPConnect) != 1 {
+		t.Fatalf("unexpected test keys: %+v", tk)
+	}
+	// Port 1 is reserved and most likely nobody is listening there
+	tk, err = measure(t, "tcpconnect://127.0.0.1:1", Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tk.Failure == nil {
+		t.Fatal("expected a failure here")
+	}
+}
+
+func TestUnitMeasureDNSLookup(t *testing.T) {
+	tk, err := measure(t, "dnslookup://localhost", Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tk.Failure != nil {
+		t.Fatalf("unexpected failure: %s", *tk.Failure)
+	}
+}
+
+// startResolver starts a DNS server that resolves example.org
+// to 127.0.0.1 and returns NXDOMAIN for any other domain.
+func startResolver(t *testing.T) (*dns.Server, string) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(
+		func(w dns.ResponseWriter, query *dns.Msg) {
+			reply := new(dns.Msg)
+			reply.SetReply(query)
+			if query.Question[0].Name != "example.org." {
+				reply.Rcode = dns.RcodeNameError
+			} else if query.Question[0].Qtype == dns.TypeA {
+				reply.Answer = append(reply.Answer, &dns.A{
+					Hdr: dns.RR_Header{
+						Name: "example.org.", Rrtype: dns.TypeA,
+						Class: dns.ClassINET, Ttl: 60,
+					},
+					A: net.IPv4(127, 0, 0, 1),
+				})
+			}
+			w.WriteMsg(reply)
+		},
+	)}
+	go server.ActivateAndServe()
+	return server, conn.LocalAddr().String()
+}
+
+func TestUnitMeasureWithResolverURL(t *testing.T) {
+	resolver, address := startResolver(t)
+	defer resolver.Shutdown()
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tk, err := measure(t, "tcpconnect://"+net.JoinHostPort("example.org", port), Config{
+		ResolverURL: "udp://" + address,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tk.Failure != nil || tk.ResolverNetwork != "udp" || tk.ResolverAddress != address {
+		t.Fatalf("unexpected test keys: %+v", tk)
+	}
+}
+
+func TestUnitMeasureWithResolverURLDoesNotFallback(t *testing.T) {
+	resolver, address := startResolver(t)
+	defer resolver.Shutdown()
+	tk, err := measure(t, "tcpconnect://www.example.com:80", Config{
+		ResolverURL: "udp://" + address,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tk.Failure == nil || *tk.Failure != "dns_nxdomain_error" || tk.ResolverAddress != "" {
+		t.Fatalf("unexpected test keys: %+v", tk)
+	}
+	for _, query := range tk.Queries {
+		if query.ResolverAddress != address {
+			t.Fatalf("unexpected resolver: %s", query.ResolverAddress)
+		}
+	}
+}
+
+func TestIntegrationMeasure(t *testing.T) {
+	for _, input := range []string{
+		"https://www.example.com/",
+		"tlshandshake://www.example.com",
+		"tcpconnect://www.example.com:80",
+		"dnslookup://www.example.com",
+	} {
+		tk, err := measure(t, input, Config{ResolverURL: "dot://8.8.8.8"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tk.Failure != nil {
+			t.Fatalf("%s: unexpected failure: %s", input, *tk.Failure)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package web_connectivity
+
+import (
+	"context"
+
+	"github.com/ooni/probe-engine/experiment/testhelper"
+	"github.com/ooni/probe-engine/internal/oohelper"
+	"github.com/ooni/probe-engine/session"
+)
+
+// control performs the control request and returns the response.
+func control(
+	ctx context.Context, sess *session.Session, thAddr string,
+	creq oohelper.ControlRequest,
+) (oohelper.ControlResponse, error) {
+	return (&oohelper.Client{
+		BaseURL:    thAddr,
+		HTTPClient: sess.HTTPDefaultClient,
+		Logger:     sess.Logger,
+		UserAgent:  sess.UserAgent(),
+	}).Control(ctx, creq)
+}
+
+// testHelperURL returns the URL of the web-connectivity test helper
+// that we should be using, or an error if there is none.
+func testHelperURL(sess *session.Session, config Config) (string, error) {
+	if config.TestHelperURL != "" {
+		return config.TestHelperURL, nil
+	}
+	return testhelper.Get(sess, "web-connectivity", "https")
+}
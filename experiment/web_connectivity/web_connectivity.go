@@ -1,65 +1,457 @@
-// Package web_connectivity contains the Web Connectivity network experiment.
+// Package web_connectivity contains the Web Connectivity network
+// experiment. This file in particular is a pure-Go implementation of it.
+//
+// See https://github.com/ooni/spec/blob/master/nettests/ts-017-web-connectivity.md.
 package web_connectivity
 
 import (
 	"context"
 	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/ooni/probe-engine/experiment"
 	"github.com/ooni/probe-engine/experiment/handler"
-	"github.com/ooni/probe-engine/experiment/mkhelper"
-	"github.com/ooni/probe-engine/experiment/mkrunner"
-	"github.com/ooni/probe-engine/measurementkit"
+	"github.com/ooni/probe-engine/experiment/httpheader"
+	"github.com/ooni/probe-engine/geoiplookup/mmdblookup"
+	"github.com/ooni/probe-engine/internal/netxlogger"
+	"github.com/ooni/probe-engine/internal/oohelper"
+	"github.com/ooni/probe-engine/internal/oonidatamodel"
+	"github.com/ooni/probe-engine/internal/oonitemplates"
 	"github.com/ooni/probe-engine/model"
 	"github.com/ooni/probe-engine/session"
 )
 
 const (
 	testName    = "web_connectivity"
-	testVersion = "0.0.1"
+	testVersion = "0.1.0"
 )
 
 // Config contains the experiment config.
 type Config struct {
-	// LogLevel is the MK log level. Empty implies "WARNING".
-	LogLevel string
+	// TestHelperURL is the URL of the control helper. When it is
+	// empty we use the web-connectivity helper from the bouncer.
+	TestHelperURL string `ooni:"URL of the web connectivity control helper"`
 }
 
-func measure(
-	ctx context.Context, sess *session.Session, measurement *model.Measurement,
-	callbacks handler.Callbacks, config Config,
+// TestKeys contains web_connectivity test keys.
+type TestKeys struct {
+	Agent          string  `json:"agent"`
+	ClientResolver string  `json:"client_resolver"`
+	Retries        *int64  `json:"retries"`    // unused
+	SOCKSProxy     *string `json:"socksproxy"` // unused
+
+	// DNS experiment
+	DNSExperimentFailure *string                      `json:"dns_experiment_failure"`
+	DNSConsistency       *string                      `json:"dns_consistency"`
+	Queries              oonidatamodel.DNSQueriesList `json:"queries"`
+
+	// TCP connect experiment
+	TCPConnect oonidatamodel.TCPConnectList `json:"tcp_connect"`
+
+	// HTTP experiment
+	HTTPExperimentFailure *string                   `json:"http_experiment_failure"`
+	Requests              oonidatamodel.RequestList `json:"requests"`
+
+	// Control
+	ControlFailure *string                  `json:"control_failure"`
+	Control        oohelper.ControlResponse `json:"control"`
+
+	// Analysis
+	BodyLengthMatch *bool       `json:"body_length_match"`
+	BodyProportion  float64     `json:"body_proportion"`
+	HeadersMatch    *bool       `json:"headers_match"`
+	StatusCodeMatch *bool       `json:"status_code_match"`
+	TitleMatch      *bool       `json:"title_match"`
+	Accessible      *bool       `json:"accessible"`
+	Blocking        interface{} `json:"blocking"`
+}
+
+// tcpResult is the result of connecting to a single endpoint.
+type tcpResult struct {
+	endpoint string
+	results  *oonitemplates.TCPConnectResults
+}
+
+type measurer struct {
+	config Config
+}
+
+func newMeasurer(config Config) *measurer {
+	return &measurer{config: config}
+}
+
+func (m *measurer) measure(
+	ctx context.Context,
+	sess *session.Session,
+	measurement *model.Measurement,
+	callbacks handler.Callbacks,
 ) error {
-	settings := measurementkit.NewSettings(
-		"WebConnectivity", sess.SoftwareName, sess.SoftwareVersion,
-		sess.CABundlePath(), sess.ProbeASNString(), sess.ProbeCC(),
-		sess.ProbeIP(), sess.ProbeNetworkName(), config.LogLevel,
-	)
-	settings.Options.GeoIPASNPath = sess.ASNDatabasePath()
+	ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
+	defer cancel()
 	if measurement.Input == "" {
 		return errors.New("web_connectivity: passed an empty input")
 	}
-	settings.Inputs = []string{measurement.Input}
-	err := mkhelper.Set(sess, "web-connectivity", "https", &settings)
+	URL, err := url.Parse(measurement.Input)
+	if err != nil {
+		return err
+	}
+	if URL.Scheme != "http" && URL.Scheme != "https" {
+		return errors.New("web_connectivity: input is not an HTTP(S) URL")
+	}
+	thURL, err := testHelperURL(sess, m.config)
 	if err != nil {
 		return err
 	}
-	return mkrunner.Do(
-		settings, sess, measurement, callbacks, measurementkit.StartEx,
+	testkeys := &TestKeys{
+		Agent:          "redirect",
+		ClientResolver: sess.ResolverIP(),
+	}
+	measurement.TestKeys = testkeys
+	var (
+		handler       = netxlogger.NewHandler(sess.Logger)
+		receivedBytes int64
+		sentBytes     int64
+	)
+	// 1. resolve the domain name using the system resolver
+	dnsResults := oonitemplates.DNSLookup(ctx, oonitemplates.DNSLookupConfig{
+		Beginning: measurement.MeasurementStartTimeSaved,
+		Handler:   handler,
+		Hostname:  URL.Hostname(),
+	})
+	testkeys.Queries = oonidatamodel.NewDNSQueriesList(dnsResults.TestKeys)
+	testkeys.DNSExperimentFailure = makeFailure(dnsResults.Error)
+	receivedBytes += dnsResults.TestKeys.ReceivedBytes
+	sentBytes += dnsResults.TestKeys.SentBytes
+	callbacks.OnProgress(0.2, fmt.Sprintf(
+		"web_connectivity: DNS lookup: %s", errString(dnsResults.Error),
+	))
+	// 2. connect to every resolved endpoint
+	var endpoints []string
+	for _, addr := range dnsResults.Addresses {
+		endpoints = append(endpoints, net.JoinHostPort(addr, port(URL)))
+	}
+	tcpResults := make([]tcpResult, len(endpoints))
+	var waitgroup sync.WaitGroup
+	waitgroup.Add(len(endpoints))
+	for idx, endpoint := range endpoints {
+		go func(idx int, endpoint string) {
+			defer waitgroup.Done()
+			tcpResults[idx] = tcpResult{
+				endpoint: endpoint,
+				results: oonitemplates.TCPConnect(ctx, oonitemplates.TCPConnectConfig{
+					Address:   endpoint,
+					Beginning: measurement.MeasurementStartTimeSaved,
+					Handler:   handler,
+				}),
+			}
+		}(idx, endpoint)
+	}
+	waitgroup.Wait()
+	for _, r := range tcpResults {
+		testkeys.TCPConnect = append(
+			testkeys.TCPConnect,
+			oonidatamodel.NewTCPConnectList(r.results.TestKeys)...,
+		)
+		receivedBytes += r.results.TestKeys.ReceivedBytes
+		sentBytes += r.results.TestKeys.SentBytes
+	}
+	callbacks.OnProgress(0.4, fmt.Sprintf(
+		"web_connectivity: connected to %d endpoints", len(endpoints),
+	))
+	// 3. ask the control helper to measure on our behalf
+	headers := map[string][]string{
+		"Accept":          []string{httpheader.RandomAccept()},
+		"Accept-Language": []string{httpheader.RandomAcceptLanguage()},
+		"User-Agent":      []string{httpheader.RandomUserAgent()},
+	}
+	testkeys.Control, err = control(ctx, sess, thURL, oohelper.ControlRequest{
+		HTTPRequest:        measurement.Input,
+		HTTPRequestHeaders: headers,
+		TCPConnect:         endpoints,
+	})
+	testkeys.ControlFailure = makeFailure(err)
+	callbacks.OnProgress(0.6, fmt.Sprintf(
+		"web_connectivity: control request: %s", errString(err),
+	))
+	// 4. fetch the URL ourselves using the same headers
+	httpResults := oonitemplates.HTTPDo(ctx, oonitemplates.HTTPDoConfig{
+		Accept:                  headers["Accept"][0],
+		AcceptLanguage:          headers["Accept-Language"][0],
+		Beginning:               measurement.MeasurementStartTimeSaved,
+		Handler:                 handler,
+		MaxResponseBodySnapSize: maxResponseBodySnapSize,
+		Method:                  "GET",
+		URL:                     measurement.Input,
+		UserAgent:               headers["User-Agent"][0],
+	})
+	testkeys.Requests = oonidatamodel.NewRequestList(httpResults.TestKeys)
+	testkeys.HTTPExperimentFailure = makeFailure(httpResults.Error)
+	receivedBytes += httpResults.TestKeys.ReceivedBytes
+	sentBytes += httpResults.TestKeys.SentBytes
+	callbacks.OnProgress(0.8, fmt.Sprintf(
+		"web_connectivity: HTTP request: %s", errString(httpResults.Error),
+	))
+	// 5. compare what we have seen with what the control has seen
+	testkeys.analyzeDNS(sess, URL.Hostname(), dnsResults.Addresses)
+	testkeys.analyzeHTTP(httpResults)
+	testkeys.analyzeBlocking(tcpResults)
+	callbacks.OnProgress(1.0, fmt.Sprintf(
+		"web_connectivity: blocking: %+v", testkeys.Blocking,
+	))
+	callbacks.OnDataUsage(
+		float64(receivedBytes)/1024.0, // downloaded
+		float64(sentBytes)/1024.0,     // uploaded
+	)
+	return nil
+}
+
+// maxResponseBodySnapSize is large enough that we can compare the
+// body length with the one seen by the control helper.
+const maxResponseBodySnapSize = 1 << 24
+
+// analyzeDNS sets DNSConsistency by comparing the addresses we have
+// resolved with the ones resolved by the control helper.
+func (tk *TestKeys) analyzeDNS(
+	sess *session.Session, hostname string, addrs []string,
+) {
+	if tk.ControlFailure != nil {
+		return // we cannot say anything
+	}
+	consistent, inconsistent := "consistent", "inconsistent"
+	if net.ParseIP(hostname) != nil {
+		tk.DNSConsistency = &consistent
+		return
+	}
+	if tk.DNSExperimentFailure != nil || tk.Control.DNS.Failure != nil {
+		if tk.DNSExperimentFailure != nil && tk.Control.DNS.Failure != nil {
+			tk.DNSConsistency = &consistent // e.g. NXDOMAIN for both
+			return
+		}
+		tk.DNSConsistency = &inconsistent
+		return
+	}
+	ours := make(map[string]bool)
+	for _, addr := range addrs {
+		ours[addr] = true
+	}
+	for _, addr := range tk.Control.DNS.Addrs {
+		if ours[addr] {
+			tk.DNSConsistency = &consistent
+			return
+		}
+	}
+	// Also consider consistent addresses belonging to the same ASN as
+	// the ones seen by the control, as it happens with CDNs.
+	asns := make(map[uint]bool)
+	for _, addr := range addrs {
+		if asn := lookupASN(sess, addr); asn != 0 {
+			asns[asn] = true
+		}
+	}
+	for _, addr := range tk.Control.DNS.Addrs {
+		if asns[lookupASN(sess, addr)] {
+			tk.DNSConsistency = &consistent
+			return
+		}
+	}
+	tk.DNSConsistency = &inconsistent
+}
+
+func lookupASN(sess *session.Session, addr string) uint {
+	asn, _, err := mmdblookup.LookupASN(sess.ASNDatabasePath(), addr, sess.Logger)
+	if err != nil {
+		return 0
+	}
+	return asn
+}
+
+// commonHeaders contains headers that are so common that it
+// does not make sense to compare them.
+var commonHeaders = map[string]bool{
+	"date":                      true,
+	"content-type":              true,
+	"server":                    true,
+	"cache-control":             true,
+	"vary":                      true,
+	"set-cookie":                true,
+	"location":                  true,
+	"expires":                   true,
+	"x-powered-by":              true,
+	"content-encoding":          true,
+	"last-modified":             true,
+	"accept-ranges":             true,
+	"pragma":                    true,
+	"x-frame-options":           true,
+	"etag":                      true,
+	"x-content-type-options":    true,
+	"age":                       true,
+	"via":                       true,
+	"p3p":                       true,
+	"x-xss-protection":          true,
+	"content-language":          true,
+	"cf-ray":                    true,
+	"strict-transport-security": true,
+	"link":                      true,
+	"x-varnish":                 true,
+}
+
+// analyzeHTTP compares our HTTP response with the control's one.
+func (tk *TestKeys) analyzeHTTP(results *oonitemplates.HTTPDoResults) {
+	if tk.ControlFailure != nil || tk.HTTPExperimentFailure != nil {
+		return
+	}
+	ctrl := tk.Control.HTTPRequest
+	if ctrl.Failure != nil {
+		return
+	}
+	statusCodeMatch := results.StatusCode == ctrl.StatusCode
+	tk.StatusCodeMatch = &statusCodeMatch
+	if length := int64(len(results.BodySnap)); length > 0 && ctrl.BodyLength > 0 {
+		tk.BodyProportion = float64(length) / float64(ctrl.BodyLength)
+		if length > ctrl.BodyLength {
+			tk.BodyProportion = float64(ctrl.BodyLength) / float64(length)
+		}
+		bodyLengthMatch := tk.BodyProportion > 0.7
+		tk.BodyLengthMatch = &bodyLengthMatch
+	}
+	ours := make(map[string]bool)
+	for key := range results.Headers {
+		if key = strings.ToLower(key); !commonHeaders[key] {
+			ours[key] = true
+		}
+	}
+	// Headers match if we have seen at least one of the uncommon headers
+	// seen by the control, or if neither of us saw any uncommon header.
+	var theirs, common int
+	for key := range ctrl.Headers {
+		if key = strings.ToLower(key); !commonHeaders[key] {
+			theirs++
+			if ours[key] {
+				common++
+			}
+		}
+	}
+	headersMatch := common > 0 || (theirs == 0 && len(ours) == 0)
+	tk.HeadersMatch = &headersMatch
+	tk.TitleMatch = matchTitles(oohelper.ExtractTitle(results.BodySnap), ctrl.Title)
+}
+
+// matchTitles compares the first word longer than four characters
+// (the average english word length being five) in our title with the
+// word in the same position in the control's title. Returns nil when
+// there is no such word and hence we cannot say anything.
+func matchTitles(ours, theirs string) *bool {
+	theirWords := strings.Split(theirs, " ")
+	for idx, word := range strings.Split(ours, " ") {
+		if len(word) < 5 {
+			continue
+		}
+		match := idx < len(theirWords) && strings.EqualFold(word, theirWords[idx])
+		return &match
+	}
+	return nil
+}
+
+// analyzeBlocking sets Blocking and Accessible. This function assumes
+// that analyzeDNS and analyzeHTTP have already been called.
+func (tk *TestKeys) analyzeBlocking(tcpResults []tcpResult) {
+	if tk.ControlFailure != nil {
+		return // we cannot say anything
+	}
+	var (
+		accessible   = true
+		inaccessible = false
 	)
+	dnsInconsistent := tk.DNSConsistency != nil && *tk.DNSConsistency == "inconsistent"
+	ctrlHTTPFailure := tk.Control.HTTPRequest.Failure
+	switch {
+	case tk.HTTPExperimentFailure == nil && ctrlHTTPFailure == nil:
+		if tk.StatusCodeMatch != nil && *tk.StatusCodeMatch &&
+			(isTrue(tk.BodyLengthMatch) || isTrue(tk.HeadersMatch) ||
+				isTrue(tk.TitleMatch)) {
+			tk.Accessible, tk.Blocking = &accessible, false
+			return
+		}
+		tk.Accessible = &inaccessible
+		if dnsInconsistent {
+			tk.Blocking = "dns"
+			return
+		}
+		tk.Blocking = "http-diff"
+	case tk.HTTPExperimentFailure != nil && ctrlHTTPFailure == nil:
+		tk.Accessible = &inaccessible
+		if dnsInconsistent || tk.DNSExperimentFailure != nil {
+			tk.Blocking = "dns"
+			return
+		}
+		if tcpBlocked(tcpResults, tk.Control.TCPConnect) {
+			tk.Blocking = "tcp_ip"
+			return
+		}
+		tk.Blocking = "http-failure"
+	case tk.HTTPExperimentFailure != nil && ctrlHTTPFailure != nil:
+		// The website is down for both of us
+		tk.Accessible, tk.Blocking = &inaccessible, false
+	default:
+		// We can access the website but the control cannot
+		tk.Accessible, tk.Blocking = &accessible, false
+	}
+}
+
+// tcpBlocked returns true when we could not connect to any of the
+// endpoints while the control could connect to at least one of them.
+func tcpBlocked(
+	tcpResults []tcpResult, control map[string]oohelper.ControlTCPConnectResult,
+) bool {
+	var ctrlSuccess bool
+	for _, r := range tcpResults {
+		if r.results.Error == nil {
+			return false
+		}
+		ctrlSuccess = ctrlSuccess || control[r.endpoint].Status
+	}
+	return ctrlSuccess
+}
+
+func isTrue(v *bool) bool {
+	return v != nil && *v
+}
+
+func port(URL *url.URL) string {
+	if port := URL.Port(); port != "" {
+		return port
+	}
+	if URL.Scheme == "https" {
+		return "443"
+	}
+	return "80"
+}
+
+func makeFailure(err error) (s *string) {
+	if err != nil {
+		failure := err.Error()
+		s = &failure
+	}
+	return
+}
+
+func errString(err error) (s string) {
+	s = "success"
+	if err != nil {
+		s = err.Error()
+	}
+	return
 }
 
 // NewExperiment creates a new experiment.
 func NewExperiment(
 	sess *session.Session, config Config,
 ) *experiment.Experiment {
-	return experiment.New(
-		sess, testName, testVersion,
-		func(
-			ctx context.Context,
-			sess *session.Session,
-			measurement *model.Measurement,
-			callbacks handler.Callbacks,
-		) error {
-			return measure(ctx, sess, measurement, callbacks, config)
-		})
+	return experiment.New(sess, testName, testVersion,
+		newMeasurer(config).measure)
 }
@@ -1,14 +1,19 @@
-package web_connectivity_test
+package web_connectivity
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/apex/log"
-	"github.com/ooni/probe-engine/experiment"
-	"github.com/ooni/probe-engine/experiment/web_connectivity"
+	"github.com/ooni/probe-engine/experiment/handler"
 	"github.com/ooni/probe-engine/internal/kvstore"
-	"github.com/ooni/probe-engine/measurementkit"
+	"github.com/ooni/probe-engine/internal/oohelper"
+	"github.com/ooni/probe-engine/internal/oonitemplates"
+	"github.com/ooni/probe-engine/model"
 	"github.com/ooni/probe-engine/session"
 )
 
@@ -17,45 +22,314 @@ const (
 	softwareVersion = "0.0.1"
 )
 
-func measureURL(
-	ctx context.Context, experiment *experiment.Experiment, URL string,
-) error {
-	measurement, err := experiment.Measure(ctx, URL)
+const targetBody = `<html><head><title>Antani Mascetti Website</title></head></html>`
+
+func newsession() *session.Session {
+	return session.New(
+		log.Log, softwareName, softwareVersion,
+		"../../testdata", nil, nil, "../../testdata",
+		kvstore.NewMemoryKeyValueStore(),
+	)
+}
+
+func newTarget() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Antani", "mascetti")
+			w.Write([]byte(targetBody))
+		},
+	))
+}
+
+// newControl returns a control helper stand-in that claims to have
+// seen the response returned by the server created by newTarget
+// after applying the modify function to such response.
+func newControl(modify func(*oohelper.ControlResponse)) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			var creq oohelper.ControlRequest
+			if err := json.NewDecoder(r.Body).Decode(&creq); err != nil {
+				w.WriteHeader(400)
+				return
+			}
+			cresp := oohelper.ControlResponse{
+				TCPConnect: make(map[string]oohelper.ControlTCPConnectResult),
+				HTTPRequest: oohelper.ControlHTTPRequestResult{
+					BodyLength: int64(len(targetBody)),
+					Title:      oohelper.ExtractTitle([]byte(targetBody)),
+					Headers:    map[string]string{"X-Antani": "mascetti"},
+					StatusCode: 200,
+				},
+				DNS: oohelper.ControlDNSResult{Addrs: []string{"127.0.0.1"}},
+			}
+			for _, endpoint := range creq.TCPConnect {
+				cresp.TCPConnect[endpoint] = oohelper.ControlTCPConnectResult{Status: true}
+			}
+			if modify != nil {
+				modify(&cresp)
+			}
+			json.NewEncoder(w).Encode(cresp)
+		},
+	))
+}
+
+func measureWithControl(
+	t *testing.T, modify func(*oohelper.ControlResponse),
+) *TestKeys {
+	target := newTarget()
+	defer target.Close()
+	control := newControl(modify)
+	defer control.Close()
+	m := newMeasurer(Config{TestHelperURL: control.URL})
+	measurement := &model.Measurement{Input: target.URL}
+	err := m.measure(
+		context.Background(),
+		newsession(),
+		measurement,
+		handler.NewPrinterCallbacks(log.Log),
+	)
 	if err != nil {
-		return err
+		t.Fatal(err)
 	}
-	return experiment.SubmitMeasurement(ctx, &measurement)
+	return measurement.TestKeys.(*TestKeys)
 }
 
-func TestIntegration(t *testing.T) {
-	if !measurementkit.Available() {
-		t.Skip("Measurement Kit not available; skipping")
+func TestUnitNewExperiment(t *testing.T) {
+	experiment := NewExperiment(newsession(), Config{})
+	if experiment == nil {
+		t.Fatal("nil experiment returned")
 	}
-	log.SetLevel(log.DebugLevel)
-	ctx := context.Background()
+}
 
-	sess := session.New(
-		log.Log, softwareName, softwareVersion, "../../testdata", nil, nil,
-		"../../testdata", kvstore.NewMemoryKeyValueStore(),
+func TestUnitMeasureWithEmptyInput(t *testing.T) {
+	m := newMeasurer(Config{})
+	err := m.measure(
+		context.Background(),
+		newsession(),
+		new(model.Measurement),
+		handler.NewPrinterCallbacks(log.Log),
 	)
-	if err := sess.MaybeLookupBackends(ctx); err != nil {
+	if err == nil || err.Error() != "web_connectivity: passed an empty input" {
+		t.Fatal("not the error we expected")
+	}
+}
+
+func TestUnitMeasureWithNonHTTPInput(t *testing.T) {
+	m := newMeasurer(Config{})
+	err := m.measure(
+		context.Background(),
+		newsession(),
+		&model.Measurement{Input: "ftp://www.example.com/"},
+		handler.NewPrinterCallbacks(log.Log),
+	)
+	if err == nil || err.Error() != "web_connectivity: input is not an HTTP(S) URL" {
+		t.Fatal("not the error we expected")
+	}
+}
+
+func TestUnitMeasureWithNoTestHelper(t *testing.T) {
+	m := newMeasurer(Config{})
+	err := m.measure(
+		context.Background(),
+		newsession(),
+		&model.Measurement{Input: "http://www.example.com/"},
+		handler.NewPrinterCallbacks(log.Log),
+	)
+	if err == nil || err.Error() != "No available web-connectivity test helper" {
+		t.Fatal("not the error we expected")
+	}
+}
+
+func TestUnitTestHelperURLFromSession(t *testing.T) {
+	sess := newsession()
+	sess.AvailableTestHelpers = map[string][]model.Service{
+		"web-connectivity": []model.Service{
+			model.Service{Address: "httpo://antani.onion", Type: "onion"},
+		},
+	}
+	if _, err := testHelperURL(sess, Config{}); err == nil {
+		t.Fatal("expected an error here")
+	}
+	sess.AvailableTestHelpers["web-connectivity"] = append(
+		sess.AvailableTestHelpers["web-connectivity"], model.Service{
+			Address: "https://wcth.ooni.io", Type: "https",
+		},
+	)
+	URL, err := testHelperURL(sess, Config{})
+	if err != nil {
 		t.Fatal(err)
 	}
-	if err := sess.MaybeLookupLocation(ctx); err != nil {
+	if URL != "https://wcth.ooni.io" {
+		t.Fatal("unexpected test helper URL")
+	}
+}
+
+func TestUnitMeasureAccessible(t *testing.T) {
+	tk := measureWithControl(t, nil)
+	if tk.ControlFailure != nil || tk.HTTPExperimentFailure != nil {
+		t.Fatal("unexpected failure")
+	}
+	if tk.DNSConsistency == nil || *tk.DNSConsistency != "consistent" {
+		t.Fatal("unexpected DNS consistency")
+	}
+	if !isTrue(tk.BodyLengthMatch) || !isTrue(tk.HeadersMatch) ||
+		!isTrue(tk.StatusCodeMatch) || !isTrue(tk.TitleMatch) {
+		t.Fatal("expected everything to match")
+	}
+	if tk.Blocking != false || !isTrue(tk.Accessible) {
+		t.Fatal("expected the website to be accessible")
+	}
+}
+
+func TestUnitMeasureWithLocalHelper(t *testing.T) {
+	target := newTarget()
+	defer target.Close()
+	helper := httptest.NewServer(oohelper.Handler{Logger: log.Log})
+	defer helper.Close()
+	m := newMeasurer(Config{TestHelperURL: helper.URL})
+	measurement := &model.Measurement{Input: target.URL}
+	err := m.measure(
+		context.Background(),
+		newsession(),
+		measurement,
+		handler.NewPrinterCallbacks(log.Log),
+	)
+	if err != nil {
 		t.Fatal(err)
 	}
+	tk := measurement.TestKeys.(*TestKeys)
+	if tk.ControlFailure != nil {
+		t.Fatal(*tk.ControlFailure)
+	}
+	if tk.Blocking != false || !isTrue(tk.Accessible) {
+		t.Fatal("expected the website to be accessible")
+	}
+}
+
+func TestUnitMeasureHTTPDiff(t *testing.T) {
+	tk := measureWithControl(t, func(cresp *oohelper.ControlResponse) {
+		cresp.HTTPRequest.BodyLength = 1 << 20
+		cresp.HTTPRequest.Headers = map[string]string{"X-Sassaroli": "melandri"}
+		cresp.HTTPRequest.Title = "Sbirulino Website"
+	})
+	if isTrue(tk.BodyLengthMatch) || isTrue(tk.HeadersMatch) || isTrue(tk.TitleMatch) {
+		t.Fatal("expected no match")
+	}
+	if tk.Blocking != "http-diff" || tk.Accessible == nil || *tk.Accessible {
+		t.Fatal("expected http-diff blocking")
+	}
+}
 
-	experiment := web_connectivity.NewExperiment(sess, web_connectivity.Config{})
-	if err := experiment.OpenReport(ctx); err != nil {
+func TestUnitMeasureControlFailure(t *testing.T) {
+	target := newTarget()
+	defer target.Close()
+	control := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(500)
+		},
+	))
+	defer control.Close()
+	m := newMeasurer(Config{TestHelperURL: control.URL})
+	measurement := &model.Measurement{Input: target.URL}
+	err := m.measure(
+		context.Background(),
+		newsession(),
+		measurement,
+		handler.NewPrinterCallbacks(log.Log),
+	)
+	if err != nil {
 		t.Fatal(err)
 	}
-	defer experiment.CloseReport(ctx)
+	tk := measurement.TestKeys.(*TestKeys)
+	if tk.ControlFailure == nil {
+		t.Fatal("expected a control failure")
+	}
+	if tk.Blocking != nil || tk.Accessible != nil || tk.DNSConsistency != nil {
+		t.Fatal("we should not have drawn any conclusion")
+	}
+}
+
+func TestUnitAnalyzeDNSInconsistent(t *testing.T) {
+	tk := &TestKeys{Control: oohelper.ControlResponse{
+		DNS: oohelper.ControlDNSResult{Addrs: []string{"93.184.216.34"}},
+	}}
+	tk.analyzeDNS(newsession(), "www.example.com", []string{"10.0.0.1"})
+	if tk.DNSConsistency == nil || *tk.DNSConsistency != "inconsistent" {
+		t.Fatal("expected inconsistent DNS")
+	}
+	failure := "generic_timeout_error"
+	tk.HTTPExperimentFailure = &failure
+	tk.analyzeBlocking(nil)
+	if tk.Blocking != "dns" {
+		t.Fatal("expected DNS blocking")
+	}
+}
 
-	for _, URL := range []string{
-		"http://www.example.com/robots.txt", "http://www.google.com/humans.txt",
-	} {
-		if err := measureURL(ctx, experiment, URL); err != nil {
-			t.Fatal(err)
-		}
+func TestUnitAnalyzeDNSBothFailed(t *testing.T) {
+	failure := "dns_nxdomain_error"
+	tk := &TestKeys{
+		Control:              oohelper.ControlResponse{DNS: oohelper.ControlDNSResult{Failure: &failure}},
+		DNSExperimentFailure: &failure,
+	}
+	tk.analyzeDNS(newsession(), "www.antani.xyz", nil)
+	if tk.DNSConsistency == nil || *tk.DNSConsistency != "consistent" {
+		t.Fatal("expected consistent DNS")
+	}
+}
+
+func TestUnitAnalyzeBlockingTCPIP(t *testing.T) {
+	failure := "connection_refused"
+	tk := &TestKeys{
+		Control: oohelper.ControlResponse{TCPConnect: map[string]oohelper.ControlTCPConnectResult{
+			"93.184.216.34:80": oohelper.ControlTCPConnectResult{Status: true},
+		}},
+		HTTPExperimentFailure: &failure,
+	}
+	tk.analyzeBlocking([]tcpResult{tcpResult{
+		endpoint: "93.184.216.34:80",
+		results: &oonitemplates.TCPConnectResults{
+			Error: errors.New(failure),
+		},
+	}})
+	if tk.Blocking != "tcp_ip" {
+		t.Fatal("expected TCP/IP blocking")
+	}
+}
+
+func TestUnitAnalyzeBlockingHTTPFailure(t *testing.T) {
+	failure := "connection_reset"
+	tk := &TestKeys{HTTPExperimentFailure: &failure}
+	tk.analyzeBlocking([]tcpResult{tcpResult{
+		endpoint: "93.184.216.34:80",
+		results:  &oonitemplates.TCPConnectResults{},
+	}})
+	if tk.Blocking != "http-failure" {
+		t.Fatal("expected HTTP failure blocking")
+	}
+}
+
+func TestUnitAnalyzeBlockingWebsiteDown(t *testing.T) {
+	failure := "connection_refused"
+	tk := &TestKeys{
+		Control: oohelper.ControlResponse{HTTPRequest: oohelper.ControlHTTPRequestResult{
+			Failure: &failure,
+		}},
+		HTTPExperimentFailure: &failure,
+	}
+	tk.analyzeBlocking(nil)
+	if tk.Blocking != false || tk.Accessible == nil || *tk.Accessible {
+		t.Fatal("expected the website to be down")
+	}
+}
+
+func TestUnitMatchTitles(t *testing.T) {
+	if matchTitles("a b c", "a b c") != nil {
+		t.Fatal("expected nil with only short words")
+	}
+	if !isTrue(matchTitles("The Antani Website", "the antani blog")) {
+		t.Fatal("expected a match")
+	}
+	if isTrue(matchTitles("The Antani Website", "Blocked")) {
+		t.Fatal("expected no match")
 	}
 }
@@ -1,55 +1,303 @@
-// Package whatsapp contains the WhatsApp network experiment.
+// Package whatsapp contains the WhatsApp network experiment. This file
+// in particular is a pure-Go implementation of that.
+//
+// See https://github.com/ooni/spec/blob/master/nettests/ts-018-whatsapp.md.
 package whatsapp
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/ooni/probe-engine/experiment"
 	"github.com/ooni/probe-engine/experiment/handler"
-	"github.com/ooni/probe-engine/experiment/mkrunner"
-	"github.com/ooni/probe-engine/measurementkit"
+	"github.com/ooni/probe-engine/experiment/httpheader"
+	"github.com/ooni/probe-engine/internal/netxlogger"
+	"github.com/ooni/probe-engine/internal/oonidatamodel"
+	"github.com/ooni/probe-engine/internal/oonitemplates"
 	"github.com/ooni/probe-engine/model"
 	"github.com/ooni/probe-engine/session"
 )
 
 const (
 	testName    = "whatsapp"
-	testVersion = "0.6.1"
+	testVersion = "0.7.0"
+
+	registrationServiceURL = "https://v.whatsapp.net/v2/register"
+	webHTTPURL             = "http://web.whatsapp.com/"
+	webHTTPSURL            = "https://web.whatsapp.com/"
 )
 
 // Config contains the experiment config.
-type Config struct {
-	// LogLevel is the MK log level. Empty implies "WARNING".
-	LogLevel string
+type Config struct{}
+
+// TestKeys contains whatsapp test keys. We do not check whether the
+// endpoints resolve to WhatsApp addresses, hence the list of DNS
+// inconsistent endpoints is always empty.
+type TestKeys struct {
+	Agent                            string                          `json:"agent"`
+	Queries                          oonidatamodel.DNSQueriesList    `json:"queries"`
+	RegistrationServerFailure        *string                         `json:"registration_server_failure"`
+	RegistrationServerStatus         string                          `json:"registration_server_status"`
+	Requests                         oonidatamodel.RequestList       `json:"requests"`
+	TCPConnect                       oonidatamodel.TCPConnectList    `json:"tcp_connect"`
+	TLSHandshakes                    oonidatamodel.TLSHandshakesList `json:"tls_handshakes"`
+	WhatsappEndpointsBlocked         []string                        `json:"whatsapp_endpoints_blocked"`
+	WhatsappEndpointsDNSInconsistent []string                        `json:"whatsapp_endpoints_dns_inconsistent"`
+	WhatsappEndpointsStatus          string                          `json:"whatsapp_endpoints_status"`
+	WhatsappWebFailure               *string                         `json:"whatsapp_web_failure"`
+	WhatsappWebStatus                string                          `json:"whatsapp_web_status"`
+}
+
+// endpointPorts contains the ports we use for each endpoint.
+var endpointPorts = []string{"443", "5222"}
+
+// endpointNames returns the names of the WhatsApp endpoints.
+func endpointNames() (names []string) {
+	for idx := 1; idx <= 16; idx++ {
+		names = append(names, fmt.Sprintf("e%d.whatsapp.net", idx))
+	}
+	return
+}
+
+type urlMeasurements struct {
+	results *oonitemplates.HTTPDoResults
+}
+
+type endpointMeasurements struct {
+	hostname string
+	results  *oonitemplates.TCPConnectResults
+}
+
+func newTestKeys() *TestKeys {
+	return &TestKeys{
+		Agent:                            "redirect",
+		RegistrationServerStatus:         "ok",
+		WhatsappEndpointsBlocked:         []string{},
+		WhatsappEndpointsDNSInconsistent: []string{},
+		WhatsappEndpointsStatus:          "ok",
+		WhatsappWebStatus:                "ok",
+	}
+}
+
+func (tk *TestKeys) addResults(r oonitemplates.Results) {
+	tk.Queries = append(tk.Queries, oonidatamodel.NewDNSQueriesList(r)...)
+	tk.Requests = append(tk.Requests, oonidatamodel.NewRequestList(r)...)
+	tk.TCPConnect = append(tk.TCPConnect, oonidatamodel.NewTCPConnectList(r)...)
+	tk.TLSHandshakes = append(
+		tk.TLSHandshakes, oonidatamodel.NewTLSHandshakesList(r)...,
+	)
+}
+
+func (tk *TestKeys) processRegistration(v *urlMeasurements) error {
+	if v == nil || v.results == nil {
+		return errors.New("passed nil results")
+	}
+	r := v.results
+	tk.addResults(r.TestKeys)
+	if r.Error != nil {
+		failureString := r.Error.Error()
+		tk.RegistrationServerFailure = &failureString
+		tk.RegistrationServerStatus = "blocked"
+	}
+	return nil
 }
 
-func measure(
-	ctx context.Context, sess *session.Session, measurement *model.Measurement,
-	callbacks handler.Callbacks, config Config,
+func (tk *TestKeys) processWeb(v *urlMeasurements) error {
+	if v == nil || v.results == nil {
+		return errors.New("passed nil results")
+	}
+	r := v.results
+	tk.addResults(r.TestKeys)
+	if tk.WhatsappWebStatus != "ok" {
+		return nil // we already flipped the state
+	}
+	if r.Error != nil {
+		failureString := r.Error.Error()
+		tk.WhatsappWebFailure = &failureString
+		tk.WhatsappWebStatus = "blocked"
+		return nil
+	}
+	if r.StatusCode != 200 {
+		failureString := "http_request_failed" // MK uses it
+		tk.WhatsappWebFailure = &failureString
+		tk.WhatsappWebStatus = "blocked"
+	}
+	return nil
+}
+
+// processEndpoints processes the endpoints results. We consider an
+// endpoint blocked when we cannot connect to any of its ports and we
+// consider the endpoints blocked when all of them are blocked.
+func (tk *TestKeys) processEndpoints(v []*endpointMeasurements) error {
+	working := make(map[string]bool)
+	for _, entry := range v {
+		if entry == nil || entry.results == nil {
+			return errors.New("passed nil results")
+		}
+		tk.addResults(entry.results.TestKeys)
+		if _, found := working[entry.hostname]; !found {
+			working[entry.hostname] = false
+		}
+		if entry.results.Error == nil {
+			working[entry.hostname] = true
+		}
+	}
+	for hostname, ok := range working {
+		if !ok {
+			tk.WhatsappEndpointsBlocked = append(
+				tk.WhatsappEndpointsBlocked, hostname,
+			)
+		}
+	}
+	sort.Strings(tk.WhatsappEndpointsBlocked)
+	if len(working) > 0 && len(tk.WhatsappEndpointsBlocked) == len(working) {
+		tk.WhatsappEndpointsStatus = "blocked"
+	}
+	return nil
+}
+
+type measurer struct {
+	config Config
+}
+
+func newMeasurer(config Config) *measurer {
+	return &measurer{config: config}
+}
+
+func (m *measurer) measure(
+	ctx context.Context,
+	sess *session.Session,
+	measurement *model.Measurement,
+	callbacks handler.Callbacks,
 ) error {
-	settings := measurementkit.NewSettings(
-		"Whatsapp", sess.SoftwareName, sess.SoftwareVersion,
-		sess.CABundlePath(), sess.ProbeASNString(), sess.ProbeCC(),
-		sess.ProbeIP(), sess.ProbeNetworkName(), config.LogLevel,
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	// setup data containers
+	var urlmeasurements = map[string]*urlMeasurements{
+		registrationServiceURL: &urlMeasurements{},
+		webHTTPURL:             &urlMeasurements{},
+		webHTTPSURL:            &urlMeasurements{},
+	}
+	var endpoints []*endpointMeasurements
+	for _, hostname := range endpointNames() {
+		for range endpointPorts {
+			endpoints = append(endpoints, &endpointMeasurements{
+				hostname: hostname,
+			})
+		}
+	}
+	// run all measurements in parallel
+	var (
+		completed     int64
+		receivedBytes int64
+		sentBytes     int64
+		total         = len(urlmeasurements) + len(endpoints)
+		waitgroup     sync.WaitGroup
 	)
-	settings.Options.GeoIPASNPath = sess.ASNDatabasePath()
-	return mkrunner.Do(
-		settings, sess, measurement, callbacks, measurementkit.StartEx,
+	progress := func(description string, err error, tk *oonitemplates.Results) {
+		atomic.AddInt64(&sentBytes, tk.SentBytes)
+		atomic.AddInt64(&receivedBytes, tk.ReceivedBytes)
+		sofar := atomic.AddInt64(&completed, 1)
+		percentage := float64(sofar) / float64(total)
+		callbacks.OnProgress(percentage, fmt.Sprintf(
+			"whatsapp: access %s: %s", description, errString(err),
+		))
+	}
+	waitgroup.Add(total)
+	for key, entry := range urlmeasurements {
+		go func(key string, entry *urlMeasurements) {
+			defer waitgroup.Done()
+			if !randomSleep(ctx) {
+				return
+			}
+			entry.results = oonitemplates.HTTPDo(ctx, oonitemplates.HTTPDoConfig{
+				Accept:         httpheader.RandomAccept(),
+				AcceptLanguage: httpheader.RandomAcceptLanguage(),
+				Beginning:      measurement.MeasurementStartTimeSaved,
+				Handler:        netxlogger.NewHandler(sess.Logger),
+				Method:         "GET",
+				URL:            key,
+				UserAgent:      httpheader.RandomUserAgent(),
+			})
+			progress(key, entry.results.Error, &entry.results.TestKeys)
+		}(key, entry)
+	}
+	for idx, entry := range endpoints {
+		port := endpointPorts[idx%len(endpointPorts)]
+		go func(entry *endpointMeasurements, port string) {
+			defer waitgroup.Done()
+			if !randomSleep(ctx) {
+				return
+			}
+			address := net.JoinHostPort(entry.hostname, port)
+			entry.results = oonitemplates.TCPConnect(ctx, oonitemplates.TCPConnectConfig{
+				Address:   address,
+				Beginning: measurement.MeasurementStartTimeSaved,
+				Handler:   netxlogger.NewHandler(sess.Logger),
+			})
+			progress(address, entry.results.Error, &entry.results.TestKeys)
+		}(entry, port)
+	}
+	waitgroup.Wait()
+	// fill the measurement entry
+	testkeys := newTestKeys()
+	measurement.TestKeys = testkeys
+	err := testkeys.processall(urlmeasurements, endpoints)
+	callbacks.OnDataUsage(
+		float64(receivedBytes)/1024.0, // downloaded
+		float64(sentBytes)/1024.0,     // uploaded
 	)
+	return err
+}
+
+func (tk *TestKeys) processall(
+	urlmeasurements map[string]*urlMeasurements,
+	endpoints []*endpointMeasurements,
+) error {
+	if err := tk.processRegistration(
+		urlmeasurements[registrationServiceURL]); err != nil {
+		return err
+	}
+	for _, key := range []string{webHTTPURL, webHTTPSURL} {
+		if err := tk.processWeb(urlmeasurements[key]); err != nil {
+			return err
+		}
+	}
+	return tk.processEndpoints(endpoints)
+}
+
+// randomSleep sleeps for a random amount of time to avoid making all
+// requests concurrently. It returns false if the context is done.
+func randomSleep(ctx context.Context) bool {
+	gen := rand.New(rand.NewSource(time.Now().UnixNano()))
+	sleeptime := time.Duration(gen.Intn(5000)) * time.Millisecond
+	select {
+	case <-time.After(sleeptime):
+		return true
+	case <-ctx.Done():
+		return false
+	}
 }
 
 // NewExperiment creates a new experiment.
 func NewExperiment(
 	sess *session.Session, config Config,
 ) *experiment.Experiment {
-	return experiment.New(
-		sess, testName, testVersion,
-		func(
-			ctx context.Context,
-			sess *session.Session,
-			measurement *model.Measurement,
-			callbacks handler.Callbacks,
-		) error {
-			return measure(ctx, sess, measurement, callbacks, config)
-		})
+	return experiment.New(sess, testName, testVersion,
+		newMeasurer(config).measure)
+}
+
+func errString(err error) (s string) {
+	s = "success"
+	if err != nil {
+		s = err.Error()
+	}
+	return
 }
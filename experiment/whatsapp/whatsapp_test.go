@@ -1,13 +1,18 @@
-package whatsapp_test
+package whatsapp
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
 	"testing"
 
 	"github.com/apex/log"
-	"github.com/ooni/probe-engine/experiment/whatsapp"
+	"github.com/ooni/probe-engine/experiment/handler"
 	"github.com/ooni/probe-engine/internal/kvstore"
-	"github.com/ooni/probe-engine/measurementkit"
+	"github.com/ooni/probe-engine/internal/oonitemplates"
+	"github.com/ooni/probe-engine/model"
 	"github.com/ooni/probe-engine/session"
 )
 
@@ -16,35 +21,223 @@ const (
 	softwareVersion = "0.0.1"
 )
 
-func TestIntegration(t *testing.T) {
-	if !measurementkit.Available() {
-		t.Skip("Measurement Kit not available; skipping")
+func TestUnitNewExperiment(t *testing.T) {
+	sess := session.New(
+		log.Log, softwareName, softwareVersion,
+		"../../testdata", nil, nil, "../../testdata",
+		kvstore.NewMemoryKeyValueStore(),
+	)
+	experiment := NewExperiment(sess, Config{})
+	if experiment == nil {
+		t.Fatal("nil experiment returned")
 	}
-	log.SetLevel(log.DebugLevel)
-	ctx := context.Background()
+}
 
-	sess := session.New(
-		log.Log, softwareName, softwareVersion, "../../testdata", nil, nil,
-		"../../testdata", kvstore.NewMemoryKeyValueStore(),
+func TestUnitMeasureWithCancelledContext(t *testing.T) {
+	m := newMeasurer(Config{})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := m.measure(
+		ctx,
+		&session.Session{
+			Logger: log.Log,
+		},
+		new(model.Measurement),
+		handler.NewPrinterCallbacks(log.Log),
 	)
-	if err := sess.MaybeLookupBackends(ctx); err != nil {
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if err.Error() != "passed nil results" {
+		t.Fatal("unexpected error")
+	}
+}
+
+func TestUnitNewTestKeys(t *testing.T) {
+	data, err := json.Marshal(newTestKeys())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{
+		`"whatsapp_endpoints_blocked":[]`,
+		`"whatsapp_endpoints_dns_inconsistent":[]`,
+	} {
+		if !strings.Contains(string(data), key) {
+			t.Fatalf("missing %s in %s", key, string(data))
+		}
+	}
+}
+
+func TestIntegrationMeasure(t *testing.T) {
+	m := newMeasurer(Config{})
+	measurement := new(model.Measurement)
+	err := m.measure(
+		context.Background(),
+		&session.Session{
+			Logger: log.Log,
+		},
+		measurement,
+		handler.NewPrinterCallbacks(log.Log),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tk := measurement.TestKeys.(*TestKeys)
+	if tk.RegistrationServerStatus != "ok" {
+		t.Fatal("unexpected registration_server_status")
+	}
+	if tk.WhatsappEndpointsStatus != "ok" {
+		t.Fatal("unexpected whatsapp_endpoints_status")
+	}
+}
+
+func TestUnitEndpointNames(t *testing.T) {
+	names := endpointNames()
+	if len(names) != 16 {
+		t.Fatal("unexpected number of endpoints")
+	}
+	if names[0] != "e1.whatsapp.net" || names[15] != "e16.whatsapp.net" {
+		t.Fatal("unexpected endpoint names")
+	}
+}
+
+func TestUnitProcessRegistrationNil(t *testing.T) {
+	tk := newTestKeys()
+	err := tk.processRegistration(nil)
+	if err == nil || err.Error() != "passed nil results" {
+		t.Fatal("not the error we expected")
+	}
+}
+
+func TestUnitProcessRegistrationFailure(t *testing.T) {
+	tk := newTestKeys()
+	err := tk.processRegistration(&urlMeasurements{
+		results: &oonitemplates.HTTPDoResults{
+			Error: errors.New("mocked error"),
+		},
+	})
+	if err != nil {
 		t.Fatal(err)
 	}
-	if err := sess.MaybeLookupLocation(ctx); err != nil {
+	if tk.RegistrationServerStatus != "blocked" {
+		t.Fatal("RegistrationServerStatus should be blocked")
+	}
+	if *tk.RegistrationServerFailure != "mocked error" {
+		t.Fatal("invalid RegistrationServerFailure")
+	}
+}
+
+func TestUnitProcessWebWithFailure(t *testing.T) {
+	tk := newTestKeys()
+	err := tk.processall(map[string]*urlMeasurements{
+		registrationServiceURL: &urlMeasurements{
+			results: &oonitemplates.HTTPDoResults{StatusCode: 200},
+		},
+		webHTTPURL: &urlMeasurements{
+			results: &oonitemplates.HTTPDoResults{StatusCode: 200},
+		},
+		webHTTPSURL: &urlMeasurements{
+			results: &oonitemplates.HTTPDoResults{
+				Error: errors.New("mocked error"),
+			},
+		},
+	}, nil)
+	if err != nil {
 		t.Fatal(err)
 	}
+	if tk.RegistrationServerStatus != "ok" {
+		t.Fatal("RegistrationServerStatus should be ok")
+	}
+	if tk.WhatsappWebStatus != "blocked" {
+		t.Fatal("WhatsappWebStatus should be blocked")
+	}
+	if *tk.WhatsappWebFailure != "mocked error" {
+		t.Fatal("invalid WhatsappWebFailure")
+	}
+}
 
-	experiment := whatsapp.NewExperiment(sess, whatsapp.Config{})
-	if err := experiment.OpenReport(ctx); err != nil {
+func TestUnitProcessWebWithBadRequest(t *testing.T) {
+	tk := newTestKeys()
+	err := tk.processWeb(&urlMeasurements{
+		results: &oonitemplates.HTTPDoResults{StatusCode: 400},
+	})
+	if err != nil {
 		t.Fatal(err)
 	}
-	defer experiment.CloseReport(ctx)
+	if tk.WhatsappWebStatus != "blocked" {
+		t.Fatal("WhatsappWebStatus should be blocked")
+	}
+	if *tk.WhatsappWebFailure != "http_request_failed" {
+		t.Fatal("invalid WhatsappWebFailure")
+	}
+}
 
-	measurement, err := experiment.Measure(ctx, "")
+func TestUnitProcessEndpointsWithSomeBlocked(t *testing.T) {
+	tk := newTestKeys()
+	err := tk.processEndpoints([]*endpointMeasurements{
+		&endpointMeasurements{
+			hostname: "e1.whatsapp.net",
+			results: &oonitemplates.TCPConnectResults{
+				Error: errors.New("mocked error"),
+			},
+		},
+		&endpointMeasurements{
+			hostname: "e1.whatsapp.net",
+			results: &oonitemplates.TCPConnectResults{
+				Error: nil, // one port is enough to declare success
+			},
+		},
+		&endpointMeasurements{
+			hostname: "e2.whatsapp.net",
+			results: &oonitemplates.TCPConnectResults{
+				Error: errors.New("mocked error"),
+			},
+		},
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
-	if err := experiment.SubmitMeasurement(ctx, &measurement); err != nil {
+	if tk.WhatsappEndpointsStatus != "ok" {
+		t.Fatal("WhatsappEndpointsStatus should be ok")
+	}
+	if len(tk.WhatsappEndpointsBlocked) != 1 ||
+		tk.WhatsappEndpointsBlocked[0] != "e2.whatsapp.net" {
+		t.Fatal("invalid WhatsappEndpointsBlocked")
+	}
+}
+
+func TestUnitProcessEndpointsWithAllBlocked(t *testing.T) {
+	tk := newTestKeys()
+	err := tk.processEndpoints([]*endpointMeasurements{
+		&endpointMeasurements{
+			hostname: "e1.whatsapp.net",
+			results: &oonitemplates.TCPConnectResults{
+				Error: errors.New("mocked error"),
+			},
+		},
+		&endpointMeasurements{
+			hostname: "e2.whatsapp.net",
+			results: &oonitemplates.TCPConnectResults{
+				Error: errors.New("mocked error"),
+			},
+		},
+	})
+	if err != nil {
 		t.Fatal(err)
 	}
+	if tk.WhatsappEndpointsStatus != "blocked" {
+		t.Fatal("WhatsappEndpointsStatus should be blocked")
+	}
+	if len(tk.WhatsappEndpointsBlocked) != 2 {
+		t.Fatal("invalid WhatsappEndpointsBlocked")
+	}
+}
+
+func TestUnitErrString(t *testing.T) {
+	if errString(nil) != "success" {
+		t.Fatal("unexpected value with nil error")
+	}
+	if errString(io.EOF) != "EOF" {
+		t.Fatal("unexpected value with real error")
+	}
 }
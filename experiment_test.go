@@ -1,13 +1,17 @@
 package engine
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/ooni/probe-engine/experiment/example"
 	"github.com/ooni/probe-engine/measurementkit"
+	"github.com/ooni/probe-engine/model"
 )
 
 func TestCreateAll(t *testing.T) {
@@ -291,6 +295,54 @@ func TestMakeGenericTestKeysMarshalError(t *testing.T) {
 	}
 }
 
+func TestPerformanceSummaryFromGoTestKeys(t *testing.T) {
+	m := &Measurement{m: model.Measurement{
+		TestName: "ndt7",
+		TestKeys: struct {
+			PerformanceSummary *model.PerformanceSummary `json:"performance_summary"`
+		}{&model.PerformanceSummary{Download: 1e06, Server: "localhost"}},
+	}}
+	summary, err := m.PerformanceSummary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Download != 1e06 || summary.Server != "localhost" {
+		t.Fatalf("unexpected summary: %+v", summary)
+	}
+}
+
+func TestPerformanceSummaryFromMKTestKeys(t *testing.T) {
+	m := &Measurement{m: model.Measurement{
+		TestName: "ndt",
+		TestKeys: map[string]interface{}{
+			"server_address": "neubot.mlab.mlab1.trn01.measurement-lab.org",
+			"simple": map[string]interface{}{
+				"download": 2000.0,
+				"ping":     40.0,
+				"upload":   1000.0,
+			},
+		},
+	}}
+	summary, err := m.PerformanceSummary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Download != 2e06 || summary.Upload != 1e06 || summary.Latency != 0.04 ||
+		summary.Server != "neubot.mlab.mlab1.trn01.measurement-lab.org" {
+		t.Fatalf("unexpected summary: %+v", summary)
+	}
+}
+
+func TestPerformanceSummaryWithNoSummary(t *testing.T) {
+	m := &Measurement{m: model.Measurement{
+		TestName: "web_connectivity",
+		TestKeys: map[string]interface{}{},
+	}}
+	if _, err := m.PerformanceSummary(); err != ErrNoPerformanceSummary {
+		t.Fatal("not the error we expected")
+	}
+}
+
 func TestOptions(t *testing.T) {
 	t.Run("when config is not a pointer", func(t *testing.T) {
 		b := &ExperimentBuilder{
@@ -438,3 +490,55 @@ func TestLoadMeasurement(t *testing.T) {
 		}
 	})
 }
+
+func TestSaveAndLoadEncryptedMeasurements(t *testing.T) {
+	sess := newSessionForTesting(t)
+	builder, err := sess.NewExperimentBuilder("example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	experiment := builder.Build()
+	data, err := ioutil.ReadFile("testdata/loadable-measurement-example.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	measurement, err := experiment.LoadMeasurement(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempdir, err := ioutil.TempDir("", "ooniprobe-engine-encrypted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempdir)
+	path := filepath.Join(tempdir, "report.jsonl")
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	for i := 0; i < 2; i++ {
+		if err := experiment.SaveMeasurementEncrypted(measurement, path, secret); err != nil {
+			t.Fatal(err)
+		}
+	}
+	saved, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(saved, []byte(`"test_name"`)) {
+		t.Fatal("the measurement was saved in cleartext")
+	}
+	measurements, err := experiment.LoadEncryptedMeasurements(path, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(measurements) != 2 {
+		t.Fatal("unexpected number of measurements")
+	}
+	wrongSecret := []byte("fedcba9876543210fedcba9876543210")
+	if _, err := experiment.LoadEncryptedMeasurements(path, wrongSecret); err == nil {
+		t.Fatal("expected an error with the wrong secret")
+	}
+	if err := experiment.SaveMeasurementEncrypted(
+		measurement, path, []byte("short"),
+	); err == nil {
+		t.Fatal("expected an error with a short secret")
+	}
+}
@@ -20,7 +20,7 @@ require (
 	github.com/armon/go-socks5 v0.0.0-20160902184237-e75332964ef5 // indirect
 	github.com/avast/retry-go v2.4.3+incompatible
 	github.com/bifurcation/mint v0.0.0-20180306135233-198357931e61 // indirect
-	github.com/boltdb/bolt v1.3.1 // indirect
+	github.com/boltdb/bolt v1.3.1
 	github.com/cognusion/go-cache-lru v0.0.0-20170419142635-f73e2280ecea // indirect
 	github.com/creack/goselect v0.0.0-20160714172859-1bd5ca702c61 // indirect
 	github.com/deckarep/golang-set v0.0.0-20171013212420-1d4478f51bed // indirect
@@ -30,11 +30,15 @@ require (
 	github.com/elazarl/goproxy v0.0.0-20171101143503-a96fa3a31826 // indirect
 	github.com/gobwas/glob v0.2.4-0.20180402141543-f00a7392b439 // indirect
 	github.com/google/gxui v0.0.0-20151028112939-f85e0a97b3a4 // indirect
+	github.com/google/uuid v1.1.1
 	github.com/grafov/m3u8 v0.0.0-20171211212457-6ab8f28ed427 // indirect
 	github.com/juju/ratelimit v1.0.2-0.20191002062651-f60b32039441 // indirect
+	github.com/lucas-clemente/quic-go v0.14.1
 	github.com/m-lab/go v1.2.2
 	github.com/m-lab/ndt7-client-go v0.2.0
+	github.com/m-lab/tcp-info v1.3.0
 	github.com/marusama/semaphore v0.0.0-20171214154724-565ffd8e868a // indirect
+	github.com/miekg/dns v1.1.27
 	github.com/montanaflynn/stats v0.5.0
 	github.com/neubot/dash v0.4.1
 	github.com/ooni/netx v0.0.0-20200113102411-24ca17149d15
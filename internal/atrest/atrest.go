@@ -0,0 +1,82 @@
+// Package atrest contains code to encrypt data stored on disk.
+//
+// We use AES-256-GCM, which provides authenticated encryption. The
+// key is derived from a secret supplied by the application. Each
+// sealed blob is the concatenation of a version byte, a random nonce
+// and the ciphertext (including the authentication tag).
+package atrest
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+)
+
+// MinSecretLength is the minimum length of the secret.
+const MinSecretLength = 16
+
+const version = 1
+
+var (
+	// ErrSecretTooShort indicates that the secret is too short.
+	ErrSecretTooShort = errors.New("atrest: secret is too short")
+
+	// ErrInvalidData indicates that the sealed data is invalid.
+	ErrInvalidData = errors.New("atrest: invalid sealed data")
+)
+
+// Sealer seals and opens data using a key derived from a secret.
+type Sealer struct {
+	aead   cipher.AEAD
+	reader io.Reader
+}
+
+// NewSealer creates a new Sealer. The purpose argument is used to derive
+// different keys from the same secret for different uses, such that, e.g.,
+// we cannot confuse a sealed key-value pair with a sealed measurement.
+func NewSealer(secret []byte, purpose string) (*Sealer, error) {
+	if len(secret) < MinSecretLength {
+		return nil, ErrSecretTooShort
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(purpose))
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Sealer{aead: aead, reader: rand.Reader}, nil
+}
+
+// Seal encrypts and authenticates plaintext and authenticates additional
+// data. The additional data is not part of the returned sealed blob, so
+// you must supply the same additional data when calling Open.
+func (s *Sealer) Seal(plaintext, additional []byte) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := io.ReadFull(s.reader, nonce); err != nil {
+		return nil, err
+	}
+	out := append([]byte{version}, nonce...)
+	return s.aead.Seal(out, nonce, plaintext, additional), nil
+}
+
+// Open is the opposite of Seal.
+func (s *Sealer) Open(sealed, additional []byte) ([]byte, error) {
+	noncesize := s.aead.NonceSize()
+	if len(sealed) < 1+noncesize || sealed[0] != version {
+		return nil, ErrInvalidData
+	}
+	nonce, ciphertext := sealed[1:1+noncesize], sealed[1+noncesize:]
+	plaintext, err := s.aead.Open(nil, nonce, ciphertext, additional)
+	if err != nil {
+		return nil, ErrInvalidData
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,76 @@
+package atrest
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+var secret = []byte("0123456789abcdef0123456789abcdef")
+
+func TestUnitSealOpen(t *testing.T) {
+	sealer, err := NewSealer(secret, "testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := []byte(`{"ClientID":"antani","Password":"mascetti"}`)
+	sealed, err := sealer.Seal(plaintext, []byte("orchestra.state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, []byte("mascetti")) {
+		t.Fatal("the sealed data contains the plaintext")
+	}
+	opened, err := sealer.Open(sealed, []byte("orchestra.state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(opened, plaintext) {
+		t.Fatal("opened data differs from plaintext")
+	}
+	if _, err := sealer.Open(sealed, []byte("other.key")); err != ErrInvalidData {
+		t.Fatal("expected failure with different additional data")
+	}
+	other, err := NewSealer(secret, "other purpose")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Open(sealed, []byte("orchestra.state")); err != ErrInvalidData {
+		t.Fatal("expected failure with key for different purpose")
+	}
+}
+
+func TestUnitOpenInvalidData(t *testing.T) {
+	sealer, err := NewSealer(secret, "testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, input := range [][]byte{nil, []byte{version}, []byte{17, 1, 2, 3}} {
+		if _, err := sealer.Open(input, nil); err != ErrInvalidData {
+			t.Fatal("not the error we expected")
+		}
+	}
+}
+
+func TestUnitNewSealerSecretTooShort(t *testing.T) {
+	if _, err := NewSealer([]byte("antani"), "testing"); err != ErrSecretTooShort {
+		t.Fatal("not the error we expected")
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("mocked error")
+}
+
+func TestUnitSealRandomFailure(t *testing.T) {
+	sealer, err := NewSealer(secret, "testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealer.reader = failingReader{}
+	if _, err := sealer.Seal([]byte("antani"), nil); err == nil {
+		t.Fatal("expected an error here")
+	}
+}
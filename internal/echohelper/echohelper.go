@@ -0,0 +1,114 @@
+// Package echohelper contains test helpers that echo back what the
+// client has sent to them, i.e., the http-return-json-headers helper
+// and the tcp-echo helper. We use these helpers to detect middleboxes
+// by comparing what we sent with what the helper has received.
+package echohelper
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// maxHeadSize is the maximum size of the request head.
+	maxHeadSize = 1 << 16
+
+	// maxHeaders is the maximum number of headers we accept.
+	maxHeaders = 128
+
+	// timeout is the maximum lifetime of a connection.
+	timeout = 10 * time.Second
+)
+
+// Serve accepts connections from listener and handles each of them in
+// a background goroutine using handler. It returns when Accept fails,
+// e.g., because the listener has been closed.
+func Serve(listener net.Listener, handler func(net.Conn)) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go handler(conn)
+	}
+}
+
+// JSONHeadersResponse is the response of the http-return-json-headers
+// helper. RequestHeaders contains the [name, value] pairs in the same
+// order and with the same case in which we have received them.
+type JSONHeadersResponse struct {
+	HeadersDict    map[string][]string `json:"headers_dict"`
+	RequestHeaders [][]string          `json:"request_headers"`
+	RequestLine    string              `json:"request_line"`
+}
+
+// HTTPReturnJSONHeaders implements the http-return-json-headers helper. We
+// read the request head from conn and we reply with a JSONHeadersResponse
+// containing the request line and the headers we have received. We do
+// not use net/http because it would canonicalize the headers names.
+func HTTPReturnJSONHeaders(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	resp, err := readRequestHead(bufio.NewReader(io.LimitReader(conn, maxHeadSize)))
+	if err != nil {
+		conn.Write([]byte("HTTP/1.1 400 Bad Request\r\nConnection: close\r\n\r\n"))
+		return
+	}
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\n"+
+		"Content-Type: application/json\r\n"+
+		"Content-Length: %d\r\n"+
+		"Connection: close\r\n\r\n", len(data))
+	conn.Write(data)
+}
+
+func readRequestHead(reader *bufio.Reader) (*JSONHeadersResponse, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	resp := &JSONHeadersResponse{
+		HeadersDict:    make(map[string][]string),
+		RequestHeaders: [][]string{},
+		RequestLine:    strings.TrimRight(line, "\r\n"),
+	}
+	for len(resp.RequestHeaders) < maxHeaders {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			return resp, nil
+		}
+		idx := strings.Index(line, ":")
+		if idx <= 0 {
+			return nil, errors.New("echohelper: invalid header line")
+		}
+		key, value := line[:idx], strings.TrimSpace(line[idx+1:])
+		resp.RequestHeaders = append(resp.RequestHeaders, []string{key, value})
+		resp.HeadersDict[key] = append(resp.HeadersDict[key], value)
+	}
+	return nil, errors.New("echohelper: too many headers")
+}
+
+// maxEchoSize is the maximum number of bytes echoed by TCPEcho.
+const maxEchoSize = 1 << 16
+
+// TCPEcho implements the tcp-echo helper. We send back to the client
+// whatever we read from conn, until the client closes the connection
+// or the connection lifetime expires.
+func TCPEcho(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	io.Copy(conn, io.LimitReader(conn, maxEchoSize))
+}
@@ -0,0 +1,113 @@
+package echohelper
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func listen(t *testing.T, handler func(net.Conn)) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go Serve(listener, handler)
+	return listener
+}
+
+func TestUnitHTTPReturnJSONHeaders(t *testing.T) {
+	listener := listen(t, HTTPReturnJSONHeaders)
+	defer listener.Close()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	request := "GeT / HTTP/1.1\r\nhOsT: antani\r\nX-Antani: a\r\nX-Antani: b\r\n\r\n"
+	if _, err := conn.Write([]byte(request)); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.SplitN(string(data), "\r\n\r\n", 2)
+	if len(parts) != 2 || !strings.HasPrefix(parts[0], "HTTP/1.1 200 OK\r\n") {
+		t.Fatal("unexpected response")
+	}
+	var resp JSONHeadersResponse
+	if err := json.Unmarshal([]byte(parts[1]), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.RequestLine != "GeT / HTTP/1.1" {
+		t.Fatal("unexpected request line")
+	}
+	if len(resp.RequestHeaders) != 3 || resp.RequestHeaders[0][0] != "hOsT" {
+		t.Fatal("unexpected request headers")
+	}
+	if len(resp.HeadersDict["X-Antani"]) != 2 {
+		t.Fatal("unexpected headers dict")
+	}
+}
+
+func TestUnitHTTPReturnJSONHeadersInvalidHeader(t *testing.T) {
+	listener := listen(t, HTTPReturnJSONHeaders)
+	defer listener.Close()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("GET / HTTP/1.1\r\nantani\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "HTTP/1.1 400 Bad Request\r\n") {
+		t.Fatal("unexpected response")
+	}
+}
+
+func TestUnitHTTPReturnJSONHeadersWithGoClient(t *testing.T) {
+	listener := listen(t, HTTPReturnJSONHeaders)
+	defer listener.Close()
+	resp, err := http.Get("http://" + listener.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var out JSONHeadersResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	if out.RequestLine != "GET / HTTP/1.1" {
+		t.Fatal("unexpected request line")
+	}
+}
+
+func TestUnitTCPEcho(t *testing.T) {
+	listener := listen(t, TCPEcho)
+	defer listener.Close()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	message := []byte("XxXx / HTTP/1.1\n\r")
+	if _, err := conn.Write(message); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, len(message))
+	if _, err := io.ReadFull(conn, data); err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(message) {
+		t.Fatal("the helper did not echo back our message")
+	}
+}
@@ -3,19 +3,38 @@ package kvstore
 
 import (
 	"errors"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
+// ErrNoSuchKey indicates that a key does not exist.
+var ErrNoSuchKey = errors.New("no such key")
+
 // MemoryKeyValueStore is an in-memory key-value store
 type MemoryKeyValueStore struct {
-	m  map[string][]byte
-	mu sync.Mutex
+	expiry map[string]time.Time
+	m      map[string][]byte
+	mu     sync.Mutex
+	now    func() time.Time
 }
 
 // NewMemoryKeyValueStore creates a new in-memory key-value store
 func NewMemoryKeyValueStore() *MemoryKeyValueStore {
 	return &MemoryKeyValueStore{
-		m: make(map[string][]byte),
+		expiry: make(map[string]time.Time),
+		m:      make(map[string][]byte),
+		now:    time.Now,
+	}
+}
+
+// expireLocked removes key if it is expired. This function
+// assumes that the caller is holding the mutex.
+func (kvs *MemoryKeyValueStore) expireLocked(key string) {
+	if t, ok := kvs.expiry[key]; ok && !kvs.now().Before(t) {
+		delete(kvs.expiry, key)
+		delete(kvs.m, key)
 	}
 }
 
@@ -28,9 +47,10 @@ func (kvs *MemoryKeyValueStore) Get(key string) ([]byte, error) {
 	)
 	kvs.mu.Lock()
 	defer kvs.mu.Unlock()
+	kvs.expireLocked(key)
 	value, ok = kvs.m[key]
 	if !ok {
-		err = errors.New("no such key")
+		err = ErrNoSuchKey
 	}
 	return value, err
 }
@@ -39,6 +59,53 @@ func (kvs *MemoryKeyValueStore) Get(key string) ([]byte, error) {
 func (kvs *MemoryKeyValueStore) Set(key string, value []byte) error {
 	kvs.mu.Lock()
 	defer kvs.mu.Unlock()
+	delete(kvs.expiry, key)
 	kvs.m[key] = value
 	return nil
 }
+
+// SetWithTTL is like Set but the key expires after ttl
+func (kvs *MemoryKeyValueStore) SetWithTTL(
+	key string, value []byte, ttl time.Duration,
+) error {
+	kvs.mu.Lock()
+	defer kvs.mu.Unlock()
+	kvs.expiry[key] = kvs.now().Add(ttl)
+	kvs.m[key] = value
+	return nil
+}
+
+// Delete removes a key from the key value store. Deleting
+// a key that does not exist is not an error.
+func (kvs *MemoryKeyValueStore) Delete(key string) error {
+	kvs.mu.Lock()
+	defer kvs.mu.Unlock()
+	delete(kvs.expiry, key)
+	delete(kvs.m, key)
+	return nil
+}
+
+// Keys returns the sorted list of keys starting with prefix. An
+// empty prefix means that we should return all keys.
+func (kvs *MemoryKeyValueStore) Keys(prefix string) ([]string, error) {
+	kvs.mu.Lock()
+	defer kvs.mu.Unlock()
+	var out []string
+	for key := range kvs.m {
+		kvs.expireLocked(key)
+		if _, ok := kvs.m[key]; ok && strings.HasPrefix(key, prefix) {
+			out = append(out, key)
+		}
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// Wipe removes all the keys from the key value store
+func (kvs *MemoryKeyValueStore) Wipe() error {
+	kvs.mu.Lock()
+	defer kvs.mu.Unlock()
+	kvs.expiry = make(map[string]time.Time)
+	kvs.m = make(map[string][]byte)
+	return nil
+}
@@ -1,6 +1,9 @@
 package kvstore
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 func TestUnitNoSuchKey(t *testing.T) {
 	kvs := NewMemoryKeyValueStore()
@@ -26,3 +29,82 @@ func TestUnitExistingKey(t *testing.T) {
 		t.Fatal("not the result we expected")
 	}
 }
+
+func TestUnitWipe(t *testing.T) {
+	kvs := NewMemoryKeyValueStore()
+	if err := kvs.Set("antani", []byte("mascetti")); err != nil {
+		t.Fatal(err)
+	}
+	if err := kvs.Wipe(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kvs.Get("antani"); err == nil {
+		t.Fatal("expected an error here")
+	}
+}
+
+func TestUnitDeleteAndKeys(t *testing.T) {
+	kvs := NewMemoryKeyValueStore()
+	for _, key := range []string{"cache.b", "cache.a", "queue.a"} {
+		if err := kvs.Set(key, []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keys, err := kvs.Keys("cache.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0] != "cache.a" || keys[1] != "cache.b" {
+		t.Fatal("unexpected keys")
+	}
+	if err := kvs.Delete("cache.a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := kvs.Delete("nonexistent"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kvs.Get("cache.a"); err != ErrNoSuchKey {
+		t.Fatal("not the error we expected")
+	}
+	keys, err = kvs.Keys("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Fatal("unexpected number of keys")
+	}
+}
+
+func TestUnitSetWithTTL(t *testing.T) {
+	kvs := NewMemoryKeyValueStore()
+	now := time.Now()
+	kvs.now = func() time.Time { return now }
+	if err := kvs.SetWithTTL("antani", []byte("mascetti"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kvs.Get("antani"); err != nil {
+		t.Fatal(err)
+	}
+	kvs.now = func() time.Time { return now.Add(2 * time.Minute) }
+	keys, err := kvs.Keys("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Fatal("expired key has been listed")
+	}
+	if _, err := kvs.Get("antani"); err != ErrNoSuchKey {
+		t.Fatal("not the error we expected")
+	}
+	// Set without TTL should clear a previous TTL
+	if err := kvs.SetWithTTL("antani", []byte("mascetti"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := kvs.Set("antani", []byte("mascetti")); err != nil {
+		t.Fatal(err)
+	}
+	kvs.now = func() time.Time { return now.Add(time.Hour) }
+	if _, err := kvs.Get("antani"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,587 @@
+// Package ndt5 contains a client for the legacy NDT protocol, also
+// known as ndt5. We implement the JSON flavour of the protocol (i.e.,
+// the one using MSG_EXTENDED_LOGIN) and the C2S, S2C and META tests.
+//
+// See https://github.com/ndt-project/ndt/wiki/NDTProtocol.
+package ndt5
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/m-lab/tcp-info/tcp"
+	"github.com/ooni/probe-engine/log"
+)
+
+// Message types used by the NDT protocol.
+const (
+	msgCommFailure = iota
+	msgSrvQueue
+	msgLogin
+	msgTestPrepare
+	msgTestStart
+	msgTestMsg
+	msgTestFinalize
+	msgError
+	msgResults
+	msgLogout
+	msgWaiting
+	msgExtendedLogin
+)
+
+// Test identifiers used by the NDT protocol.
+const (
+	testC2S    = 1 << 1
+	testS2C    = 1 << 2
+	testStatus = 1 << 4
+	testMeta   = 1 << 5
+)
+
+// Special values of the SRV_QUEUE message.
+const (
+	srvQueueHeartbeat   = "9990"
+	srvQueueServerBusy  = "9987"
+	srvQueueServerFault = "9977"
+	srvQueueReady       = "0"
+)
+
+const (
+	// DefaultPort is the default port of ndt5 servers.
+	DefaultPort = "3001"
+
+	// DefaultDuration is the default duration of C2S and S2C.
+	DefaultDuration = 10 * time.Second
+
+	// kickoff is the legacy message the server sends after login.
+	kickoff = "123456 654321"
+
+	// progressInterval is the interval between OnProgress calls.
+	progressInterval = 250 * time.Millisecond
+
+	// version is the protocol version we claim to speak.
+	version = "v3.7.0"
+)
+
+// ErrServerBusy indicates that the server cannot serve us now.
+var ErrServerBusy = errors.New("ndt5: server busy")
+
+// ErrTCPInfoNotSupported indicates that we cannot read TCP_INFO
+// on this platform, hence we don't collect client side samples.
+var ErrTCPInfoNotSupported = errors.New("ndt5: TCP_INFO not supported")
+
+// TCPInfo is a sample of the client side TCP_INFO.
+type TCPInfo struct {
+	// Elapsed is the time elapsed since the beginning of the test in seconds.
+	Elapsed float64 `json:"elapsed"`
+
+	// TCPInfo is the TCP_INFO of the connection.
+	TCPInfo *tcp.LinuxTCPInfo `json:"tcp_info"`
+}
+
+// C2SResults contains the results of the C2S (upload) test.
+type C2SResults struct {
+	// ClientThroughput is the throughput measured by us in kbit/s.
+	ClientThroughput float64 `json:"client_throughput"`
+
+	// Elapsed is the duration of the test in seconds.
+	Elapsed float64 `json:"elapsed"`
+
+	// NumBytes is the number of bytes we have sent.
+	NumBytes int64 `json:"num_bytes"`
+
+	// ServerThroughput is the throughput measured by the server in kbit/s.
+	ServerThroughput float64 `json:"server_throughput"`
+
+	// TCPInfo contains the TCP_INFO samples we have collected on
+	// the client side. It is empty when TCP_INFO is not available.
+	TCPInfo []TCPInfo `json:"tcp_info"`
+}
+
+// S2CResults contains the results of the S2C (download) test.
+type S2CResults struct {
+	// ClientThroughput is the throughput measured by us in kbit/s.
+	ClientThroughput float64 `json:"client_throughput"`
+
+	// Elapsed is the duration of the test in seconds.
+	Elapsed float64 `json:"elapsed"`
+
+	// NumBytes is the number of bytes we have received.
+	NumBytes int64 `json:"num_bytes"`
+
+	// ServerThroughput is the throughput measured by the server in kbit/s.
+	ServerThroughput float64 `json:"server_throughput"`
+
+	// TCPInfo contains the TCP_INFO samples we have collected on
+	// the client side. It is empty when TCP_INFO is not available.
+	TCPInfo []TCPInfo `json:"tcp_info"`
+
+	// TotalSentBytes is the number of bytes sent by the server.
+	TotalSentBytes int64 `json:"total_sent_bytes"`
+
+	// UnsentData is the amount of data queued but not sent by the server.
+	UnsentData int64 `json:"unsent_data"`
+
+	// Web100 is the snapshot of the server side TCP state, which
+	// includes the TCPInfo.* variables where the server supports them.
+	Web100 map[string]string `json:"web100_data"`
+}
+
+// Results contains the results of an ndt5 measurement.
+type Results struct {
+	ServerAddress string      `json:"server_address"`
+	ServerResults []string    `json:"server_results"`
+	ServerVersion string      `json:"server_version"`
+	C2S           *C2SResults `json:"test_c2s"`
+	S2C           *S2CResults `json:"test_s2c"`
+}
+
+// Client is an ndt5 client.
+type Client struct {
+	// Duration is the expected duration of C2S and S2C. If zero, we
+	// use DefaultDuration.
+	Duration time.Duration
+
+	// Logger is the logger to use.
+	Logger log.Logger
+
+	// OnProgress is an optional callback called periodically while
+	// running C2S ("upload") and S2C ("download").
+	OnProgress func(test string, elapsed time.Duration, numBytes int64)
+
+	// Server is the server address. If the port is missing, we
+	// will use DefaultPort.
+	Server string
+
+	// SoftwareName is the name of the software running the test.
+	SoftwareName string
+
+	// SoftwareVersion is the version of the software running the test.
+	SoftwareVersion string
+}
+
+// Run runs the ndt5 tests. On failure, it returns the error along
+// with the results we have collected so far.
+func (c *Client) Run(ctx context.Context) (*Results, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := &Results{ServerAddress: c.Server}
+	address := c.Server
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, DefaultPort)
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return results, err
+	}
+	conn, err := dial(ctx, address)
+	if err != nil {
+		return results, err
+	}
+	defer conn.Close()
+	cc := &controlConn{conn: conn}
+	if err := cc.login(); err != nil {
+		return results, err
+	}
+	if results.ServerVersion, err = cc.readString(msgLogin); err != nil {
+		return results, err
+	}
+	c.Logger.Debugf("ndt5: server version: %s", results.ServerVersion)
+	tests, err := cc.readString(msgLogin)
+	if err != nil {
+		return results, err
+	}
+	for _, test := range strings.Fields(tests) {
+		switch test {
+		case strconv.Itoa(testC2S):
+			results.C2S, err = c.runC2S(ctx, cc, host)
+		case strconv.Itoa(testS2C):
+			results.S2C, err = c.runS2C(ctx, cc, host)
+		case strconv.Itoa(testMeta):
+			err = c.runMeta(cc)
+		default:
+			err = fmt.Errorf("ndt5: unexpected test: %s", test)
+		}
+		if err != nil {
+			return results, err
+		}
+	}
+	for {
+		kind, payload, err := cc.readMessage()
+		if err != nil {
+			return results, err
+		}
+		if kind == msgLogout {
+			return results, nil
+		}
+		if kind != msgResults {
+			return results, fmt.Errorf("ndt5: unexpected message: %d", kind)
+		}
+		msg, err := decodeMsg(payload)
+		if err != nil {
+			return results, err
+		}
+		results.ServerResults = append(results.ServerResults, msg)
+	}
+}
+
+func (c *Client) duration() time.Duration {
+	if c.Duration > 0 {
+		return c.Duration
+	}
+	return DefaultDuration
+}
+
+func (c *Client) progress(test string, begin time.Time, numBytes int64) {
+	if c.OnProgress != nil {
+		c.OnProgress(test, time.Since(begin), numBytes)
+	}
+}
+
+func (c *Client) runC2S(
+	ctx context.Context, cc *controlConn, host string,
+) (*C2SResults, error) {
+	conn, err := c.prepare(ctx, cc, host)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	results := new(C2SResults)
+	buffer := make([]byte, 1<<13)
+	rand.Read(buffer)
+	begin := time.Now()
+	conn.SetWriteDeadline(begin.Add(c.duration()))
+	last := begin
+	for {
+		count, err := conn.Write(buffer)
+		results.NumBytes += int64(count)
+		if err != nil {
+			if !isTimeout(err) {
+				return nil, err
+			}
+			break
+		}
+		if time.Since(last) >= progressInterval {
+			c.progress("upload", begin, results.NumBytes)
+			results.TCPInfo = sampleTCPInfo(conn, begin, results.TCPInfo)
+			last = time.Now()
+		}
+	}
+	results.TCPInfo = sampleTCPInfo(conn, begin, results.TCPInfo)
+	results.Elapsed = time.Since(begin).Seconds()
+	results.ClientThroughput = throughput(results.NumBytes, results.Elapsed)
+	conn.Close() // tell the server we're done
+	msg, err := cc.readString(msgTestMsg)
+	if err != nil {
+		return nil, err
+	}
+	if results.ServerThroughput, err = strconv.ParseFloat(
+		strings.TrimSpace(msg), 64); err != nil {
+		return nil, err
+	}
+	if _, err := cc.readString(msgTestFinalize); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (c *Client) runS2C(
+	ctx context.Context, cc *controlConn, host string,
+) (*S2CResults, error) {
+	conn, err := c.prepare(ctx, cc, host)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	results := &S2CResults{Web100: make(map[string]string)}
+	buffer := make([]byte, 1<<13)
+	begin := time.Now()
+	// Give the server some extra time to complete the test
+	conn.SetReadDeadline(begin.Add(c.duration() + 5*time.Second))
+	last := begin
+	for {
+		count, err := conn.Read(buffer)
+		results.NumBytes += int64(count)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if time.Since(last) >= progressInterval {
+			c.progress("download", begin, results.NumBytes)
+			results.TCPInfo = sampleTCPInfo(conn, begin, results.TCPInfo)
+			last = time.Now()
+		}
+	}
+	results.TCPInfo = sampleTCPInfo(conn, begin, results.TCPInfo)
+	results.Elapsed = time.Since(begin).Seconds()
+	results.ClientThroughput = throughput(results.NumBytes, results.Elapsed)
+	kind, payload, err := cc.readMessage()
+	if err != nil {
+		return nil, err
+	}
+	if kind != msgTestMsg {
+		return nil, fmt.Errorf("ndt5: unexpected message: %d", kind)
+	}
+	if err := parseS2CResults(payload, results); err != nil {
+		return nil, err
+	}
+	if err := cc.writeString(msgTestMsg, strconv.FormatFloat(
+		results.ClientThroughput, 'f', -1, 64)); err != nil {
+		return nil, err
+	}
+	for {
+		kind, payload, err := cc.readMessage()
+		if err != nil {
+			return nil, err
+		}
+		if kind == msgTestFinalize {
+			return results, nil
+		}
+		if kind != msgTestMsg {
+			return nil, fmt.Errorf("ndt5: unexpected message: %d", kind)
+		}
+		msg, err := decodeMsg(payload)
+		if err != nil {
+			return nil, err
+		}
+		parseWeb100(msg, results.Web100)
+	}
+}
+
+func (c *Client) runMeta(cc *controlConn) error {
+	if _, err := cc.readString(msgTestPrepare); err != nil {
+		return err
+	}
+	if _, err := cc.readString(msgTestStart); err != nil {
+		return err
+	}
+	for _, msg := range []string{
+		"client.os.name:" + runtime.GOOS,
+		"client.application:" + c.SoftwareName + "/" + c.SoftwareVersion,
+		"", // signals the end of the metadata
+	} {
+		if err := cc.writeString(msgTestMsg, msg); err != nil {
+			return err
+		}
+	}
+	_, err := cc.readString(msgTestFinalize)
+	return err
+}
+
+// prepare handles TEST_PREPARE and TEST_START and returns the
+// connection to use for transferring data.
+func (c *Client) prepare(
+	ctx context.Context, cc *controlConn, host string,
+) (net.Conn, error) {
+	msg, err := cc.readString(msgTestPrepare)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(msg)
+	if len(fields) < 1 {
+		return nil, errors.New("ndt5: missing port in TEST_PREPARE")
+	}
+	conn, err := dial(ctx, net.JoinHostPort(host, fields[0]))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := cc.readString(msgTestStart); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// controlConn is the connection used for the control protocol.
+type controlConn struct {
+	conn net.Conn
+}
+
+func (cc *controlConn) login() error {
+	data, err := json.Marshal(map[string]string{
+		"msg":   version,
+		"tests": strconv.Itoa(testC2S | testS2C | testStatus | testMeta),
+	})
+	if err != nil {
+		return err
+	}
+	if err := cc.writeMessage(msgExtendedLogin, data); err != nil {
+		return err
+	}
+	buffer := make([]byte, len(kickoff))
+	if _, err := io.ReadFull(cc.conn, buffer); err != nil {
+		return err
+	}
+	if string(buffer) != kickoff {
+		return errors.New("ndt5: invalid kickoff message")
+	}
+	for {
+		msg, err := cc.readString(msgSrvQueue)
+		if err != nil {
+			return err
+		}
+		switch msg {
+		case srvQueueReady:
+			return nil
+		case srvQueueHeartbeat:
+			if err := cc.writeString(msgWaiting, ""); err != nil {
+				return err
+			}
+		case srvQueueServerBusy, srvQueueServerFault:
+			return ErrServerBusy
+		}
+		// Otherwise msg is our position in the queue and we wait
+	}
+}
+
+func (cc *controlConn) readMessage() (uint8, []byte, error) {
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(cc.conn, header); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[1:]))
+	if _, err := io.ReadFull(cc.conn, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
+
+func (cc *controlConn) readString(expected uint8) (string, error) {
+	kind, payload, err := cc.readMessage()
+	if err != nil {
+		return "", err
+	}
+	if kind != expected {
+		return "", fmt.Errorf(
+			"ndt5: expected message %d but got %d", expected, kind,
+		)
+	}
+	return decodeMsg(payload)
+}
+
+func (cc *controlConn) writeMessage(kind uint8, payload []byte) error {
+	if len(payload) > 0xffff {
+		return errors.New("ndt5: payload too large")
+	}
+	var buffer bytes.Buffer
+	buffer.WriteByte(kind)
+	binary.Write(&buffer, binary.BigEndian, uint16(len(payload)))
+	buffer.Write(payload)
+	_, err := cc.conn.Write(buffer.Bytes())
+	return err
+}
+
+func (cc *controlConn) writeString(kind uint8, msg string) error {
+	data, err := json.Marshal(map[string]string{"msg": msg})
+	if err != nil {
+		return err
+	}
+	return cc.writeMessage(kind, data)
+}
+
+// decodeMsg extracts the msg field from a JSON payload.
+func decodeMsg(payload []byte) (string, error) {
+	var message struct {
+		Msg string `json:"msg"`
+	}
+	if err := json.Unmarshal(payload, &message); err != nil {
+		return "", err
+	}
+	return message.Msg, nil
+}
+
+// parseS2CResults parses the results the server sends at the end of
+// S2C. Servers either send them as a JSON object or as a string
+// containing the throughput, the unsent data and the total sent bytes.
+func parseS2CResults(payload []byte, results *S2CResults) error {
+	var message struct {
+		Msg              string `json:"msg"`
+		ThroughputValue  string `json:"ThroughputValue"`
+		TotalSentByte    string `json:"TotalSentByte"`
+		UnsentDataAmount string `json:"UnsentDataAmount"`
+	}
+	if err := json.Unmarshal(payload, &message); err != nil {
+		return err
+	}
+	fields := []string{
+		message.ThroughputValue, message.UnsentDataAmount, message.TotalSentByte,
+	}
+	if message.ThroughputValue == "" {
+		fields = strings.Fields(message.Msg)
+	}
+	if len(fields) != 3 {
+		return errors.New("ndt5: invalid S2C results")
+	}
+	var err error
+	if results.ServerThroughput, err = strconv.ParseFloat(fields[0], 64); err != nil {
+		return err
+	}
+	if results.UnsentData, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+		return err
+	}
+	results.TotalSentBytes, err = strconv.ParseInt(fields[2], 10, 64)
+	return err
+}
+
+// parseWeb100 parses "Name: value" lines into web100.
+func parseWeb100(msg string, web100 map[string]string) {
+	for _, line := range strings.Split(msg, "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		web100[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+}
+
+// dial connects to address and makes sure the connection is closed
+// when the context is done, so that pending I/O is interrupted.
+func dial(ctx context.Context, address string) (net.Conn, error) {
+	conn, err := new(net.Dialer).DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	return conn, nil
+}
+
+// sampleTCPInfo appends the current TCP_INFO of conn to samples. We
+// ignore errors, since TCP_INFO is not available on all platforms.
+func sampleTCPInfo(conn net.Conn, begin time.Time, samples []TCPInfo) []TCPInfo {
+	info, err := getTCPInfo(conn)
+	if err != nil {
+		return samples
+	}
+	return append(samples, TCPInfo{
+		Elapsed: time.Since(begin).Seconds(),
+		TCPInfo: info,
+	})
+}
+
+// throughput returns the throughput in kbit/s.
+func throughput(numBytes int64, elapsed float64) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(numBytes) * 8 / 1000 / elapsed
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
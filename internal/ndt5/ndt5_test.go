@@ -0,0 +1,296 @@
+package ndt5
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+)
+
+const duration = 500 * time.Millisecond
+
+// standin is a minimal ndt5 server we use for testing.
+type standin struct {
+	listener net.Listener
+	queue    []string
+	tests    string
+}
+
+func newStandin(t *testing.T, tests string, queue ...string) *standin {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &standin{listener: listener, queue: queue, tests: tests}
+}
+
+func (s *standin) serve() error {
+	conn, err := s.listener.Accept()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	cc := &controlConn{conn: conn}
+	kind, _, err := cc.readMessage()
+	if err != nil {
+		return err
+	}
+	if kind != msgExtendedLogin {
+		return errors.New("expected MSG_EXTENDED_LOGIN")
+	}
+	if _, err := conn.Write([]byte(kickoff)); err != nil {
+		return err
+	}
+	for _, msg := range s.queue {
+		if err := cc.writeString(msgSrvQueue, msg); err != nil {
+			return err
+		}
+		if msg == srvQueueHeartbeat {
+			if _, err := cc.readString(msgWaiting); err != nil {
+				return err
+			}
+		}
+		if msg == srvQueueServerBusy {
+			return nil
+		}
+	}
+	if err := cc.writeString(msgSrvQueue, srvQueueReady); err != nil {
+		return err
+	}
+	if err := cc.writeString(msgLogin, "v3.7.0 (standin)"); err != nil {
+		return err
+	}
+	if err := cc.writeString(msgLogin, s.tests); err != nil {
+		return err
+	}
+	for _, test := range []func(*controlConn) error{s.c2s, s.s2c, s.meta} {
+		if err := test(cc); err != nil {
+			return err
+		}
+	}
+	if err := cc.writeString(msgResults, "standin: all good"); err != nil {
+		return err
+	}
+	return cc.writeString(msgLogout, "")
+}
+
+func (s *standin) prepare(cc *controlConn) (net.Conn, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	defer listener.Close()
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	if err != nil {
+		return nil, err
+	}
+	if err := cc.writeString(msgTestPrepare, port); err != nil {
+		return nil, err
+	}
+	conn, err := listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if err := cc.writeString(msgTestStart, ""); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (s *standin) c2s(cc *controlConn) error {
+	conn, err := s.prepare(cc)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	begin := time.Now()
+	count, err := io.Copy(ioutil.Discard, conn)
+	if err != nil {
+		return err
+	}
+	elapsed := time.Since(begin).Seconds()
+	if err := cc.writeString(msgTestMsg, strconv.FormatFloat(
+		throughput(count, elapsed), 'f', -1, 64)); err != nil {
+		return err
+	}
+	return cc.writeString(msgTestFinalize, "")
+}
+
+func (s *standin) s2c(cc *controlConn) error {
+	conn, err := s.prepare(cc)
+	if err != nil {
+		return err
+	}
+	buffer := make([]byte, 1<<13)
+	var count int64
+	for begin := time.Now(); time.Since(begin) < duration; {
+		n, err := conn.Write(buffer)
+		count += int64(n)
+		if err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	conn.Close()
+	if err := cc.writeMessage(msgTestMsg, []byte(`{"ThroughputValue":"1000",
+		"UnsentDataAmount":"0","TotalSentByte":"`+
+		strconv.FormatInt(count, 10)+`"}`)); err != nil {
+		return err
+	}
+	if _, err := cc.readString(msgTestMsg); err != nil {
+		return err
+	}
+	if err := cc.writeString(msgTestMsg, "MinRTT: 10\nCurMSS: 1448\n"); err != nil {
+		return err
+	}
+	return cc.writeString(msgTestFinalize, "")
+}
+
+func (s *standin) meta(cc *controlConn) error {
+	if err := cc.writeString(msgTestPrepare, ""); err != nil {
+		return err
+	}
+	if err := cc.writeString(msgTestStart, ""); err != nil {
+		return err
+	}
+	for {
+		msg, err := cc.readString(msgTestMsg)
+		if err != nil {
+			return err
+		}
+		if msg == "" {
+			break
+		}
+	}
+	return cc.writeString(msgTestFinalize, "")
+}
+
+func newClient(s *standin) *Client {
+	return &Client{
+		Duration:        duration,
+		Logger:          log.Log,
+		Server:          s.listener.Addr().String(),
+		SoftwareName:    "ooniprobe-example",
+		SoftwareVersion: "0.0.1",
+	}
+}
+
+func TestUnitRunWithStandin(t *testing.T) {
+	s := newStandin(t, "2 4 32", "1", srvQueueHeartbeat)
+	defer s.listener.Close()
+	errch := make(chan error, 1)
+	go func() { errch <- s.serve() }()
+	var progress int
+	client := newClient(s)
+	client.OnProgress = func(test string, elapsed time.Duration, numBytes int64) {
+		progress++
+	}
+	results, err := client.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errch; err != nil {
+		t.Fatal(err)
+	}
+	if results.ServerVersion != "v3.7.0 (standin)" {
+		t.Fatal("unexpected server version")
+	}
+	if results.C2S == nil || results.C2S.NumBytes <= 0 ||
+		results.C2S.ServerThroughput <= 0 {
+		t.Fatal("unexpected C2S results")
+	}
+	if results.S2C == nil || results.S2C.NumBytes != results.S2C.TotalSentBytes ||
+		results.S2C.ServerThroughput != 1000 || results.S2C.Web100["CurMSS"] != "1448" {
+		t.Fatalf("unexpected S2C results: %+v", results.S2C)
+	}
+	if len(results.ServerResults) != 1 {
+		t.Fatal("unexpected server results")
+	}
+	if runtime.GOOS == "linux" {
+		if len(results.C2S.TCPInfo) <= 0 || len(results.S2C.TCPInfo) <= 0 {
+			t.Fatal("no TCP_INFO samples")
+		}
+		if last := results.C2S.TCPInfo[len(results.C2S.TCPInfo)-1]; last.TCPInfo.BytesAcked <= 0 {
+			t.Fatalf("unexpected TCP_INFO sample: %+v", last.TCPInfo)
+		}
+	}
+	if progress <= 0 {
+		t.Fatal("OnProgress was not called")
+	}
+}
+
+func TestUnitRunWithBusyServer(t *testing.T) {
+	s := newStandin(t, "", srvQueueServerBusy)
+	defer s.listener.Close()
+	go s.serve()
+	if _, err := newClient(s).Run(context.Background()); err != ErrServerBusy {
+		t.Fatal("not the error we expected")
+	}
+}
+
+func TestUnitRunWithUnexpectedTest(t *testing.T) {
+	s := newStandin(t, "1")
+	defer s.listener.Close()
+	go s.serve()
+	_, err := newClient(s).Run(context.Background())
+	if err == nil || err.Error() != "ndt5: unexpected test: 1" {
+		t.Fatal("not the error we expected")
+	}
+}
+
+func TestUnitRunWithConnectionRefused(t *testing.T) {
+	client := &Client{Logger: log.Log, Server: "127.0.0.1:1"}
+	if _, err := client.Run(context.Background()); err == nil {
+		t.Fatal("expected an error here")
+	}
+}
+
+func TestUnitSampleTCPInfo(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	samples := sampleTCPInfo(conn, time.Now(), nil)
+	if runtime.GOOS != "linux" {
+		if len(samples) != 0 {
+			t.Fatal("unexpected TCP_INFO samples")
+		}
+		return
+	}
+	if len(samples) != 1 || samples[0].TCPInfo.State != 1 { // TCP_ESTABLISHED
+		t.Fatalf("unexpected TCP_INFO samples: %+v", samples)
+	}
+	type fakeConn struct{ net.Conn }
+	if len(sampleTCPInfo(fakeConn{conn}, time.Now(), nil)) != 0 {
+		t.Fatal("expected no samples for a non TCP connection")
+	}
+}
+
+func TestUnitParseS2CResults(t *testing.T) {
+	var results S2CResults
+	err := parseS2CResults([]byte(`{"msg":"1234.5 17 4096"}`), &results)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results.ServerThroughput != 1234.5 || results.UnsentData != 17 ||
+		results.TotalSentBytes != 4096 {
+		t.Fatal("unexpected results")
+	}
+	if err := parseS2CResults([]byte(`{"msg":"1234.5"}`), &results); err == nil {
+		t.Fatal("expected an error here")
+	}
+}
@@ -0,0 +1,41 @@
+// +build linux
+
+package ndt5
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"github.com/m-lab/tcp-info/tcp"
+)
+
+// getTCPInfo returns the TCP_INFO of conn. The layout of tcp.LinuxTCPInfo
+// matches the one of struct tcp_info, hence the kernel fills it directly.
+func getTCPInfo(conn net.Conn) (*tcp.LinuxTCPInfo, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, errors.New("ndt5: not a TCP connection")
+	}
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	info := new(tcp.LinuxTCPInfo)
+	size := uint32(unsafe.Sizeof(*info))
+	var errno syscall.Errno
+	err = rawConn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall6(
+			syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_TCP, syscall.TCP_INFO,
+			uintptr(unsafe.Pointer(info)), uintptr(unsafe.Pointer(&size)), 0,
+		)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if errno != 0 {
+		return nil, errno
+	}
+	return info, nil
+}
@@ -0,0 +1,15 @@
+// +build !linux
+
+package ndt5
+
+import (
+	"net"
+
+	"github.com/m-lab/tcp-info/tcp"
+)
+
+// getTCPInfo returns the TCP_INFO of conn. We only know how to
+// read TCP_INFO on Linux, hence here we always fail.
+func getTCPInfo(conn net.Conn) (*tcp.LinuxTCPInfo, error) {
+	return nil, ErrTCPInfoNotSupported
+}
@@ -0,0 +1,95 @@
+// Package oohelper contains the client and the server implementing
+// the Web Connectivity control protocol. The client sends the URL we
+// are measuring, the request headers and the endpoints we have resolved
+// to the control helper, which performs the same measurement from an
+// uncensored vantage point and returns its results.
+//
+// See https://github.com/ooni/spec/blob/master/nettests/ts-017-web-connectivity.md.
+package oohelper
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/ooni/probe-engine/internal/jsonapi"
+	"github.com/ooni/probe-engine/log"
+)
+
+// ControlRequest is the request sent to the control helper.
+type ControlRequest struct {
+	HTTPRequest        string              `json:"http_request"`
+	HTTPRequestHeaders map[string][]string `json:"http_request_headers"`
+	TCPConnect         []string            `json:"tcp_connect"`
+}
+
+// ControlTCPConnectResult is the result of a TCP connect
+// performed by the control helper.
+type ControlTCPConnectResult struct {
+	Status  bool    `json:"status"`
+	Failure *string `json:"failure"`
+}
+
+// ControlHTTPRequestResult is the result of the HTTP request
+// performed by the control helper.
+type ControlHTTPRequestResult struct {
+	BodyLength int64             `json:"body_length"`
+	Failure    *string           `json:"failure"`
+	Title      string            `json:"title"`
+	Headers    map[string]string `json:"headers"`
+	StatusCode int64             `json:"status_code"`
+}
+
+// ControlDNSResult is the result of the DNS lookup
+// performed by the control helper.
+type ControlDNSResult struct {
+	Failure *string  `json:"failure"`
+	Addrs   []string `json:"addrs"`
+}
+
+// ControlResponse is the response from the control helper.
+type ControlResponse struct {
+	TCPConnect  map[string]ControlTCPConnectResult `json:"tcp_connect"`
+	HTTPRequest ControlHTTPRequestResult           `json:"http_request"`
+	DNS         ControlDNSResult                   `json:"dns"`
+}
+
+// Client is a client for the control helper.
+type Client struct {
+	// BaseURL is the base URL of the control helper.
+	BaseURL string
+
+	// HTTPClient is the HTTP client to use.
+	HTTPClient *http.Client
+
+	// Logger is the logger to use.
+	Logger log.Logger
+
+	// UserAgent is the user agent to use.
+	UserAgent string
+}
+
+// Control sends creq to the control helper and returns its response.
+func (c *Client) Control(
+	ctx context.Context, creq ControlRequest,
+) (out ControlResponse, err error) {
+	err = (&jsonapi.Client{
+		BaseURL:    c.BaseURL,
+		HTTPClient: c.HTTPClient,
+		Logger:     c.Logger,
+		UserAgent:  c.UserAgent,
+	}).Create(ctx, "/", creq, &out)
+	return
+}
+
+var titleRegexp = regexp.MustCompile(`(?i)<title>([^<]{1,256})</title>`)
+
+// ExtractTitle returns the title of the web page in body, if any.
+func ExtractTitle(body []byte) string {
+	match := titleRegexp.FindSubmatch(body)
+	if len(match) < 2 {
+		return ""
+	}
+	return strings.TrimSpace(string(match[1]))
+}
@@ -0,0 +1,69 @@
+package oohelper
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/apex/log"
+)
+
+func TestUnitClientControl(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "POST" {
+				w.WriteHeader(400)
+				return
+			}
+			w.Write([]byte(`{"dns":{"failure":null,"addrs":["93.184.216.34"]},
+				"http_request":{"status_code":200,"title":"Example Domain"}}`))
+		},
+	))
+	defer server.Close()
+	client := &Client{
+		BaseURL:    server.URL,
+		HTTPClient: http.DefaultClient,
+		Logger:     log.Log,
+		UserAgent:  "ooniprobe-engine/0.0.1",
+	}
+	cresp, err := client.Control(context.Background(), ControlRequest{
+		HTTPRequest: "http://www.example.com/",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cresp.DNS.Addrs) != 1 || cresp.DNS.Addrs[0] != "93.184.216.34" {
+		t.Fatal("unexpected DNS result")
+	}
+	if cresp.HTTPRequest.StatusCode != 200 || cresp.HTTPRequest.Title != "Example Domain" {
+		t.Fatal("unexpected HTTP result")
+	}
+}
+
+func TestUnitClientControlFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(502)
+		},
+	))
+	defer server.Close()
+	client := &Client{
+		BaseURL:    server.URL,
+		HTTPClient: http.DefaultClient,
+		Logger:     log.Log,
+	}
+	if _, err := client.Control(context.Background(), ControlRequest{}); err == nil {
+		t.Fatal("expected an error here")
+	}
+}
+
+func TestUnitExtractTitle(t *testing.T) {
+	body := []byte(`<html><head><TITLE> Antani Mascetti </TITLE></head></html>`)
+	if title := ExtractTitle(body); title != "Antani Mascetti" {
+		t.Fatal("unexpected title")
+	}
+	if title := ExtractTitle([]byte("<html></html>")); title != "" {
+		t.Fatal("unexpected title")
+	}
+}
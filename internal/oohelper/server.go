@@ -0,0 +1,175 @@
+package oohelper
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/ooni/probe-engine/internal/oonitemplates"
+	"github.com/ooni/probe-engine/log"
+)
+
+const (
+	// maxRequestBodySize is the maximum size of a control request.
+	maxRequestBodySize = 1 << 20
+
+	// maxResponseBodySnapSize is the maximum body size we read when
+	// fetching the URL on behalf of the client.
+	maxResponseBodySnapSize = 1 << 24
+)
+
+// Handler is the control helper http.Handler.
+type Handler struct {
+	// Logger is the logger to use.
+	Logger log.Logger
+
+	// Timeout is the maximum time we spend measuring. When
+	// zero, we use a reasonable default.
+	Timeout time.Duration
+}
+
+// ServeHTTP implements http.Handler.ServeHTTP.
+func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Server", "oohelperd")
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var creq ControlRequest
+	reader := io.LimitReader(r.Body, maxRequestBodySize)
+	if err := json.NewDecoder(reader).Decode(&creq); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	URL, err := url.Parse(creq.HTTPRequest)
+	if err != nil || (URL.Scheme != "http" && URL.Scheme != "https") {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	h.Logger.Debugf("oohelper: measuring %s", creq.HTTPRequest)
+	cresp := Measure(ctx, creq)
+	data, err := json.Marshal(cresp)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// Measure performs the control measurement described by creq. We run
+// the DNS lookup, the TCP connects, and the HTTP request in parallel.
+func Measure(ctx context.Context, creq ControlRequest) ControlResponse {
+	var (
+		cresp = ControlResponse{
+			TCPConnect: make(map[string]ControlTCPConnectResult),
+		}
+		mu        sync.Mutex
+		waitgroup sync.WaitGroup
+	)
+	waitgroup.Add(2 + len(creq.TCPConnect))
+	go func() {
+		defer waitgroup.Done()
+		result := measureDNS(ctx, creq.HTTPRequest)
+		mu.Lock()
+		cresp.DNS = result
+		mu.Unlock()
+	}()
+	for _, endpoint := range creq.TCPConnect {
+		go func(endpoint string) {
+			defer waitgroup.Done()
+			result := measureTCPConnect(ctx, endpoint)
+			mu.Lock()
+			cresp.TCPConnect[endpoint] = result
+			mu.Unlock()
+		}(endpoint)
+	}
+	go func() {
+		defer waitgroup.Done()
+		result := measureHTTP(ctx, creq)
+		mu.Lock()
+		cresp.HTTPRequest = result
+		mu.Unlock()
+	}()
+	waitgroup.Wait()
+	return cresp
+}
+
+func measureDNS(ctx context.Context, URL string) (out ControlDNSResult) {
+	parsed, err := url.Parse(URL)
+	if err != nil {
+		out.Failure = makeFailure(err)
+		return
+	}
+	if net.ParseIP(parsed.Hostname()) != nil {
+		out.Addrs = []string{parsed.Hostname()}
+		return
+	}
+	results := oonitemplates.DNSLookup(ctx, oonitemplates.DNSLookupConfig{
+		Hostname: parsed.Hostname(),
+	})
+	out.Addrs, out.Failure = results.Addresses, makeFailure(results.Error)
+	if out.Addrs == nil {
+		out.Addrs = []string{} // emit [] rather than null
+	}
+	return
+}
+
+func measureTCPConnect(
+	ctx context.Context, endpoint string,
+) ControlTCPConnectResult {
+	results := oonitemplates.TCPConnect(ctx, oonitemplates.TCPConnectConfig{
+		Address: endpoint,
+	})
+	return ControlTCPConnectResult{
+		Status:  results.Error == nil,
+		Failure: makeFailure(results.Error),
+	}
+}
+
+func measureHTTP(
+	ctx context.Context, creq ControlRequest,
+) (out ControlHTTPRequestResult) {
+	header := http.Header(creq.HTTPRequestHeaders)
+	results := oonitemplates.HTTPDo(ctx, oonitemplates.HTTPDoConfig{
+		Accept:                  header.Get("Accept"),
+		AcceptLanguage:          header.Get("Accept-Language"),
+		MaxResponseBodySnapSize: maxResponseBodySnapSize,
+		Method:                  "GET",
+		URL:                     creq.HTTPRequest,
+		UserAgent:               header.Get("User-Agent"),
+	})
+	out.Headers = make(map[string]string)
+	if results.Error != nil {
+		out.BodyLength = -1
+		out.Failure = makeFailure(results.Error)
+		out.StatusCode = -1
+		return
+	}
+	out.BodyLength = int64(len(results.BodySnap))
+	for key := range results.Headers {
+		out.Headers[key] = results.Headers.Get(key)
+	}
+	out.StatusCode = results.StatusCode
+	out.Title = ExtractTitle(results.BodySnap)
+	return
+}
+
+func makeFailure(err error) (s *string) {
+	if err != nil {
+		failure := err.Error()
+		s = &failure
+	}
+	return
+}
@@ -0,0 +1,101 @@
+package oohelper
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/apex/log"
+)
+
+func TestUnitHandlerEndToEnd(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("User-Agent") != "antani/1.0" {
+				w.WriteHeader(400)
+				return
+			}
+			w.Header().Set("X-Antani", "mascetti")
+			w.Write([]byte(`<html><title>Antani</title></html>`))
+		},
+	))
+	defer target.Close()
+	helper := httptest.NewServer(Handler{Logger: log.Log})
+	defer helper.Close()
+	URL, err := url.Parse(target.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Port 1 is reserved and most likely nobody is listening there
+	closed := net.JoinHostPort(URL.Hostname(), "1")
+	client := &Client{
+		BaseURL:    helper.URL,
+		HTTPClient: http.DefaultClient,
+		Logger:     log.Log,
+	}
+	cresp, err := client.Control(context.Background(), ControlRequest{
+		HTTPRequest: target.URL,
+		HTTPRequestHeaders: map[string][]string{
+			"User-Agent": []string{"antani/1.0"},
+		},
+		TCPConnect: []string{URL.Host, closed},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cresp.DNS.Failure != nil || len(cresp.DNS.Addrs) != 1 ||
+		cresp.DNS.Addrs[0] != URL.Hostname() {
+		t.Fatal("unexpected DNS result")
+	}
+	if !cresp.TCPConnect[URL.Host].Status {
+		t.Fatal("expected to connect to the target")
+	}
+	if cresp.TCPConnect[closed].Status || cresp.TCPConnect[closed].Failure == nil {
+		t.Fatal("expected to fail connecting to the closed port")
+	}
+	result := cresp.HTTPRequest
+	if result.Failure != nil || result.StatusCode != 200 || result.Title != "Antani" ||
+		result.Headers["X-Antani"] != "mascetti" || result.BodyLength != 34 {
+		t.Fatalf("unexpected HTTP result: %+v", result)
+	}
+}
+
+func TestUnitHandlerHTTPFailure(t *testing.T) {
+	cresp := Measure(context.Background(), ControlRequest{
+		HTTPRequest: "http://127.0.0.1:1/",
+	})
+	if cresp.HTTPRequest.Failure == nil || cresp.HTTPRequest.StatusCode != -1 {
+		t.Fatal("expected an HTTP failure")
+	}
+}
+
+func TestUnitHandlerBadRequests(t *testing.T) {
+	helper := httptest.NewServer(Handler{Logger: log.Log})
+	defer helper.Close()
+	resp, err := http.Get(helper.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatal("unexpected status code")
+	}
+	for _, body := range []string{
+		`{`, `{"http_request":"ftp://www.example.com/"}`,
+	} {
+		resp, err := http.Post(
+			helper.URL, "application/json", bytes.NewReader([]byte(body)),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatal("unexpected status code")
+		}
+	}
+}
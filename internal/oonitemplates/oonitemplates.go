@@ -9,6 +9,7 @@
 package oonitemplates
 
 import (
+	"bytes"
 	"context"
 	"io"
 	"io/ioutil"
@@ -166,10 +167,14 @@ type dnsFallback struct {
 	network, address string
 }
 
-func configureDNS(seed int64, network, address string) (modelx.DNSResolver, error) {
+// configureDNS creates the resolver for network and address. Unless
+// nofallbacks is true, we chain two random fallback resolvers to it.
+func configureDNS(
+	seed int64, network, address string, nofallbacks bool,
+) (modelx.DNSResolver, error) {
 	resolver, err := netx.NewResolver(handlers.NoHandler, network, address)
-	if err != nil {
-		return nil, err
+	if err != nil || nofallbacks {
+		return resolver, err
 	}
 	fallbacks := []dnsFallback{
 		dnsFallback{
@@ -277,6 +282,7 @@ type HTTPDoConfig struct {
 	AcceptLanguage     string
 	Beginning          time.Time
 	Body               []byte
+	CABundlePath       string
 	DNSServerAddress   string
 	DNSServerNetwork   string
 	Handler            modelx.Handler
@@ -286,6 +292,27 @@ type HTTPDoConfig struct {
 	URL                string
 	UserAgent          string
 
+	// Host is the Host header to send. By default we use the host in
+	// the URL. Because the SNI is derived from the URL, unless SNI is
+	// set, setting Host allows one to perform domain fronting.
+	Host string
+
+	// SNI is the SNI to use. By default we use the host in the URL,
+	// hence setting SNI allows one to connect to a specific IP
+	// address while still validating the certificate for a domain.
+	SNI string
+
+	// NoDNSFallbacks disables the fallback resolvers, so that only
+	// the configured resolver is used to resolve domain names.
+	NoDNSFallbacks bool
+
+	// Headers contains additional request headers. We do not
+	// canonicalize their names, so that one can control the
+	// exact case of the headers we send. Note that Go writes the
+	// Host and User-Agent headers by itself, hence you should use
+	// the UserAgent field to set the user agent.
+	Headers http.Header
+
 	// MaxEventsBodySnapSize controls the snap size that
 	// we're using for bodies returned as modelx.Measurement.
 	//
@@ -320,7 +347,6 @@ func HTTPDo(
 		config.Beginning = time.Now()
 	}
 	channel := make(chan modelx.Measurement)
-	// TODO(bassosimone): tell client to use specific CA bundle?
 	root := &modelx.MeasurementRoot{
 		Beginning: config.Beginning,
 		Handler: &channelHandler{
@@ -334,21 +360,35 @@ func HTTPDo(
 		time.Now().UnixNano(),
 		config.DNSServerNetwork,
 		config.DNSServerAddress,
+		config.NoDNSFallbacks,
 	)
 	if err != nil {
 		results.Error = err
 		return results
 	}
 	client.SetResolver(resolver)
+	if config.CABundlePath != "" {
+		if err := client.SetCABundle(config.CABundlePath); err != nil {
+			results.Error = err
+			return results
+		}
+	}
 	if config.InsecureSkipVerify {
 		client.ForceSkipVerify()
 	}
-	// TODO(bassosimone): implement sending body
-	req, err := http.NewRequest(config.Method, config.URL, nil)
+	if config.SNI != "" {
+		client.ForceSpecificSNI(config.SNI)
+	}
+	req, err := http.NewRequest(
+		config.Method, config.URL, bytes.NewReader(config.Body),
+	)
 	if err != nil {
 		results.Error = err
 		return results
 	}
+	for key, values := range config.Headers {
+		req.Header[key] = values
+	}
 	if config.Accept != "" {
 		req.Header.Set("Accept", config.Accept)
 	}
@@ -356,6 +396,9 @@ func HTTPDo(
 		req.Header.Set("Accept-Language", config.AcceptLanguage)
 	}
 	req.Header.Set("User-Agent", config.UserAgent)
+	if config.Host != "" {
+		req.Host = config.Host
+	}
 	req = req.WithContext(ctx)
 	results.TestKeys.collect(channel, config.Handler, func() {
 		defer client.HTTPClient.CloseIdleConnections()
@@ -392,6 +435,7 @@ type TLSConnectConfig struct {
 	DNSServerNetwork   string
 	Handler            modelx.Handler
 	InsecureSkipVerify bool
+	NoDNSFallbacks     bool
 	SNI                string
 }
 
@@ -426,6 +470,7 @@ func TLSConnect(
 		time.Now().UnixNano(),
 		config.DNSServerNetwork,
 		config.DNSServerAddress,
+		config.NoDNSFallbacks,
 	)
 	if err != nil {
 		results.Error = err
@@ -456,6 +501,7 @@ type TCPConnectConfig struct {
 	DNSServerAddress string
 	DNSServerNetwork string
 	Handler          modelx.Handler
+	NoDNSFallbacks   bool
 }
 
 // TCPConnectResults contains the results of a TCPConnect
@@ -489,6 +535,7 @@ func TCPConnect(
 		time.Now().UnixNano(),
 		config.DNSServerNetwork,
 		config.DNSServerAddress,
+		config.NoDNSFallbacks,
 	)
 	if err != nil {
 		results.Error = err
@@ -507,6 +554,99 @@ func TCPConnect(
 	return results
 }
 
+// ConnectAndDoConfig contains ConnectAndDo settings.
+type ConnectAndDoConfig struct {
+	Address          string
+	Beginning        time.Time
+	CABundlePath     string
+	DNSServerAddress string
+	DNSServerNetwork string
+	Handler          modelx.Handler
+
+	// Network is either "tcp" or "udp".
+	Network string
+
+	// TLS indicates that we should perform a TLS handshake after
+	// we have connected, using SNI and CABundlePath. It only makes
+	// sense when Network is "tcp". The handshake is recorded in
+	// TestKeys.TLSHandshakes.
+	TLS bool
+
+	// SNI is the SNI to use for the TLS handshake. By default we
+	// use the host in Address.
+	SNI string
+
+	// Do is called with the connection, when we have managed to
+	// establish it, to implement the protocol we want to measure. The
+	// connection is closed when Do returns. The I/O performed by Do
+	// is recorded in TestKeys.NetworkEvents.
+	Do func(conn net.Conn) error
+}
+
+// ConnectAndDoResults contains the results of a ConnectAndDo
+type ConnectAndDoResults struct {
+	TestKeys Results
+	Error    error
+}
+
+// ConnectAndDo establishes a TCP or UDP connection and then uses it
+// to perform the exchange implemented by config.Do.
+func ConnectAndDo(
+	ctx context.Context, config ConnectAndDoConfig,
+) *ConnectAndDoResults {
+	var (
+		mu      sync.Mutex
+		results = new(ConnectAndDoResults)
+	)
+	if config.Beginning.IsZero() {
+		config.Beginning = time.Now()
+	}
+	channel := make(chan modelx.Measurement)
+	root := &modelx.MeasurementRoot{
+		Beginning: config.Beginning,
+		Handler: &channelHandler{
+			ch: channel,
+		},
+	}
+	ctx = modelx.WithMeasurementRoot(ctx, root)
+	dialer := netx.NewDialer(handlers.NoHandler)
+	resolver, err := configureDNS(
+		time.Now().UnixNano(),
+		config.DNSServerNetwork,
+		config.DNSServerAddress,
+		false,
+	)
+	if err != nil {
+		results.Error = err
+		return results
+	}
+	dialer.SetResolver(resolver)
+	if config.CABundlePath != "" {
+		if err := dialer.SetCABundle(config.CABundlePath); err != nil {
+			results.Error = err
+			return results
+		}
+	}
+	if config.SNI != "" {
+		dialer.ForceSpecificSNI(config.SNI)
+	}
+	dial := dialer.DialContext
+	if config.TLS {
+		dial = dialer.DialTLSContext
+	}
+	results.TestKeys.collect(channel, config.Handler, func() {
+		conn, err := dial(ctx, config.Network, config.Address)
+		if err == nil {
+			defer conn.Close()
+			err = config.Do(conn)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		results.Error = err
+	}, true)
+	return results
+}
+
 func init() {
 	rtx.Must(transports.Init(), "transport.Init() failed")
 }
@@ -557,6 +697,7 @@ func OBFS4Connect(
 		time.Now().UnixNano(),
 		config.DNSServerNetwork,
 		config.DNSServerAddress,
+		false,
 	)
 	if err != nil {
 		results.Error = err
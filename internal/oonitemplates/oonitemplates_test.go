@@ -2,8 +2,13 @@ package oonitemplates
 
 import (
 	"context"
+	"encoding/pem"
 	"errors"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"strings"
 	"sync"
 	"testing"
@@ -96,6 +101,145 @@ func TestIntegrationHTTPDoGood(t *testing.T) {
 	}
 }
 
+func TestUnitHTTPDoWithHeaders(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			received <- ""
+			return
+		}
+		defer conn.Close()
+		data := make([]byte, 4096)
+		count, _ := conn.Read(data)
+		received <- string(data[:count])
+		conn.Write([]byte("HTTP/1.1 204 No Content\r\nConnection: close\r\n\r\n"))
+	}()
+	results := HTTPDo(context.Background(), HTTPDoConfig{
+		Headers: map[string][]string{"x-aNTAni": []string{"mascetti"}},
+		Method:  "GET",
+		URL:     "http://" + listener.Addr().String() + "/",
+	})
+	if results.Error != nil {
+		t.Fatal(results.Error)
+	}
+	if !strings.Contains(<-received, "\r\nx-aNTAni: mascetti\r\n") {
+		t.Fatal("the header case was not preserved")
+	}
+}
+
+func TestUnitHTTPDoWithHost(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.Host))
+		},
+	))
+	defer server.Close()
+	results := HTTPDo(context.Background(), HTTPDoConfig{
+		Host:                    "hidden.example.com",
+		MaxResponseBodySnapSize: 1 << 10,
+		Method:                  "GET",
+		URL:                     server.URL,
+	})
+	if results.Error != nil {
+		t.Fatal(results.Error)
+	}
+	if string(results.BodySnap) != "hidden.example.com" {
+		t.Fatal("the Host header was not overridden")
+	}
+}
+
+func TestUnitHTTPDoWithCABundle(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(204)
+		},
+	))
+	defer server.Close()
+	bundle, err := ioutil.TempFile("", "oonitemplates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(bundle.Name())
+	err = pem.Encode(bundle, &pem.Block{
+		Type: "CERTIFICATE", Bytes: server.Certificate().Raw,
+	})
+	bundle.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := HTTPDo(context.Background(), HTTPDoConfig{
+		CABundlePath: bundle.Name(),
+		Method:       "GET",
+		URL:          server.URL,
+	})
+	if results.Error != nil {
+		t.Fatal(results.Error)
+	}
+	if results.StatusCode != 204 {
+		t.Fatal("unexpected status code")
+	}
+}
+
+// newCABundle writes the certificate of server into a CA bundle
+// and returns the bundle path. The caller must remove it.
+func newCABundle(t *testing.T, server *httptest.Server) string {
+	bundle, err := ioutil.TempFile("", "oonitemplates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pem.Encode(bundle, &pem.Block{
+		Type: "CERTIFICATE", Bytes: server.Certificate().Raw,
+	})
+	bundle.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bundle.Name()
+}
+
+func TestUnitHTTPDoWithBodyAndSNI(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			data, _ := ioutil.ReadAll(r.Body)
+			w.Write([]byte(r.TLS.ServerName + " " + string(data)))
+		},
+	))
+	defer server.Close()
+	bundle := newCABundle(t, server)
+	defer os.Remove(bundle)
+	results := HTTPDo(context.Background(), HTTPDoConfig{
+		Body:                    []byte("antani"),
+		CABundlePath:            bundle,
+		MaxResponseBodySnapSize: 1 << 10,
+		Method:                  "POST",
+		SNI:                     "example.com", // in the httptest certificate
+		URL:                     server.URL,
+	})
+	if results.Error != nil {
+		t.Fatal(results.Error)
+	}
+	if string(results.BodySnap) != "example.com antani" {
+		t.Fatal("the body or the SNI were not sent")
+	}
+}
+
+func TestUnitHTTPDoWithNonexistentCABundle(t *testing.T) {
+	results := HTTPDo(context.Background(), HTTPDoConfig{
+		CABundlePath: "testdata/nonexistent.pem",
+		Method:       "GET",
+		URL:          "https://www.example.com/",
+	})
+	if results.Error == nil {
+		t.Fatal("expected an error here")
+	}
+}
+
 func TestIntegrationHTTPDoUnknownDNS(t *testing.T) {
 	ctx := context.Background()
 	results := HTTPDo(ctx, HTTPDoConfig{
@@ -267,6 +411,113 @@ func TestIntegrationTCPConnectUnknownDNS(t *testing.T) {
 	}
 }
 
+func TestUnitConnectAndDoUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		buffer := make([]byte, 128)
+		count, addr, err := conn.ReadFrom(buffer)
+		if err == nil {
+			conn.WriteTo(buffer[:count], addr)
+		}
+	}()
+	results := ConnectAndDo(context.Background(), ConnectAndDoConfig{
+		Address: conn.LocalAddr().String(),
+		Network: "udp",
+		Do: func(conn net.Conn) error {
+			if _, err := conn.Write([]byte("antani")); err != nil {
+				return err
+			}
+			_, err := conn.Read(make([]byte, 128))
+			return err
+		},
+	})
+	if results.Error != nil {
+		t.Fatal(results.Error)
+	}
+	if len(results.TestKeys.NetworkEvents) < 3 {
+		t.Fatal("expected connect, write and read events")
+	}
+	if results.TestKeys.SentBytes != 6 || results.TestKeys.ReceivedBytes != 6 {
+		t.Fatal("unexpected number of bytes sent or received")
+	}
+}
+
+func TestUnitConnectAndDoError(t *testing.T) {
+	expected := errors.New("mocked error")
+	results := ConnectAndDo(context.Background(), ConnectAndDoConfig{
+		Address: "127.0.0.1:53",
+		Network: "udp",
+		Do: func(conn net.Conn) error {
+			return expected
+		},
+	})
+	if results.Error != expected {
+		t.Fatal("not the error that we expected")
+	}
+}
+
+func TestUnitConnectAndDoTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(204)
+		},
+	))
+	defer server.Close()
+	bundle := newCABundle(t, server)
+	defer os.Remove(bundle)
+	results := ConnectAndDo(context.Background(), ConnectAndDoConfig{
+		Address:      server.Listener.Addr().String(),
+		CABundlePath: bundle,
+		Network:      "tcp",
+		SNI:          "example.com", // in the httptest certificate
+		TLS:          true,
+		Do: func(conn net.Conn) error {
+			_, err := conn.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+			if err != nil {
+				return err
+			}
+			_, err = conn.Read(make([]byte, 128))
+			return err
+		},
+	})
+	if results.Error != nil {
+		t.Fatal(results.Error)
+	}
+	if len(results.TestKeys.TLSHandshakes) != 1 {
+		t.Fatal("expected a TLS handshake")
+	}
+	if results.TestKeys.SentBytes <= 0 || results.TestKeys.ReceivedBytes <= 0 {
+		t.Fatal("expected to count the handshake bytes")
+	}
+}
+
+func TestUnitConnectAndDoWithNonexistentCABundle(t *testing.T) {
+	results := ConnectAndDo(context.Background(), ConnectAndDoConfig{
+		Address:      "127.0.0.1:443",
+		CABundlePath: "testdata/nonexistent.pem",
+		Network:      "tcp",
+		TLS:          true,
+	})
+	if results.Error == nil {
+		t.Fatal("expected an error here")
+	}
+}
+
+func TestIntegrationConnectAndDoUnknownDNS(t *testing.T) {
+	results := ConnectAndDo(context.Background(), ConnectAndDoConfig{
+		Address:          "ooni.io:443",
+		DNSServerNetwork: "antani",
+		Network:          "tcp",
+	})
+	if !strings.HasSuffix(results.Error.Error(), "unsupported network value") {
+		t.Fatal("not the error that we expected")
+	}
+}
+
 func obfs4config() OBFS4ConnectConfig {
 	// TODO(bassosimone): this is a public working bridge we have found
 	// with @hellais. We should ask @phw whether there is some obfs4 bridge
@@ -2,43 +2,481 @@ package engine
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/ooni/probe-engine/internal/atrest"
+	"github.com/ooni/probe-engine/internal/kvstore"
 	"github.com/rogpeppe/go-internal/lockedfile"
 )
 
 // KVStore is a simple, atomic key-value store. The user of
 // probe-engine should supply an implementation of this interface,
 // which will be used by probe-engine to store specific data.
+//
+// If you have an implementation of SimpleKVStore, which was the
+// KVStore interface before we added Delete and Keys, then you can
+// use NewKVStoreFromSimple to adapt it to this interface.
 type KVStore interface {
+	// Get returns the value of key. If key does not exist or has
+	// expired, the error is ErrNoSuchKey.
 	Get(key string) (value []byte, err error)
+
+	// Set sets the value of key.
 	Set(key string, value []byte) (err error)
+
+	// Delete removes key. Removing a nonexistent key is not an error.
+	Delete(key string) (err error)
+
+	// Keys returns the sorted list of keys starting with prefix. An
+	// empty prefix means that we should return all keys.
+	Keys(prefix string) (keys []string, err error)
+}
+
+// TTLKVStore is a KVStore where keys may expire.
+type TTLKVStore interface {
+	KVStore
+
+	// SetWithTTL is like Set but key expires after ttl.
+	SetWithTTL(key string, value []byte, ttl time.Duration) (err error)
 }
 
-// FileSystemKVStore is a directory based KVStore
+// SimpleKVStore is a key-value store only implementing Get and Set.
+type SimpleKVStore interface {
+	Get(key string) (value []byte, err error)
+	Set(key string, value []byte) (err error)
+}
+
+var (
+	// ErrInvalidKey indicates that a key is not valid.
+	ErrInvalidKey = errors.New("invalid key")
+
+	// ErrNoSuchKey indicates that a key does not exist.
+	ErrNoSuchKey = kvstore.ErrNoSuchKey
+)
+
+// escapeKey maps key to a string that is safe to use as a file name
+// on all the platforms we care about. We leave most characters alone,
+// so that already existing keys (e.g. "orchestra.state") map to the
+// same file name, and we %-escape path separators, characters that
+// are not valid in Windows file names, control characters and the
+// percent sign itself. We also escape a leading dot, so that a key
+// cannot be "." or ".." and cannot collide with our metadata, and
+// trailing dots and spaces, which Windows silently strips.
+func escapeKey(key string) (string, error) {
+	if key == "" {
+		return "", ErrInvalidKey
+	}
+	var sb strings.Builder
+	for idx := 0; idx < len(key); idx++ {
+		b := key[idx]
+		escape := b < 0x20 || b == 0x7f || strings.IndexByte(`%/\:*?"<>|`, b) >= 0 ||
+			(idx == 0 && b == '.') || (idx == len(key)-1 && (b == '.' || b == ' '))
+		if escape {
+			fmt.Fprintf(&sb, "%%%02X", b)
+			continue
+		}
+		sb.WriteByte(b)
+	}
+	return sb.String(), nil
+}
+
+// unescapeKey is the opposite of escapeKey.
+func unescapeKey(name string) (string, error) {
+	var sb strings.Builder
+	for idx := 0; idx < len(name); idx++ {
+		if name[idx] != '%' {
+			sb.WriteByte(name[idx])
+			continue
+		}
+		if idx+2 >= len(name) {
+			return "", ErrInvalidKey
+		}
+		b, err := strconv.ParseUint(name[idx+1:idx+3], 16, 8)
+		if err != nil {
+			return "", ErrInvalidKey
+		}
+		sb.WriteByte(byte(b))
+		idx += 2
+	}
+	return sb.String(), nil
+}
+
+// FileSystemKVStore is a directory based KVStore. Each key is
+// stored into a file inside of the base directory, whose name is
+// derived from the key such that we never escape the base directory.
 type FileSystemKVStore struct {
 	basedir string
+	now     func() time.Time
 }
 
 // NewFileSystemKVStore creates a new FileSystemKVStore.
 func NewFileSystemKVStore(basedir string) (kvs *FileSystemKVStore, err error) {
 	if err = os.MkdirAll(basedir, 0700); err == nil {
-		kvs = &FileSystemKVStore{basedir: basedir}
+		kvs = &FileSystemKVStore{basedir: basedir, now: time.Now}
 	}
 	return
 }
 
-func (kvs *FileSystemKVStore) filename(key string) string {
-	return filepath.Join(kvs.basedir, key)
+// expirydir is the directory containing keys expiration times. The
+// leading dot guarantees that it cannot collide with a key.
+const expirydir = ".expiry"
+
+func (kvs *FileSystemKVStore) filename(key string) (string, error) {
+	name, err := escapeKey(key)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(kvs.basedir, name), nil
+}
+
+func (kvs *FileSystemKVStore) expiryfilename(key string) (string, error) {
+	name, err := escapeKey(key)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(kvs.basedir, expirydir, name), nil
+}
+
+// expiry returns the time when key expires. The zero time
+// indicates that key does not expire.
+func (kvs *FileSystemKVStore) expiry(key string) (time.Time, error) {
+	var t time.Time
+	expiryfilename, err := kvs.expiryfilename(key)
+	if err != nil {
+		return t, err
+	}
+	data, err := lockedfile.Read(expiryfilename)
+	if os.IsNotExist(err) {
+		return t, nil
+	}
+	if err != nil {
+		return t, err
+	}
+	err = t.UnmarshalText(data)
+	return t, err
+}
+
+// expired returns whether key has expired. If so, it also removes the key.
+func (kvs *FileSystemKVStore) expired(key string) (bool, error) {
+	t, err := kvs.expiry(key)
+	if err != nil {
+		return false, err
+	}
+	if t.IsZero() || kvs.now().Before(t) {
+		return false, nil
+	}
+	return true, kvs.Delete(key)
 }
 
 // Get returns the specified key's value
 func (kvs *FileSystemKVStore) Get(key string) ([]byte, error) {
-	return lockedfile.Read(kvs.filename(key))
+	filename, err := kvs.filename(key)
+	if err != nil {
+		return nil, err
+	}
+	expired, err := kvs.expired(key)
+	if err != nil {
+		return nil, err
+	}
+	if expired {
+		return nil, ErrNoSuchKey
+	}
+	value, err := lockedfile.Read(filename)
+	if os.IsNotExist(err) {
+		return nil, ErrNoSuchKey
+	}
+	return value, err
 }
 
 // Set sets the value of a specific key
 func (kvs *FileSystemKVStore) Set(key string, value []byte) error {
-	return lockedfile.Write(kvs.filename(key), bytes.NewReader(value), 0600)
+	filename, err := kvs.filename(key)
+	if err != nil {
+		return err
+	}
+	expiryfilename, err := kvs.expiryfilename(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(expiryfilename); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return lockedfile.Write(filename, bytes.NewReader(value), 0600)
+}
+
+// SetWithTTL is like Set but key expires after ttl
+func (kvs *FileSystemKVStore) SetWithTTL(
+	key string, value []byte, ttl time.Duration,
+) error {
+	filename, err := kvs.filename(key)
+	if err != nil {
+		return err
+	}
+	expiryfilename, err := kvs.expiryfilename(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(expiryfilename), 0700); err != nil {
+		return err
+	}
+	expiry, err := kvs.now().Add(ttl).MarshalText()
+	if err != nil {
+		return err
+	}
+	err = lockedfile.Write(expiryfilename, bytes.NewReader(expiry), 0600)
+	if err != nil {
+		return err
+	}
+	return lockedfile.Write(filename, bytes.NewReader(value), 0600)
+}
+
+// Delete removes the specified key
+func (kvs *FileSystemKVStore) Delete(key string) error {
+	filename, err := kvs.filename(key)
+	if err != nil {
+		return err
+	}
+	expiryfilename, err := kvs.expiryfilename(key)
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{expiryfilename, filename} {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Keys returns the sorted list of keys starting with prefix
+func (kvs *FileSystemKVStore) Keys(prefix string) ([]string, error) {
+	infos, err := ioutil.ReadDir(kvs.basedir)
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, info := range infos {
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			continue // not a key
+		}
+		key, err := unescapeKey(info.Name())
+		if err != nil {
+			continue // not created by us
+		}
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		expired, err := kvs.expired(key)
+		if err != nil {
+			return nil, err
+		}
+		if !expired {
+			out = append(out, key)
+		}
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// Wipe securely erases all the keys stored by this FileSystemKVStore
+// as well as its base directory. See SecureWipe for more info.
+func (kvs *FileSystemKVStore) Wipe() error {
+	return SecureWipe(kvs.basedir)
+}
+
+// simpleKVStoreAdapter adapts a SimpleKVStore to be a KVStore.
+type simpleKVStoreAdapter struct {
+	mu    sync.Mutex
+	store SimpleKVStore
+}
+
+// simpleKVStoreIndex is the key where simpleKVStoreAdapter stores its index.
+const simpleKVStoreIndex = "ooniprobe-engine.kvstore.index"
+
+// simpleKVStoreIndexData is the content of the index.
+type simpleKVStoreIndexData struct {
+	Deleted map[string]bool
+	Keys    map[string]bool
+}
+
+// NewKVStoreFromSimple adapts a SimpleKVStore to be a KVStore. Since
+// a SimpleKVStore cannot list or delete keys, we keep an index of the
+// keys we have set and deleted inside the SimpleKVStore itself. As a
+// consequence, Keys does not return the keys that have been set before
+// you started using the adapter, even though Get returns them.
+func NewKVStoreFromSimple(store SimpleKVStore) KVStore {
+	return &simpleKVStoreAdapter{store: store}
+}
+
+func (kvs *simpleKVStoreAdapter) readIndex() (*simpleKVStoreIndexData, error) {
+	index := &simpleKVStoreIndexData{
+		Deleted: make(map[string]bool),
+		Keys:    make(map[string]bool),
+	}
+	data, err := kvs.store.Get(simpleKVStoreIndex)
+	if err != nil || len(data) <= 0 {
+		return index, nil // assume the index does not exist yet
+	}
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+func (kvs *simpleKVStoreAdapter) writeIndex(index *simpleKVStoreIndexData) error {
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return kvs.store.Set(simpleKVStoreIndex, data)
+}
+
+func (kvs *simpleKVStoreAdapter) Get(key string) ([]byte, error) {
+	if key == "" || key == simpleKVStoreIndex {
+		return nil, ErrInvalidKey
+	}
+	kvs.mu.Lock()
+	defer kvs.mu.Unlock()
+	index, err := kvs.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	if index.Deleted[key] {
+		return nil, ErrNoSuchKey
+	}
+	return kvs.store.Get(key)
+}
+
+func (kvs *simpleKVStoreAdapter) Set(key string, value []byte) error {
+	if key == "" || key == simpleKVStoreIndex {
+		return ErrInvalidKey
+	}
+	kvs.mu.Lock()
+	defer kvs.mu.Unlock()
+	index, err := kvs.readIndex()
+	if err != nil {
+		return err
+	}
+	if err := kvs.store.Set(key, value); err != nil {
+		return err
+	}
+	delete(index.Deleted, key)
+	index.Keys[key] = true
+	return kvs.writeIndex(index)
+}
+
+func (kvs *simpleKVStoreAdapter) Delete(key string) error {
+	if key == "" || key == simpleKVStoreIndex {
+		return ErrInvalidKey
+	}
+	kvs.mu.Lock()
+	defer kvs.mu.Unlock()
+	index, err := kvs.readIndex()
+	if err != nil {
+		return err
+	}
+	// Overwrite the value such that we do not leave data around
+	if err := kvs.store.Set(key, nil); err != nil {
+		return err
+	}
+	delete(index.Keys, key)
+	index.Deleted[key] = true
+	return kvs.writeIndex(index)
+}
+
+func (kvs *simpleKVStoreAdapter) Keys(prefix string) ([]string, error) {
+	kvs.mu.Lock()
+	defer kvs.mu.Unlock()
+	index, err := kvs.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for key := range index.Keys {
+		if strings.HasPrefix(key, prefix) {
+			out = append(out, key)
+		}
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// EncryptedKVStore is a KVStore that encrypts values using authenticated
+// encryption before storing them into another KVStore. Keys are stored
+// in cleartext, but each value is bound to its key, so one cannot swap
+// the values of two keys without us noticing.
+type EncryptedKVStore struct {
+	sealer *atrest.Sealer
+	store  KVStore
+}
+
+// NewEncryptedKVStore creates a new EncryptedKVStore wrapping store and
+// using a key derived from secret. The secret should be a random value
+// at least 16 bytes long, typically kept by the app in the platform
+// specific keystore. We return an error if the secret is too short.
+func NewEncryptedKVStore(store KVStore, secret []byte) (*EncryptedKVStore, error) {
+	sealer, err := atrest.NewSealer(secret, "ooniprobe-engine kvstore")
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedKVStore{sealer: sealer, store: store}, nil
+}
+
+// Get returns the specified key's value
+func (kvs *EncryptedKVStore) Get(key string) ([]byte, error) {
+	sealed, err := kvs.store.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return kvs.sealer.Open(sealed, []byte(key))
+}
+
+// Set sets the value of a specific key
+func (kvs *EncryptedKVStore) Set(key string, value []byte) error {
+	sealed, err := kvs.sealer.Seal(value, []byte(key))
+	if err != nil {
+		return err
+	}
+	return kvs.store.Set(key, sealed)
+}
+
+// SetWithTTL is like Set but key expires after ttl. This method
+// fails if the underlying KVStore is not a TTLKVStore.
+func (kvs *EncryptedKVStore) SetWithTTL(
+	key string, value []byte, ttl time.Duration,
+) error {
+	store, ok := kvs.store.(TTLKVStore)
+	if !ok {
+		return errors.New("the underlying KVStore does not support TTL")
+	}
+	sealed, err := kvs.sealer.Seal(value, []byte(key))
+	if err != nil {
+		return err
+	}
+	return store.SetWithTTL(key, sealed, ttl)
+}
+
+// Delete removes the specified key
+func (kvs *EncryptedKVStore) Delete(key string) error {
+	return kvs.store.Delete(key)
+}
+
+// Keys returns the sorted list of keys starting with prefix
+func (kvs *EncryptedKVStore) Keys(prefix string) ([]string, error) {
+	return kvs.store.Keys(prefix)
+}
+
+// Wipe wipes the underlying KVStore, if it supports wiping.
+func (kvs *EncryptedKVStore) Wipe() error {
+	return maybeWipe(kvs.store)
 }
@@ -2,8 +2,14 @@ package engine
 
 import (
 	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
 	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/ooni/probe-engine/internal/kvstore"
 )
 
 func TestKVStoreIntegration(t *testing.T) {
@@ -29,3 +35,331 @@ func TestKVStoreIntegration(t *testing.T) {
 		t.Fatal("invalid value")
 	}
 }
+
+func TestUnitEncryptedKVStore(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "ooniprobe-engine-kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempdir)
+	fskvs, err := NewFileSystemKVStore(tempdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	var kvstore KVStore
+	kvstore, err = NewEncryptedKVStore(fskvs, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := []byte(`{"ClientID":"antani","Password":"mascetti"}`)
+	if err := kvstore.Set("orchestra.state", value); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := ioutil.ReadFile(filepath.Join(tempdir, "orchestra.state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, []byte("mascetti")) {
+		t.Fatal("the value has been stored in cleartext")
+	}
+	ovalue, err := kvstore.Get("orchestra.state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ovalue, value) {
+		t.Fatal("invalid value")
+	}
+	// Make sure we notice if someone swaps the values of two keys
+	if err := fskvs.Set("other.key", raw); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kvstore.Get("other.key"); err == nil {
+		t.Fatal("expected an error here")
+	}
+	if _, err := kvstore.Get("nonexistent"); err == nil {
+		t.Fatal("expected an error here")
+	}
+	if _, err := NewEncryptedKVStore(fskvs, []byte("short")); err == nil {
+		t.Fatal("expected an error with a short secret")
+	}
+}
+
+func TestUnitFileSystemKVStoreWipe(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "ooniprobe-engine-kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempdir)
+	basedir := filepath.Join(tempdir, "kvstore2")
+	fskvs, err := NewFileSystemKVStore(basedir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kvstore, err := NewEncryptedKVStore(fskvs, []byte("0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kvstore.Set("antani", []byte("mascetti")); err != nil {
+		t.Fatal(err)
+	}
+	if err := kvstore.Wipe(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(basedir); !os.IsNotExist(err) {
+		t.Fatal("the base directory still exists")
+	}
+}
+
+func TestUnitEscapeKey(t *testing.T) {
+	for input, expected := range map[string]string{
+		"orchestra.state": "orchestra.state",
+		"../x":            "%2E.%2Fx",
+		"..":              "%2E%2E",
+		"a/b\\c":          "a%2Fb%5Cc",
+		"100%":            "100%25",
+		"C:foo ":          "C%3Afoo%20",
+		"tab\there":       "tab%09here",
+	} {
+		output, err := escapeKey(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if output != expected {
+			t.Fatalf("escapeKey(%q) = %q; expected %q", input, output, expected)
+		}
+		unescaped, err := unescapeKey(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if unescaped != input {
+			t.Fatalf("unescapeKey(%q) = %q; expected %q", output, unescaped, input)
+		}
+	}
+	if _, err := escapeKey(""); err != ErrInvalidKey {
+		t.Fatal("not the error we expected")
+	}
+	for _, input := range []string{"%", "%2", "%zz"} {
+		if _, err := unescapeKey(input); err != ErrInvalidKey {
+			t.Fatalf("unescapeKey(%q): not the error we expected", input)
+		}
+	}
+}
+
+func newFileSystemKVStoreForTesting(t *testing.T) (*FileSystemKVStore, string) {
+	tempdir, err := ioutil.TempDir("", "ooniprobe-engine-kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kvs, err := NewFileSystemKVStore(filepath.Join(tempdir, "kvstore2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kvs, tempdir
+}
+
+// testTTLKVStoreContract checks the behavior that all the
+// TTLKVStore implementations must have in common.
+func testTTLKVStoreContract(t *testing.T, kvs TTLKVStore) {
+	if _, err := kvs.Get("antani"); err != ErrNoSuchKey {
+		t.Fatalf("not the error we expected: %+v", err)
+	}
+	if err := kvs.Set("antani", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	value, err := kvs.Get("antani")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(value, []byte("x")) {
+		t.Fatal("invalid value")
+	}
+	if err := kvs.Delete("antani"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kvs.Get("antani"); err != ErrNoSuchKey {
+		t.Fatalf("not the error we expected: %+v", err)
+	}
+	if err := kvs.SetWithTTL("mascetti", []byte("x"), -time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kvs.Get("mascetti"); err != ErrNoSuchKey {
+		t.Fatalf("not the error we expected: %+v", err)
+	}
+	keys, err := kvs.Keys("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Fatalf("unexpected keys: %+v", keys)
+	}
+}
+
+func TestUnitKVStoreContract(t *testing.T) {
+	t.Run("FileSystemKVStore", func(t *testing.T) {
+		kvs, tempdir := newFileSystemKVStoreForTesting(t)
+		defer os.RemoveAll(tempdir)
+		testTTLKVStoreContract(t, kvs)
+	})
+	t.Run("BoltKVStore", func(t *testing.T) {
+		kvs, _, cleanup := newBoltKVStoreForTesting(t)
+		defer cleanup()
+		testTTLKVStoreContract(t, kvs)
+	})
+	t.Run("MemoryKeyValueStore", func(t *testing.T) {
+		testTTLKVStoreContract(t, kvstore.NewMemoryKeyValueStore())
+	})
+}
+
+func TestUnitFileSystemKVStoreCannotEscapeBasedir(t *testing.T) {
+	kvs, tempdir := newFileSystemKVStoreForTesting(t)
+	defer os.RemoveAll(tempdir)
+	if err := kvs.Set("../x", []byte("antani")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(tempdir, "x")); !os.IsNotExist(err) {
+		t.Fatal("we have escaped the base directory")
+	}
+	value, err := kvs.Get("../x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "antani" {
+		t.Fatal("invalid value")
+	}
+	if err := kvs.Set("", nil); err != ErrInvalidKey {
+		t.Fatal("not the error we expected")
+	}
+}
+
+func TestUnitFileSystemKVStoreDeleteAndKeys(t *testing.T) {
+	kvs, tempdir := newFileSystemKVStoreForTesting(t)
+	defer os.RemoveAll(tempdir)
+	for _, key := range []string{"queue/b", "queue/a", "cache.a"} {
+		if err := kvs.Set(key, []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := kvs.SetWithTTL("queue/c", []byte("x"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := kvs.Keys("queue/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 3 || keys[0] != "queue/a" || keys[1] != "queue/b" || keys[2] != "queue/c" {
+		t.Fatalf("unexpected keys: %+v", keys)
+	}
+	if err := kvs.Delete("queue/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := kvs.Delete("queue/c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := kvs.Delete("nonexistent"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kvs.Get("queue/a"); err != ErrNoSuchKey {
+		t.Fatal("not the error we expected")
+	}
+	keys, err = kvs.Keys("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0] != "cache.a" || keys[1] != "queue/b" {
+		t.Fatalf("unexpected keys: %+v", keys)
+	}
+}
+
+func TestUnitFileSystemKVStoreTTL(t *testing.T) {
+	kvs, tempdir := newFileSystemKVStoreForTesting(t)
+	defer os.RemoveAll(tempdir)
+	now := time.Now()
+	kvs.now = func() time.Time { return now }
+	if err := kvs.SetWithTTL("cache.a", []byte("x"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kvs.Get("cache.a"); err != nil {
+		t.Fatal(err)
+	}
+	kvs.now = func() time.Time { return now.Add(time.Hour) }
+	keys, err := kvs.Keys("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Fatal("expired key has been listed")
+	}
+	if _, err := kvs.Get("cache.a"); err != ErrNoSuchKey {
+		t.Fatal("not the error we expected")
+	}
+	// Set without TTL should clear a previous TTL
+	if err := kvs.SetWithTTL("cache.a", []byte("x"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := kvs.Set("cache.a", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	kvs.now = func() time.Time { return now.Add(24 * time.Hour) }
+	if _, err := kvs.Get("cache.a"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type simpleKVStore struct {
+	m map[string][]byte
+}
+
+func (kvs *simpleKVStore) Get(key string) ([]byte, error) {
+	value, ok := kvs.m[key]
+	if !ok {
+		return nil, errors.New("no such key")
+	}
+	return value, nil
+}
+
+func (kvs *simpleKVStore) Set(key string, value []byte) error {
+	kvs.m[key] = value
+	return nil
+}
+
+func TestUnitKVStoreFromSimple(t *testing.T) {
+	simple := &simpleKVStore{m: map[string][]byte{
+		"orchestra.state": []byte("existing"),
+	}}
+	kvs := NewKVStoreFromSimple(simple)
+	value, err := kvs.Get("orchestra.state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "existing" {
+		t.Fatal("invalid value")
+	}
+	for _, key := range []string{"cache.b", "cache.a", "queue.a"} {
+		if err := kvs.Set(key, []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := kvs.Delete("cache.b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kvs.Get("cache.b"); err == nil {
+		t.Fatal("expected an error here")
+	}
+	keys, err := kvs.Keys("cache.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "cache.a" {
+		t.Fatalf("unexpected keys: %+v", keys)
+	}
+	if err := kvs.Set("cache.b", []byte("y")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kvs.Get("cache.b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := kvs.Set(simpleKVStoreIndex, nil); err != ErrInvalidKey {
+		t.Fatal("not the error we expected")
+	}
+}
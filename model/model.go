@@ -245,6 +245,27 @@ var (
 	DefaultResolverASNString = fmt.Sprintf("AS%d", DefaultResolverASN)
 )
 
+// PerformanceSummary is the summary that performance experiments (i.e.,
+// dash, ndt and ndt7) include into their test keys, so that consumers do
+// not need to know the test keys format of each of them. All values use
+// SI units. A zero value means the experiment cannot measure it.
+type PerformanceSummary struct {
+	// Download is the download speed in bit/s.
+	Download float64 `json:"download"`
+
+	// Jitter is the latency variation in seconds.
+	Jitter float64 `json:"jitter"`
+
+	// Latency is the latency in seconds.
+	Latency float64 `json:"latency"`
+
+	// Server identifies the server we have used.
+	Server string `json:"server"`
+
+	// Upload is the upload speed in bit/s.
+	Upload float64 `json:"upload"`
+}
+
 // URLInfo contains info on a test lists URL
 type URLInfo struct {
 	CategoryCode string `json:"category_code"`
@@ -256,6 +277,8 @@ type URLInfo struct {
 type KeyValueStore interface {
 	Get(key string) (value []byte, err error)
 	Set(key string, value []byte) (err error)
+	Delete(key string) (err error)
+	Keys(prefix string) (keys []string, err error)
 }
 
 // TorTarget is a target for the tor experiment.
@@ -0,0 +1,430 @@
+package engine
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	// UploadStatusPending indicates that we did not try to upload yet.
+	UploadStatusPending = "pending"
+
+	// UploadStatusUploaded indicates that the upload succeeded.
+	UploadStatusUploaded = "uploaded"
+
+	// UploadStatusFailed indicates that the upload failed.
+	UploadStatusFailed = "failed"
+)
+
+var (
+	resultsBucket      = []byte("results")
+	measurementsBucket = []byte("measurements")
+
+	// ErrNoSuchResult indicates that a result does not exist.
+	ErrNoSuchResult = errors.New("no such result")
+
+	// ErrNoSuchMeasurement indicates that a measurement does not exist.
+	ErrNoSuchMeasurement = errors.New("no such measurement")
+)
+
+// ResultsDB is a local database containing the history of the results
+// and of the measurements performed by this device. The database is stored
+// into a single file using a pure-Go embedded database.
+type ResultsDB struct {
+	db *bolt.DB
+}
+
+// OpenResultsDB opens the results database at the specified path,
+// creating the database if it does not already exist.
+func OpenResultsDB(path string) (*ResultsDB, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{resultsBucket, measurementsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &ResultsDB{db: db}, nil
+}
+
+// Close closes the results database.
+func (rdb *ResultsDB) Close() error {
+	return rdb.db.Close()
+}
+
+// ResultRecord is a run of an experiment, which contains one
+// or more measurements, as stored inside the ResultsDB.
+type ResultRecord struct {
+	ID               int64     `json:"id"`
+	ExperimentName   string    `json:"experiment_name"`
+	StartTime        time.Time `json:"start_time"`
+	EndTime          time.Time `json:"end_time"`
+	IsDone           bool      `json:"is_done"`
+	ProbeASN         string    `json:"probe_asn"`
+	ProbeCC          string    `json:"probe_cc"`
+	ProbeNetworkName string    `json:"probe_network_name"`
+}
+
+// MeasurementRecord is a measurement as stored inside the ResultsDB.
+type MeasurementRecord struct {
+	ID             string                 `json:"id"`
+	ResultID       int64                  `json:"result_id"`
+	ExperimentName string                 `json:"experiment_name"`
+	Input          string                 `json:"input"`
+	StartTime      time.Time              `json:"start_time"`
+	Runtime        float64                `json:"runtime"`
+	ProbeASN       string                 `json:"probe_asn"`
+	ProbeCC        string                 `json:"probe_cc"`
+	IsAnomaly      bool                   `json:"is_anomaly"`
+	IsFailed       bool                   `json:"is_failed"`
+	Failure        string                 `json:"failure"`
+	SummaryKeys    map[string]interface{} `json:"summary_keys"`
+	ReportID       string                 `json:"report_id"`
+	UploadStatus   string                 `json:"upload_status"`
+	UploadFailure  string                 `json:"upload_failure"`
+	UploadTime     time.Time              `json:"upload_time"`
+	Measurement    json.RawMessage        `json:"measurement"`
+}
+
+// MeasurementSummary contains the summary of a measurement, which
+// is computed by the application when saving a measurement.
+type MeasurementSummary struct {
+	// Failure is the reason why the measurement failed, if any.
+	Failure string
+
+	// IsAnomaly indicates whether the measurement is anomalous.
+	IsAnomaly bool
+
+	// Keys contains experiment specific summary keys.
+	Keys map[string]interface{}
+}
+
+// CreateResult creates a new result for the specified experiment using
+// the location information currently known by the session.
+func (rdb *ResultsDB) CreateResult(
+	sess *Session, experimentName string,
+) (*ResultRecord, error) {
+	record := &ResultRecord{
+		ExperimentName:   experimentName,
+		StartTime:        time.Now().UTC(),
+		ProbeASN:         sess.ProbeASNString(),
+		ProbeCC:          sess.ProbeCC(),
+		ProbeNetworkName: sess.ProbeNetworkName(),
+	}
+	err := rdb.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(resultsBucket)
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		record.ID = int64(seq)
+		return putJSON(bucket, resultKey(record.ID), record)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// FinishResult marks the specified result as done.
+func (rdb *ResultsDB) FinishResult(resultID int64) error {
+	return rdb.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(resultsBucket)
+		var record ResultRecord
+		err := getJSON(bucket, resultKey(resultID), &record, ErrNoSuchResult)
+		if err != nil {
+			return err
+		}
+		record.EndTime = time.Now().UTC()
+		record.IsDone = true
+		return putJSON(bucket, resultKey(resultID), &record)
+	})
+}
+
+// GetResult returns the result with the specified ID.
+func (rdb *ResultsDB) GetResult(resultID int64) (*ResultRecord, error) {
+	record := new(ResultRecord)
+	err := rdb.db.View(func(tx *bolt.Tx) error {
+		return getJSON(
+			tx.Bucket(resultsBucket), resultKey(resultID), record, ErrNoSuchResult,
+		)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// AddMeasurement adds a measurement belonging to the specified result
+// to the database. We use the measurement ID as the key, so adding again
+// the same measurement will replace the previously saved version.
+func (rdb *ResultsDB) AddMeasurement(
+	resultID int64, measurement *Measurement, summary MeasurementSummary,
+) (*MeasurementRecord, error) {
+	if measurement.m.ID == "" {
+		return nil, errors.New("measurement has no ID")
+	}
+	data, err := json.Marshal(measurement.m)
+	if err != nil {
+		return nil, err
+	}
+	// Note: the MeasurementStartTimeSaved field is not set when we've
+	// loaded the measurement from disk, hence we parse the string.
+	startTime, _ := time.Parse(resultsDBDateFormat, measurement.m.MeasurementStartTime)
+	record := &MeasurementRecord{
+		ID:             measurement.m.ID,
+		ResultID:       resultID,
+		ExperimentName: measurement.m.TestName,
+		Input:          measurement.m.Input,
+		StartTime:      startTime,
+		Runtime:        measurement.m.MeasurementRuntime,
+		ProbeASN:       measurement.m.ProbeASN,
+		ProbeCC:        measurement.m.ProbeCC,
+		IsAnomaly:      summary.IsAnomaly,
+		IsFailed:       summary.Failure != "",
+		Failure:        summary.Failure,
+		SummaryKeys:    summary.Keys,
+		ReportID:       measurement.m.ReportID,
+		UploadStatus:   UploadStatusPending,
+		Measurement:    data,
+	}
+	err = rdb.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(resultsBucket).Get(resultKey(resultID)) == nil {
+			return ErrNoSuchResult
+		}
+		return putJSON(tx.Bucket(measurementsBucket), []byte(record.ID), record)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// SetUploadStatus records the outcome of submitting the measurement
+// to the OONI collector. Since submitting modifies the measurement, we
+// also update the measurement saved into the database. A nil uploadErr
+// means that the measurement has been uploaded successfully.
+func (rdb *ResultsDB) SetUploadStatus(
+	measurement *Measurement, uploadErr error,
+) error {
+	data, err := json.Marshal(measurement.m)
+	if err != nil {
+		return err
+	}
+	return rdb.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(measurementsBucket)
+		var record MeasurementRecord
+		if err := getJSON(
+			bucket, []byte(measurement.m.ID), &record, ErrNoSuchMeasurement,
+		); err != nil {
+			return err
+		}
+		record.Measurement = data
+		record.ReportID = measurement.m.ReportID
+		record.UploadTime = time.Now().UTC()
+		record.UploadStatus = UploadStatusUploaded
+		record.UploadFailure = ""
+		if uploadErr != nil {
+			record.UploadStatus = UploadStatusFailed
+			record.UploadFailure = uploadErr.Error()
+		}
+		return putJSON(bucket, []byte(record.ID), &record)
+	})
+}
+
+// GetMeasurement returns the measurement with the specified ID.
+func (rdb *ResultsDB) GetMeasurement(measurementID string) (*MeasurementRecord, error) {
+	record := new(MeasurementRecord)
+	err := rdb.db.View(func(tx *bolt.Tx) error {
+		return getJSON(
+			tx.Bucket(measurementsBucket), []byte(measurementID), record,
+			ErrNoSuchMeasurement,
+		)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// ResultsQuery contains the criteria for querying results. Empty
+// fields mean that we should not filter by such field.
+type ResultsQuery struct {
+	ExperimentName string    // only results of this experiment
+	ProbeASN       string    // only results in this network (e.g. "AS30722")
+	Since          time.Time // only results started at or after this time
+	Until          time.Time // only results started before this time
+}
+
+// ResultsQueryResult contains the results of QueryResults.
+type ResultsQueryResult struct {
+	Result []ResultRecord
+}
+
+// Count returns the number of returned results
+func (r *ResultsQueryResult) Count() int64 {
+	return int64(len(r.Result))
+}
+
+// At returns the result at the given index or nil
+func (r *ResultsQueryResult) At(idx int64) (out *ResultRecord) {
+	if idx >= 0 && idx < int64(len(r.Result)) {
+		out = &r.Result[int(idx)]
+	}
+	return
+}
+
+// QueryResults returns the results matching the query, sorted by
+// increasing result ID and hence by increasing start time.
+func (rdb *ResultsDB) QueryResults(query *ResultsQuery) (*ResultsQueryResult, error) {
+	if query == nil {
+		return nil, errors.New("QueryResults: passed nil query")
+	}
+	out := new(ResultsQueryResult)
+	err := rdb.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(resultsBucket).ForEach(func(k, v []byte) error {
+			var record ResultRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+			if query.ExperimentName != "" && query.ExperimentName != record.ExperimentName {
+				return nil
+			}
+			if query.ProbeASN != "" && query.ProbeASN != record.ProbeASN {
+				return nil
+			}
+			if !inTimeRange(record.StartTime, query.Since, query.Until) {
+				return nil
+			}
+			out.Result = append(out.Result, record)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// MeasurementsQuery contains the criteria for querying measurements. Empty
+// fields mean that we should not filter by such field.
+type MeasurementsQuery struct {
+	ExperimentName string    // only measurements of this experiment
+	OnlyAnomalies  bool      // only anomalous measurements
+	ProbeASN       string    // only measurements in this network (e.g. "AS30722")
+	ResultID       int64     // only measurements belonging to this result
+	Since          time.Time // only measurements started at or after this time
+	Until          time.Time // only measurements started before this time
+	UploadStatus   string    // only measurements with this upload status
+}
+
+// MeasurementsQueryResult contains the results of QueryMeasurements.
+type MeasurementsQueryResult struct {
+	Result []MeasurementRecord
+}
+
+// Count returns the number of returned measurements
+func (r *MeasurementsQueryResult) Count() int64 {
+	return int64(len(r.Result))
+}
+
+// At returns the measurement at the given index or nil
+func (r *MeasurementsQueryResult) At(idx int64) (out *MeasurementRecord) {
+	if idx >= 0 && idx < int64(len(r.Result)) {
+		out = &r.Result[int(idx)]
+	}
+	return
+}
+
+// QueryMeasurements returns the measurements matching the query. To find
+// the measurements whose upload should be retried, query for the measurements
+// whose UploadStatus is either UploadStatusPending or UploadStatusFailed.
+func (rdb *ResultsDB) QueryMeasurements(
+	query *MeasurementsQuery,
+) (*MeasurementsQueryResult, error) {
+	if query == nil {
+		return nil, errors.New("QueryMeasurements: passed nil query")
+	}
+	out := new(MeasurementsQueryResult)
+	err := rdb.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(measurementsBucket).ForEach(func(k, v []byte) error {
+			var record MeasurementRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+			if query.ExperimentName != "" && query.ExperimentName != record.ExperimentName {
+				return nil
+			}
+			if query.OnlyAnomalies && !record.IsAnomaly {
+				return nil
+			}
+			if query.ProbeASN != "" && query.ProbeASN != record.ProbeASN {
+				return nil
+			}
+			if query.ResultID != 0 && query.ResultID != record.ResultID {
+				return nil
+			}
+			if query.UploadStatus != "" && query.UploadStatus != record.UploadStatus {
+				return nil
+			}
+			if !inTimeRange(record.StartTime, query.Since, query.Until) {
+				return nil
+			}
+			out.Result = append(out.Result, record)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// resultsDBDateFormat is the format of the measurement_start_time field.
+const resultsDBDateFormat = "2006-01-02 15:04:05"
+
+func inTimeRange(t, since, until time.Time) bool {
+	if !since.IsZero() && t.Before(since) {
+		return false
+	}
+	if !until.IsZero() && !t.Before(until) {
+		return false
+	}
+	return true
+}
+
+// resultKey uses big endian such that keys sort by result ID.
+func resultKey(resultID int64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(resultID))
+	return key
+}
+
+func putJSON(bucket *bolt.Bucket, key []byte, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(key, data)
+}
+
+func getJSON(bucket *bolt.Bucket, key []byte, v interface{}, notFound error) error {
+	data := bucket.Get(key)
+	if data == nil {
+		return notFound
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,212 @@
+package engine
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/ooni/probe-engine/model"
+)
+
+func newResultsDBForTesting(t *testing.T) (*ResultsDB, *Session, func()) {
+	tempdir, err := ioutil.TempDir("", "ooniprobe-engine-resultsdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess, err := NewSession(SessionConfig{
+		AssetsDir:       "testdata",
+		Logger:          log.Log,
+		SoftwareName:    "ooniprobe-engine",
+		SoftwareVersion: "0.0.1",
+		TempDir:         tempdir,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdb, err := OpenResultsDB(filepath.Join(tempdir, "results.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rdb, sess, func() {
+		rdb.Close()
+		os.RemoveAll(tempdir)
+	}
+}
+
+func newMeasurementForTesting(name, input, asn string) *Measurement {
+	return &Measurement{m: model.Measurement{
+		ID:                   "b6b4e4c8-3c86-4d1a-9d8c-" + input,
+		Input:                input,
+		MeasurementStartTime: time.Now().UTC().Format(resultsDBDateFormat),
+		ProbeASN:             asn,
+		ProbeCC:              "IT",
+		TestName:             name,
+	}}
+}
+
+func TestUnitResultsDBWorkflow(t *testing.T) {
+	rdb, sess, cleanup := newResultsDBForTesting(t)
+	defer cleanup()
+	result, err := rdb.CreateResult(sess, "web_connectivity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.ID != 1 {
+		t.Fatal("unexpected result ID")
+	}
+	for _, m := range []*Measurement{
+		newMeasurementForTesting("web_connectivity", "000000000001", "AS30722"),
+		newMeasurementForTesting("web_connectivity", "000000000002", "AS30722"),
+	} {
+		if _, err := rdb.AddMeasurement(result.ID, m, MeasurementSummary{
+			IsAnomaly: m.m.Input == "000000000002",
+			Keys:      map[string]interface{}{"blocking": false},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rdb.FinishResult(result.ID); err != nil {
+		t.Fatal(err)
+	}
+	result, err = rdb.GetResult(result.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.IsDone || result.EndTime.IsZero() {
+		t.Fatal("the result has not been marked as done")
+	}
+	anomalies, err := rdb.QueryMeasurements(&MeasurementsQuery{
+		ExperimentName: "web_connectivity",
+		OnlyAnomalies:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if anomalies.Count() != 1 || anomalies.At(0).Input != "000000000002" {
+		t.Fatal("unexpected anomalies query result")
+	}
+	if anomalies.At(1) != nil {
+		t.Fatal("expected nil when out of bounds")
+	}
+	pending, err := rdb.QueryMeasurements(&MeasurementsQuery{
+		UploadStatus: UploadStatusPending,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending.Count() != 2 {
+		t.Fatal("unexpected number of pending measurements")
+	}
+	first := newMeasurementForTesting("web_connectivity", "000000000001", "AS30722")
+	first.m.ReportID = "20200126T230000Z_AS30722_antani"
+	if err := rdb.SetUploadStatus(first, nil); err != nil {
+		t.Fatal(err)
+	}
+	second := newMeasurementForTesting("web_connectivity", "000000000002", "AS30722")
+	if err := rdb.SetUploadStatus(second, errors.New("mocked error")); err != nil {
+		t.Fatal(err)
+	}
+	record, err := rdb.GetMeasurement(first.m.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.UploadStatus != UploadStatusUploaded || record.ReportID != first.m.ReportID {
+		t.Fatal("unexpected upload status after successful upload")
+	}
+	record, err = rdb.GetMeasurement(second.m.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.UploadStatus != UploadStatusFailed || record.UploadFailure != "mocked error" {
+		t.Fatal("unexpected upload status after failed upload")
+	}
+}
+
+func TestUnitResultsDBQueryFilters(t *testing.T) {
+	rdb, sess, cleanup := newResultsDBForTesting(t)
+	defer cleanup()
+	result, err := rdb.CreateResult(sess, "telegram")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newMeasurementForTesting("telegram", "000000000003", "AS12345")
+	if _, err := rdb.AddMeasurement(result.ID, m, MeasurementSummary{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, query := range []*MeasurementsQuery{
+		&MeasurementsQuery{ExperimentName: "web_connectivity"},
+		&MeasurementsQuery{ProbeASN: "AS30722"},
+		&MeasurementsQuery{ResultID: result.ID + 1},
+		&MeasurementsQuery{Since: time.Now().Add(time.Hour)},
+		&MeasurementsQuery{Until: time.Now().Add(-time.Hour)},
+	} {
+		out, err := rdb.QueryMeasurements(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out.Count() != 0 {
+			t.Fatalf("unexpected results for query %+v", query)
+		}
+	}
+	out, err := rdb.QueryMeasurements(&MeasurementsQuery{
+		ProbeASN: "AS12345",
+		ResultID: result.ID,
+		Since:    time.Now().Add(-time.Hour),
+		Until:    time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Count() != 1 {
+		t.Fatal("expected to find the measurement")
+	}
+	results, err := rdb.QueryResults(&ResultsQuery{ExperimentName: "telegram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results.Count() != 1 || results.At(0).ID != result.ID {
+		t.Fatal("unexpected results query result")
+	}
+	results, err = rdb.QueryResults(&ResultsQuery{ExperimentName: "dash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results.Count() != 0 {
+		t.Fatal("expected no results here")
+	}
+}
+
+func TestUnitResultsDBErrors(t *testing.T) {
+	rdb, _, cleanup := newResultsDBForTesting(t)
+	defer cleanup()
+	if _, err := rdb.GetResult(117); err != ErrNoSuchResult {
+		t.Fatal("not the error we expected")
+	}
+	if err := rdb.FinishResult(117); err != ErrNoSuchResult {
+		t.Fatal("not the error we expected")
+	}
+	m := newMeasurementForTesting("telegram", "000000000004", "AS12345")
+	if _, err := rdb.AddMeasurement(117, m, MeasurementSummary{}); err != ErrNoSuchResult {
+		t.Fatal("not the error we expected")
+	}
+	if _, err := rdb.GetMeasurement(m.m.ID); err != ErrNoSuchMeasurement {
+		t.Fatal("not the error we expected")
+	}
+	if err := rdb.SetUploadStatus(m, nil); err != ErrNoSuchMeasurement {
+		t.Fatal("not the error we expected")
+	}
+	m.m.ID = ""
+	if _, err := rdb.AddMeasurement(117, m, MeasurementSummary{}); err == nil {
+		t.Fatal("expected an error here")
+	}
+	if _, err := rdb.QueryResults(nil); err == nil {
+		t.Fatal("expected an error here")
+	}
+	if _, err := rdb.QueryMeasurements(nil); err == nil {
+		t.Fatal("expected an error here")
+	}
+}
@@ -0,0 +1,94 @@
+package engine
+
+import (
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// SecureWipe erases the files and directories at the specified paths. For
+// each regular file, we first overwrite its content with random data and
+// flush it to the storage, and then we remove it. We remove directories
+// only after we have wiped their content. Paths that do not exist are
+// ignored. We continue wiping in case of errors and return the first one.
+//
+// Note that, on flash storage and journaling or copy-on-write file systems,
+// overwriting a file does not guarantee that the old content is gone. For
+// this reason, you should also consider encrypting data at rest, using,
+// e.g., NewEncryptedKVStore and Experiment.SaveMeasurementEncrypted.
+func SecureWipe(paths ...string) error {
+	var firstErr error
+	for _, path := range paths {
+		if err := securewipe(path); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func securewipe(root string) error {
+	var (
+		dirs     []string
+		firstErr error
+	)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			dirs = append(dirs, path)
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			if err := overwrite(path, info.Size()); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		if err := os.Remove(path); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		return nil
+	})
+	if err != nil && firstErr == nil {
+		firstErr = err
+	}
+	// Remove directories deepest first. Walk visits parents before children.
+	for idx := len(dirs) - 1; idx >= 0; idx-- {
+		if err := os.Remove(dirs[idx]); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func overwrite(path string, size int64) error {
+	filep, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(filep, rand.Reader, size); err != nil {
+		filep.Close()
+		return err
+	}
+	if err := filep.Sync(); err != nil {
+		filep.Close()
+		return err
+	}
+	return filep.Close()
+}
+
+type wiper interface {
+	Wipe() error
+}
+
+// maybeWipe wipes store if it implements the Wipe method.
+func maybeWipe(store interface{}) error {
+	if w, ok := store.(wiper); ok {
+		return w.Wipe()
+	}
+	return nil
+}
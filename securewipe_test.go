@@ -0,0 +1,64 @@
+package engine
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnitSecureWipe(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "ooniprobe-engine-securewipe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempdir)
+	nested := filepath.Join(tempdir, "assets", "nested")
+	if err := os.MkdirAll(nested, 0700); err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(nested, "report.jsonl")
+	if err := ioutil.WriteFile(filename, []byte("antani"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	single := filepath.Join(tempdir, "results.db")
+	if err := ioutil.WriteFile(single, []byte("mascetti"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	nonexistent := filepath.Join(tempdir, "nonexistent")
+	err = SecureWipe(filepath.Join(tempdir, "assets"), single, nonexistent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{filepath.Join(tempdir, "assets"), single} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("%s still exists", path)
+		}
+	}
+}
+
+func TestUnitOverwrite(t *testing.T) {
+	filep, err := ioutil.TempFile("", "ooniprobe-engine-securewipe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(filep.Name())
+	content := []byte("this is the content that we want to overwrite")
+	if _, err := filep.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	filep.Close()
+	if err := overwrite(filep.Name(), int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filep.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != len(content) || string(data) == string(content) {
+		t.Fatal("the file has not been overwritten")
+	}
+	if err := overwrite(filepath.Join(os.TempDir(), "nonexistent-file-xx"), 10); err == nil {
+		t.Fatal("expected an error here")
+	}
+}
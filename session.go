@@ -167,3 +167,17 @@ func (sess *Session) SetIncludeProbeIP(value bool) {
 func (sess *Session) NewExperimentBuilder(name string) (*ExperimentBuilder, error) {
 	return newExperimentBuilder(sess, name)
 }
+
+// WipeState securely erases the engine state, i.e., the content of the
+// KVStore (if the KVStore has a Wipe method), the temporary directory and
+// the assets directory. See SecureWipe for the caveats. You should not use
+// the session after calling this method. Remember that you should also erase
+// the files the engine does not know about, e.g., saved measurements and
+// the results database, which you can do by calling SecureWipe.
+func (sess *Session) WipeState() error {
+	err := maybeWipe(sess.session.KVStore)
+	if werr := SecureWipe(sess.session.TempDir, sess.session.AssetsDir); err == nil {
+		err = werr
+	}
+	return err
+}